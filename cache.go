@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/ReanSn0w/pikpak-webdav-proxy/pkg/fs"
+	"github.com/ReanSn0w/pikpak-webdav-proxy/pkg/web"
+)
+
+// cacheCommand - команды обслуживания локального кеша. Без --server
+// они работают с LOCAL_PATH напрямую, с ним - через запущенный сервер
+type cacheCommand struct {
+	Server string `long:"server" description:"Адрес запущенного сервера, например http://localhost:8080"`
+
+	Ls     cacheLsCommand     `command:"ls" description:"Показать слой каждого файла"`
+	GC     cacheGCCommand     `command:"gc" description:"Вытеснить чистые файлы по возрасту или размеру кеша"`
+	Verify cacheVerifyCommand `command:"verify" description:"Сравнить локальные файлы с удаленными"`
+	Evict  cacheEvictCommand  `command:"evict" description:"Удалить локальные копии файлов, доступных на удаленном сервере"`
+	Export cacheExportCommand `command:"export" description:"Вывести список файлов, которых нет на удаленном сервере"`
+}
+
+// cacheRun - выбранная команда обслуживания кеша. Ее устанавливает
+// Execute команды при разборе аргументов, а ошибки команды возвращаются
+// при выполнении, так как разбор аргументов ожидает только ошибки go-flags
+var cacheRun func(ctx context.Context, m web.CacheMaintainer, out io.Writer) error
+
+// errVerifyFailed возвращается, если локальные файлы отличаются от удаленных
+var errVerifyFailed = errors.New("local files differ from remote")
+
+type cacheLsCommand struct {
+	Recursive bool `short:"r" long:"recursive" description:"Показать вложенные директории"`
+	Args      struct {
+		Path string `positional-arg-name:"path"`
+	} `positional-args:"yes"`
+}
+
+func (c *cacheLsCommand) Execute(args []string) error {
+	cacheRun = func(ctx context.Context, m web.CacheMaintainer, out io.Writer) error {
+		entries, err := m.ListCache(ctx, c.Args.Path, c.Recursive)
+		if err != nil {
+			return err
+		}
+
+		tw := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+		for _, e := range entries {
+			size, name := strconv.FormatInt(e.Size, 10), e.Path
+			if e.IsDir {
+				size, name = "-", name+"/"
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", e.Layer, size, e.ModTime.Format("2006-01-02 15:04:05"), name)
+		}
+		return tw.Flush()
+	}
+	return nil
+}
+
+type cacheGCCommand struct {
+	OlderThan time.Duration `long:"older-than" description:"Вытеснить файлы, измененные раньше указанного времени назад"`
+	MaxSize   int64         `long:"max-size" description:"Вытеснять самые старые файлы, пока размер кеша в байтах больше указанного"`
+	DryRun    bool          `long:"dry-run" description:"Только показать файлы, которые будут вытеснены"`
+}
+
+func (c *cacheGCCommand) Execute(args []string) error {
+	cacheRun = func(ctx context.Context, m web.CacheMaintainer, out io.Writer) error {
+		if c.OlderThan <= 0 && c.MaxSize <= 0 {
+			return errors.New("either --older-than or --max-size is required")
+		}
+
+		result, err := m.CollectGarbage(ctx, fs.GCOptions{OlderThan: c.OlderThan, MaxSize: c.MaxSize, DryRun: c.DryRun})
+		if err != nil {
+			return err
+		}
+
+		verb := "evicted"
+		if c.DryRun {
+			verb = "would evict"
+		}
+
+		for _, f := range result.Evicted {
+			fmt.Fprintf(out, "%s %s (%d bytes)\n", verb, f.Path, f.Size)
+		}
+		fmt.Fprintf(out, "%s %d files, %d bytes; cache size %d bytes\n", verb, len(result.Evicted), result.Freed, result.Size)
+		return nil
+	}
+	return nil
+}
+
+type cacheVerifyCommand struct {
+	Hash bool `long:"hash" description:"Сравнить содержимое файлов одинакового размера (может потребовать их загрузки)"`
+	Args struct {
+		Path string `positional-arg-name:"path"`
+	} `positional-args:"yes"`
+}
+
+func (c *cacheVerifyCommand) Execute(args []string) error {
+	cacheRun = func(ctx context.Context, m web.CacheMaintainer, out io.Writer) error {
+		files, err := m.CacheFiles(ctx, c.Args.Path, c.Hash)
+		if err != nil {
+			return err
+		}
+
+		counts := make(map[fs.CacheState]int)
+		for _, f := range files {
+			counts[f.State]++
+			switch f.State {
+			case fs.CacheModified:
+				fmt.Fprintf(out, "%s (%s) %s\n", f.State, f.Reason, f.Path)
+			case fs.CacheLocalOnly:
+				fmt.Fprintf(out, "%s %s\n", f.State, f.Path)
+			}
+		}
+
+		fmt.Fprintf(out, "%d files: %d clean, %d modified, %d local-only\n",
+			len(files), counts[fs.CacheClean], counts[fs.CacheModified], counts[fs.CacheLocalOnly])
+
+		if counts[fs.CacheModified] > 0 {
+			return errVerifyFailed
+		}
+		return nil
+	}
+	return nil
+}
+
+type cacheEvictCommand struct {
+	Args struct {
+		Paths []string `positional-arg-name:"path" required:"1"`
+	} `positional-args:"yes"`
+}
+
+func (c *cacheEvictCommand) Execute(args []string) error {
+	cacheRun = func(ctx context.Context, m web.CacheMaintainer, out io.Writer) error {
+		for _, name := range c.Args.Paths {
+			if err := m.Evict(ctx, name); err != nil {
+				return err
+			}
+			fmt.Fprintf(out, "evicted %s\n", name)
+		}
+		return nil
+	}
+	return nil
+}
+
+type cacheExportCommand struct {
+	Output string `short:"o" long:"output" description:"Файл для списка (по умолчанию - стандартный вывод)"`
+	Args   struct {
+		Path string `positional-arg-name:"path"`
+	} `positional-args:"yes"`
+}
+
+func (c *cacheExportCommand) Execute(args []string) error {
+	cacheRun = func(ctx context.Context, m web.CacheMaintainer, out io.Writer) error {
+		files, err := m.LocalOnlyFiles(ctx, c.Args.Path)
+		if err != nil {
+			return err
+		}
+		if files == nil {
+			files = []fs.CacheFile{}
+		}
+
+		if c.Output != "" {
+			f, err := os.Create(c.Output)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			out = f
+		}
+
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		return enc.Encode(files)
+	}
+	return nil
+}
+
+// runCacheCommand выполняет выбранную команду и возвращает код завершения
+func runCacheCommand(ctx context.Context, m web.CacheMaintainer) int {
+	err := cacheRun(ctx, m, os.Stdout)
+	switch {
+	case errors.Is(err, errVerifyFailed):
+		return 1
+	case err != nil:
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		return 2
+	}
+	return 0
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/ReanSn0w/pikpak-webdav-proxy/pkg/fs"
+)
+
+// encryptCommand - шифрование файлов, записанных в кеш до включения
+// шифрования. Работает с LOCAL_PATH напрямую
+type encryptCommand struct {
+	Args struct {
+		Path string `positional-arg-name:"path"`
+	} `positional-args:"yes"`
+}
+
+// encryptRun - выбранная команда шифрования, см. cacheRun
+var encryptRun func(ctx context.Context, p *fs.PikpakProxy, out io.Writer) error
+
+func (c *encryptCommand) Execute(args []string) error {
+	encryptRun = func(ctx context.Context, p *fs.PikpakProxy, out io.Writer) error {
+		result, err := p.EncryptCache(ctx, c.Args.Path)
+		fmt.Fprintf(out, "encrypted %d files (%d bytes), %d already encrypted\n", result.Files, result.Bytes, result.Skipped)
+		return err
+	}
+	return nil
+}
+
+// runEncryptCommand выполняет шифрование кеша и возвращает код завершения
+func runEncryptCommand(ctx context.Context, p *fs.PikpakProxy) int {
+	if err := encryptRun(ctx, p, os.Stdout); err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		return 2
+	}
+	return 0
+}
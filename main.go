@@ -1,15 +1,24 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/ReanSn0w/gokit/pkg/app"
 	"github.com/ReanSn0w/pikpak-webdav-proxy/pkg/fs"
+	"github.com/ReanSn0w/pikpak-webdav-proxy/pkg/lock"
+	"github.com/ReanSn0w/pikpak-webdav-proxy/pkg/quota"
+	"github.com/ReanSn0w/pikpak-webdav-proxy/pkg/s3"
+	"github.com/ReanSn0w/pikpak-webdav-proxy/pkg/sftpd"
+	"github.com/ReanSn0w/pikpak-webdav-proxy/pkg/web"
 	"github.com/go-pkgz/lgr"
-	"github.com/studio-b12/gowebdav"
 	"golang.org/x/net/webdav"
 )
 
@@ -22,6 +31,25 @@ var (
 		Port      string `long:"port" env:"PORT" default:"8080" description:"Порт для WebDAV сервера"`
 		LocalPath string `long:"local-path" env:"LOCAL_PATH" default:"/cache" description:"Путь к директории кеша"`
 
+		ContentTypes map[string]string `long:"content-type" env:"CONTENT_TYPES" env-delim:"," description:"Тип содержимого для расширения файла в формате ext:type"`
+
+		ReadOnly      bool     `long:"read-only" env:"READ_ONLY" description:"Запретить запись везде, кроме путей из правил записи"`
+		WritePolicies []string `long:"write-policy" env:"WRITE_POLICIES" env-delim:";" description:"Правило записи в формате шаблон:режим (read-only, local-only, write-through, deny)"`
+
+		Filters struct {
+			Preset string   `long:"preset" env:"PRESET" default:"none" choice:"junk" choice:"none" description:"Встроенный набор фильтров служебных файлов"`
+			Rules  []string `long:"rule" env:"RULES" env-delim:";" description:"Фильтр в формате шаблон:режим (drop, local-only, reject), шаблон с префиксом re: - регулярное выражение"`
+		} `group:"Filters" namespace:"filters" env-namespace:"FILTERS"`
+
+		Names struct {
+			Form            string `long:"form" env:"FORM" default:"none" choice:"none" choice:"nfc" choice:"nfd" description:"Форма нормализации Unicode для сопоставления имен файлов в локальном и удаленном слоях"`
+			CaseInsensitive bool   `long:"case-insensitive" env:"CASE_INSENSITIVE" description:"Сопоставлять имена файлов без учета регистра"`
+			Encoding        string `long:"encoding" env:"ENCODING" default:"none" description:"Правила кодирования имен для удаленного сервера через запятую (none, default, ctl, backslash, colon, asterisk, question, doublequote, ltgt, pipe, leftspace, rightspace, rightperiod)"`
+			MaxLength       int    `long:"max-length" env:"MAX_LENGTH" description:"Максимальная длина имени на удаленном сервере в байтах (0 - без ограничения)"`
+		} `group:"Names" namespace:"names" env-namespace:"NAMES"`
+
+		ConflictPolicy string `long:"conflict-policy" env:"CONFLICT_POLICY" default:"none" choice:"none" choice:"local" choice:"remote" choice:"newest" choice:"keep-both" description:"Политика разрешения конфликтов между локальной и удаленной версией файла"`
+
 		Auth struct {
 			Enabled bool   `long:"enabled" env:"ENABLED" description:"Включить аутентификацию"`
 			User    string `long:"user" env:"USER" description:"Пользователь для аутентификации"`
@@ -33,6 +61,64 @@ var (
 			User string `long:"user" env:"USER" description:"Пользователь для WebDAV сервера"`
 			Pass string `long:"pass" env:"PASS" description:"Пароль для WebDAV сервера"`
 		} `group:"Target Server" namespace:"webdav" env-namespace:"WEBDAV"`
+
+		Cache struct {
+			MaxSize       int64   `long:"max-size" env:"MAX_SIZE" description:"Максимальный размер локального кеша в байтах (0 - без ограничения)"`
+			HighWatermark float64 `long:"high-watermark" env:"HIGH_WATERMARK" default:"0.9" description:"Доля размера кеша, при превышении которой начинается вытеснение"`
+			LowWatermark  float64 `long:"low-watermark" env:"LOW_WATERMARK" default:"0.8" description:"Доля размера кеша, до которой выполняется вытеснение"`
+			APIPath       string  `long:"api-path" env:"API_PATH" default:"/.webdav-proxy/cache/" description:"Путь к API обслуживания кеша (не должен совпадать с директорией хранилища)"`
+			Hardlinks     bool    `long:"hardlinks" env:"HARDLINKS" description:"Копировать локальные файлы жесткими ссылками, если reflink не поддерживается"`
+		} `group:"Cache" namespace:"cache" env-namespace:"CACHE"`
+
+		Encryption struct {
+			Key     string `long:"key" env:"KEY" description:"Ключ шифрования локального кеша: 32 байта в hex или base64"`
+			KeyFile string `long:"key-file" env:"KEY_FILE" description:"Файл с ключом шифрования локального кеша"`
+		} `group:"Encryption" namespace:"encryption" env-namespace:"ENCRYPTION"`
+
+		Stream struct {
+			ReadAhead  int           `long:"read-ahead" env:"READ_AHEAD" default:"8388608" description:"Объем опережающего чтения медиафайлов с удаленного сервера в байтах (0 - отключить потоковое чтение)"`
+			Idle       time.Duration `long:"idle" env:"IDLE" default:"30s" description:"Время ожидания следующего запроса диапазона для открытого потока"`
+			IdleMemory int64         `long:"idle-memory" env:"IDLE_MEMORY" default:"67108864" description:"Общий объем буферов потоков, ожидающих следующего запроса, в байтах (0 - не сохранять потоки)"`
+		} `group:"Streaming" namespace:"stream" env-namespace:"STREAM"`
+
+		Quota struct {
+			TTL time.Duration `long:"ttl" env:"TTL" default:"5m" description:"Время кеширования квоты удаленного сервера"`
+		} `group:"Quota" namespace:"quota" env-namespace:"QUOTA"`
+
+		Locks struct {
+			Path     string        `long:"path" env:"PATH" description:"Файл для хранения блокировок (по умолчанию в служебной директории кеша)"`
+			Upstream bool          `long:"upstream" env:"UPSTREAM" description:"Дублировать блокировки на удаленный WebDAV сервер"`
+			Sweep    time.Duration `long:"sweep" env:"SWEEP" default:"1m" description:"Интервал удаления истекших блокировок"`
+		} `group:"Locks" namespace:"locks" env-namespace:"LOCKS"`
+
+		SFTP struct {
+			Enabled bool   `long:"enabled" env:"ENABLED" description:"Включить SFTP сервер"`
+			Port    string `long:"port" env:"PORT" default:"2022" description:"Порт для SFTP сервера"`
+			HostKey string `long:"host-key" env:"HOST_KEY" description:"Файл ключа хоста (по умолчанию в служебной директории кеша, создается при первом запуске)"`
+		} `group:"SFTP" namespace:"sftp" env-namespace:"SFTP"`
+
+		S3 struct {
+			Enabled bool     `long:"enabled" env:"ENABLED" description:"Включить S3 шлюз"`
+			Port    string   `long:"port" env:"PORT" default:"9000" description:"Порт для S3 шлюза"`
+			Keys    []string `long:"key" env:"KEYS" env-delim:"," description:"Ключ доступа в формате access:secret"`
+			Buckets []string `long:"bucket" env:"BUCKETS" env-delim:"," description:"Корзина в формате имя:путь (по умолчанию - директории верхнего уровня)"`
+		} `group:"S3" namespace:"s3" env-namespace:"S3"`
+
+		UI struct {
+			Enabled bool   `long:"enabled" env:"ENABLED" description:"Включить веб-интерфейс"`
+			Path    string `long:"path" env:"PATH" default:"/_ui/" description:"Путь к веб-интерфейсу (не должен совпадать с директорией хранилища)"`
+		} `group:"Web UI" namespace:"ui" env-namespace:"UI"`
+
+		Share struct {
+			Enabled bool          `long:"enabled" env:"ENABLED" description:"Включить ссылки для общего доступа"`
+			Path    string        `long:"path" env:"PATH" default:"/s/" description:"Путь к ссылкам для общего доступа (не должен совпадать с директорией хранилища)"`
+			Secret  string        `long:"secret" env:"SECRET" description:"Ключ подписи ссылок (по умолчанию создается в служебной директории кеша)"`
+			MaxTTL  time.Duration `long:"max-ttl" env:"MAX_TTL" default:"168h" description:"Максимальный срок действия ссылки"`
+		} `group:"Share links" namespace:"share" env-namespace:"SHARE"`
+
+		CacheCmd   cacheCommand   `command:"cache" description:"Обслуживание локального кеша"`
+		SyncCmd    syncCommand    `command:"sync" description:"Двусторонняя синхронизация локального кеша с удаленным сервером"`
+		EncryptCmd encryptCommand `command:"encrypt" description:"Шифрование существующего локального кеша"`
 	}{}
 )
 
@@ -46,7 +132,17 @@ func main() {
 		}
 	}
 
-	wd := gowebdav.NewClient(opts.Webdav.URL, opts.Webdav.User, opts.Webdav.Pass)
+	// Команды обслуживания кеша через запущенный сервер
+	if cacheRun != nil && opts.CacheCmd.Server != "" {
+		var user, pass string
+		if opts.Auth.Enabled {
+			user, pass = opts.Auth.User, opts.Auth.Pass
+		}
+		client := web.NewCacheClient(strings.TrimSuffix(opts.CacheCmd.Server, "/")+opts.Cache.APIPath, user, pass)
+		os.Exit(runCacheCommand(app.Context(), client))
+	}
+
+	wd := fs.NewRemoteClient(opts.Webdav.URL, opts.Webdav.User, opts.Webdav.Pass)
 	err := wd.Connect()
 	if err != nil {
 		app.Log().Logf("[ERROR] webdav error: %v", err)
@@ -56,15 +152,157 @@ func main() {
 	// Создаём директорию кеша
 	os.MkdirAll(opts.LocalPath, 0755)
 
+	conflictPolicy, err := fs.ParseConflictPolicy(opts.ConflictPolicy)
+	if err != nil {
+		app.Log().Logf("[ERROR] %v", err)
+		os.Exit(1)
+	}
+
+	policies, err := writePolicies()
+	if err != nil {
+		app.Log().Logf("[ERROR] %v", err)
+		os.Exit(1)
+	}
+
+	filters, err := fileFilters()
+	if err != nil {
+		app.Log().Logf("[ERROR] %v", err)
+		os.Exit(1)
+	}
+
+	nameForm, err := fs.ParseNameForm(opts.Names.Form)
+	if err != nil {
+		app.Log().Logf("[ERROR] %v", err)
+		os.Exit(1)
+	}
+
+	nameEncoding, err := fs.ParseNameEncoding(opts.Names.Encoding)
+	if err != nil {
+		app.Log().Logf("[ERROR] %v", err)
+		os.Exit(1)
+	}
+
+	mimeTypes := fs.NewMIMETypes(opts.ContentTypes)
+
+	encryption, err := encryptionOption()
+	if err != nil {
+		app.Log().Logf("[ERROR] %v", err)
+		os.Exit(1)
+	}
+
 	// Создаём proxy filesystem
-	fs := fs.NewPikpakProxy(app.Log(), opts.LocalPath, wd)
+	fs := fs.NewPikpakProxy(app.Log(), opts.LocalPath, wd,
+		fs.WithConflictPolicy(conflictPolicy),
+		fs.WithMIMETypes(mimeTypes),
+		fs.WithPolicies(policies...),
+		fs.WithFilters(filters...),
+		fs.WithNameForm(nameForm),
+		fs.WithCaseInsensitive(opts.Names.CaseInsensitive),
+		fs.WithNameEncoding(nameEncoding, opts.Names.MaxLength),
+		fs.WithCacheBudget(opts.Cache.MaxSize),
+		fs.WithWatermarks(opts.Cache.HighWatermark, opts.Cache.LowWatermark),
+		fs.WithStreaming(opts.Stream.ReadAhead, opts.Stream.Idle, opts.Stream.IdleMemory),
+		fs.WithHardlinks(opts.Cache.Hardlinks),
+		encryption,
+		fs.WithQuota(quota.NewCached(app.Log(),
+			quota.NewHTTPSource(opts.Webdav.URL, opts.Webdav.User, opts.Webdav.Pass),
+			opts.Quota.TTL,
+		)),
+	)
+
+	// Сервер и команды, работающие с кешем напрямую, перезаписывают одни
+	// и те же служебные файлы и не должны выполняться одновременно
+	if err := lockCache(fs); err != nil {
+		app.Log().Logf("[ERROR] %v", err)
+		os.Exit(2)
+	}
+
+	// Команды обслуживания кеша без сервера
+	if cacheRun != nil {
+		os.Exit(runCacheCommand(app.Context(), fs))
+	}
+
+	// Синхронизация без сервера
+	if syncRun != nil {
+		os.Exit(runSyncCommand(app.Context(), fs))
+	}
+
+	// Шифрование кеша без сервера
+	if encryptRun != nil {
+		os.Exit(runEncryptCommand(app.Context(), fs))
+	}
+
+	// Система блокировок
+	ls, err := lockSystem(app.Log(), fs)
+	if err != nil {
+		app.Log().Logf("[ERROR] lock system error: %v", err)
+		os.Exit(2)
+	}
+	go ls.Sweep(app.Context(), opts.Locks.Sweep)
 
-	// WebDAV обработчик
-	handler := webdavHandler(app.Log(), fs)
+	// WebDAV обработчик с проверкой If-Match/If-None-Match и копированием
+	// на стороне хранилища
+	handler := web.Preconditions(fs, web.Copy(app.Log(), fs, ls.Internal(), webdavHandler(app.Log(), web.ContentTypeFS(fs), ls)))
+	handler = web.ContentType(handler)
+	handler = web.Index(app.Log(), fs, handler)
+	handler = web.Streaming(app.Log(), mimeTypes, fs, handler)
+	handler = web.Checksums(app.Log(), fs, fs.MetaPath("tmp"), handler)
+	handler = web.Budget(fs, handler)
+	handler = web.Permissions(fs, handler)
 
 	// Middleware для авторизации
 	http.Handle("/", authMiddleware(handler))
 
+	// API обслуживания кеша
+	if err := web.CheckPrefix(fs, opts.Cache.APIPath); err != nil {
+		app.Log().Logf("[ERROR] cache api error: %v", err)
+		os.Exit(2)
+	}
+	cacheAPI := web.NewCacheAPI(app.Log(), fs, opts.Cache.APIPath)
+	http.Handle(cacheAPI.Prefix(), authMiddleware(cacheAPI))
+
+	// Веб-интерфейс
+	if opts.UI.Enabled {
+		if err := web.CheckPrefix(fs, opts.UI.Path); err != nil {
+			app.Log().Logf("[ERROR] web ui error: %v", err)
+			os.Exit(2)
+		}
+		ui := web.NewUI(app.Log(), fs, opts.UI.Path)
+		http.Handle(ui.Prefix(), authMiddleware(ui))
+	}
+
+	// Ссылки для общего доступа. Сами ссылки доступны без аутентификации,
+	// а создание ссылки - только после нее
+	if opts.Share.Enabled {
+		shares, err := shareLinks(app.Log(), fs)
+		if err != nil {
+			app.Log().Logf("[ERROR] share links error: %v", err)
+			os.Exit(2)
+		}
+		http.Handle(shares.Prefix(), shares)
+		http.Handle(shares.Prefix()+"new", authMiddleware(http.HandlerFunc(shares.Create)))
+	}
+
+	// SFTP сервер
+	if opts.SFTP.Enabled {
+		go serveSFTP(app.Context(), app.Log(), fs)
+	}
+
+	// S3 шлюз
+	if opts.S3.Enabled {
+		gateway, err := s3Gateway(app.Log(), fs)
+		if err != nil {
+			app.Log().Logf("[ERROR] s3 gateway error: %v", err)
+			os.Exit(1)
+		}
+
+		go func() {
+			addr := fmt.Sprintf(":%s", opts.S3.Port)
+			app.Log().Logf("[INFO] S3 шлюз запущен на %s", addr)
+			log.Fatal(http.ListenAndServe(addr, gateway))
+		}()
+	}
+
 	addr := fmt.Sprintf(":%s", opts.Port)
 	log.Printf("WebDAV сервер запущен на %s", addr)
 	log.Fatal(http.ListenAndServe(addr, nil))
@@ -84,16 +322,185 @@ func authMiddleware(next http.Handler) http.Handler {
 	})
 }
 
-func webdavHandler(log lgr.L, fs webdav.FileSystem) http.Handler {
-	return &webdav.Handler{
-		FileSystem: fs,
-		LockSystem: webdav.NewMemLS(),
-		Logger: func(r *http.Request, err error) {
-			if err != nil {
-				log.Logf("[ERROR] [%s] %s -> ERR: %v", r.Method, r.URL.Path, err)
-			} else {
-				log.Logf("[INFO] [%s] %s -> OK", r.Method, r.URL.Path)
-			}
-		},
+// writePolicies разбирает правила записи. В режиме только для чтения
+// после них добавляется правило, запрещающее запись в остальные пути
+func writePolicies() ([]fs.PolicyRule, error) {
+	var rules []fs.PolicyRule
+	for _, s := range opts.WritePolicies {
+		rule, err := fs.ParsePolicyRule(s)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+
+	if opts.ReadOnly {
+		rule, err := fs.NewPolicyRule("/**", fs.WriteReadOnly)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+
+	return rules, nil
+}
+
+// encryptionOption читает ключ шифрования локального кеша из параметра
+// или файла. Без ключа кеш не шифруется
+func encryptionOption() (fs.Option, error) {
+	var (
+		key fs.EncryptionKey
+		err error
+	)
+
+	switch {
+	case opts.Encryption.Key != "" && opts.Encryption.KeyFile != "":
+		return nil, errors.New("encryption key and key file are mutually exclusive")
+	case opts.Encryption.Key != "":
+		key, err = fs.ParseEncryptionKey(opts.Encryption.Key)
+	case opts.Encryption.KeyFile != "":
+		key, err = fs.LoadEncryptionKey(opts.Encryption.KeyFile)
+	default:
+		return func(*fs.PikpakProxy) {}, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+	return fs.WithEncryption(key), nil
+}
+
+// fileFilters разбирает фильтры файлов. Встроенный набор проверяется
+// после заданных фильтров, чтобы их можно было переопределить
+func fileFilters() ([]fs.FilterRule, error) {
+	var rules []fs.FilterRule
+	for _, s := range opts.Filters.Rules {
+		rule, err := fs.ParseFilterRule(s)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+
+	if opts.Filters.Preset == "junk" {
+		rules = append(rules, fs.JunkFilters()...)
+	}
+
+	return rules, nil
+}
+
+func serveSFTP(ctx context.Context, log lgr.L, proxy *fs.PikpakProxy) {
+	path := opts.SFTP.HostKey
+	if path == "" {
+		path = proxy.MetaPath("ssh_host_ed25519_key")
+	}
+
+	key, err := sftpd.LoadHostKey(path)
+	if err != nil {
+		log.Logf("[ERROR] sftp host key error: %v", err)
+		os.Exit(2)
 	}
+
+	var user, pass string
+	if opts.Auth.Enabled {
+		user, pass = opts.Auth.User, opts.Auth.Pass
+	}
+
+	addr := fmt.Sprintf(":%s", opts.SFTP.Port)
+	log.Logf("[INFO] SFTP сервер запущен на %s", addr)
+	if err := sftpd.New(log, proxy, key, user, pass).ListenAndServe(ctx, addr); err != nil {
+		log.Logf("[ERROR] sftp server error: %v", err)
+		os.Exit(2)
+	}
+}
+
+func s3Gateway(log lgr.L, proxy *fs.PikpakProxy) (*s3.Gateway, error) {
+	keys := make(map[string]string)
+	for _, s := range opts.S3.Keys {
+		access, secret, ok := strings.Cut(s, ":")
+		if !ok || access == "" || secret == "" {
+			return nil, fmt.Errorf("invalid s3 key, expected access:secret")
+		}
+		keys[access] = secret
+	}
+
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("s3 keys are not configured")
+	}
+
+	var buckets []s3.Bucket
+	for _, s := range opts.S3.Buckets {
+		bucket, err := s3.ParseBucket(s)
+		if err != nil {
+			return nil, err
+		}
+		buckets = append(buckets, bucket)
+	}
+
+	return s3.New(log, proxy, keys, proxy.MetaPath("tmp"), buckets...), nil
+}
+
+func shareLinks(log lgr.L, proxy *fs.PikpakProxy) (*web.Shares, error) {
+	if err := web.CheckPrefix(proxy, opts.Share.Path); err != nil {
+		return nil, err
+	}
+
+	secret := []byte(opts.Share.Secret)
+	if len(secret) == 0 {
+		var err error
+		secret, err = web.LoadSecret(proxy.MetaPath("share_secret"))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return web.NewShares(log, proxy, secret, opts.Share.Path, opts.Share.MaxTTL), nil
+}
+
+// lockCache захватывает блокировку локального кеша до завершения процесса
+func lockCache(proxy *fs.PikpakProxy) error {
+	_, err := proxy.LockCache()
+	if errors.Is(err, fs.ErrCacheLocked) && cacheRun != nil {
+		return fmt.Errorf("%w, use --server to reach the running server", err)
+	}
+	return err
+}
+
+func lockSystem(log lgr.L, resolver lock.Resolver) (*lock.FileLS, error) {
+	path := opts.Locks.Path
+	if path == "" {
+		path = filepath.Join(opts.LocalPath, fs.MetaDir, "locks.json")
+	}
+
+	var upstream lock.Upstream
+	if opts.Locks.Upstream {
+		upstream = lock.NewHTTPUpstream(opts.Webdav.URL, opts.Webdav.User, opts.Webdav.Pass, resolver)
+	}
+
+	return lock.NewFileLS(log, path, upstream)
+}
+
+// webdavHandler создает обработчик WebDAV. Запросы LOCK создают
+// блокировки клиентов, остальные запросы блокируют ресурс только на время
+// своего выполнения, и такие блокировки не сохраняются и не дублируются
+// на удаленный сервер
+func webdavHandler(log lgr.L, fs webdav.FileSystem, ls *lock.FileLS) http.Handler {
+	logger := func(r *http.Request, err error) {
+		if err != nil {
+			log.Logf("[ERROR] [%s] %s -> ERR: %v", r.Method, r.URL.Path, err)
+		} else {
+			log.Logf("[INFO] [%s] %s -> OK", r.Method, r.URL.Path)
+		}
+	}
+
+	locks := &webdav.Handler{FileSystem: fs, LockSystem: ls, Logger: logger}
+	requests := &webdav.Handler{FileSystem: fs, LockSystem: ls.Internal(), Logger: logger}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "LOCK" {
+			locks.ServeHTTP(w, r)
+			return
+		}
+		requests.ServeHTTP(w, r)
+	})
 }
@@ -0,0 +1,172 @@
+package fs
+
+import (
+	"encoding/json"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/ReanSn0w/pikpak-webdav-proxy/pkg/utils"
+	"github.com/go-pkgz/lgr"
+)
+
+// remoteVersion - версия удаленного файла, от которой произошла
+// локальная копия: скачанная или загруженная на сервер
+type remoteVersion struct {
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mtime"`
+	ETag    string    `json:"etag,omitempty"`
+}
+
+func remoteVersionOf(info os.FileInfo) remoteVersion {
+	return remoteVersion{Size: info.Size(), ModTime: info.ModTime(), ETag: fileETag(info)}
+}
+
+// matches проверяет, что удаленный файл не изменился с этой версии
+func (v remoteVersion) matches(remote os.FileInfo) bool {
+	if etag := fileETag(remote); v.ETag != "" && etag != "" {
+		return v.ETag == etag
+	}
+	return v.Size == remote.Size() && sameModTime(v.ModTime, remote.ModTime())
+}
+
+// baselineStore хранит для локальных копий версию удаленного файла,
+// на которой они основаны. Конфликтом считается только изменение
+// удаленного файла после этой версии, а не правка локальной копии
+type baselineStore struct {
+	log  lgr.L
+	path string
+
+	mu    sync.Mutex
+	items map[string]remoteVersion
+}
+
+func newBaselineStore(log lgr.L, path string) *baselineStore {
+	s := &baselineStore{
+		log:   log,
+		path:  path,
+		items: make(map[string]remoteVersion),
+	}
+
+	data, err := os.ReadFile(path)
+	switch {
+	case os.IsNotExist(err):
+		return s
+	case err != nil:
+		log.Logf("[WARN] failed to read baselines: %v", err)
+		return s
+	}
+
+	if err := json.Unmarshal(data, &s.items); err != nil {
+		log.Logf("[WARN] failed to decode baselines: %v", err)
+	}
+
+	return s
+}
+
+// get возвращает версию удаленного файла, на которой основана
+// локальная копия name
+func (s *baselineStore) get(name string) (remoteVersion, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	v, ok := s.items[path.Clean("/"+name)]
+	return v, ok
+}
+
+// set запоминает версию удаленного файла remote как основу локальной
+// копии name
+func (s *baselineStore) set(name string, remote os.FileInfo) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	v := remoteVersionOf(remote)
+	name = path.Clean("/" + name)
+	if prev, ok := s.items[name]; ok && prev == v {
+		return
+	}
+
+	s.items[name] = v
+	s.save()
+}
+
+// move переносит версии файла и всех вложенных в него файлов
+func (s *baselineStore) move(oldName, newName string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	oldName, newName = path.Clean("/"+oldName), path.Clean("/"+newName)
+
+	changed := false
+	moved := make(map[string]remoteVersion)
+	for key, v := range s.items {
+		if rel, ok := within(oldName, key); ok {
+			delete(s.items, key)
+			moved[path.Join(newName, rel)] = v
+			changed = true
+		} else if _, ok := within(newName, key); ok {
+			delete(s.items, key)
+			changed = true
+		}
+	}
+
+	if !changed {
+		return
+	}
+
+	for key, v := range moved {
+		s.items[key] = v
+	}
+
+	s.save()
+}
+
+// forget удаляет версии файла и всех вложенных в него файлов
+func (s *baselineStore) forget(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	name = path.Clean("/" + name)
+
+	changed := false
+	for key := range s.items {
+		if _, ok := within(name, key); ok {
+			delete(s.items, key)
+			changed = true
+		}
+	}
+
+	if changed {
+		s.save()
+	}
+}
+
+// save записывает версии в файл, ошибки только логируются
+func (s *baselineStore) save() {
+	if err := utils.WriteJSONAtomic(s.path, s.items); err != nil {
+		s.log.Logf("[ERROR] failed to save baselines: %v", err)
+	}
+}
+
+// recordBaseline запоминает удаленную версию файла name перед первой
+// записью в его локальную копию, если она еще не известна
+func (p *PikpakProxy) recordBaseline(name string) {
+	if p.conflictPolicy == ConflictNone {
+		return
+	}
+	if _, ok := p.baselines.get(name); ok {
+		return
+	}
+
+	if remote, err := p.remoteClient.Stat(name); err == nil && !remote.IsDir() {
+		p.baselines.set(name, remote)
+	}
+}
+
+// recordUploaded запоминает версию файла name, загруженную на сервер
+func (p *PikpakProxy) recordUploaded(name string) {
+	if remote, err := p.remoteClient.Stat(name); err == nil && !remote.IsDir() {
+		p.baselines.set(name, remote)
+	}
+}
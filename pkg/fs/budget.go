@@ -0,0 +1,252 @@
+package fs
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path"
+	"sort"
+	"sync/atomic"
+)
+
+// ErrInsufficientStorage возвращается, если запись превысит бюджет
+// локального кеша, а освободить место вытеснением не удалось
+var ErrInsufficientStorage = errors.New("insufficient storage in local cache")
+
+type budgetKey struct{}
+
+// BudgetContext позволяет узнать через BudgetExceeded, что запись в файл,
+// открытый с этим контекстом, не поместилась в бюджет кеша. Обработчик
+// WebDAV отвечает на любую ошибку записи при PUT кодом 405
+func BudgetContext(ctx context.Context) context.Context {
+	return context.WithValue(ctx, budgetKey{}, new(atomic.Bool))
+}
+
+// BudgetExceeded сообщает, была ли запись с контекстом BudgetContext
+// отклонена из-за бюджета кеша
+func BudgetExceeded(ctx context.Context) bool {
+	exceeded, _ := ctx.Value(budgetKey{}).(*atomic.Bool)
+	return exceeded != nil && exceeded.Load()
+}
+
+// markExceeded отмечает в контексте отклоненную запись
+func markExceeded(ctx context.Context) {
+	if exceeded, _ := ctx.Value(budgetKey{}).(*atomic.Bool); exceeded != nil {
+		exceeded.Store(true)
+	}
+}
+
+const (
+	defaultHighWatermark = 0.9
+	defaultLowWatermark  = 0.8
+)
+
+// Reserve проверяет, поместится ли файл name размером size в локальный кеш,
+// и при необходимости вытесняет чистые файлы. Бюджет считается по месту
+// на диске, то есть с учетом шифрования. Место, занятое текущей версией
+// файла, считается свободным
+func (p *PikpakProxy) Reserve(ctx context.Context, name string, size int64) error {
+	return p.reserve(name, p.crypt.storedSize(size), diskSize(p.LocalFilePath(name)))
+}
+
+// ReserveTemp резервирует в бюджете кеша место под временный файл размером
+// size в MetaPath("tmp"), например тело запроса, которое сохраняется
+// до проверки. Резерв учитывается в размере кеша, пока не будет вызвана
+// возвращенная функция, то есть пока файл не удален или не перенесен
+func (p *PikpakProxy) ReserveTemp(ctx context.Context, size int64) (func(), error) {
+	if err := p.reserve("", size, 0); err != nil {
+		return nil, err
+	}
+	return p.usage.hold(size), nil
+}
+
+// reserve проверяет, поместятся ли size байт на диске, если освободить
+// replaced байт, занятых файлом name, и при необходимости вытесняет
+// чистые файлы. Файл name не вытесняется
+func (p *PikpakProxy) reserve(name string, size, replaced int64) error {
+	if p.cacheBudget <= 0 {
+		return nil
+	}
+
+	used, err := p.usage.get()
+	if err != nil {
+		return err
+	}
+
+	need := used - replaced + size - p.cacheBudget
+	if need <= 0 {
+		return nil
+	}
+
+	target := name
+	if target == "" {
+		target = "temporary file"
+	}
+	p.log.Logf("[INFO] cache budget exceeded by %d bytes for %s, evicting", need, target)
+	if freed := p.evictClean(need, name); freed < need {
+		return ErrInsufficientStorage
+	}
+
+	return nil
+}
+
+// checkWatermark запускает вытеснение, если размер кеша превысил верхнюю
+// границу. Вытеснение продолжается до нижней границы
+func (p *PikpakProxy) checkWatermark() {
+	if p.cacheBudget <= 0 {
+		return
+	}
+
+	used, err := p.usage.get()
+	if err != nil || float64(used) <= float64(p.cacheBudget)*p.highWatermark {
+		return
+	}
+
+	if !p.evicting.CompareAndSwap(false, true) {
+		return
+	}
+
+	go func() {
+		defer p.evicting.Store(false)
+
+		target := int64(float64(p.cacheBudget) * p.lowWatermark)
+		p.log.Logf("[INFO] cache usage %d bytes is above high watermark, evicting to %d", used, target)
+		p.evictClean(used-target, "")
+	}()
+}
+
+// evictClean удаляет из локального слоя чистые файлы, то есть файлы,
+// совпадающие с удаленной версией, начиная с самых старых, пока не будет
+// освобождено need байт. Файл skip не удаляется. Возвращает размер
+// освобожденного места
+func (p *PikpakProxy) evictClean(need int64, skip string) int64 {
+	candidates := p.localFiles("/")
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].info.ModTime().Before(candidates[j].info.ModTime())
+	})
+
+	var freed int64
+	var evicted []string
+	clean := p.cleanChecker()
+	for _, c := range candidates {
+		if freed >= need {
+			break
+		}
+
+		if c.name == skip || !clean.check(c.name, c.info) {
+			continue
+		}
+
+		size, err := p.removeCached(c.name)
+		if err != nil {
+			p.log.Logf("[WARN] failed to evict %s: %v", c.name, err)
+			continue
+		}
+
+		p.log.Logf("[DEBUG] evicted clean file %s (%d bytes)", c.name, size)
+		p.checksums.forget(c.name)
+		evicted = append(evicted, c.name)
+		freed += size
+	}
+
+	p.markEvicted(evicted)
+	p.log.Logf("[INFO] evicted %d bytes from local cache", freed)
+	return freed
+}
+
+// cleanChecker проверяет, совпадают ли локальные файлы с удаленными
+// версиями, то есть могут ли они быть удалены без потери данных.
+//
+// Сначала используются записанные состояния: снимок последней синхронизации
+// и версия, от которой произошла локальная копия. Если локальный файл не
+// изменился с тех пор, сервер не запрашивается. Удаление файла на сервере
+// в обход прокси при этом не обнаруживается. Для остальных файлов список
+// удаленной директории читается один раз за проверку, а не по запросу
+// на каждый файл
+type cleanChecker struct {
+	p     *PikpakProxy
+	state *syncState
+	dirs  map[string]map[string]os.FileInfo
+}
+
+func (p *PikpakProxy) cleanChecker() *cleanChecker {
+	return &cleanChecker{
+		p:     p,
+		state: loadSyncState(p.log, p.MetaPath("sync.json")),
+		dirs:  make(map[string]map[string]os.FileInfo),
+	}
+}
+
+// check проверяет, совпадает ли локальный файл name с удаленной версией
+func (c *cleanChecker) check(name string, local os.FileInfo) bool {
+	if c.p.recordedClean(c.state, name, local) {
+		return true
+	}
+
+	remote, ok := c.remote(name)
+	return ok && sameVersion(local, remote)
+}
+
+// remote возвращает удаленную версию файла name из списка его директории
+func (c *cleanChecker) remote(name string) (os.FileInfo, bool) {
+	dir := path.Dir(name)
+	infos, ok := c.dirs[dir]
+	if !ok {
+		infos = make(map[string]os.FileInfo)
+		list, err := c.p.remoteClient.ReadDir(dir)
+		if err != nil && !remoteMissing(err) {
+			c.p.log.Logf("[WARN] failed to list %s for eviction: %v", dir, err)
+		}
+		for _, info := range list {
+			infos[info.Name()] = info
+		}
+		c.dirs[dir] = infos
+	}
+
+	info, ok := infos[path.Base(name)]
+	return info, ok
+}
+
+// isClean проверяет, совпадает ли один локальный файл с удаленной версией.
+// Для проверки многих файлов используется cleanChecker
+func (p *PikpakProxy) isClean(name string, local os.FileInfo) bool {
+	if p.recordedClean(loadSyncState(p.log, p.MetaPath("sync.json")), name, local) {
+		return true
+	}
+
+	remote, err := p.remoteClient.Stat(name)
+	return err == nil && sameVersion(local, remote)
+}
+
+// recordedClean проверяет, что локальный файл не изменился с момента,
+// когда он совпадал с удаленной версией: после синхронизации или скачивания
+func (p *PikpakProxy) recordedClean(state *syncState, name string, local os.FileInfo) bool {
+	key := name
+	if p.matchNames() {
+		key = p.nameKey(name)
+	}
+	if e, ok := state.Items[key]; ok && !e.IsDir && e.Remote.Size == local.Size() &&
+		e.Local.Size == local.Size() && sameModTime(e.Local.ModTime, local.ModTime()) {
+		return true
+	}
+
+	base, ok := p.baselines.get(name)
+	return ok && base.Size == local.Size() && sameModTime(base.ModTime, local.ModTime())
+}
+
+// sameVersion проверяет, совпадает ли локальный файл с удаленным
+// по размеру и времени изменения
+func sameVersion(local, remote os.FileInfo) bool {
+	return !remote.IsDir() && remote.Size() == local.Size() && sameModTime(local.ModTime(), remote.ModTime())
+}
+
+// clampWatermarks проверяет границы вытеснения
+func clampWatermarks(high, low float64) (float64, float64) {
+	if high <= 0 || high > 1 {
+		high = defaultHighWatermark
+	}
+	if low <= 0 || low >= high {
+		low = high * defaultLowWatermark / defaultHighWatermark
+	}
+	return high, low
+}
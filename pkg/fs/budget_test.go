@@ -0,0 +1,154 @@
+package fs_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ReanSn0w/pikpak-webdav-proxy/pkg/fs"
+	"github.com/ReanSn0w/pikpak-webdav-proxy/pkg/web"
+	lgr "github.com/go-pkgz/lgr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/webdav"
+)
+
+// setupBudget создает кеш с чистым файлом old.bin (есть на удаленном
+// сервере) и измененным локально dirty.bin, по 40 байт каждый
+func setupBudget(t *testing.T, budget int64, opts ...fs.Option) (*fs.PikpakProxy, string, *MockWebdav) {
+	tmpDir := t.TempDir()
+	mockClient := &MockWebdav{}
+
+	writeLocalFile(t, tmpDir, "old.bin", strings.Repeat("o", 40), testTime)
+	writeLocalFile(t, tmpDir, "dirty.bin", strings.Repeat("d", 40), testTime.Add(-time.Hour))
+
+	mockClient.On("Stat", "/old.bin").Return(newSizedFileInfo("old.bin", 40, testTime), nil)
+	mockClient.On("Stat", mock.Anything).Return(nil, os.ErrNotExist)
+	mockClient.On("ReadDir", "/").Return([]os.FileInfo{newSizedFileInfo("old.bin", 40, testTime)}, nil)
+
+	opts = append([]fs.Option{fs.WithCacheBudget(budget)}, opts...)
+	return fs.NewPikpakProxy(lgr.New(), tmpDir, mockClient, opts...), tmpDir, mockClient
+}
+
+func TestReserve_Unlimited(t *testing.T) {
+	proxy := fs.NewPikpakProxy(lgr.New(), t.TempDir(), &MockWebdav{})
+	assert.NoError(t, proxy.Reserve(context.Background(), "/big.bin", 1<<40))
+}
+
+func TestReserve_Fits(t *testing.T) {
+	proxy, tmpDir, _ := setupBudget(t, 100)
+
+	assert.NoError(t, proxy.Reserve(context.Background(), "/new.bin", 20))
+	assert.FileExists(t, filepath.Join(tmpDir, "old.bin"))
+
+	// Перезаписываемый файл не учитывается
+	assert.NoError(t, proxy.Reserve(context.Background(), "/dirty.bin", 60))
+	assert.FileExists(t, filepath.Join(tmpDir, "old.bin"))
+}
+
+func TestReserve_EvictsCleanFiles(t *testing.T) {
+	proxy, tmpDir, _ := setupBudget(t, 100)
+
+	assert.NoError(t, proxy.Reserve(context.Background(), "/new.bin", 50))
+
+	// Вытесняется только файл, совпадающий с удаленной версией
+	assert.NoFileExists(t, filepath.Join(tmpDir, "old.bin"))
+	assert.FileExists(t, filepath.Join(tmpDir, "dirty.bin"))
+}
+
+func TestReserve_ListsDirectoryOnce(t *testing.T) {
+	proxy, tmpDir, mockClient := setupBudget(t, 100)
+	writeLocalFile(t, tmpDir, "older.bin", strings.Repeat("o", 40), testTime.Add(-2*time.Hour))
+	mockClient.ExpectedCalls = nil
+	mockClient.On("ReadDir", "/").Return([]os.FileInfo{
+		newSizedFileInfo("old.bin", 40, testTime),
+		newSizedFileInfo("older.bin", 40, testTime.Add(-2*time.Hour)),
+	}, nil)
+
+	assert.NoError(t, proxy.Reserve(context.Background(), "/new.bin", 60))
+	assert.NoFileExists(t, filepath.Join(tmpDir, "old.bin"))
+	assert.NoFileExists(t, filepath.Join(tmpDir, "older.bin"))
+
+	// Сервер запрашивается один раз на директорию, а не на каждый файл
+	mockClient.AssertNumberOfCalls(t, "ReadDir", 1)
+	mockClient.AssertNotCalled(t, "Stat", mock.Anything)
+}
+
+func TestReserve_RecordedSyncState(t *testing.T) {
+	proxy, tmpDir, mockClient := setupBudget(t, 100)
+	mockClient.ExpectedCalls = nil
+	mockClient.On("ReadDir", "/").Return([]os.FileInfo{}, nil)
+
+	// Файл не менялся с последней синхронизации, его удаленная версия
+	// не запрашивается
+	state := `{"/old.bin":{"local":{"size":40,"mtime":"2024-01-02T03:04:05Z"},"remote":{"size":40,"mtime":"2024-01-02T03:04:05Z"}}}`
+	require.NoError(t, os.MkdirAll(proxy.MetaPath(), 0755))
+	require.NoError(t, os.WriteFile(proxy.MetaPath("sync.json"), []byte(state), 0644))
+
+	assert.NoError(t, proxy.Reserve(context.Background(), "/new.bin", 50))
+	assert.NoFileExists(t, filepath.Join(tmpDir, "old.bin"))
+	assert.FileExists(t, filepath.Join(tmpDir, "dirty.bin"))
+	mockClient.AssertNotCalled(t, "Stat", mock.Anything)
+}
+
+func TestReserve_Insufficient(t *testing.T) {
+	proxy, tmpDir, _ := setupBudget(t, 100)
+
+	err := proxy.Reserve(context.Background(), "/new.bin", 70)
+	assert.ErrorIs(t, err, fs.ErrInsufficientStorage)
+	assert.FileExists(t, filepath.Join(tmpDir, "dirty.bin"))
+}
+
+func TestWrite_ExceedsBudget(t *testing.T) {
+	proxy, _, _ := setupBudget(t, 100)
+
+	f, err := proxy.OpenFile(context.Background(), "/new.bin", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	require.NoError(t, err)
+	defer f.Close()
+
+	_, err = f.Write(make([]byte, 15))
+	require.NoError(t, err)
+
+	_, err = f.Write(make([]byte, 15))
+	assert.ErrorIs(t, err, fs.ErrInsufficientStorage)
+}
+
+func TestWrite_ExceedsBudgetChunked(t *testing.T) {
+	proxy, tmpDir, _ := setupBudget(t, 100)
+	handler := web.Budget(proxy, &webdav.Handler{FileSystem: proxy, LockSystem: webdav.NewMemLS()})
+
+	// Размер загрузки заранее неизвестен, бюджет превышается во время записи
+	req := httptest.NewRequest(http.MethodPut, "/new.bin", strings.NewReader(strings.Repeat("n", 30)))
+	req.ContentLength = -1
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusInsufficientStorage, rec.Code)
+	assert.Contains(t, rec.Body.String(), fs.ErrInsufficientStorage.Error())
+	assert.FileExists(t, filepath.Join(tmpDir, "dirty.bin"))
+}
+
+func TestWatermark_Eviction(t *testing.T) {
+	proxy, tmpDir, _ := setupBudget(t, 100, fs.WithWatermarks(0.5, 0.4))
+
+	// После записи кеш занимает 90 байт при верхней границе 50
+	f, err := proxy.OpenFile(context.Background(), "/new.bin", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	require.NoError(t, err)
+	_, err = f.Write(make([]byte, 10))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	assert.Eventually(t, func() bool {
+		_, err := os.Stat(filepath.Join(tmpDir, "old.bin"))
+		return os.IsNotExist(err)
+	}, time.Second, 10*time.Millisecond)
+
+	assert.FileExists(t, filepath.Join(tmpDir, "dirty.bin"))
+	assert.FileExists(t, filepath.Join(tmpDir, "new.bin"))
+}
@@ -0,0 +1,34 @@
+package fs
+
+import (
+	"errors"
+	"fmt"
+	"os"
+)
+
+// ErrCacheLocked возвращается, если локальный кеш уже использует другой
+// процесс: запущенный сервер или команда, работающая с кешем напрямую
+var ErrCacheLocked = errors.New("local cache is used by another process")
+
+// LockCache захватывает исключительную блокировку локального кеша.
+// Сервер и команды синхронизации и обслуживания перезаписывают одни
+// и те же служебные файлы, поэтому с кешем может работать только один
+// процесс. Блокировка снимается вызовом unlock или при завершении процесса
+func (p *PikpakProxy) LockCache() (unlock func(), err error) {
+	if err := os.MkdirAll(p.MetaPath(), 0755); err != nil {
+		return nil, err
+	}
+
+	name := p.MetaPath("lock")
+	f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := lockFile(f); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("lock %s: %w", name, err)
+	}
+
+	return func() { f.Close() }, nil
+}
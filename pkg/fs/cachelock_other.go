@@ -0,0 +1,11 @@
+//go:build !unix
+
+package fs
+
+import "os"
+
+// lockFile не блокирует файл там, где нет flock: одновременный запуск
+// сервера и команд остается на совести пользователя
+func lockFile(f *os.File) error {
+	return nil
+}
@@ -0,0 +1,376 @@
+package fs
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/ReanSn0w/pikpak-webdav-proxy/pkg/utils"
+	"github.com/go-pkgz/lgr"
+)
+
+// ErrNoChecksum возвращается, если контрольная сумма файла неизвестна
+var ErrNoChecksum = errors.New("checksum is not available")
+
+// Checksums - контрольные суммы содержимого файла в шестнадцатеричном виде
+type Checksums struct {
+	SHA256 string `json:"sha256,omitempty"`
+	MD5    string `json:"md5,omitempty"`
+}
+
+// RemoteChecksummer - необязательный интерфейс клиента удаленного сервера,
+// который умеет получать контрольные суммы файлов без их загрузки
+type RemoteChecksummer interface {
+	Checksums(path string) (Checksums, error)
+}
+
+// Checksums возвращает контрольные суммы файла name. Для локальных файлов
+// они вычисляются, если еще не известны, для удаленных запрашиваются
+// у сервера, если он это поддерживает
+func (p *PikpakProxy) Checksums(ctx context.Context, name string) (Checksums, error) {
+	return p.checksumsOf(name, true)
+}
+
+// CachedChecksums возвращает контрольные суммы локального файла name,
+// только если их не нужно вычислять. Удаленный сервер не запрашивается.
+// Неизвестные суммы локального файла вычисляются в фоне и будут доступны
+// при следующем обращении
+func (p *PikpakProxy) CachedChecksums(ctx context.Context, name string) (Checksums, error) {
+	return p.checksumsOf(name, false)
+}
+
+func (p *PikpakProxy) checksumsOf(name string, compute bool) (Checksums, error) {
+	localPath := p.LocalFilePath(name)
+	if !compute {
+		// Без локальной копии суммы можно получить только у сервера
+		if local, err := p.crypt.stat(localPath); err != nil || local.IsDir() {
+			return Checksums{}, ErrNoChecksum
+		}
+	}
+
+	info, err := p.stat(name)
+	if err != nil {
+		return Checksums{}, err
+	}
+
+	if info.IsDir() {
+		return Checksums{}, ErrNoChecksum
+	}
+
+	if local, err := os.Stat(localPath); err == nil && sameFile(local, info) {
+		if !compute {
+			sums, err := p.checksums.lookup(name, info)
+			if err != nil {
+				p.checksums.schedule(name, localPath)
+			}
+			return sums, err
+		}
+		return p.checksums.get(name, localPath, info)
+	}
+
+	if !compute {
+		return Checksums{}, ErrNoChecksum
+	}
+
+	if c, ok := p.remoteClient.(RemoteChecksummer); ok {
+		_, remoteName := p.resolveLayers(name)
+		return p.checksums.remoteLookup(c, remoteName, info)
+	}
+
+	return Checksums{}, ErrNoChecksum
+}
+
+const (
+	// checksumSaveInterval - минимальный интервал между записями файла
+	// контрольных сумм: изменения за это время сохраняются одной записью
+	checksumSaveInterval = time.Second
+	// checksumQueueSize - число файлов, ожидающих фонового вычисления сумм
+	checksumQueueSize = 1024
+)
+
+// checksumStore хранит контрольные суммы локальных файлов, пока
+// не изменились их размер и время изменения
+type checksumStore struct {
+	log  lgr.L
+	path string
+	// crypt расшифровывает локальные файлы при вычислении сумм
+	crypt *localCrypt
+
+	mu    sync.Mutex
+	items map[string]checksumEntry
+	// saved - время последней записи, timer - отложенная запись
+	saved time.Time
+	timer *time.Timer
+	// queue - очередь фонового вычисления, pending - файлы в ней
+	queue   chan checksumJob
+	pending map[string]bool
+	// remote - ответы удаленного сервера, в том числе об отсутствии сумм,
+	// пока не изменились размер и время изменения удаленного файла
+	remote map[string]remoteChecksumEntry
+}
+
+type checksumJob struct {
+	name      string
+	localPath string
+}
+
+type checksumEntry struct {
+	Checksums
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mtime"`
+	// Written - суммы вычислены при записи или скачивании этой версии
+	// файла через прокси, а не при обращении к уже существующему файлу
+	Written bool `json:"written,omitempty"`
+}
+
+type remoteChecksumEntry struct {
+	checksumEntry
+	err error
+}
+
+func newChecksumStore(log lgr.L, path string) *checksumStore {
+	s := &checksumStore{
+		log:     log,
+		path:    path,
+		items:   make(map[string]checksumEntry),
+		pending: make(map[string]bool),
+		remote:  make(map[string]remoteChecksumEntry),
+	}
+
+	data, err := os.ReadFile(path)
+	switch {
+	case os.IsNotExist(err):
+		return s
+	case err != nil:
+		log.Logf("[WARN] failed to read checksums: %v", err)
+		return s
+	}
+
+	if err := json.Unmarshal(data, &s.items); err != nil {
+		log.Logf("[WARN] failed to decode checksums: %v", err)
+	}
+
+	return s
+}
+
+// lookup возвращает сохраненные контрольные суммы, если файл не изменился
+func (s *checksumStore) lookup(name string, info os.FileInfo) (Checksums, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, ok := s.items[path.Clean("/"+name)]
+	if !ok || e.Size != info.Size() || !e.ModTime.Equal(info.ModTime()) {
+		return Checksums{}, ErrNoChecksum
+	}
+
+	return e.Checksums, nil
+}
+
+// written возвращает контрольные суммы версии файла, записанной или
+// скачанной через прокси. Для файлов, появившихся в кеше в обход прокси,
+// суммы не возвращаются, даже если уже вычислены
+func (s *checksumStore) written(name string, info os.FileInfo) (Checksums, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, ok := s.items[path.Clean("/"+name)]
+	if !ok || !e.Written || e.Size != info.Size() || !e.ModTime.Equal(info.ModTime()) {
+		return Checksums{}, false
+	}
+
+	return e.Checksums, true
+}
+
+// get возвращает контрольные суммы файла, вычисляя их при необходимости
+func (s *checksumStore) get(name, localPath string, info os.FileInfo) (Checksums, error) {
+	if sums, err := s.lookup(name, info); err == nil {
+		return sums, nil
+	}
+	return s.update(name, localPath, false)
+}
+
+// remoteLookup запрашивает контрольные суммы удаленного файла name
+// у сервера. Ответ запоминается, пока файл не изменился: PikPak не отдает
+// суммы, и без этого каждое скачивание стоило бы лишнего PROPFIND
+func (s *checksumStore) remoteLookup(c RemoteChecksummer, name string, info os.FileInfo) (Checksums, error) {
+	s.mu.Lock()
+	e, ok := s.remote[name]
+	s.mu.Unlock()
+
+	if ok && e.Size == info.Size() && e.ModTime.Equal(info.ModTime()) {
+		return e.Checksums, e.err
+	}
+
+	sums, err := c.Checksums(name)
+	if err == nil || errors.Is(err, ErrNoChecksum) {
+		s.mu.Lock()
+		s.remote[name] = remoteChecksumEntry{
+			checksumEntry: checksumEntry{Checksums: sums, Size: info.Size(), ModTime: info.ModTime()},
+			err:           err,
+		}
+		s.mu.Unlock()
+	}
+
+	return sums, err
+}
+
+// schedule ставит вычисление контрольных сумм файла в очередь фоновой
+// обработки. Если очередь заполнена, файл пропускается: суммы будут
+// запрошены снова при следующем обращении к нему
+func (s *checksumStore) schedule(name, localPath string) {
+	name = path.Clean("/" + name)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.pending[name] {
+		return
+	}
+
+	if s.queue == nil {
+		s.queue = make(chan checksumJob, checksumQueueSize)
+		go s.work()
+	}
+
+	select {
+	case s.queue <- checksumJob{name: name, localPath: localPath}:
+		s.pending[name] = true
+	default:
+	}
+}
+
+// work вычисляет контрольные суммы файлов из очереди по одному, чтобы
+// не нагружать диск параллельным чтением
+func (s *checksumStore) work() {
+	for job := range s.queue {
+		if _, err := s.update(job.name, job.localPath, false); err != nil && !os.IsNotExist(err) {
+			s.log.Logf("[WARN] failed to compute checksums for %s: %v", job.name, err)
+		}
+
+		s.mu.Lock()
+		delete(s.pending, job.name)
+		s.mu.Unlock()
+	}
+}
+
+// update вычисляет и сохраняет контрольные суммы локального файла.
+// written отмечает версию, только что записанную через прокси
+func (s *checksumStore) update(name, localPath string, written bool) (Checksums, error) {
+	f, err := s.crypt.open(localPath, os.O_RDONLY, 0)
+	if err != nil {
+		return Checksums{}, err
+	}
+	defer f.Close()
+
+	// Файл мог измениться после получения информации о нем
+	info, err := f.Stat()
+	if err != nil {
+		return Checksums{}, err
+	}
+
+	sha, md := sha256.New(), md5.New()
+	if _, err := io.Copy(io.MultiWriter(sha, md), f); err != nil {
+		return Checksums{}, err
+	}
+
+	sums := Checksums{
+		SHA256: hex.EncodeToString(sha.Sum(nil)),
+		MD5:    hex.EncodeToString(md.Sum(nil)),
+	}
+
+	s.set(name, sums, info, written)
+	return sums, nil
+}
+
+// set сохраняет контрольные суммы версии info локального файла name
+func (s *checksumStore) set(name string, sums Checksums, info os.FileInfo, written bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.items[path.Clean("/"+name)] = checksumEntry{Checksums: sums, Size: info.Size(), ModTime: info.ModTime(), Written: written}
+	s.changed()
+}
+
+// move переносит контрольные суммы файла и всех вложенных в него файлов
+func (s *checksumStore) move(oldName, newName string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	oldName, newName = path.Clean("/"+oldName), path.Clean("/"+newName)
+
+	moved := make(map[string]checksumEntry)
+	for key, e := range s.items {
+		if rel, ok := within(oldName, key); ok {
+			delete(s.items, key)
+			moved[path.Join(newName, rel)] = e
+		} else if _, ok := within(newName, key); ok {
+			delete(s.items, key)
+		}
+	}
+
+	for key, e := range moved {
+		s.items[key] = e
+	}
+
+	s.changed()
+}
+
+// forget удаляет контрольные суммы файла и всех вложенных в него файлов
+func (s *checksumStore) forget(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	name = path.Clean("/" + name)
+
+	changed := false
+	for key := range s.items {
+		if _, ok := within(name, key); ok {
+			delete(s.items, key)
+			changed = true
+		}
+	}
+
+	if changed {
+		s.changed()
+	}
+}
+
+// changed сохраняет контрольные суммы не чаще checksumSaveInterval:
+// изменения, сделанные раньше, записываются отложенно одним файлом.
+// Вызывается под s.mu
+func (s *checksumStore) changed() {
+	if s.timer != nil {
+		return
+	}
+
+	wait := time.Until(s.saved.Add(checksumSaveInterval))
+	if wait <= 0 {
+		s.save()
+		s.saved = time.Now()
+		return
+	}
+
+	s.timer = time.AfterFunc(wait, func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		s.timer = nil
+		s.save()
+		s.saved = time.Now()
+	})
+}
+
+// save записывает контрольные суммы в файл. Вызывается под s.mu
+func (s *checksumStore) save() {
+	if err := utils.WriteJSONAtomic(s.path, s.items); err != nil {
+		s.log.Logf("[ERROR] failed to save checksums: %v", err)
+	}
+}
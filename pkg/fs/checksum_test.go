@@ -0,0 +1,154 @@
+package fs_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ReanSn0w/pikpak-webdav-proxy/pkg/fs"
+	lgr "github.com/go-pkgz/lgr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	dataSHA256 = "3a6eb0790f39ac87c94f3856b2dd2c5d110e6811602261a9a923d3bb23adc8b7"
+	dataMD5    = "8d777f385d3dfec8815d20f7496026dc"
+)
+
+// checksumWebdav - удаленный сервер, предоставляющий контрольные суммы
+type checksumWebdav struct {
+	*MockWebdav
+	sums fs.Checksums
+}
+
+func (c checksumWebdav) Checksums(path string) (fs.Checksums, error) {
+	return c.sums, nil
+}
+
+func TestChecksums_ComputedOnWrite(t *testing.T) {
+	tmpDir := t.TempDir()
+	proxy := fs.NewPikpakProxy(lgr.New(), tmpDir, &MockWebdav{})
+
+	f, err := proxy.OpenFile(context.Background(), "/file.txt", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	require.NoError(t, err)
+	_, err = f.Write([]byte("data"))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	sums, err := proxy.CachedChecksums(context.Background(), "/file.txt")
+	require.NoError(t, err)
+	assert.Equal(t, fs.Checksums{SHA256: dataSHA256, MD5: dataMD5}, sums)
+
+	// Контрольные суммы сохраняются между перезапусками
+	restarted := fs.NewPikpakProxy(lgr.New(), tmpDir, &MockWebdav{})
+	sums, err = restarted.CachedChecksums(context.Background(), "/file.txt")
+	require.NoError(t, err)
+	assert.Equal(t, dataSHA256, sums.SHA256)
+}
+
+func TestChecksums_Local(t *testing.T) {
+	tmpDir := t.TempDir()
+	proxy := fs.NewPikpakProxy(lgr.New(), tmpDir, &MockWebdav{})
+	require.NoError(t, os.WriteFile(filepath.Join(tmpDir, "file.txt"), []byte("data"), 0644))
+
+	// Файл записан в обход прокси, контрольная сумма еще не вычислена
+	_, err := proxy.CachedChecksums(context.Background(), "/file.txt")
+	assert.ErrorIs(t, err, fs.ErrNoChecksum)
+
+	sums, err := proxy.Checksums(context.Background(), "/file.txt")
+	require.NoError(t, err)
+	assert.Equal(t, fs.Checksums{SHA256: dataSHA256, MD5: dataMD5}, sums)
+
+	// Изменение файла делает сохраненную сумму недействительной
+	require.NoError(t, os.WriteFile(filepath.Join(tmpDir, "file.txt"), []byte("changed"), 0644))
+	_, err = proxy.CachedChecksums(context.Background(), "/file.txt")
+	assert.ErrorIs(t, err, fs.ErrNoChecksum)
+}
+
+func TestChecksums_ComputedInBackground(t *testing.T) {
+	tmpDir := t.TempDir()
+	proxy := fs.NewPikpakProxy(lgr.New(), tmpDir, &MockWebdav{})
+	require.NoError(t, os.WriteFile(filepath.Join(tmpDir, "file.txt"), []byte("data"), 0644))
+
+	// Неизвестные суммы не вычисляются при запросе, а ставятся в очередь
+	_, err := proxy.CachedChecksums(context.Background(), "/file.txt")
+	assert.ErrorIs(t, err, fs.ErrNoChecksum)
+
+	assert.Eventually(t, func() bool {
+		sums, err := proxy.CachedChecksums(context.Background(), "/file.txt")
+		return err == nil && sums.SHA256 == dataSHA256
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestChecksums_MovedOnRename(t *testing.T) {
+	tmpDir := t.TempDir()
+	mockClient := &MockWebdav{}
+	proxy := fs.NewPikpakProxy(lgr.New(), tmpDir, mockClient)
+	require.NoError(t, os.WriteFile(filepath.Join(tmpDir, "file.txt"), []byte("data"), 0644))
+
+	_, err := proxy.Checksums(context.Background(), "/file.txt")
+	require.NoError(t, err)
+
+	mockClient.On("Rename", "/file.txt", "/moved.txt", true).Return(nil)
+	require.NoError(t, proxy.Rename(context.Background(), "/file.txt", "/moved.txt"))
+
+	sums, err := proxy.CachedChecksums(context.Background(), "/moved.txt")
+	require.NoError(t, err)
+	assert.Equal(t, dataSHA256, sums.SHA256)
+}
+
+func TestChecksums_Remote(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	mockClient := &MockWebdav{}
+	mockClient.On("Stat", "/remote.bin").Return(newMockFileInfo("remote.bin", false), nil)
+
+	proxy := fs.NewPikpakProxy(lgr.New(), tmpDir, mockClient)
+	_, err := proxy.Checksums(context.Background(), "/remote.bin")
+	assert.ErrorIs(t, err, fs.ErrNoChecksum)
+
+	client := &countingChecksumWebdav{MockWebdav: mockClient, sums: fs.Checksums{MD5: dataMD5}}
+	proxy = fs.NewPikpakProxy(lgr.New(), tmpDir, client)
+
+	// Без явного запроса удаленный сервер не опрашивается
+	_, err = proxy.CachedChecksums(context.Background(), "/remote.bin")
+	assert.ErrorIs(t, err, fs.ErrNoChecksum)
+	assert.Zero(t, client.calls)
+
+	sums, err := proxy.Checksums(context.Background(), "/remote.bin")
+	require.NoError(t, err)
+	assert.Equal(t, dataMD5, sums.MD5)
+	assert.Equal(t, 1, client.calls)
+}
+
+func TestChecksums_RemoteMissingCached(t *testing.T) {
+	mockClient := &MockWebdav{}
+	mockClient.On("Stat", "/remote.bin").Return(newMockFileInfo("remote.bin", false), nil)
+
+	client := &countingChecksumWebdav{MockWebdav: mockClient}
+	proxy := fs.NewPikpakProxy(lgr.New(), t.TempDir(), client)
+
+	for range 3 {
+		_, err := proxy.Checksums(context.Background(), "/remote.bin")
+		assert.ErrorIs(t, err, fs.ErrNoChecksum)
+	}
+	assert.Equal(t, 1, client.calls)
+}
+
+// countingChecksumWebdav - удаленный сервер, считающий запросы сумм
+type countingChecksumWebdav struct {
+	*MockWebdav
+	sums  fs.Checksums
+	calls int
+}
+
+func (c *countingChecksumWebdav) Checksums(path string) (fs.Checksums, error) {
+	c.calls++
+	if c.sums == (fs.Checksums{}) {
+		return fs.Checksums{}, fs.ErrNoChecksum
+	}
+	return c.sums, nil
+}
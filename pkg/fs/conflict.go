@@ -0,0 +1,354 @@
+package fs
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ConflictPolicy - политика разрешения конфликтов между локальной
+// и удаленной версией одного и того же файла
+type ConflictPolicy string
+
+const (
+	// ConflictNone - обнаружение конфликтов отключено, локальная версия
+	// используется без обращения к удаленному серверу
+	ConflictNone ConflictPolicy = "none"
+	// ConflictLocal - побеждает локальная версия
+	ConflictLocal ConflictPolicy = "local"
+	// ConflictRemote - побеждает удаленная версия
+	ConflictRemote ConflictPolicy = "remote"
+	// ConflictNewest - побеждает версия с более поздним временем изменения
+	ConflictNewest ConflictPolicy = "newest"
+	// ConflictKeepBoth - локальная версия остается под исходным именем,
+	// удаленная доступна как "name (conflict).ext"
+	ConflictKeepBoth ConflictPolicy = "keep-both"
+)
+
+// conflictSuffix добавляется к имени удаленной версии при политике keep-both
+const conflictSuffix = " (conflict)"
+
+// modTimeTolerance - допустимое расхождение времени изменения,
+// вызванное разной точностью хранения времени в слоях
+const modTimeTolerance = 2 * time.Second
+
+// ParseConflictPolicy разбирает название политики разрешения конфликтов
+func ParseConflictPolicy(s string) (ConflictPolicy, error) {
+	switch policy := ConflictPolicy(s); policy {
+	case ConflictNone, ConflictLocal, ConflictRemote, ConflictNewest, ConflictKeepBoth:
+		return policy, nil
+	case "":
+		return ConflictNone, nil
+	default:
+		return "", fmt.Errorf("unknown conflict policy: %s", s)
+	}
+}
+
+// Conflict - обнаруженное расхождение локальной и удаленной версий файла
+type Conflict struct {
+	Path          string
+	LocalSize     int64
+	RemoteSize    int64
+	LocalModTime  time.Time
+	RemoteModTime time.Time
+	LocalETag     string
+	RemoteETag    string
+	TypeMismatch  bool
+	Resolution    Layer
+	DetectedAt    time.Time
+
+	// remote - удаленная версия файла на момент обнаружения
+	remote os.FileInfo
+}
+
+// localVersion - версия локального файла, которая сравнивалась с удаленной
+type localVersion struct {
+	size    int64
+	modTime time.Time
+}
+
+func versionOf(info os.FileInfo) localVersion {
+	return localVersion{size: info.Size(), modTime: info.ModTime()}
+}
+
+// conflictRegistry хранит результаты сравнения версий файлов, найденных
+// в обоих слоях при чтении директорий и записи. Пока локальный файл
+// не изменился, Stat и OpenFile используют их без запросов к серверу
+type conflictRegistry struct {
+	mu    sync.Mutex
+	items map[string]Conflict
+	// same - файлы без конфликта: версии в слоях совпадают или файл
+	// есть только в локальном слое
+	same map[string]localVersion
+}
+
+func newConflictRegistry() *conflictRegistry {
+	return &conflictRegistry{items: make(map[string]Conflict), same: make(map[string]localVersion)}
+}
+
+// set сохраняет конфликт и возвращает true, если он новый или изменился
+func (r *conflictRegistry) set(c Conflict) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.same, c.Path)
+
+	prev, ok := r.items[c.Path]
+	if ok && prev.LocalSize == c.LocalSize && prev.RemoteSize == c.RemoteSize &&
+		prev.LocalModTime.Equal(c.LocalModTime) && prev.RemoteModTime.Equal(c.RemoteModTime) &&
+		prev.Resolution == c.Resolution {
+		prev.remote = c.remote
+		r.items[c.Path] = prev
+		return false
+	}
+
+	r.items[c.Path] = c
+	return true
+}
+
+// clear запоминает, что версия local файла name не конфликтует
+// с удаленной: совпадает с ней или удаленной версии нет
+func (r *conflictRegistry) clear(name string, local os.FileInfo) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	name = path.Clean("/" + name)
+	delete(r.items, name)
+	r.same[name] = versionOf(local)
+}
+
+// lookup возвращает результат последнего сравнения версии local файла
+// name. Если версия еще не сравнивалась, known равен false
+func (r *conflictRegistry) lookup(name string, local os.FileInfo) (c Conflict, conflict, known bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	name = path.Clean("/" + name)
+	version := versionOf(local)
+
+	if c, ok := r.items[name]; ok && c.remote != nil &&
+		c.LocalSize == version.size && c.LocalModTime.Equal(version.modTime) {
+		return c, true, true
+	}
+	if v, ok := r.same[name]; ok && v.size == version.size && v.modTime.Equal(version.modTime) {
+		return Conflict{}, false, true
+	}
+	return Conflict{}, false, false
+}
+
+// forget удаляет конфликты для пути и всех вложенных в него файлов
+func (r *conflictRegistry) forget(name string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	name = path.Clean("/" + name)
+	prefix := strings.TrimSuffix(name, "/") + "/"
+	for key := range r.items {
+		if key == name || strings.HasPrefix(key, prefix) {
+			delete(r.items, key)
+		}
+	}
+	for key := range r.same {
+		if key == name || strings.HasPrefix(key, prefix) {
+			delete(r.same, key)
+		}
+	}
+}
+
+func (r *conflictRegistry) list() []Conflict {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	result := make([]Conflict, 0, len(r.items))
+	for _, c := range r.items {
+		result = append(result, c)
+	}
+
+	sort.Slice(result, func(i, j int) bool { return result[i].Path < result[j].Path })
+	return result
+}
+
+// Conflicts возвращает список обнаруженных и еще не разрешенных конфликтов
+func (p *PikpakProxy) Conflicts() []Conflict {
+	return p.conflicts.list()
+}
+
+// ConflictPolicy возвращает текущую политику разрешения конфликтов
+func (p *PikpakProxy) ConflictPolicy() ConflictPolicy {
+	return p.conflictPolicy
+}
+
+// conflictingRemote проверяет, конфликтует ли локальный файл с удаленным,
+// и возвращает удаленную версию, если по политике побеждает она. Удаленный
+// сервер запрашивается, только если эта версия локального файла еще
+// не сравнивалась при чтении директории или предыдущем обращении
+func (p *PikpakProxy) conflictingRemote(name string, local os.FileInfo) (os.FileInfo, bool) {
+	if p.conflictPolicy == ConflictNone {
+		return nil, false
+	}
+
+	if c, conflict, known := p.conflicts.lookup(name, local); known {
+		if !conflict {
+			return nil, false
+		}
+		return c.remote, c.Resolution == LayerRemote
+	}
+
+	remote, err := p.remoteClient.Stat(name)
+	if remoteMissing(err) {
+		p.conflicts.clear(name, local)
+		return nil, false
+	}
+	if err != nil || (local.IsDir() && remote.IsDir()) {
+		return nil, false
+	}
+
+	if !p.detectConflict(name, local, remote) {
+		return nil, false
+	}
+
+	return remote, p.resolveConflict(local, remote) == LayerRemote
+}
+
+// detectConflict сравнивает версии файла и регистрирует конфликт
+func (p *PikpakProxy) detectConflict(name string, local, remote os.FileInfo) bool {
+	name = path.Clean("/" + name)
+
+	localETag, remoteETag := fileETag(local), fileETag(remote)
+
+	differ := false
+	base, hasBase := p.baselines.get(name)
+	switch {
+	case local.IsDir() != remote.IsDir():
+		differ = true
+	case hasBase:
+		// Правка локальной копии - не конфликт, пока удаленный файл
+		// не изменился с версии, на которой она основана
+		differ = !base.matches(remote)
+	case localETag != "" && remoteETag != "":
+		differ = localETag != remoteETag
+	case local.Size() != remote.Size():
+		differ = true
+	default:
+		delta := local.ModTime().Sub(remote.ModTime())
+		differ = delta > modTimeTolerance || delta < -modTimeTolerance
+	}
+
+	if !differ {
+		p.conflicts.clear(name, local)
+		return false
+	}
+
+	c := Conflict{
+		Path:          name,
+		LocalSize:     local.Size(),
+		RemoteSize:    remote.Size(),
+		LocalModTime:  local.ModTime(),
+		RemoteModTime: remote.ModTime(),
+		LocalETag:     localETag,
+		RemoteETag:    remoteETag,
+		TypeMismatch:  local.IsDir() != remote.IsDir(),
+		Resolution:    p.resolveConflict(local, remote),
+		DetectedAt:    time.Now(),
+		remote:        remote,
+	}
+
+	if !p.conflicts.set(c) {
+		return true
+	}
+
+	if c.TypeMismatch {
+		p.log.Logf("[WARN] conflict: %s is a %s locally and a %s remotely (policy: %s)",
+			name, fileType(local), fileType(remote), p.conflictPolicy)
+	} else {
+		p.log.Logf("[WARN] conflict: %s (local: %d bytes, %s; remote: %d bytes, %s; policy: %s)",
+			name, c.LocalSize, c.LocalModTime.Format(time.RFC3339),
+			c.RemoteSize, c.RemoteModTime.Format(time.RFC3339), p.conflictPolicy)
+	}
+
+	return true
+}
+
+// resolveConflict возвращает слой, версия из которого видна под исходным именем
+func (p *PikpakProxy) resolveConflict(local, remote os.FileInfo) Layer {
+	switch p.conflictPolicy {
+	case ConflictRemote:
+		return LayerRemote
+	case ConflictNewest:
+		if remote.ModTime().After(local.ModTime()) {
+			return LayerRemote
+		}
+		return LayerLocal
+	default:
+		return LayerLocal
+	}
+}
+
+// fileETag возвращает ETag файла, если слой его предоставляет
+func fileETag(info os.FileInfo) string {
+	if e, ok := info.(interface{ ETag() string }); ok {
+		return e.ETag()
+	}
+	return ""
+}
+
+func fileType(info os.FileInfo) string {
+	if info.IsDir() {
+		return "directory"
+	}
+	return "file"
+}
+
+// conflictName возвращает имя, под которым видна удаленная версия файла
+func conflictName(name string) string {
+	ext := path.Ext(name)
+	if ext == name {
+		ext = ""
+	}
+	return strings.TrimSuffix(name, ext) + conflictSuffix + ext
+}
+
+// conflictOriginal возвращает исходное имя для имени конфликтующей версии
+func conflictOriginal(name string) (string, bool) {
+	dir, base := path.Split(name)
+
+	ext := path.Ext(base)
+	if ext == base {
+		ext = ""
+	}
+
+	stem := strings.TrimSuffix(base, ext)
+	if !strings.HasSuffix(stem, conflictSuffix) {
+		return "", false
+	}
+
+	return dir + strings.TrimSuffix(stem, conflictSuffix) + ext, true
+}
+
+// renamedInfo - информация о файле, отображаемом под другим именем
+type renamedInfo struct {
+	os.FileInfo
+	name string
+}
+
+func (r renamedInfo) Name() string {
+	return r.name
+}
+
+// ETag возвращает ETag удаленного сервера исходного файла
+func (r renamedInfo) ETag() string {
+	return fileETag(r.FileInfo)
+}
+
+// ContentType возвращает тип содержимого исходного файла, если его
+// сообщил удаленный сервер
+func (r renamedInfo) ContentType() string {
+	if c, ok := r.FileInfo.(interface{ ContentType() string }); ok {
+		return c.ContentType()
+	}
+	return ""
+}
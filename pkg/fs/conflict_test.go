@@ -0,0 +1,271 @@
+package fs_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ReanSn0w/pikpak-webdav-proxy/pkg/fs"
+	lgr "github.com/go-pkgz/lgr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/webdav"
+)
+
+func newSizedFileInfo(name string, size int64, modTime time.Time) *MockFileInfo {
+	m := &MockFileInfo{name: name}
+	m.On("Name").Return(name)
+	m.On("IsDir").Return(false)
+	m.On("Size").Return(size)
+	m.On("Mode").Return(os.FileMode(0644))
+	m.On("ModTime").Return(modTime)
+	m.On("Sys").Return(nil)
+	return m
+}
+
+// writeLocalFile создает локальный файл с заданным временем изменения
+func writeLocalFile(t *testing.T, dir, name, content string, modTime time.Time) {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	require.NoError(t, os.WriteFile(path, []byte(content), 0644))
+	require.NoError(t, os.Chtimes(path, modTime, modTime))
+}
+
+func TestParseConflictPolicy(t *testing.T) {
+	for _, s := range []string{"none", "local", "remote", "newest", "keep-both"} {
+		policy, err := fs.ParseConflictPolicy(s)
+		assert.NoError(t, err)
+		assert.Equal(t, fs.ConflictPolicy(s), policy)
+	}
+
+	policy, err := fs.ParseConflictPolicy("")
+	assert.NoError(t, err)
+	assert.Equal(t, fs.ConflictNone, policy)
+
+	_, err = fs.ParseConflictPolicy("unknown")
+	assert.Error(t, err)
+}
+
+func TestConflict_LocalWins(t *testing.T) {
+	tmpDir := t.TempDir()
+	mockClient := &MockWebdav{}
+
+	writeLocalFile(t, tmpDir, "file.txt", "test", testTime)
+	mockClient.On("Stat", "/file.txt").Return(newSizedFileInfo("file.txt", 10, testTime), nil)
+
+	proxy := fs.NewPikpakProxy(lgr.New(), tmpDir, mockClient, fs.WithConflictPolicy(fs.ConflictLocal))
+
+	info, err := proxy.Stat(context.Background(), "/file.txt")
+	require.NoError(t, err)
+	assert.Equal(t, int64(4), info.Size())
+
+	conflicts := proxy.Conflicts()
+	require.Len(t, conflicts, 1)
+	assert.Equal(t, "/file.txt", conflicts[0].Path)
+	assert.Equal(t, int64(4), conflicts[0].LocalSize)
+	assert.Equal(t, int64(10), conflicts[0].RemoteSize)
+	assert.Equal(t, fs.LayerLocal, conflicts[0].Resolution)
+}
+
+func TestConflict_RemoteWins(t *testing.T) {
+	tmpDir := t.TempDir()
+	mockClient := &MockWebdav{}
+
+	writeLocalFile(t, tmpDir, "file.txt", "test", testTime)
+	mockClient.On("Stat", "/file.txt").Return(newSizedFileInfo("file.txt", 10, testTime), nil)
+
+	proxy := fs.NewPikpakProxy(lgr.New(), tmpDir, mockClient, fs.WithConflictPolicy(fs.ConflictRemote))
+
+	info, err := proxy.Stat(context.Background(), "/file.txt")
+	require.NoError(t, err)
+	assert.Equal(t, int64(10), info.Size())
+
+	f, err := proxy.OpenFile(context.Background(), "/file.txt", os.O_RDONLY, 0)
+	require.NoError(t, err)
+	defer f.Close()
+
+	stat, err := f.Stat()
+	require.NoError(t, err)
+	assert.Equal(t, int64(10), stat.Size())
+}
+
+func TestConflict_Newest(t *testing.T) {
+	tmpDir := t.TempDir()
+	mockClient := &MockWebdav{}
+
+	writeLocalFile(t, tmpDir, "old.txt", "test", testTime)
+	writeLocalFile(t, tmpDir, "new.txt", "test", testTime.Add(time.Hour))
+
+	mockClient.On("Stat", "/old.txt").Return(newSizedFileInfo("old.txt", 10, testTime.Add(time.Minute)), nil)
+	mockClient.On("Stat", "/new.txt").Return(newSizedFileInfo("new.txt", 10, testTime.Add(time.Minute)), nil)
+
+	proxy := fs.NewPikpakProxy(lgr.New(), tmpDir, mockClient, fs.WithConflictPolicy(fs.ConflictNewest))
+
+	info, err := proxy.Stat(context.Background(), "/old.txt")
+	require.NoError(t, err)
+	assert.Equal(t, int64(10), info.Size())
+
+	info, err = proxy.Stat(context.Background(), "/new.txt")
+	require.NoError(t, err)
+	assert.Equal(t, int64(4), info.Size())
+}
+
+func TestConflict_SameVersion(t *testing.T) {
+	tmpDir := t.TempDir()
+	mockClient := &MockWebdav{}
+
+	writeLocalFile(t, tmpDir, "file.txt", "test", testTime)
+	mockClient.On("Stat", "/file.txt").Return(newSizedFileInfo("file.txt", 4, testTime.Add(time.Second)), nil)
+
+	proxy := fs.NewPikpakProxy(lgr.New(), tmpDir, mockClient, fs.WithConflictPolicy(fs.ConflictRemote))
+
+	_, err := proxy.Stat(context.Background(), "/file.txt")
+	require.NoError(t, err)
+	assert.Empty(t, proxy.Conflicts())
+}
+
+func TestConflict_KeepBoth(t *testing.T) {
+	tmpDir := t.TempDir()
+	mockClient := &MockWebdav{}
+
+	writeLocalFile(t, tmpDir, "file.txt", "test", testTime)
+
+	remote := newSizedFileInfo("file.txt", 10, testTime.Add(time.Hour))
+	mockClient.On("ReadDir", "/").Return([]os.FileInfo{remote}, nil)
+	mockClient.On("Stat", "/file.txt").Return(remote, nil)
+
+	proxy := fs.NewPikpakProxy(lgr.New(), tmpDir, mockClient, fs.WithConflictPolicy(fs.ConflictKeepBoth))
+
+	entries, err := proxy.ReaddirLayers(context.Background(), "/")
+	require.NoError(t, err)
+
+	sizes := make(map[string]int64)
+	for _, e := range entries {
+		sizes[e.Name()] = e.Size()
+	}
+	assert.Equal(t, map[string]int64{"file.txt": 4, "file (conflict).txt": 10}, sizes)
+
+	info, err := proxy.Stat(context.Background(), "/file (conflict).txt")
+	require.NoError(t, err)
+	assert.Equal(t, "file (conflict).txt", info.Name())
+	assert.Equal(t, int64(10), info.Size())
+
+	mockClient.On("RemoveAll", "/file.txt").Return(nil)
+	require.NoError(t, proxy.RemoveAll(context.Background(), "/file.txt"))
+	assert.Empty(t, proxy.Conflicts())
+}
+
+func TestConflict_KeepBoth_NoConflict(t *testing.T) {
+	tmpDir := t.TempDir()
+	mockClient := &MockWebdav{}
+
+	mockClient.On("Stat", "/file (conflict).txt").Return(nil, os.ErrNotExist)
+
+	proxy := fs.NewPikpakProxy(lgr.New(), tmpDir, mockClient, fs.WithConflictPolicy(fs.ConflictKeepBoth))
+
+	_, err := proxy.Stat(context.Background(), "/file (conflict).txt")
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestConflict_CachedFromListing(t *testing.T) {
+	tmpDir := t.TempDir()
+	mockClient := &MockWebdav{}
+
+	writeLocalFile(t, tmpDir, "file.txt", "test", testTime)
+	writeLocalFile(t, tmpDir, "local.txt", "local", testTime)
+	mockClient.On("ReadDir", "/").Return([]os.FileInfo{
+		newSizedFileInfo("file.txt", 10, testTime.Add(time.Hour)),
+	}, nil)
+
+	proxy := fs.NewPikpakProxy(lgr.New(), tmpDir, mockClient, fs.WithConflictPolicy(fs.ConflictRemote))
+	ctx := context.Background()
+
+	_, err := proxy.Readdir(ctx, "/")
+	require.NoError(t, err)
+
+	// Версии уже сравнены при чтении директории
+	info, err := proxy.Stat(ctx, "/file.txt")
+	require.NoError(t, err)
+	assert.Equal(t, int64(10), info.Size())
+
+	info, err = proxy.Stat(ctx, "/local.txt")
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), info.Size())
+
+	mockClient.AssertNotCalled(t, "Stat", "/file.txt")
+	mockClient.AssertNotCalled(t, "Stat", "/local.txt")
+
+	// После записи локальная версия сравнивается заново, один раз
+	writeLocalFile(t, tmpDir, "local.txt", "changed", testTime.Add(time.Minute))
+	mockClient.On("Stat", "/local.txt").Return(nil, os.ErrNotExist).Once()
+
+	for range 2 {
+		info, err = proxy.Stat(ctx, "/local.txt")
+		require.NoError(t, err)
+		assert.Equal(t, int64(7), info.Size())
+	}
+	mockClient.AssertExpectations(t)
+}
+
+func TestConflict_LocalEditIsNotConflict(t *testing.T) {
+	tmpDir := t.TempDir()
+	ctx := context.Background()
+
+	mockClient := &MockWebdav{}
+	mockClient.On("Stat", "/file.txt").Return(newSizedFileInfo("file.txt", 10, testTime), nil)
+
+	proxy := fs.NewPikpakProxy(lgr.New(), tmpDir, mockClient, fs.WithConflictPolicy(fs.ConflictRemote))
+
+	f, err := proxy.OpenFile(ctx, "/file.txt", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	require.NoError(t, err)
+	_, err = f.Write([]byte("edit"))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	// Удаленный файл не менялся: видна правка пользователя
+	info, err := proxy.Stat(ctx, "/file.txt")
+	require.NoError(t, err)
+	assert.Equal(t, int64(4), info.Size())
+	assert.Empty(t, proxy.Conflicts())
+
+	// Удаленный файл изменился после версии, на которой основана копия
+	changed := &MockWebdav{}
+	changed.On("Stat", "/file.txt").Return(newSizedFileInfo("file.txt", 12, testTime.Add(time.Hour)), nil)
+
+	proxy = fs.NewPikpakProxy(lgr.New(), tmpDir, changed, fs.WithConflictPolicy(fs.ConflictRemote))
+
+	info, err = proxy.Stat(ctx, "/file.txt")
+	require.NoError(t, err)
+	assert.Equal(t, int64(12), info.Size())
+	assert.Len(t, proxy.Conflicts(), 1)
+}
+
+// TestConflict_LocalOnlyCached тестирует, что отсутствие локального файла
+// на удаленном сервере, отвечающем 404, запоминается до его изменения
+func TestConflict_LocalOnlyCached(t *testing.T) {
+	tmpDir := t.TempDir()
+	writeLocalFile(t, tmpDir, "local.txt", "local", testTime)
+
+	var stats atomic.Int32
+	handler := &webdav.Handler{FileSystem: webdav.Dir(t.TempDir()), LockSystem: webdav.NewMemLS()}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "PROPFIND" && r.URL.Path == "/local.txt" {
+			stats.Add(1)
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	t.Cleanup(srv.Close)
+
+	proxy := fs.NewPikpakProxy(lgr.New(), tmpDir, newClient(srv.URL), fs.WithConflictPolicy(fs.ConflictRemote))
+	for range 3 {
+		info, err := proxy.Stat(context.Background(), "/local.txt")
+		require.NoError(t, err)
+		assert.Equal(t, int64(5), info.Size())
+	}
+	assert.EqualValues(t, 1, stats.Load())
+}
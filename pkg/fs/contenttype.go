@@ -0,0 +1,95 @@
+package fs
+
+import (
+	"mime"
+	"path"
+	"strings"
+)
+
+// defaultMIMETypes дополняет таблицу пакета mime типами, которые часто
+// встречаются в облачном хранилище, но отсутствуют в системной таблице
+var defaultMIMETypes = map[string]string{
+	".7z":   "application/x-7z-compressed",
+	".aac":  "audio/aac",
+	".avi":  "video/x-msvideo",
+	".azw3": "application/vnd.amazon.ebook",
+	".epub": "application/epub+zip",
+	".flac": "audio/flac",
+	".flv":  "video/x-flv",
+	".heic": "image/heic",
+	".iso":  "application/x-iso9660-image",
+	".m3u":  "audio/x-mpegurl",
+	".m3u8": "application/vnd.apple.mpegurl",
+	".m4a":  "audio/mp4",
+	".m4v":  "video/x-m4v",
+	".md":   "text/markdown; charset=utf-8",
+	".mkv":  "video/x-matroska",
+	".mobi": "application/x-mobipocket-ebook",
+	".mov":  "video/quicktime",
+	".mp3":  "audio/mpeg",
+	".mp4":  "video/mp4",
+	".ogg":  "audio/ogg",
+	".rar":  "application/vnd.rar",
+	".srt":  "application/x-subrip",
+	".wav":  "audio/wav",
+	".webm": "video/webm",
+	".wmv":  "video/x-ms-wmv",
+}
+
+// MIMETypes определяет тип содержимого файла по расширению без чтения
+// самого файла. Типы из конфигурации имеют приоритет над всеми остальными
+type MIMETypes struct {
+	overrides map[string]string
+}
+
+// NewMIMETypes создает таблицу типов. Ключи overrides - расширения файлов
+// с точкой или без нее
+func NewMIMETypes(overrides map[string]string) *MIMETypes {
+	m := &MIMETypes{overrides: make(map[string]string, len(overrides))}
+	for ext, ctype := range overrides {
+		m.overrides[normalizeExt(ext)] = ctype
+	}
+	return m
+}
+
+// Override возвращает тип, заданный для файла в конфигурации
+func (m *MIMETypes) Override(name string) (string, bool) {
+	if m == nil {
+		return "", false
+	}
+
+	ctype, ok := m.overrides[normalizeExt(path.Ext(name))]
+	return ctype, ok
+}
+
+// TypeByName возвращает тип содержимого по имени файла или пустую строку,
+// если расширение неизвестно
+func (m *MIMETypes) TypeByName(name string) string {
+	if ctype, ok := m.Override(name); ok {
+		return ctype
+	}
+
+	ext := normalizeExt(path.Ext(name))
+	if ext == "." {
+		return ""
+	}
+
+	if ctype, ok := defaultMIMETypes[ext]; ok {
+		return ctype
+	}
+
+	return mime.TypeByExtension(ext)
+}
+
+// IsMedia проверяет, является ли файл видео, аудио или плейлистом HLS,
+// которые плееры читают потоком
+func (m *MIMETypes) IsMedia(name string) bool {
+	ctype := m.TypeByName(name)
+	return strings.HasPrefix(ctype, "video/") ||
+		strings.HasPrefix(ctype, "audio/") ||
+		ctype == "application/vnd.apple.mpegurl"
+}
+
+func normalizeExt(ext string) string {
+	return "." + strings.ToLower(strings.TrimPrefix(ext, "."))
+}
@@ -0,0 +1,107 @@
+package fs_test
+
+import (
+	"context"
+	"mime"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ReanSn0w/pikpak-webdav-proxy/pkg/fs"
+	lgr "github.com/go-pkgz/lgr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/webdav"
+)
+
+// typedFileInfo - информация об удаленном файле со свойством getcontenttype
+type typedFileInfo struct {
+	etagFileInfo
+	contentType string
+}
+
+func (t typedFileInfo) ContentType() string {
+	return t.contentType
+}
+
+func statContentType(t *testing.T, proxy *fs.PikpakProxy, name string) (string, error) {
+	t.Helper()
+
+	info, err := proxy.Stat(context.Background(), name)
+	require.NoError(t, err)
+
+	c, ok := info.(webdav.ContentTyper)
+	require.True(t, ok)
+
+	return c.ContentType(context.Background())
+}
+
+func TestMIMETypes_TypeByName(t *testing.T) {
+	types := fs.NewMIMETypes(map[string]string{".MKV": "video/webm", "log": "text/plain"})
+
+	assert.Equal(t, "video/webm", types.TypeByName("/movie.mkv"))
+	assert.Equal(t, "text/plain", types.TypeByName("/app.LOG"))
+	assert.Equal(t, "audio/flac", types.TypeByName("/song.flac"))
+	assert.Equal(t, "image/png", types.TypeByName("/image.png"))
+	assert.Equal(t, "", types.TypeByName("/README"))
+	assert.Equal(t, "", types.TypeByName("/file.unknownext"))
+}
+
+func TestMIMETypes_AmbiguousExtension(t *testing.T) {
+	// .ts - это и MPEG-TS, и исходники TypeScript: без настройки тип
+	// берется из системной таблицы, как в x/net/webdav
+	types := fs.NewMIMETypes(nil)
+	assert.Equal(t, mime.TypeByExtension(".ts"), types.TypeByName("/src/index.ts"))
+
+	types = fs.NewMIMETypes(map[string]string{".ts": "video/mp2t"})
+	assert.Equal(t, "video/mp2t", types.TypeByName("/video/segment.ts"))
+	assert.True(t, types.IsMedia("/video/segment.ts"))
+}
+
+func TestContentType_Remote(t *testing.T) {
+	tmpDir := t.TempDir()
+	mockClient := &MockWebdav{}
+	remote := func(name, ctype string) typedFileInfo {
+		return typedFileInfo{etagFileInfo{newMockFileInfo(name, false), ""}, ctype}
+	}
+	mockClient.On("Stat", "/upstream.bin").Return(remote("upstream.bin", "application/x-custom"), nil)
+	mockClient.On("Stat", "/movie.mkv").Return(remote("movie.mkv", ""), nil)
+	mockClient.On("Stat", "/blob").Return(remote("blob", ""), nil)
+	mockClient.On("Stat", "/notes.txt").Return(remote("notes.txt", "application/octet-stream"), nil)
+
+	proxy := fs.NewPikpakProxy(lgr.New(), tmpDir, mockClient,
+		fs.WithMIMETypes(fs.NewMIMETypes(map[string]string{"txt": "text/plain; charset=utf-8"})),
+	)
+
+	tests := map[string]string{
+		"/upstream.bin": "application/x-custom",
+		"/movie.mkv":    "video/x-matroska",
+		"/blob":         "application/octet-stream",
+		"/notes.txt":    "text/plain; charset=utf-8",
+	}
+
+	for name, expected := range tests {
+		ctype, err := statContentType(t, proxy, name)
+		require.NoError(t, err)
+		assert.Equal(t, expected, ctype, name)
+	}
+
+	// Тип определяется без чтения содержимого
+	mockClient.AssertNotCalled(t, "ReadStreamRange")
+}
+
+func TestContentType_Local(t *testing.T) {
+	tmpDir := t.TempDir()
+	proxy := fs.NewPikpakProxy(lgr.New(), tmpDir, &MockWebdav{})
+
+	require.NoError(t, os.WriteFile(filepath.Join(tmpDir, "song.flac"), []byte("data"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(tmpDir, "blob"), []byte("data"), 0644))
+
+	ctype, err := statContentType(t, proxy, "/song.flac")
+	require.NoError(t, err)
+	assert.Equal(t, "audio/flac", ctype)
+
+	// Локальный файл с неизвестным расширением определяется по содержимому
+	_, err = statContentType(t, proxy, "/blob")
+	assert.Equal(t, webdav.ErrNotImplemented, err)
+}
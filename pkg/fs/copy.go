@@ -0,0 +1,232 @@
+package fs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+// RemoteCopier - необязательный интерфейс клиента удаленного сервера,
+// копирующего файлы на стороне сервера
+type RemoteCopier interface {
+	Copy(oldName, newName string, overwrite bool) error
+}
+
+// Copy копирует файл или директорию src в dst, по возможности не передавая
+// содержимое через прокси: удаленные файлы копируются на удаленном сервере,
+// локальные - через reflink или жесткую ссылку, а удаленные файлы в пути,
+// изменения которых остаются локальными, скачиваются одним запросом.
+// Без recursive директория копируется без содержимого
+func (p *PikpakProxy) Copy(ctx context.Context, src, dst string, overwrite, recursive bool) error {
+	if err := p.CheckAccess(src, false); err != nil {
+		return err
+	}
+	if err := p.CheckAccess(dst, true); err != nil {
+		return err
+	}
+	if p.hidden(dst) {
+		return &os.PathError{Op: "copy", Path: dst, Err: os.ErrPermission}
+	}
+
+	info, err := p.stat(src)
+	switch {
+	case remoteMissing(err):
+		return notExist("copy", src)
+	case err != nil:
+		return err
+	}
+
+	if _, err := p.stat(dst); err == nil {
+		if !overwrite {
+			return &os.PathError{Op: "copy", Path: dst, Err: os.ErrExist}
+		}
+		if err := p.RemoveAll(ctx, dst); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	defer p.checkWatermark()
+	defer p.usage.invalidate()
+
+	if err := p.copy(ctx, path.Clean("/"+src), path.Clean("/"+dst), info, recursive); err != nil {
+		return err
+	}
+
+	// Свойства копируются одинаково независимо от того, как скопировано
+	// содержимое
+	p.props.copy(src, dst, recursive)
+	return nil
+}
+
+func (p *PikpakProxy) copy(ctx context.Context, src, dst string, info os.FileInfo, recursive bool) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	layers, remoteName := p.resolveLayers(src)
+	remoteOnly := layers == LayerRemote || !p.localWins(src, info)
+
+	// Директория, которой нет в локальном слое, и удаленный файл копируются
+	// целиком на удаленном сервере, если изменения пути dst туда попадают
+	if remoteOnly && (recursive || !info.IsDir()) && remoteWrites(p.writeMode(dst)) {
+		err := p.copyRemote(remoteName, dst)
+		if err == nil {
+			p.log.Logf("[DEBUG] Copy (remote): %s -> %s", src, dst)
+			return nil
+		}
+		if !errors.Is(err, errors.ErrUnsupported) {
+			return err
+		}
+	}
+
+	if info.IsDir() {
+		if err := p.Mkdir(ctx, dst, info.Mode().Perm()); err != nil {
+			return err
+		}
+		if !recursive {
+			return nil
+		}
+
+		children, err := p.Readdir(ctx, src)
+		if err != nil {
+			return err
+		}
+		for _, child := range children {
+			if err := p.copy(ctx, path.Join(src, child.Name()), path.Join(dst, child.Name()), child, true); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	// Копия в локальном слое занимает место в кеше так же, как PUT
+	if err := p.Reserve(ctx, dst, info.Size()); err != nil {
+		return err
+	}
+
+	dstPath := p.LocalFilePath(dst)
+	if remoteOnly {
+		p.log.Logf("[DEBUG] Copy (download): %s -> %s", src, dst)
+		if err := p.download(remoteName, dst, info); err != nil {
+			return err
+		}
+	} else {
+		before := diskSize(dstPath)
+		if err := p.copyLocal(p.LocalFilePath(src), dstPath); err != nil {
+			return err
+		}
+		p.usage.add(diskSize(dstPath) - before)
+	}
+
+	if p.writeMode(dst) == WriteThrough {
+		return p.upload(dst)
+	}
+	return nil
+}
+
+// localWins проверяет, видна ли по пути name локальная версия файла
+func (p *PikpakProxy) localWins(name string, info os.FileInfo) bool {
+	local, err := os.Stat(p.LocalFilePath(name))
+	if err != nil {
+		return false
+	}
+	if info.IsDir() {
+		return local.IsDir()
+	}
+	return sameFile(local, info)
+}
+
+// copyRemote копирует файл на удаленном сервере. Если клиент этого
+// не поддерживает, возвращается ошибка errors.ErrUnsupported
+func (p *PikpakProxy) copyRemote(remoteName, dst string) error {
+	c, ok := p.remoteClient.(RemoteCopier)
+	if !ok {
+		return fmt.Errorf("remote client does not support copy: %w", errors.ErrUnsupported)
+	}
+	defer p.invalidateStreams(dst)
+	return c.Copy(remoteName, dst, true)
+}
+
+// copyLocal копирует локальный файл через reflink, если его поддерживает
+// файловая система, затем жесткой ссылкой, если они разрешены, и обычным
+// копированием в остальных случаях
+func (p *PikpakProxy) copyLocal(srcPath, dstPath string) error {
+	if err := os.MkdirAll(filepath.Dir(dstPath), 0755); err != nil {
+		return err
+	}
+
+	err := reflink(srcPath, dstPath)
+	if err == nil {
+		p.log.Logf("[DEBUG] Copy (reflink): %s -> %s", srcPath, dstPath)
+		return nil
+	}
+
+	if p.hardlinks {
+		if err := hardlink(srcPath, dstPath); err == nil {
+			p.log.Logf("[DEBUG] Copy (hardlink): %s -> %s", srcPath, dstPath)
+			return nil
+		}
+	}
+
+	p.log.Logf("[DEBUG] Copy (local): %s -> %s", srcPath, dstPath)
+	return copyFile(srcPath, dstPath)
+}
+
+// copyFile копирует содержимое и права файла
+func copyFile(srcPath, dstPath string) error {
+	in, err := os.Open(srcPath)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+
+	out, err := os.OpenFile(dstPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(out, in)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(dstPath)
+	}
+	return err
+}
+
+// unshare отделяет файл, имеющий другие жесткие ссылки, перед записью
+// в него, чтобы изменения не попали в копии. При truncate содержимое
+// не нужно, поэтому ссылка просто удаляется
+func (p *PikpakProxy) unshare(localPath string, truncate bool) error {
+	info, err := os.Lstat(localPath)
+	if err != nil || !info.Mode().IsRegular() || linkCount(info) < 2 {
+		return nil
+	}
+
+	if truncate {
+		return os.Remove(localPath)
+	}
+
+	tmpPath := localPath + ".unshare"
+	if err := reflink(localPath, tmpPath); err != nil {
+		if err := copyFile(localPath, tmpPath); err != nil {
+			return err
+		}
+	}
+
+	if err := os.Chtimes(tmpPath, info.ModTime(), info.ModTime()); err != nil {
+		p.log.Logf("[WARN] failed to keep mtime of %s: %v", localPath, err)
+	}
+
+	return os.Rename(tmpPath, localPath)
+}
@@ -0,0 +1,224 @@
+package fs_test
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/ReanSn0w/pikpak-webdav-proxy/pkg/fs"
+	lgr "github.com/go-pkgz/lgr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/studio-b12/gowebdav"
+	"golang.org/x/net/webdav"
+)
+
+// methodLog запоминает методы запросов к удаленному серверу
+type methodLog struct {
+	mu      sync.Mutex
+	methods []string
+}
+
+func (l *methodLog) count(method string) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	n := 0
+	for _, m := range l.methods {
+		if m == method {
+			n++
+		}
+	}
+	return n
+}
+
+func setupCopy(t *testing.T, opts ...fs.Option) (*fs.PikpakProxy, string, string, *methodLog) {
+	localDir, remoteDir := t.TempDir(), t.TempDir()
+	log := &methodLog{}
+
+	handler := &webdav.Handler{FileSystem: webdav.Dir(remoteDir), LockSystem: webdav.NewMemLS()}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		log.mu.Lock()
+		log.methods = append(log.methods, r.Method)
+		log.mu.Unlock()
+		handler.ServeHTTP(w, r)
+	}))
+	t.Cleanup(srv.Close)
+
+	client := gowebdav.NewClient(srv.URL, "", "")
+	return fs.NewPikpakProxy(lgr.New(), localDir, client, opts...), localDir, remoteDir, log
+}
+
+func TestCopy_Remote(t *testing.T) {
+	proxy, localDir, remoteDir, log := setupCopy(t)
+
+	require.NoError(t, os.MkdirAll(filepath.Join(remoteDir, "dir", "sub"), 0755))
+	writeLocalFile(t, remoteDir, "dir/a.txt", "aaa", testTime)
+	writeLocalFile(t, remoteDir, "dir/sub/b.txt", "bbb", testTime)
+
+	require.NoError(t, proxy.Copy(context.Background(), "/dir/a.txt", "/a.txt", false, true))
+	require.NoError(t, proxy.Copy(context.Background(), "/dir", "/copy", false, true))
+
+	assert.Equal(t, "aaa", readFile(t, remoteDir, "a.txt"))
+	assert.Equal(t, "bbb", readFile(t, remoteDir, "copy/sub/b.txt"))
+	assert.NoFileExists(t, filepath.Join(localDir, "a.txt"))
+	assert.NoDirExists(t, filepath.Join(localDir, "copy"))
+
+	// Содержимое не передается через прокси
+	assert.Equal(t, 2, log.count("COPY"))
+	assert.Zero(t, log.count(http.MethodGet))
+	assert.Zero(t, log.count(http.MethodPut))
+}
+
+func TestCopy_RemoteToLocal(t *testing.T) {
+	rule, err := fs.NewPolicyRule("/private/**", fs.WriteLocalOnly)
+	require.NoError(t, err)
+	proxy, localDir, remoteDir, log := setupCopy(t, fs.WithPolicies(rule))
+
+	writeLocalFile(t, remoteDir, "big.bin", string(make([]byte, 1<<20)), testTime)
+
+	require.NoError(t, proxy.Copy(context.Background(), "/big.bin", "/private/big.bin", false, true))
+
+	info, err := os.Stat(filepath.Join(localDir, "private", "big.bin"))
+	require.NoError(t, err)
+	assert.Equal(t, int64(1<<20), info.Size())
+	assert.NoFileExists(t, filepath.Join(remoteDir, "private", "big.bin"))
+
+	// Файл скачан одним запросом
+	assert.Equal(t, 1, log.count(http.MethodGet))
+	assert.Zero(t, log.count("COPY"))
+}
+
+func TestCopy_Local(t *testing.T) {
+	proxy, localDir, remoteDir, _ := setupCopy(t)
+
+	writeLocalFile(t, localDir, "a.txt", "local", testTime)
+	writeLocalFile(t, localDir, "b.txt", "other", testTime)
+
+	require.NoError(t, proxy.Copy(context.Background(), "/a.txt", "/c.txt", false, true))
+	assert.Equal(t, "local", readFile(t, localDir, "c.txt"))
+	assert.NoFileExists(t, filepath.Join(remoteDir, "c.txt"))
+
+	err := proxy.Copy(context.Background(), "/a.txt", "/b.txt", false, true)
+	assert.True(t, os.IsExist(err))
+
+	require.NoError(t, proxy.Copy(context.Background(), "/a.txt", "/b.txt", true, true))
+	assert.Equal(t, "local", readFile(t, localDir, "b.txt"))
+
+	err = proxy.Copy(context.Background(), "/missing.txt", "/d.txt", false, true)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestCopy_Budget(t *testing.T) {
+	rule, err := fs.NewPolicyRule("/private/**", fs.WriteLocalOnly)
+	require.NoError(t, err)
+	proxy, localDir, remoteDir, log := setupCopy(t, fs.WithPolicies(rule), fs.WithCacheBudget(15))
+
+	writeLocalFile(t, localDir, "a.txt", "0123456789", testTime)
+	writeLocalFile(t, remoteDir, "big.bin", string(make([]byte, 20)), testTime)
+
+	// Ни локальная копия, ни скачанный файл не помещаются в бюджет
+	err = proxy.Copy(context.Background(), "/a.txt", "/b.txt", false, true)
+	assert.ErrorIs(t, err, fs.ErrInsufficientStorage)
+	assert.NoFileExists(t, filepath.Join(localDir, "b.txt"))
+
+	err = proxy.Copy(context.Background(), "/big.bin", "/private/big.bin", false, true)
+	assert.ErrorIs(t, err, fs.ErrInsufficientStorage)
+	assert.NoFileExists(t, filepath.Join(localDir, "private", "big.bin"))
+	assert.Zero(t, log.count(http.MethodGet))
+}
+
+func TestCopy_MergedDirectory(t *testing.T) {
+	proxy, localDir, remoteDir, _ := setupCopy(t)
+
+	require.NoError(t, os.Mkdir(filepath.Join(localDir, "dir"), 0755))
+	require.NoError(t, os.Mkdir(filepath.Join(remoteDir, "dir"), 0755))
+	writeLocalFile(t, localDir, "dir/local.txt", "local", testTime)
+	writeLocalFile(t, remoteDir, "dir/remote.txt", "remote", testTime)
+
+	require.NoError(t, proxy.Copy(context.Background(), "/dir", "/copy", false, true))
+
+	assert.Equal(t, "local", readFile(t, localDir, "copy/local.txt"))
+	assert.Equal(t, "remote", readFile(t, remoteDir, "copy/remote.txt"))
+
+	names := []string{}
+	infos, err := proxy.Readdir(context.Background(), "/copy")
+	require.NoError(t, err)
+	for _, info := range infos {
+		names = append(names, info.Name())
+	}
+	assert.ElementsMatch(t, []string{"local.txt", "remote.txt"}, names)
+
+	// Без Depth: infinity копируется только директория
+	require.NoError(t, proxy.Copy(context.Background(), "/dir", "/empty", false, false))
+	infos, err = proxy.Readdir(context.Background(), "/empty")
+	require.NoError(t, err)
+	assert.Empty(t, infos)
+}
+
+func TestCopy_DeadProps(t *testing.T) {
+	rule, err := fs.NewPolicyRule("/private/**", fs.WriteLocalOnly)
+	require.NoError(t, err)
+	proxy, localDir, remoteDir, _ := setupCopy(t, fs.WithPolicies(rule))
+
+	require.NoError(t, os.MkdirAll(filepath.Join(remoteDir, "dir", "sub"), 0755))
+	writeLocalFile(t, remoteDir, "dir/sub/remote.txt", "remote", testTime)
+	writeLocalFile(t, localDir, "local.txt", "local", testTime)
+
+	prop := webdav.Property{XMLName: win32Time, InnerXML: []byte("x")}
+	for _, name := range []string{"/dir", "/dir/sub/remote.txt", "/local.txt"} {
+		patchProp(t, proxy, name, false, prop)
+	}
+
+	copies := []struct {
+		src, dst  string
+		recursive bool
+		expected  []string
+	}{
+		{"/local.txt", "/local-copy.txt", true, []string{"/local-copy.txt"}},
+		{"/dir/sub/remote.txt", "/remote-copy.txt", true, []string{"/remote-copy.txt"}},
+		{"/dir/sub/remote.txt", "/private/remote.txt", true, []string{"/private/remote.txt"}},
+		{"/dir", "/tree", true, []string{"/tree", "/tree/sub/remote.txt"}},
+		{"/dir", "/private/tree", true, []string{"/private/tree", "/private/tree/sub/remote.txt"}},
+		{"/dir", "/shallow", false, []string{"/shallow"}},
+	}
+
+	for _, c := range copies {
+		require.NoError(t, proxy.Copy(context.Background(), c.src, c.dst, false, c.recursive), c.dst)
+		for _, name := range c.expected {
+			assert.Contains(t, deadProps(t, proxy, name), win32Time, name)
+		}
+	}
+}
+
+func TestCopy_HardlinksAreUnshared(t *testing.T) {
+	proxy, localDir, _, _ := setupCopy(t, fs.WithHardlinks(true))
+
+	writeLocalFile(t, localDir, "a.txt", "original", testTime)
+	writeLocalFile(t, localDir, "b.txt", "original", testTime)
+	require.NoError(t, proxy.Copy(context.Background(), "/a.txt", "/a2.txt", false, true))
+	require.NoError(t, proxy.Copy(context.Background(), "/b.txt", "/b2.txt", false, true))
+
+	// Перезапись копии
+	f, err := proxy.OpenFile(context.Background(), "/a2.txt", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	require.NoError(t, err)
+	f.Write([]byte("changed"))
+	require.NoError(t, f.Close())
+
+	// Запись в середину копии
+	f, err = proxy.OpenFile(context.Background(), "/b2.txt", os.O_RDWR, 0644)
+	require.NoError(t, err)
+	f.Seek(2, io.SeekStart)
+	f.Write([]byte("XX"))
+	require.NoError(t, f.Close())
+
+	assert.Equal(t, "original", readFile(t, localDir, "a.txt"))
+	assert.Equal(t, "changed", readFile(t, localDir, "a2.txt"))
+	assert.Equal(t, "original", readFile(t, localDir, "b.txt"))
+	assert.Equal(t, "orXXinal", readFile(t, localDir, "b2.txt"))
+}
@@ -0,0 +1,655 @@
+package fs
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/go-pkgz/lgr"
+	"golang.org/x/net/webdav"
+)
+
+const (
+	// cryptMagic - начало зашифрованного файла. За ним следует случайный
+	// идентификатор файла и зашифрованный размер содержимого, затем блоки
+	// по cryptChunkSize байт, каждый со своим nonce и тегом AES-GCM.
+	// Размер в заголовке защищен тегом, поэтому обрезанный файл
+	// не читается как целый
+	cryptMagic      = "PPXENC02"
+	cryptIDSize     = 16
+	cryptChunkSize  = 64 << 10
+	cryptNonceSize  = 12
+	cryptOverhead   = cryptNonceSize + 16
+	cryptSizeField  = 8
+	cryptHeaderSize = len(cryptMagic) + cryptIDSize + cryptSizeField + cryptOverhead
+)
+
+// ErrCorrupted возвращается при чтении зашифрованного блока, который
+// не удалось расшифровать: файл поврежден или ключ не подходит
+var ErrCorrupted = errors.New("encrypted file is corrupted or the key is wrong")
+
+// EncryptionKey - ключ шифрования локального кеша (AES-256)
+type EncryptionKey [32]byte
+
+// ParseEncryptionKey разбирает ключ, записанный в hex (64 символа)
+// или base64
+func ParseEncryptionKey(s string) (EncryptionKey, error) {
+	var key EncryptionKey
+	s = strings.TrimSpace(s)
+
+	data, err := hex.DecodeString(s)
+	if err != nil || len(data) != len(key) {
+		data, err = base64.StdEncoding.DecodeString(s)
+		if err != nil {
+			data, err = base64.RawStdEncoding.DecodeString(s)
+		}
+	}
+	if err != nil || len(data) != len(key) {
+		return key, fmt.Errorf("encryption key must be %d bytes in hex or base64", len(key))
+	}
+
+	copy(key[:], data)
+	return key, nil
+}
+
+// LoadEncryptionKey читает ключ шифрования из файла
+func LoadEncryptionKey(path string) (EncryptionKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return EncryptionKey{}, err
+	}
+	return ParseEncryptionKey(string(data))
+}
+
+// localCrypt шифрует файлы локального слоя. Нулевой указатель означает,
+// что шифрование выключено, и файлы читаются и записываются как есть
+type localCrypt struct {
+	aead cipher.AEAD
+	// tmpDir - директория временных файлов при шифровании
+	tmpDir string
+	// usage учитывает временные файлы в размере кеша
+	usage *cacheUsage
+
+	log lgr.L
+	// plain - незашифрованные файлы, о которых уже выведено предупреждение.
+	// Файл удаляется из списка, когда его содержимое зашифровано, а сам
+	// список ограничен maxPlainWarnings файлами
+	plain      sync.Map
+	plainCount atomic.Int64
+	plainFull  atomic.Bool
+}
+
+// maxPlainWarnings - число незашифрованных файлов, о которых
+// предупреждение выводится отдельно
+const maxPlainWarnings = 10000
+
+func newLocalCrypt(key EncryptionKey) *localCrypt {
+	// Ключ фиксированной длины, поэтому ошибок здесь не бывает
+	block, _ := aes.NewCipher(key[:])
+	aead, _ := cipher.NewGCM(block)
+	return &localCrypt{aead: aead}
+}
+
+// open открывает локальный файл. Зашифрованные файлы расшифровываются
+// при чтении, а новые файлы шифруются. Незашифрованный файл читается
+// как есть, а перед записью в него шифруется
+func (c *localCrypt) open(path string, flag int, perm os.FileMode) (webdav.File, error) {
+	if c == nil {
+		return os.OpenFile(path, flag, perm)
+	}
+
+	write := flag&(os.O_WRONLY|os.O_RDWR|os.O_APPEND|os.O_TRUNC) != 0
+	if write && flag&os.O_TRUNC == 0 {
+		if err := c.encrypt(path); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+
+	// Для записи части блока нужно прочитать его целиком
+	sysFlag := flag &^ (os.O_WRONLY | os.O_APPEND)
+	if write || flag&os.O_CREATE != 0 {
+		sysFlag |= os.O_RDWR
+	}
+
+	f, err := os.OpenFile(path, sysFlag, perm)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if !info.Mode().IsRegular() {
+		return f, nil
+	}
+
+	header, ok, err := readCryptHeader(f)
+	switch {
+	case err != nil:
+		f.Close()
+		return nil, err
+	case !ok && (info.Size() > 0 || sysFlag&os.O_RDWR == 0):
+		// Незашифрованный или пустой файл, открытый только для чтения
+		if info.Size() > 0 {
+			c.warnPlain(path)
+		}
+		return f, nil
+	case !ok:
+		if header, err = c.writeHeader(f, nil, 0); err != nil {
+			f.Close()
+			return nil, err
+		}
+		c.forgetPlain(path)
+	}
+
+	size, err := c.headerSize(header)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	return &cryptFile{
+		file:     f,
+		c:        c,
+		id:       header[len(cryptMagic) : len(cryptMagic)+cryptIDSize],
+		size:     size,
+		stored:   size,
+		index:    -1,
+		write:    write || flag&os.O_CREATE != 0,
+		appended: flag&os.O_APPEND != 0,
+	}, nil
+}
+
+// warnPlain предупреждает о незашифрованном файле, записанном до включения
+// шифрования. Для каждого файла предупреждение выводится один раз, а после
+// maxPlainWarnings файлов выводится общее предупреждение
+func (c *localCrypt) warnPlain(path string) {
+	if c.log == nil {
+		return
+	}
+	if _, ok := c.plain.Load(path); ok {
+		return
+	}
+
+	if c.plainCount.Load() >= maxPlainWarnings {
+		if c.plainFull.CompareAndSwap(false, true) {
+			c.log.Logf("[WARN] more than %d files are not encrypted, further warnings are suppressed", maxPlainWarnings)
+		}
+		return
+	}
+
+	if _, loaded := c.plain.LoadOrStore(path, struct{}{}); loaded {
+		return
+	}
+	c.plainCount.Add(1)
+	c.log.Logf("[WARN] %s is not encrypted, run the encrypt command to encrypt the local cache", path)
+}
+
+// forgetPlain убирает файл path из списка незашифрованных после того,
+// как его содержимое зашифровано
+func (c *localCrypt) forgetPlain(path string) {
+	if _, ok := c.plain.LoadAndDelete(path); ok {
+		c.plainCount.Add(-1)
+	}
+}
+
+// create создает новый локальный файл для записи
+func (c *localCrypt) create(path string) (webdav.File, error) {
+	return c.open(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+}
+
+// stat возвращает информацию о локальном файле с размером содержимого
+func (c *localCrypt) stat(path string) (os.FileInfo, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	return c.info(path, info), nil
+}
+
+// info заменяет размер зашифрованного файла размером его содержимого
+// из заголовка. Если заголовок не удалось проверить, размер не меняется,
+// а ошибка возвращается при открытии файла
+func (c *localCrypt) info(path string, info os.FileInfo) os.FileInfo {
+	if c == nil || !info.Mode().IsRegular() || info.Size() < int64(cryptHeaderSize) {
+		return info
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return info
+	}
+	defer f.Close()
+
+	header, ok, err := readCryptHeader(f)
+	if err != nil || !ok {
+		return info
+	}
+
+	size, err := c.headerSize(header)
+	if err != nil {
+		return info
+	}
+	return cryptInfo{FileInfo: info, size: size}
+}
+
+// storedSize возвращает место на диске, которое займет содержимое
+// размером size
+func (c *localCrypt) storedSize(size int64) int64 {
+	if c == nil {
+		return size
+	}
+
+	chunks := (size + cryptChunkSize - 1) / cryptChunkSize
+	return int64(cryptHeaderSize) + size + chunks*cryptOverhead
+}
+
+// encrypt шифрует незашифрованный локальный файл, сохраняя права и время
+// изменения. Зашифрованные и пустые файлы не изменяются
+func (c *localCrypt) encrypt(path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() || info.Size() == 0 {
+		return nil
+	}
+	if _, ok, err := readCryptHeader(in); err != nil || ok {
+		return err
+	}
+	if _, err := in.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	if c.usage != nil {
+		defer c.usage.hold(c.storedSize(info.Size()))()
+	}
+
+	tmpPath, err := tempFile(c.tmpDir, "encrypt")
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(tmpPath, info.Mode().Perm()); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	out, err := c.open(tmpPath, os.O_WRONLY|os.O_TRUNC, 0)
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	_, err = io.Copy(out, in)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chtimes(tmpPath, info.ModTime(), info.ModTime())
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, path)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	c.forgetPlain(path)
+	return nil
+}
+
+// encrypted проверяет, зашифрован ли локальный файл
+func encrypted(path string) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	_, ok, err := readCryptHeader(f)
+	return ok, err
+}
+
+// readCryptHeader читает заголовок файла. Файл без заголовка
+// не зашифрован
+func readCryptHeader(f *os.File) ([]byte, bool, error) {
+	header := make([]byte, cryptHeaderSize)
+	n, err := f.ReadAt(header, 0)
+	if n < len(header) {
+		if err == io.EOF {
+			err = nil
+		}
+		return nil, false, err
+	}
+	if !bytes.Equal(header[:len(cryptMagic)], []byte(cryptMagic)) {
+		return nil, false, nil
+	}
+	return header, true, nil
+}
+
+// writeHeader записывает заголовок с размером содержимого size. Без id
+// создается новый идентификатор файла
+func (c *localCrypt) writeHeader(f *os.File, id []byte, size int64) ([]byte, error) {
+	header := make([]byte, len(cryptMagic)+cryptIDSize+cryptNonceSize, cryptHeaderSize)
+	copy(header, cryptMagic)
+
+	if id != nil {
+		copy(header[len(cryptMagic):], id)
+	} else if _, err := rand.Read(header[len(cryptMagic) : len(cryptMagic)+cryptIDSize]); err != nil {
+		return nil, err
+	}
+
+	nonce := header[len(cryptMagic)+cryptIDSize:]
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	plain := binary.BigEndian.AppendUint64(nil, uint64(size))
+	header = c.aead.Seal(header, nonce, plain, header[:len(cryptMagic)+cryptIDSize])
+
+	if _, err := f.WriteAt(header, 0); err != nil {
+		return nil, err
+	}
+	return header, nil
+}
+
+// headerSize проверяет заголовок и возвращает размер содержимого
+func (c *localCrypt) headerSize(header []byte) (int64, error) {
+	prefix := len(cryptMagic) + cryptIDSize
+	nonce := header[prefix : prefix+cryptNonceSize]
+
+	plain, err := c.aead.Open(nil, nonce, header[prefix+cryptNonceSize:], header[:prefix])
+	if err != nil || len(plain) != cryptSizeField {
+		return 0, ErrCorrupted
+	}
+	return int64(binary.BigEndian.Uint64(plain)), nil
+}
+
+// cryptInfo - информация о зашифрованном файле с размером его содержимого
+type cryptInfo struct {
+	os.FileInfo
+	size int64
+}
+
+func (i cryptInfo) Size() int64 {
+	return i.size
+}
+
+// sameFile работает как os.SameFile для информации о зашифрованных файлах
+func sameFile(a, b os.FileInfo) bool {
+	if i, ok := a.(cryptInfo); ok {
+		a = i.FileInfo
+	}
+	if i, ok := b.(cryptInfo); ok {
+		b = i.FileInfo
+	}
+	return os.SameFile(a, b)
+}
+
+// cryptFile - открытый зашифрованный файл. Содержимое читается
+// и записывается блоками, поэтому Seek и запись в середину файла
+// расшифровывают только затронутые блоки
+type cryptFile struct {
+	// file не встраивается, чтобы методы вроде ReadFrom и WriteAt
+	// не обходили шифрование
+	file *os.File
+	c    *localCrypt
+	id   []byte
+
+	// size - размер содержимого, stored - размер, записанный в заголовке
+	size     int64
+	stored   int64
+	pos      int64
+	write    bool
+	appended bool
+
+	// chunk - расшифрованный блок с номером index
+	chunk []byte
+	index int64
+	dirty bool
+}
+
+func (f *cryptFile) Read(b []byte) (int, error) {
+	if f.pos >= f.size {
+		return 0, io.EOF
+	}
+
+	if err := f.load(f.pos / cryptChunkSize); err != nil {
+		return 0, err
+	}
+
+	n := copy(b, f.chunk[f.pos%cryptChunkSize:])
+	f.pos += int64(n)
+	return n, nil
+}
+
+func (f *cryptFile) Write(b []byte) (int, error) {
+	if !f.write {
+		return 0, &os.PathError{Op: "write", Path: f.file.Name(), Err: syscall.EBADF}
+	}
+
+	if f.appended {
+		f.pos = f.size
+	}
+
+	// Промежуток после конца файла заполняется нулями
+	if f.pos > f.size {
+		pos := f.pos
+		f.pos = f.size
+		if err := f.writeChunks(make([]byte, pos-f.size)); err != nil {
+			return 0, err
+		}
+	}
+
+	start := f.pos
+	err := f.writeChunks(b)
+	return int(f.pos - start), err
+}
+
+func (f *cryptFile) writeChunks(b []byte) error {
+	for len(b) > 0 {
+		if err := f.load(f.pos / cryptChunkSize); err != nil {
+			return err
+		}
+
+		off := int(f.pos % cryptChunkSize)
+		n := min(len(b), cryptChunkSize-off)
+		if off+n > len(f.chunk) {
+			f.chunk = f.chunk[:off+n]
+		}
+		copy(f.chunk[off:], b[:n])
+
+		f.dirty = true
+		f.pos += int64(n)
+		f.size = max(f.size, f.pos)
+		b = b[n:]
+	}
+	return nil
+}
+
+func (f *cryptFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.pos
+	case io.SeekEnd:
+		offset += f.size
+	default:
+		return 0, &os.PathError{Op: "seek", Path: f.file.Name(), Err: os.ErrInvalid}
+	}
+
+	if offset < 0 {
+		return 0, &os.PathError{Op: "seek", Path: f.file.Name(), Err: os.ErrInvalid}
+	}
+
+	f.pos = offset
+	return offset, nil
+}
+
+func (f *cryptFile) Readdir(count int) ([]os.FileInfo, error) {
+	return f.file.Readdir(count)
+}
+
+func (f *cryptFile) Stat() (os.FileInfo, error) {
+	info, err := f.file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return cryptInfo{FileInfo: info, size: f.size}, nil
+}
+
+// Close записывает измененный блок и новый размер содержимого. Заголовок
+// обновляется последним, поэтому прерванная запись не увеличивает размер
+func (f *cryptFile) Close() error {
+	err := f.flush()
+	if err == nil && f.size != f.stored {
+		_, err = f.c.writeHeader(f.file, f.id, f.size)
+	}
+	if closeErr := f.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// load расшифровывает блок с номером index, предварительно записав
+// измененный текущий блок
+func (f *cryptFile) load(index int64) error {
+	if index == f.index {
+		return nil
+	}
+	if err := f.flush(); err != nil {
+		return err
+	}
+
+	if f.chunk == nil {
+		f.chunk = make([]byte, 0, cryptChunkSize)
+	}
+	f.chunk, f.index = f.chunk[:0], index
+
+	n := min(f.size-index*cryptChunkSize, cryptChunkSize)
+	if n <= 0 {
+		return nil
+	}
+
+	buf := make([]byte, n+cryptOverhead)
+	if _, err := f.file.ReadAt(buf, chunkOffset(index)); err != nil {
+		f.index = -1
+		if err == io.EOF {
+			return ErrCorrupted
+		}
+		return err
+	}
+
+	plain, err := f.c.aead.Open(f.chunk, buf[:cryptNonceSize], buf[cryptNonceSize:], f.aad(index))
+	if err != nil {
+		f.index = -1
+		return fmt.Errorf("%s: %w", f.file.Name(), ErrCorrupted)
+	}
+	f.chunk = plain
+	return nil
+}
+
+// flush шифрует и записывает измененный текущий блок. Каждая запись
+// использует новый nonce
+func (f *cryptFile) flush() error {
+	if !f.dirty {
+		return nil
+	}
+
+	buf := make([]byte, cryptNonceSize, cryptNonceSize+len(f.chunk)+cryptOverhead)
+	if _, err := rand.Read(buf); err != nil {
+		return err
+	}
+	buf = f.c.aead.Seal(buf, buf[:cryptNonceSize], f.chunk, f.aad(f.index))
+
+	if _, err := f.file.WriteAt(buf, chunkOffset(f.index)); err != nil {
+		return err
+	}
+
+	f.dirty = false
+	return nil
+}
+
+// aad связывает блок с файлом и его местом в файле, чтобы блоки нельзя
+// было переставить или перенести в другой файл
+func (f *cryptFile) aad(index int64) []byte {
+	aad := make([]byte, len(f.id)+8)
+	copy(aad, f.id)
+	binary.BigEndian.PutUint64(aad[len(f.id):], uint64(index))
+	return aad
+}
+
+func chunkOffset(index int64) int64 {
+	return int64(cryptHeaderSize) + index*(cryptChunkSize+cryptOverhead)
+}
+
+// ErrNoEncryption возвращается при миграции кеша без ключа шифрования
+var ErrNoEncryption = errors.New("cache encryption is not configured")
+
+// EncryptResult - результат шифрования существующего кеша
+type EncryptResult struct {
+	// Files и Bytes - количество и размер зашифрованных файлов
+	Files int
+	Bytes int64
+	// Skipped - файлы, которые уже были зашифрованы
+	Skipped int
+}
+
+// EncryptCache шифрует незашифрованные файлы локального слоя внутри root.
+// Файлы шифруются по одному через временный файл, поэтому прерванную
+// миграцию можно продолжить повторным запуском
+func (p *PikpakProxy) EncryptCache(ctx context.Context, root string) (EncryptResult, error) {
+	var result EncryptResult
+	if p.crypt == nil {
+		return result, ErrNoEncryption
+	}
+
+	for _, f := range p.localFiles(root) {
+		if err := ctx.Err(); err != nil {
+			return result, err
+		}
+
+		localPath := p.LocalFilePath(f.name)
+		if ok, err := encrypted(localPath); err != nil || ok {
+			if err != nil {
+				return result, err
+			}
+			result.Skipped++
+			continue
+		}
+
+		if err := p.crypt.encrypt(localPath); err != nil {
+			return result, fmt.Errorf("failed to encrypt %s: %w", f.name, err)
+		}
+
+		p.log.Logf("[DEBUG] encrypted %s (%d bytes)", f.name, f.info.Size())
+		result.Files++
+		result.Bytes += f.info.Size()
+	}
+
+	p.usage.invalidate()
+	p.log.Logf("[INFO] encrypted %d files (%d bytes), %d already encrypted", result.Files, result.Bytes, result.Skipped)
+	return result, nil
+}
@@ -0,0 +1,290 @@
+package fs_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ReanSn0w/pikpak-webdav-proxy/pkg/fs"
+	lgr "github.com/go-pkgz/lgr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testKey = fs.EncryptionKey{1, 2, 3, 4, 5, 6, 7, 8}
+
+func randomData(size int) []byte {
+	data := make([]byte, size)
+	rand.New(rand.NewSource(int64(size))).Read(data)
+	return data
+}
+
+func writeProxyFile(t *testing.T, proxy *fs.PikpakProxy, name string, flag int, data []byte) {
+	f, err := proxy.OpenFile(context.Background(), name, flag, 0644)
+	require.NoError(t, err)
+	_, err = f.Write(data)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+}
+
+func TestEncryption_ReadWrite(t *testing.T) {
+	proxy, localDir, _, _ := setupCopy(t, fs.WithEncryption(testKey))
+	ctx := context.Background()
+
+	data := randomData(200000)
+	writeProxyFile(t, proxy, "/file.bin", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, data)
+
+	// На диске хранится только зашифрованное содержимое
+	raw, err := os.ReadFile(filepath.Join(localDir, "file.bin"))
+	require.NoError(t, err)
+	assert.Greater(t, len(raw), len(data))
+	assert.False(t, bytes.Contains(raw, data[1000:1100]))
+
+	info, err := proxy.Stat(ctx, "/file.bin")
+	require.NoError(t, err)
+	assert.EqualValues(t, len(data), info.Size())
+	assert.Equal(t, string(data), readProxyFile(t, proxy, "/file.bin"))
+
+	// Чтение с произвольной позиции
+	f, err := proxy.OpenFile(ctx, "/file.bin", os.O_RDONLY, 0)
+	require.NoError(t, err)
+	_, err = f.Seek(131000, io.SeekStart)
+	require.NoError(t, err)
+	buf := make([]byte, 1000)
+	_, err = io.ReadFull(f, buf)
+	require.NoError(t, err)
+	assert.Equal(t, data[131000:132000], buf)
+
+	end, err := f.Seek(0, io.SeekEnd)
+	require.NoError(t, err)
+	assert.EqualValues(t, len(data), end)
+	require.NoError(t, f.Close())
+
+	// Запись в середину, в конец и после конца файла
+	f, err = proxy.OpenFile(ctx, "/file.bin", os.O_WRONLY, 0)
+	require.NoError(t, err)
+	_, err = f.Seek(65000, io.SeekStart)
+	require.NoError(t, err)
+	_, err = f.Write(bytes.Repeat([]byte("x"), 1000))
+	require.NoError(t, err)
+	_, err = f.Seek(300000, io.SeekStart)
+	require.NoError(t, err)
+	_, err = f.Write([]byte("tail"))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	writeProxyFile(t, proxy, "/file.bin", os.O_WRONLY|os.O_APPEND, []byte("!"))
+
+	expected := append([]byte{}, data...)
+	copy(expected[65000:], bytes.Repeat([]byte("x"), 1000))
+	expected = append(expected, make([]byte, 300000-len(data))...)
+	expected = append(expected, "tail!"...)
+
+	assert.Equal(t, string(expected), readProxyFile(t, proxy, "/file.bin"))
+
+	infos, err := proxy.Readdir(ctx, "/")
+	require.NoError(t, err)
+	require.Len(t, infos, 1)
+	assert.EqualValues(t, len(expected), infos[0].Size())
+}
+
+func TestEncryption_Fetch(t *testing.T) {
+	proxy, localDir, remoteDir, _ := setupCopy(t, fs.WithEncryption(testKey))
+	ctx := context.Background()
+
+	data := randomData(100000)
+	require.NoError(t, os.WriteFile(filepath.Join(remoteDir, "remote.bin"), data, 0644))
+
+	require.NoError(t, proxy.Fetch(ctx, "/remote.bin"))
+
+	raw, err := os.ReadFile(filepath.Join(localDir, "remote.bin"))
+	require.NoError(t, err)
+	assert.False(t, bytes.Contains(raw, data[:100]))
+	assert.Equal(t, string(data), readProxyFile(t, proxy, "/remote.bin"))
+
+	// Закешированный файл совпадает с удаленным
+	files, err := proxy.CacheFiles(ctx, "/", false)
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+	assert.Equal(t, fs.CacheClean, files[0].State)
+
+	sums, err := proxy.Checksums(ctx, "/remote.bin")
+	require.NoError(t, err)
+	assert.NotEmpty(t, sums.SHA256)
+}
+
+func TestEncryption_WrongKey(t *testing.T) {
+	proxy, localDir, remoteDir, _ := setupCopy(t, fs.WithEncryption(testKey))
+	writeProxyFile(t, proxy, "/file.txt", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, []byte("secret"))
+
+	other := fs.NewPikpakProxy(lgr.New(), localDir, remoteClient(t, remoteDir), fs.WithEncryption(fs.EncryptionKey{9}))
+
+	// Заголовок с размером не проходит проверку уже при открытии
+	_, err := other.OpenFile(context.Background(), "/file.txt", os.O_RDONLY, 0)
+	assert.True(t, errors.Is(err, fs.ErrCorrupted), "%v", err)
+}
+
+func TestEncryption_Truncated(t *testing.T) {
+	proxy, localDir, _, _ := setupCopy(t, fs.WithEncryption(testKey))
+	data := randomData(200000)
+	writeProxyFile(t, proxy, "/file.bin", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, data)
+
+	// Файл обрезан точно по границе блоков: каждый оставшийся блок цел
+	raw, err := os.ReadFile(filepath.Join(localDir, "file.bin"))
+	require.NoError(t, err)
+	const overhead = 28
+	chunk := 64<<10 + overhead
+	header := len(raw) - len(data) - 4*overhead
+	require.NoError(t, os.WriteFile(filepath.Join(localDir, "file.bin"), raw[:header+2*chunk], 0644))
+
+	info, err := proxy.Stat(context.Background(), "/file.bin")
+	require.NoError(t, err)
+	assert.EqualValues(t, len(data), info.Size())
+
+	f, err := proxy.OpenFile(context.Background(), "/file.bin", os.O_RDONLY, 0)
+	require.NoError(t, err)
+	defer f.Close()
+
+	_, err = io.ReadAll(f)
+	assert.True(t, errors.Is(err, fs.ErrCorrupted))
+}
+
+func TestEncryption_Budget(t *testing.T) {
+	proxy, _, _, _ := setupCopy(t, fs.WithEncryption(testKey), fs.WithCacheBudget(150))
+
+	// 100 байт помещаются в бюджет без шифрования, но не с ним
+	assert.ErrorIs(t, proxy.Reserve(context.Background(), "/file.bin", 100), fs.ErrInsufficientStorage)
+
+	f, err := proxy.OpenFile(context.Background(), "/file.bin", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	require.NoError(t, err)
+	defer f.Close()
+	_, err = f.Write(make([]byte, 100))
+	assert.ErrorIs(t, err, fs.ErrInsufficientStorage)
+
+	writeProxyFile(t, proxy, "/small.bin", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, make([]byte, 10))
+	used, err := proxy.CacheUsage()
+	require.NoError(t, err)
+	assert.Greater(t, used, int64(10))
+}
+
+func TestEncryptCache(t *testing.T) {
+	localDir := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(localDir, "dir"), 0755))
+	writeLocalFile(t, localDir, "dir/a.txt", "aaa", testTime)
+	writeLocalFile(t, localDir, "b.txt", "bbb", testTime)
+
+	plain := fs.NewPikpakProxy(lgr.New(), localDir, remoteClient(t, t.TempDir()))
+	_, err := plain.EncryptCache(context.Background(), "/")
+	assert.ErrorIs(t, err, fs.ErrNoEncryption)
+
+	proxy := fs.NewPikpakProxy(lgr.New(), localDir, remoteClient(t, t.TempDir()), fs.WithEncryption(testKey))
+
+	// Незашифрованные файлы читаются до миграции
+	assert.Equal(t, "aaa", readProxyFile(t, proxy, "/dir/a.txt"))
+
+	result, err := proxy.EncryptCache(context.Background(), "/")
+	require.NoError(t, err)
+	assert.Equal(t, fs.EncryptResult{Files: 2, Bytes: 6}, result)
+
+	raw, err := os.ReadFile(filepath.Join(localDir, "dir", "a.txt"))
+	require.NoError(t, err)
+	assert.NotEqual(t, "aaa", string(raw))
+	assert.Equal(t, "aaa", readProxyFile(t, proxy, "/dir/a.txt"))
+
+	info, err := proxy.Stat(context.Background(), "/b.txt")
+	require.NoError(t, err)
+	assert.EqualValues(t, 3, info.Size())
+	assert.True(t, info.ModTime().Equal(testTime))
+
+	result, err = proxy.EncryptCache(context.Background(), "/")
+	require.NoError(t, err)
+	assert.Equal(t, fs.EncryptResult{Skipped: 2}, result)
+}
+
+func TestEncryption_WarnsPlaintext(t *testing.T) {
+	localDir := t.TempDir()
+	writeLocalFile(t, localDir, "a.txt", "plain", testTime)
+
+	var logs bytes.Buffer
+	proxy := fs.NewPikpakProxy(lgr.New(lgr.Out(&logs)), localDir, remoteClient(t, t.TempDir()), fs.WithEncryption(testKey))
+
+	// Предупреждение выводится один раз на файл
+	assert.Equal(t, "plain", readProxyFile(t, proxy, "/a.txt"))
+	assert.Equal(t, "plain", readProxyFile(t, proxy, "/a.txt"))
+	assert.Equal(t, 1, bytes.Count(logs.Bytes(), []byte("a.txt is not encrypted")))
+
+	// Зашифрованные файлы не отмечаются
+	writeProxyFile(t, proxy, "/b.txt", os.O_WRONLY|os.O_CREATE, []byte("secret"))
+	assert.Equal(t, "secret", readProxyFile(t, proxy, "/b.txt"))
+	assert.NotContains(t, logs.String(), "b.txt is not encrypted")
+}
+
+func TestEncryption_PlainWarningForgotten(t *testing.T) {
+	localDir := t.TempDir()
+	writeLocalFile(t, localDir, "a.txt", "plain", testTime)
+
+	var logs bytes.Buffer
+	proxy := fs.NewPikpakProxy(lgr.New(lgr.Out(&logs)), localDir, remoteClient(t, t.TempDir()), fs.WithEncryption(testKey))
+	assert.Equal(t, "plain", readProxyFile(t, proxy, "/a.txt"))
+
+	// После шифрования файл больше не отмечен как незашифрованный, и новая
+	// незашифрованная копия снова вызывает предупреждение
+	_, err := proxy.EncryptCache(context.Background(), "/")
+	require.NoError(t, err)
+	writeLocalFile(t, localDir, "a.txt", "plain", testTime)
+	assert.Equal(t, "plain", readProxyFile(t, proxy, "/a.txt"))
+	assert.Equal(t, 2, bytes.Count(logs.Bytes(), []byte("a.txt is not encrypted")))
+}
+
+func TestEncryption_EncryptsOnWrite(t *testing.T) {
+	localDir := t.TempDir()
+	writeLocalFile(t, localDir, "a.txt", "plain", testTime)
+
+	proxy := fs.NewPikpakProxy(lgr.New(), localDir, remoteClient(t, t.TempDir()), fs.WithEncryption(testKey))
+	writeProxyFile(t, proxy, "/a.txt", os.O_WRONLY|os.O_APPEND, []byte(" text"))
+
+	raw, err := os.ReadFile(filepath.Join(localDir, "a.txt"))
+	require.NoError(t, err)
+	assert.False(t, bytes.Contains(raw, []byte("plain")))
+	assert.Equal(t, "plain text", readProxyFile(t, proxy, "/a.txt"))
+}
+
+func TestParseEncryptionKey(t *testing.T) {
+	raw := bytes.Repeat([]byte{0xab}, 32)
+
+	key, err := fs.ParseEncryptionKey(hex.EncodeToString(raw) + "\n")
+	require.NoError(t, err)
+	assert.Equal(t, raw, key[:])
+
+	key, err = fs.ParseEncryptionKey(base64.StdEncoding.EncodeToString(raw))
+	require.NoError(t, err)
+	assert.Equal(t, raw, key[:])
+
+	_, err = fs.ParseEncryptionKey("short")
+	assert.Error(t, err)
+
+	path := filepath.Join(t.TempDir(), "key")
+	require.NoError(t, os.WriteFile(path, []byte(hex.EncodeToString(raw)), 0600))
+	key, err = fs.LoadEncryptionKey(path)
+	require.NoError(t, err)
+	assert.Equal(t, raw, key[:])
+}
+
+func TestEncryption_WriteThrough(t *testing.T) {
+	rule, err := fs.NewPolicyRule("/**", fs.WriteThrough)
+	require.NoError(t, err)
+	proxy, _, remoteDir, _ := setupCopy(t, fs.WithEncryption(testKey), fs.WithPolicies(rule))
+
+	data := randomData(70000)
+	writeProxyFile(t, proxy, "/file.bin", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, data)
+
+	// На удаленный сервер загружается расшифрованное содержимое
+	assert.Equal(t, string(data), readFile(t, remoteDir, "file.bin"))
+}
@@ -0,0 +1,68 @@
+package fs
+
+import (
+	"os"
+	"path"
+	"time"
+)
+
+// dirInfo - объединенная информация о директории, существующей
+// хотя бы в одном из слоев
+type dirInfo struct {
+	name    string
+	mode    os.FileMode
+	modTime time.Time
+}
+
+// newDirInfo объединяет информацию о директории из обоих слоев: время
+// изменения - наибольшее из двух, права доступа берутся из локального слоя.
+// Любой из аргументов local и remote может быть nil
+func newDirInfo(name string, local, remote os.FileInfo) os.FileInfo {
+	info := &dirInfo{name: path.Base(path.Clean("/" + name))}
+
+	for _, fi := range []os.FileInfo{remote, local} {
+		if fi == nil {
+			continue
+		}
+
+		info.mode = fi.Mode()
+		if fi.ModTime().After(info.modTime) {
+			info.modTime = fi.ModTime()
+		}
+	}
+
+	info.mode |= os.ModeDir
+	return info
+}
+
+func (d *dirInfo) Name() string       { return d.name }
+func (d *dirInfo) Size() int64        { return 0 }
+func (d *dirInfo) Mode() os.FileMode  { return d.mode }
+func (d *dirInfo) ModTime() time.Time { return d.modTime }
+func (d *dirInfo) IsDir() bool        { return true }
+func (d *dirInfo) Sys() any           { return nil }
+
+// statDir возвращает информацию о директории, найденной в локальном слое,
+// с учетом версии на удаленном сервере. Если удаленный сервер недоступен,
+// используется только локальная информация
+func (p *PikpakProxy) statDir(name string, local os.FileInfo, remoteName string) os.FileInfo {
+	remote, err := p.remoteClient.Stat(remoteName)
+	if err != nil {
+		p.log.Logf("[DEBUG] Stat (local dir, remote unavailable): %s: %v", name, err)
+		return newDirInfo(name, local, nil)
+	}
+
+	if remote.IsDir() {
+		p.log.Logf("[DEBUG] Stat (merged dir): %s", name)
+		return newDirInfo(name, local, remote)
+	}
+
+	// На удаленном сервере на месте директории находится файл
+	if p.conflictPolicy != ConflictNone && p.detectConflict(name, local, remote) &&
+		p.resolveConflict(local, remote) == LayerRemote {
+		p.log.Logf("[DEBUG] Stat (remote, conflict): %s", name)
+		return remote
+	}
+
+	return newDirInfo(name, local, nil)
+}
@@ -0,0 +1,105 @@
+package fs_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ReanSn0w/pikpak-webdav-proxy/pkg/fs"
+	lgr "github.com/go-pkgz/lgr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStat_RootMerged(t *testing.T) {
+	tmpDir := t.TempDir()
+	mockClient := &MockWebdav{}
+
+	require.NoError(t, os.Chtimes(tmpDir, testTime, testTime))
+	local, err := os.Stat(tmpDir)
+	require.NoError(t, err)
+
+	mockClient.On("Stat", "/").Return(newDirInfo("", testTime.Add(time.Hour)), nil)
+
+	proxy := fs.NewPikpakProxy(lgr.New(), tmpDir, mockClient)
+
+	info, err := proxy.Stat(context.Background(), "/")
+	require.NoError(t, err)
+	assert.True(t, info.IsDir())
+	assert.Equal(t, "/", info.Name())
+	assert.True(t, info.ModTime().Equal(testTime.Add(time.Hour)))
+	assert.Equal(t, local.Mode(), info.Mode())
+}
+
+func TestStat_RootRemoteUnavailable(t *testing.T) {
+	tmpDir := t.TempDir()
+	mockClient := &MockWebdav{}
+
+	require.NoError(t, os.Chtimes(tmpDir, testTime, testTime))
+
+	mockClient.On("Stat", "/").Return(nil, errors.New("connection refused"))
+
+	proxy := fs.NewPikpakProxy(lgr.New(), tmpDir, mockClient)
+
+	info, err := proxy.Stat(context.Background(), "/")
+	require.NoError(t, err)
+	assert.True(t, info.IsDir())
+	assert.True(t, info.ModTime().Equal(testTime))
+}
+
+func TestStat_SubdirMerged(t *testing.T) {
+	tmpDir := t.TempDir()
+	mockClient := &MockWebdav{}
+
+	dir := filepath.Join(tmpDir, "dir")
+	require.NoError(t, os.Mkdir(dir, 0750))
+	require.NoError(t, os.Chtimes(dir, testTime.Add(2*time.Hour), testTime.Add(2*time.Hour)))
+
+	mockClient.On("Stat", "/dir").Return(newDirInfo("dir", testTime), nil)
+
+	proxy := fs.NewPikpakProxy(lgr.New(), tmpDir, mockClient)
+
+	info, err := proxy.Stat(context.Background(), "/dir")
+	require.NoError(t, err)
+	assert.Equal(t, "dir", info.Name())
+	assert.True(t, info.ModTime().Equal(testTime.Add(2*time.Hour)))
+	assert.Equal(t, os.ModeDir|0750, info.Mode())
+}
+
+func TestStat_RemoteOnlyDir(t *testing.T) {
+	tmpDir := t.TempDir()
+	mockClient := &MockWebdav{}
+
+	mockClient.On("Stat", "/dir").Return(newDirInfo("dir", testTime), nil)
+
+	proxy := fs.NewPikpakProxy(lgr.New(), tmpDir, mockClient)
+
+	info, err := proxy.Stat(context.Background(), "/dir")
+	require.NoError(t, err)
+	assert.True(t, info.IsDir())
+	assert.Equal(t, "dir", info.Name())
+	assert.True(t, info.ModTime().Equal(testTime))
+}
+
+func TestReaddir_MergedDirectoryEntry(t *testing.T) {
+	tmpDir := t.TempDir()
+	mockClient := &MockWebdav{}
+
+	dir := filepath.Join(tmpDir, "dir")
+	require.NoError(t, os.Mkdir(dir, 0750))
+	require.NoError(t, os.Chtimes(dir, testTime, testTime))
+
+	mockClient.On("ReadDir", "/").Return([]os.FileInfo{newDirInfo("dir", testTime.Add(time.Hour))}, nil)
+
+	proxy := fs.NewPikpakProxy(lgr.New(), tmpDir, mockClient)
+
+	entries, err := proxy.ReaddirLayers(context.Background(), "/")
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, fs.LayerBoth, entries[0].Layer)
+	assert.True(t, entries[0].ModTime().Equal(testTime.Add(time.Hour)))
+	assert.Equal(t, os.ModeDir|0750, entries[0].Mode())
+}
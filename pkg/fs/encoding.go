@@ -0,0 +1,385 @@
+package fs
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/ReanSn0w/pikpak-webdav-proxy/pkg/utils"
+	"github.com/go-pkgz/lgr"
+)
+
+// NameEncoding - набор правил кодирования имен, которые не принимает
+// удаленный сервер. Запрещенные символы заменяются похожими символами
+// Unicode, как это делает rclone, поэтому закодированные имена остаются
+// читаемыми в веб-интерфейсе PikPak
+type NameEncoding uint
+
+const (
+	// EncodeCtl - управляющие символы 0x00-0x1F и 0x7F
+	EncodeCtl NameEncoding = 1 << iota
+	// EncodeBackSlash - символ \
+	EncodeBackSlash
+	// EncodeColon - символ :
+	EncodeColon
+	// EncodeAsterisk - символ *
+	EncodeAsterisk
+	// EncodeQuestion - символ ?
+	EncodeQuestion
+	// EncodeDoubleQuote - символ "
+	EncodeDoubleQuote
+	// EncodeLtGt - символы < и >
+	EncodeLtGt
+	// EncodePipe - символ |
+	EncodePipe
+	// EncodeLeftSpace - пробел в начале имени
+	EncodeLeftSpace
+	// EncodeRightSpace - пробел в конце имени
+	EncodeRightSpace
+	// EncodeRightPeriod - точка в конце имени
+	EncodeRightPeriod
+
+	// EncodeNone - имена передаются без изменений
+	EncodeNone NameEncoding = 0
+	// DefaultNameEncoding - правила для имен, которые отклоняет PikPak
+	DefaultNameEncoding = EncodeCtl | EncodeBackSlash | EncodeColon | EncodeAsterisk |
+		EncodeQuestion | EncodeDoubleQuote | EncodeLtGt | EncodePipe |
+		EncodeLeftSpace | EncodeRightSpace | EncodeRightPeriod
+)
+
+var nameEncodingNames = map[string]NameEncoding{
+	"none":        EncodeNone,
+	"default":     DefaultNameEncoding,
+	"ctl":         EncodeCtl,
+	"backslash":   EncodeBackSlash,
+	"colon":       EncodeColon,
+	"asterisk":    EncodeAsterisk,
+	"question":    EncodeQuestion,
+	"doublequote": EncodeDoubleQuote,
+	"ltgt":        EncodeLtGt,
+	"pipe":        EncodePipe,
+	"leftspace":   EncodeLeftSpace,
+	"rightspace":  EncodeRightSpace,
+	"rightperiod": EncodeRightPeriod,
+}
+
+// ParseNameEncoding разбирает список правил кодирования, разделенных
+// запятыми, например "default" или "ctl,colon,rightperiod"
+func ParseNameEncoding(s string) (NameEncoding, error) {
+	var enc NameEncoding
+
+	for _, part := range strings.Split(s, ",") {
+		part = strings.ToLower(strings.TrimSpace(part))
+		if part == "" {
+			continue
+		}
+
+		flag, ok := nameEncodingNames[part]
+		if !ok {
+			return 0, fmt.Errorf("unknown name encoding: %s", part)
+		}
+		enc |= flag
+	}
+
+	return enc, nil
+}
+
+// quoteRune экранирует символы, совпадающие с заменами, чтобы
+// кодирование оставалось обратимым
+const quoteRune = '‛'
+
+// replacement - замена символа и правило, которое ее включает
+type replacement struct {
+	flag NameEncoding
+	from rune
+	to   rune
+}
+
+var replacements = []replacement{
+	{EncodeBackSlash, '\\', '＼'},
+	{EncodeColon, ':', '：'},
+	{EncodeAsterisk, '*', '＊'},
+	{EncodeQuestion, '?', '？'},
+	{EncodeDoubleQuote, '"', '＂'},
+	{EncodeLtGt, '<', '＜'},
+	{EncodeLtGt, '>', '＞'},
+	{EncodePipe, '|', '｜'},
+	{EncodeLeftSpace | EncodeRightSpace, ' ', '␠'},
+	{EncodeRightPeriod, '.', '．'},
+	{EncodeCtl, 0x7F, '␡'},
+}
+
+// nameEncoder кодирует имена файлов для удаленного сервера. Слишком
+// длинные имена сокращаются, а исходные имена сохраняются в служебной
+// директории, чтобы их можно было восстановить
+type nameEncoder struct {
+	flags     NameEncoding
+	maxLength int
+	encode    map[rune]rune
+	decode    map[rune]rune
+
+	log  lgr.L
+	path string
+
+	mu    sync.Mutex
+	names map[string]string
+}
+
+func newNameEncoder(log lgr.L, flags NameEncoding, maxLength int, path string) *nameEncoder {
+	e := &nameEncoder{
+		flags:     flags,
+		maxLength: maxLength,
+		encode:    make(map[rune]rune),
+		decode:    make(map[rune]rune),
+		log:       log,
+		path:      path,
+		names:     make(map[string]string),
+	}
+
+	for _, r := range replacements {
+		if flags&r.flag == 0 {
+			continue
+		}
+		e.encode[r.from] = r.to
+		e.decode[r.to] = r.from
+	}
+
+	if flags&EncodeCtl != 0 {
+		for c := rune(0); c < 0x20; c++ {
+			e.encode[c] = 0x2400 + c
+			e.decode[0x2400+c] = c
+		}
+	}
+
+	data, err := os.ReadFile(path)
+	switch {
+	case os.IsNotExist(err):
+		return e
+	case err != nil:
+		log.Logf("[WARN] failed to read encoded names: %v", err)
+		return e
+	}
+
+	if err := json.Unmarshal(data, &e.names); err != nil {
+		log.Logf("[WARN] failed to decode encoded names: %v", err)
+	}
+
+	return e
+}
+
+// encodePath кодирует каждый элемент пути
+func (e *nameEncoder) encodePath(name string) string {
+	return e.mapPath(name, e.encodeName)
+}
+
+func (e *nameEncoder) mapPath(name string, fn func(string) string) string {
+	parts := strings.Split(name, "/")
+	for i, part := range parts {
+		if part != "" {
+			parts[i] = fn(part)
+		}
+	}
+	return strings.Join(parts, "/")
+}
+
+// encodeName кодирует имя файла
+func (e *nameEncoder) encodeName(name string) string {
+	runes := []rune(name)
+
+	// replaced[i] - заменяется ли символ i правилом кодирования
+	replaced := make([]bool, len(runes))
+	for i, r := range runes {
+		switch {
+		case r == ' ':
+			replaced[i] = (i == 0 && e.flags&EncodeLeftSpace != 0) ||
+				(i == len(runes)-1 && e.flags&EncodeRightSpace != 0)
+		case r == '.':
+			replaced[i] = i == len(runes)-1 && e.flags&EncodeRightPeriod != 0
+		default:
+			_, replaced[i] = e.encode[r]
+		}
+	}
+
+	var b strings.Builder
+	for i, r := range runes {
+		switch {
+		case replaced[i]:
+			b.WriteRune(e.encode[r])
+		case e.special(r):
+			b.WriteRune(quoteRune)
+			b.WriteRune(r)
+		case r == quoteRune && i+1 < len(runes) &&
+			(replaced[i+1] || e.special(runes[i+1]) || runes[i+1] == quoteRune):
+			b.WriteRune(quoteRune)
+			b.WriteRune(r)
+		default:
+			b.WriteRune(r)
+		}
+	}
+
+	return e.shorten(name, b.String())
+}
+
+// decodeName восстанавливает исходное имя файла
+func (e *nameEncoder) decodeName(name string) string {
+	e.mu.Lock()
+	original, ok := e.names[name]
+	e.mu.Unlock()
+	if ok {
+		return original
+	}
+
+	runes := []rune(name)
+
+	var b strings.Builder
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+		switch {
+		case r == quoteRune && i+1 < len(runes) && (e.special(runes[i+1]) || runes[i+1] == quoteRune):
+			b.WriteRune(runes[i+1])
+			i++
+		case e.special(r):
+			b.WriteRune(e.decode[r])
+		default:
+			b.WriteRune(r)
+		}
+	}
+
+	return b.String()
+}
+
+// special проверяет, является ли символ заменой
+func (e *nameEncoder) special(r rune) bool {
+	_, ok := e.decode[r]
+	return ok
+}
+
+// shorten сокращает закодированное имя до допустимой длины, сохраняя
+// расширение. К имени добавляется хеш исходного имени, а соответствие
+// запоминается для восстановления при чтении
+func (e *nameEncoder) shorten(original, encoded string) string {
+	if e.maxLength <= 0 || len(encoded) <= e.maxLength {
+		return encoded
+	}
+
+	sum := sha256.Sum256([]byte(original))
+	suffix := "~" + hex.EncodeToString(sum[:4])
+
+	ext := path.Ext(encoded)
+	if len(ext)+len(suffix) > e.maxLength/2 {
+		ext = ""
+	}
+
+	stem := strings.TrimSuffix(encoded, ext)
+	limit := e.maxLength - len(suffix) - len(ext)
+	for len(stem) > limit {
+		_, size := utf8.DecodeLastRuneInString(stem)
+		stem = stem[:len(stem)-size]
+	}
+
+	short := stem + suffix + ext
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.names[short] != original {
+		e.names[short] = original
+		e.save()
+	}
+
+	return short
+}
+
+// save записывает соответствие сокращенных имен исходным
+func (e *nameEncoder) save() {
+	if err := utils.WriteJSONAtomic(e.path, e.names); err != nil {
+		e.log.Logf("[ERROR] failed to save encoded names: %v", err)
+	}
+}
+
+// encodedClient - клиент удаленного сервера, кодирующий имена файлов
+// в запросах и восстанавливающий их в ответах
+type encodedClient struct {
+	Webdav
+	enc *nameEncoder
+}
+
+func (c *encodedClient) Stat(name string) (os.FileInfo, error) {
+	info, err := c.Webdav.Stat(c.enc.encodePath(name))
+	if err != nil {
+		return nil, err
+	}
+	return c.decodeInfo(info), nil
+}
+
+func (c *encodedClient) ReadDir(name string) ([]os.FileInfo, error) {
+	infos, err := c.Webdav.ReadDir(c.enc.encodePath(name))
+	if err != nil {
+		return nil, err
+	}
+
+	for i, info := range infos {
+		infos[i] = c.decodeInfo(info)
+	}
+
+	return infos, nil
+}
+
+func (c *encodedClient) ReadStreamRange(name string, offset int64, length int64) (io.ReadCloser, error) {
+	return c.Webdav.ReadStreamRange(c.enc.encodePath(name), offset, length)
+}
+
+func (c *encodedClient) MkdirAll(name string, perm os.FileMode) error {
+	return c.Webdav.MkdirAll(c.enc.encodePath(name), perm)
+}
+
+func (c *encodedClient) RemoveAll(name string) error {
+	return c.Webdav.RemoveAll(c.enc.encodePath(name))
+}
+
+func (c *encodedClient) Rename(oldName, newName string, overwrite bool) error {
+	return c.Webdav.Rename(c.enc.encodePath(oldName), c.enc.encodePath(newName), overwrite)
+}
+
+func (c *encodedClient) WriteStream(name string, stream io.Reader, mode os.FileMode) error {
+	w, ok := c.Webdav.(RemoteWriter)
+	if !ok {
+		return fmt.Errorf("remote client does not support writes: %s", name)
+	}
+	return w.WriteStream(c.enc.encodePath(name), stream, mode)
+}
+
+func (c *encodedClient) Copy(oldName, newName string, overwrite bool) error {
+	cp, ok := c.Webdav.(RemoteCopier)
+	if !ok {
+		return fmt.Errorf("remote client does not support copy: %w", errors.ErrUnsupported)
+	}
+	return cp.Copy(c.enc.encodePath(oldName), c.enc.encodePath(newName), overwrite)
+}
+
+func (c *encodedClient) Checksums(name string) (Checksums, error) {
+	cs, ok := c.Webdav.(RemoteChecksummer)
+	if !ok {
+		return Checksums{}, ErrNoChecksum
+	}
+	return cs.Checksums(c.enc.encodePath(name))
+}
+
+func (c *encodedClient) RemotePath(name string) (string, error) {
+	return c.enc.encodePath(name), nil
+}
+
+func (c *encodedClient) decodeInfo(info os.FileInfo) os.FileInfo {
+	if name := c.enc.decodeName(info.Name()); name != info.Name() {
+		return renamedInfo{FileInfo: info, name: name}
+	}
+	return info
+}
@@ -0,0 +1,105 @@
+package fs_test
+
+import (
+	"context"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ReanSn0w/pikpak-webdav-proxy/pkg/fs"
+	lgr "github.com/go-pkgz/lgr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseNameEncoding(t *testing.T) {
+	enc, err := fs.ParseNameEncoding("colon, Pipe")
+	require.NoError(t, err)
+	assert.Equal(t, fs.EncodeColon|fs.EncodePipe, enc)
+
+	enc, err = fs.ParseNameEncoding("default")
+	require.NoError(t, err)
+	assert.Equal(t, fs.DefaultNameEncoding, enc)
+
+	_, err = fs.ParseNameEncoding("slash")
+	assert.Error(t, err)
+}
+
+func TestEncoding_RemoteRequests(t *testing.T) {
+	mockClient := &MockWebdav{}
+	mockClient.On("MkdirAll", "/Q：A？/notes．", mock.Anything).Return(nil)
+	mockClient.On("Rename", "/a｜b", "/␠c␠", true).Return(nil)
+
+	proxy := fs.NewPikpakProxy(lgr.New(), t.TempDir(), mockClient, fs.WithNameEncoding(fs.DefaultNameEncoding, 0))
+	ctx := context.Background()
+
+	require.NoError(t, proxy.Mkdir(ctx, "/Q:A?/notes.", 0755))
+
+	f, err := proxy.OpenFile(ctx, "/a|b", os.O_RDWR|os.O_CREATE, 0644)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	require.NoError(t, proxy.Rename(ctx, "/a|b", "/ c "))
+
+	mockClient.AssertExpectations(t)
+}
+
+func TestEncoding_RemotePath(t *testing.T) {
+	mockClient := &MockWebdav{}
+	mockClient.On("Stat", "/Q：A？/a｜b").Return(newMockFileInfo("a｜b", false), nil)
+	mockClient.On("Stat", "/Q：A？/new").Return(nil, os.ErrNotExist)
+
+	proxy := fs.NewPikpakProxy(lgr.New(), t.TempDir(), mockClient, fs.WithNameEncoding(fs.DefaultNameEncoding, 0))
+
+	remote, err := proxy.RemotePath("/Q:A?/a|b")
+	require.NoError(t, err)
+	assert.Equal(t, "/Q：A？/a｜b", remote)
+
+	_, err = proxy.RemotePath("/Q:A?/new")
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestEncoding_DecodeListing(t *testing.T) {
+	mockClient := &MockWebdav{}
+	mockClient.On("ReadDir", "/").Return([]os.FileInfo{
+		newMockFileInfo("a：b", false),
+		newMockFileInfo("‛：literal", false),
+		newMockFileInfo("‛plain", false),
+		newMockFileInfo("name．", false),
+	}, nil)
+
+	proxy := fs.NewPikpakProxy(lgr.New(), t.TempDir(), mockClient, fs.WithNameEncoding(fs.DefaultNameEncoding, 0))
+
+	infos, err := proxy.Readdir(context.Background(), "/")
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"a:b", "：literal", "‛plain", "name."}, names(infos))
+}
+
+func TestEncoding_LongNames(t *testing.T) {
+	tmpDir := t.TempDir()
+	long := strings.Repeat("очень длинное имя ", 5) + ".mkv"
+
+	var short string
+	mockClient := &MockWebdav{}
+	mockClient.On("MkdirAll", mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+		short = path.Base(args.String(0))
+	}).Return(nil)
+
+	proxy := fs.NewPikpakProxy(lgr.New(), tmpDir, mockClient, fs.WithNameEncoding(fs.EncodeNone, 100))
+	require.NoError(t, proxy.Mkdir(context.Background(), "/"+long, 0755))
+
+	assert.LessOrEqual(t, len(short), 100)
+	assert.True(t, strings.HasSuffix(short, ".mkv"))
+
+	// Соответствие имен сохраняется между запусками
+	require.NoError(t, os.RemoveAll(filepath.Join(tmpDir, long)))
+	mockClient = &MockWebdav{}
+	mockClient.On("ReadDir", "/").Return([]os.FileInfo{newMockFileInfo(short, true)}, nil)
+
+	proxy = fs.NewPikpakProxy(lgr.New(), tmpDir, mockClient, fs.WithNameEncoding(fs.EncodeNone, 100))
+	infos, err := proxy.Readdir(context.Background(), "/")
+	require.NoError(t, err)
+	assert.Equal(t, []string{long}, names(infos))
+}
@@ -0,0 +1,16 @@
+package fs
+
+import "strings"
+
+// quoteETag приводит ETag удаленного сервера к виду "value"
+func quoteETag(etag string) string {
+	if strings.HasPrefix(etag, `"`) || strings.HasPrefix(etag, `W/"`) {
+		return etag
+	}
+	return `"` + etag + `"`
+}
+
+// localETag возвращает ETag локального файла на основе SHA-256 содержимого
+func localETag(sums Checksums) string {
+	return `"` + sums.SHA256[:32] + `"`
+}
@@ -0,0 +1,131 @@
+package fs_test
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ReanSn0w/pikpak-webdav-proxy/pkg/fs"
+	lgr "github.com/go-pkgz/lgr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/webdav"
+)
+
+// etagFileInfo - информация об удаленном файле с ETag, как у gowebdav.File
+type etagFileInfo struct {
+	*MockFileInfo
+	etag string
+}
+
+func (e etagFileInfo) ETag() string {
+	return e.etag
+}
+
+func statETag(t *testing.T, proxy *fs.PikpakProxy, name string) string {
+	t.Helper()
+
+	info, err := proxy.Stat(context.Background(), name)
+	require.NoError(t, err)
+
+	e, ok := info.(webdav.ETager)
+	require.True(t, ok)
+
+	etag, err := e.ETag(context.Background())
+	require.NoError(t, err)
+	return etag
+}
+
+func TestETag_Remote(t *testing.T) {
+	tmpDir := t.TempDir()
+	mockClient := &MockWebdav{}
+	mockClient.On("Stat", "/remote.txt").Return(etagFileInfo{newMockFileInfo("remote.txt", false), "abc123"}, nil)
+	mockClient.On("Stat", "/quoted.txt").Return(etagFileInfo{newMockFileInfo("quoted.txt", false), `W/"xyz"`}, nil)
+
+	proxy := fs.NewPikpakProxy(lgr.New(), tmpDir, mockClient)
+
+	assert.Equal(t, `"abc123"`, statETag(t, proxy, "/remote.txt"))
+	assert.Equal(t, `W/"xyz"`, statETag(t, proxy, "/quoted.txt"))
+
+	// ETag доступен и через открытый файл
+	f, err := proxy.OpenFile(context.Background(), "/remote.txt", os.O_RDONLY, 0)
+	require.NoError(t, err)
+	defer f.Close()
+
+	info, err := f.Stat()
+	require.NoError(t, err)
+	etag, err := info.(webdav.ETager).ETag(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, `"abc123"`, etag)
+}
+
+// headETag возвращает ETag файла name в ответе обработчика WebDAV на HEAD
+func headETag(t *testing.T, handler http.Handler, name string) string {
+	t.Helper()
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodHead, name, nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	return rec.Header().Get("ETag")
+}
+
+func TestETag_LocalStable(t *testing.T) {
+	tmpDir := t.TempDir()
+	mockClient := &MockWebdav{}
+	proxy := fs.NewPikpakProxy(lgr.New(), tmpDir, mockClient)
+	handler := &webdav.Handler{FileSystem: proxy, LockSystem: webdav.NewMemLS()}
+
+	localPath := filepath.Join(tmpDir, "file.txt")
+	require.NoError(t, os.WriteFile(localPath, []byte("first"), 0644))
+	mtime := time.Now().Add(-time.Hour).Truncate(time.Second)
+	require.NoError(t, os.Chtimes(localPath, mtime, mtime))
+
+	// Файл, появившийся в обход прокси, не читается ради ETag, и ETag
+	// не меняется после вычисления хеша
+	outside := headETag(t, handler, "/file.txt")
+	_, err := proxy.CachedChecksums(context.Background(), "/file.txt")
+	assert.ErrorIs(t, err, fs.ErrNoChecksum)
+	_, err = proxy.Checksums(context.Background(), "/file.txt")
+	require.NoError(t, err)
+	assert.Equal(t, outside, headETag(t, handler, "/file.txt"))
+
+	// Файл, записанный через прокси, получает ETag из хеша содержимого,
+	// поэтому другое содержимое того же размера дает другой ETag даже
+	// с тем же временем изменения
+	for _, data := range []string{"first", "other"} {
+		writeProxyFile(t, proxy, "/file.txt", os.O_RDWR|os.O_TRUNC, []byte(data))
+		sum := sha256.Sum256([]byte(data))
+		assert.Equal(t, `"`+hex.EncodeToString(sum[:16])+`"`, headETag(t, handler, "/file.txt"))
+	}
+}
+
+func TestETag_ConditionalGet(t *testing.T) {
+	tmpDir := t.TempDir()
+	mockClient := &MockWebdav{}
+	proxy := fs.NewPikpakProxy(lgr.New(), tmpDir, mockClient)
+	writeProxyFile(t, proxy, "/file.txt", os.O_RDWR|os.O_CREATE, []byte("data"))
+
+	handler := &webdav.Handler{FileSystem: proxy, LockSystem: webdav.NewMemLS()}
+	etag := statETag(t, proxy, "/file.txt")
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/file.txt", nil))
+	assert.Equal(t, etag, rec.Header().Get("ETag"))
+
+	req := httptest.NewRequest(http.MethodGet, "/file.txt", nil)
+	req.Header.Set("If-None-Match", etag)
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusNotModified, rec.Code)
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("PROPFIND", "/file.txt", strings.NewReader("")))
+	assert.Contains(t, rec.Body.String(), strings.Trim(etag, `"`))
+}
@@ -0,0 +1,175 @@
+package fs
+
+import (
+	"context"
+	"encoding/xml"
+	"os"
+
+	"golang.org/x/net/webdav"
+)
+
+// proxyFile - файл, возвращаемый OpenFile. Добавляет к файлу любого слоя
+// ETag, тип содержимого и поддержку "мертвых" свойств
+type proxyFile struct {
+	webdav.File
+	p    *PikpakProxy
+	name string
+	// write - файл открыт для записи, после закрытия нужно обновить
+	// контрольные суммы
+	write bool
+	// written и replaced - объем записанных данных и место на диске,
+	// занятое перезаписанным файлом, для проверки бюджета кеша
+	written  int64
+	replaced int64
+	// before - размер файла на диске при открытии, после закрытия
+	// размер кеша меняется на разницу
+	before int64
+	// mode - режим записи файла
+	mode WriteMode
+	// ctx - контекст запроса, открывшего файл
+	ctx context.Context
+}
+
+func (f *proxyFile) Write(b []byte) (int, error) {
+	if f.write && f.p.cacheBudget > 0 {
+		used, err := f.p.usage.get()
+		if err == nil && used-f.replaced+f.p.crypt.storedSize(f.written+int64(len(b))) > f.p.cacheBudget {
+			f.p.log.Logf("[WARN] write to %s exceeds local cache budget", f.name)
+			markExceeded(f.ctx)
+			return 0, ErrInsufficientStorage
+		}
+	}
+
+	n, err := f.File.Write(b)
+	f.written += int64(n)
+	return n, err
+}
+
+func (f *proxyFile) Close() error {
+	if err := f.File.Close(); err != nil {
+		return err
+	}
+
+	if !f.write {
+		return nil
+	}
+
+	f.p.usage.add(diskSize(f.p.LocalFilePath(f.name)) - f.before)
+	defer f.p.checkWatermark()
+
+	if _, err := f.p.checksums.update(f.name, f.p.LocalFilePath(f.name), true); err != nil {
+		f.p.log.Logf("[WARN] failed to compute checksums for %s: %v", f.name, err)
+	}
+
+	if f.mode == WriteThrough {
+		return f.p.upload(f.name)
+	}
+
+	return nil
+}
+
+func (f *proxyFile) Stat() (os.FileInfo, error) {
+	info, err := f.File.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	return f.p.fileInfo(f.name, info), nil
+}
+
+// DeadProps возвращает свойства, сохраненные клиентами. Для директорий
+// к ним добавляются свойства квоты, которых нет среди живых свойств
+// обработчика WebDAV
+func (f *proxyFile) DeadProps() (map[xml.Name]webdav.Property, error) {
+	props := f.p.props.get(f.name)
+
+	if info, err := f.File.Stat(); err == nil && info.IsDir() {
+		for name, prop := range f.p.quotaProps(context.Background()) {
+			props[name] = prop
+		}
+	}
+
+	return props, nil
+}
+
+func (f *proxyFile) Patch(patches []webdav.Proppatch) ([]webdav.Propstat, error) {
+	patches, denied := filterProtected(patches)
+
+	stats := f.p.props.patch(f.name, patches)
+	if denied != nil {
+		stats = append(stats, *denied)
+	}
+
+	return stats, nil
+}
+
+// fileInfo - информация о файле, реализующая webdav.ETager
+// и webdav.ContentTyper, чтобы обработчик WebDAV не вычислял ETag
+// по времени изменения и не читал начало файла для определения типа
+type fileInfo struct {
+	os.FileInfo
+	p    *PikpakProxy
+	name string
+}
+
+// fileInfo добавляет ETag и тип содержимого к информации о файле name.
+// Директории возвращаются без изменений
+func (p *PikpakProxy) fileInfo(name string, info os.FileInfo) os.FileInfo {
+	if info.IsDir() {
+		return info
+	}
+	return fileInfo{FileInfo: info, p: p, name: name}
+}
+
+// remote проверяет, получена ли информация с удаленного сервера
+func (i fileInfo) remote() bool {
+	_, ok := i.FileInfo.(interface{ ETag() string })
+	return ok
+}
+
+// ETag возвращает ETag удаленного сервера для удаленных файлов и хеш
+// содержимого для локальных файлов, записанных или скачанных через прокси:
+// он вычисляется во время записи, и запросы не читают файл. Для файлов,
+// появившихся в кеше в обход прокси, обработчик WebDAV строит ETag из
+// размера и времени изменения. Хеш таких файлов не используется, даже
+// когда он вычислен позже, чтобы ETag не менялся без изменения файла
+func (i fileInfo) ETag(ctx context.Context) (string, error) {
+	if !i.remote() {
+		if sums, ok := i.p.checksums.written(i.name, i.FileInfo); ok {
+			return localETag(sums), nil
+		}
+		return "", webdav.ErrNotImplemented
+	}
+
+	if etag := fileETag(i.FileInfo); etag != "" {
+		return quoteETag(etag), nil
+	}
+
+	return "", webdav.ErrNotImplemented
+}
+
+// ContentType возвращает тип из конфигурации, затем свойство getcontenttype
+// удаленного сервера, затем тип по расширению. Тип удаленного файла
+// с неизвестным расширением не определяется по содержимому, чтобы
+// не загружать начало файла
+func (i fileInfo) ContentType(ctx context.Context) (string, error) {
+	if ctype, ok := i.p.mimeTypes.Override(i.name); ok {
+		return ctype, nil
+	}
+
+	if i.remote() {
+		if c, ok := i.FileInfo.(interface{ ContentType() string }); ok && c.ContentType() != "" {
+			return c.ContentType(), nil
+		}
+	}
+
+	if ctype := i.p.mimeTypes.TypeByName(i.name); ctype != "" {
+		return ctype, nil
+	}
+
+	if i.remote() {
+		return "application/octet-stream", nil
+	}
+
+	return "", webdav.ErrNotImplemented
+}
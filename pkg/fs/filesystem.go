@@ -2,13 +2,17 @@ package fs
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"path"
 	"path/filepath"
 	"strings"
+	"sync/atomic"
+	"time"
 
+	"github.com/ReanSn0w/pikpak-webdav-proxy/pkg/quota"
 	"github.com/ReanSn0w/pikpak-webdav-proxy/pkg/utils"
 	"github.com/go-pkgz/lgr"
 	"golang.org/x/net/webdav"
@@ -23,144 +27,500 @@ type Webdav interface {
 	Rename(oldName, newName string, overwrite bool) error
 }
 
+// MetaDir - служебная директория в корне локального слоя, в которой прокси
+// хранит свои данные. Она недоступна клиентам
+const MetaDir = ".webdav-proxy"
+
 type PikpakProxy struct {
 	log          lgr.L
 	localPath    string
 	remoteClient Webdav
+
+	conflictPolicy ConflictPolicy
+	conflicts      *conflictRegistry
+	baselines      *baselineStore
+	policies       []PolicyRule
+	filters        []FilterRule
+	props          *propStore
+	checksums      *checksumStore
+	mimeTypes      *MIMETypes
+	usage          *cacheUsage
+	quotaSource    quota.Source
+	cacheBudget    int64
+	highWatermark  float64
+	lowWatermark   float64
+	evicting       atomic.Bool
+
+	nameForm        NameForm
+	caseInsensitive bool
+	nameEncoding    NameEncoding
+	maxNameLength   int
+
+	streams   *utils.StreamPool
+	hardlinks bool
+	crypt     *localCrypt
 }
 
-func NewPikpakProxy(log lgr.L, localPath string, remoteClient Webdav) *PikpakProxy {
-	return &PikpakProxy{
-		log:          log,
-		localPath:    localPath,
-		remoteClient: remoteClient,
+func NewPikpakProxy(log lgr.L, localPath string, remoteClient Webdav, opts ...Option) *PikpakProxy {
+	p := &PikpakProxy{
+		log:            log,
+		localPath:      localPath,
+		remoteClient:   &missingClient{Webdav: remoteClient},
+		conflictPolicy: ConflictNone,
+		conflicts:      newConflictRegistry(),
+		mimeTypes:      NewMIMETypes(nil),
+		highWatermark:  defaultHighWatermark,
+		lowWatermark:   defaultLowWatermark,
+		nameForm:       NameFormNone,
+	}
+
+	p.props = newPropStore(log, p.MetaPath("props.json"))
+	p.checksums = newChecksumStore(log, p.MetaPath("checksums.json"))
+	p.baselines = newBaselineStore(log, p.MetaPath("baselines.json"))
+	p.usage = newCacheUsage(localPath)
+	p.usage.syncedCheck = p.syncedCheck
+
+	for _, opt := range opts {
+		opt(p)
+	}
+	p.checksums.crypt = p.crypt
+	if p.crypt != nil {
+		p.crypt.tmpDir = p.MetaPath("tmp")
+		p.crypt.usage = p.usage
+		p.crypt.log = log
+	}
+
+	if p.nameEncoding != EncodeNone || p.maxNameLength > 0 {
+		enc := newNameEncoder(log, p.nameEncoding, p.maxNameLength, p.MetaPath("names.json"))
+		p.remoteClient = &encodedClient{Webdav: p.remoteClient, enc: enc}
 	}
+	p.remoteClient = newMovedClient(log, p.remoteClient, p.MetaPath("moves.json"))
+
+	return p
 }
 
 func (p *PikpakProxy) LocalFilePath(name string) string {
 	name = strings.TrimPrefix(path.Clean(name), "/")
+	if p.matchNames() && !isMeta(name) {
+		name = p.localName(name)
+	}
 	return filepath.Join(p.localPath, name)
 }
 
+// MetaPath возвращает путь к файлу в служебной директории
+func (p *PikpakProxy) MetaPath(elem ...string) string {
+	return filepath.Join(append([]string{p.localPath, MetaDir}, elem...)...)
+}
+
+// tempFile создает пустой временный файл в директории dir и возвращает
+// его путь. Временные файлы хранятся в служебной директории, чтобы
+// незавершенные загрузки не попадали в листинги
+func tempFile(dir, prefix string) (string, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+
+	f, err := os.CreateTemp(dir, prefix+"-*")
+	if err != nil {
+		return "", err
+	}
+	return f.Name(), f.Close()
+}
+
+// isMeta проверяет, относится ли путь к служебной директории
+func isMeta(name string) bool {
+	name = strings.TrimPrefix(path.Clean("/"+name), "/")
+	return name == MetaDir || strings.HasPrefix(name, MetaDir+"/")
+}
+
 func (p *PikpakProxy) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	if err := p.CheckAccess(name, true); err != nil {
+		return err
+	}
+
+	if p.hidden(name) {
+		p.log.Logf("[DEBUG] Mkdir dropped by filter: %s", name)
+		return nil
+	}
+
 	localPath := p.LocalFilePath(name)
+	mode := p.writeMode(name)
 
 	localErr := os.MkdirAll(localPath, perm)
+	if !remoteWrites(mode) {
+		return localErr
+	}
+
 	remoteErr := p.remoteClient.MkdirAll(name, perm)
-	if localErr != nil && remoteErr != nil {
-		return fmt.Errorf("failed to create local and remote directories: %w", localErr)
+	if remoteErr != nil {
+		p.log.Logf("[WARN] remote mkdir of %s failed: %v", name, remoteErr)
+	}
+	if err := writeResult(mode, localErr, remoteErr); err != nil {
+		return fmt.Errorf("failed to create local and remote directories: %w", err)
 	}
 
 	return nil
 }
 
 func (p *PikpakProxy) RemoveAll(ctx context.Context, name string) error {
+	if err := p.CheckAccess(name, true); err != nil {
+		return err
+	}
+
+	if p.hidden(name) {
+		return nil
+	}
+
 	localPath := p.LocalFilePath(name)
+	mode := p.writeMode(name)
 
+	// Размер удаляемого файла учитывается сразу, директории пересчитываются
+	info, statErr := os.Lstat(localPath)
 	errLocal := os.RemoveAll(localPath)
-	errRemote := p.remoteClient.RemoveAll(name)
-	if errRemote != nil && errLocal != nil {
-		return fmt.Errorf("failed to remove local and remote files: %w", errLocal)
+	if remoteWrites(mode) {
+		errRemote := p.remoteClient.RemoveAll(name)
+		p.invalidateStreams(name)
+		if err := writeResult(mode, errLocal, errRemote); err != nil {
+			return fmt.Errorf("failed to remove local and remote files: %w", err)
+		}
+	} else if errLocal != nil {
+		return errLocal
+	}
+
+	p.conflicts.forget(name)
+	p.baselines.forget(name)
+	p.props.forget(name)
+	p.checksums.forget(name)
+	if statErr == nil && !info.IsDir() {
+		p.usage.add(-info.Size())
+	} else if statErr == nil {
+		p.usage.invalidate()
 	}
 
 	return nil
 }
 
 func (p *PikpakProxy) Rename(ctx context.Context, oldName, newName string) error {
+	if err := p.CheckAccess(oldName, true); err != nil {
+		return err
+	}
+	if err := p.CheckAccess(newName, true); err != nil {
+		return err
+	}
+	if p.hidden(oldName) || p.hidden(newName) {
+		return &os.PathError{Op: "rename", Path: newName, Err: os.ErrPermission}
+	}
+
 	oldPath := p.LocalFilePath(oldName)
 	newPath := p.LocalFilePath(newName)
 
-	localErr := os.Rename(oldPath, newPath)
-	remoteErr := p.remoteClient.Rename(oldName, newName, true)
-	if localErr != nil && remoteErr != nil {
-		return fmt.Errorf("failed to rename local and remote files: %w", localErr)
+	// Переименование на удаленном сервере выполняется, только если его
+	// разрешают правила обоих путей
+	mode := WriteDefault
+	switch oldMode, newMode := p.writeMode(oldName), p.writeMode(newName); {
+	case !remoteWrites(oldMode) || !remoteWrites(newMode):
+		mode = WriteLocalOnly
+	case oldMode == WriteThrough || newMode == WriteThrough:
+		mode = WriteThrough
+	}
+
+	// Локальный слой хранит только измененную часть директории: переносится
+	// она, а остальное содержимое перемещает удаленный сервер
+	localErr := p.renameLocal(oldPath, newPath)
+	if remoteWrites(mode) {
+		remoteErr := p.remoteClient.Rename(oldName, newName, true)
+		p.invalidateStreams(oldName)
+		p.invalidateStreams(newName)
+		if remoteErr != nil {
+			p.log.Logf("[WARN] remote rename of %s to %s failed: %v", oldName, newName, remoteErr)
+		}
+		if os.IsNotExist(localErr) && remoteErr == nil {
+			localErr = nil
+		}
+		if err := writeResult(mode, localErr, remoteErr); err != nil {
+			return fmt.Errorf("failed to rename local and remote files: %w", err)
+		}
+	} else if localErr != nil {
+		return localErr
+	}
+
+	p.conflicts.forget(oldName)
+	if remoteWrites(mode) {
+		p.baselines.move(oldName, newName)
+	} else {
+		// Удаленный файл остался на месте, и копия больше на нем не основана
+		p.baselines.forget(oldName)
+		p.baselines.forget(newName)
 	}
+	p.props.move(oldName, newName)
+	p.checksums.move(oldName, newName)
 
 	return nil
 }
 
+// Chtimes изменяет время изменения локальной копии файла name. Удаленный
+// сервер не позволяет задать время изменения, поэтому для файла без
+// локальной копии возвращается errors.ErrUnsupported
+func (p *PikpakProxy) Chtimes(ctx context.Context, name string, atime, mtime time.Time) error {
+	if err := p.CheckAccess(name, true); err != nil {
+		return err
+	}
+
+	if p.hidden(name) {
+		return nil
+	}
+
+	localPath := p.LocalFilePath(name)
+	if _, err := os.Lstat(localPath); os.IsNotExist(err) {
+		if _, err := p.stat(name); err != nil {
+			return err
+		}
+		return fmt.Errorf("chtimes %s: file has no local copy: %w", name, errors.ErrUnsupported)
+	}
+
+	return os.Chtimes(localPath, atime, mtime)
+}
+
+// renameLocal переносит локальный файл или директорию, создавая
+// родительскую директорию, которой может не быть в локальном слое
+func (p *PikpakProxy) renameLocal(oldPath, newPath string) error {
+	if _, err := os.Lstat(oldPath); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(newPath), 0755); err != nil {
+		return err
+	}
+
+	// Перезаписанный файл назначения освобождает место в кеше
+	replaced := diskSize(newPath)
+	if err := os.Rename(oldPath, newPath); err != nil {
+		return err
+	}
+	p.usage.add(-replaced)
+	return nil
+}
+
 func (p *PikpakProxy) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	info, err := p.stat(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return p.fileInfo(name, info), nil
+}
+
+func (p *PikpakProxy) stat(name string) (os.FileInfo, error) {
+	layers, remoteName := p.resolveLayers(name)
+	if layers == 0 {
+		return nil, notExist("stat", name)
+	}
+
 	localPath := p.LocalFilePath(name)
 
-	if info, err := os.Stat(localPath); err == nil && name != "/" {
-		p.log.Logf("[DEBUG] Stat (local): %s", name)
-		return info, nil
+	if layers&LayerLocal != 0 {
+		if info, err := p.crypt.stat(localPath); err == nil {
+			if info.IsDir() {
+				if layers == LayerBoth {
+					return p.statDir(name, info, remoteName), nil
+				}
+				return newDirInfo(name, info, nil), nil
+			}
+
+			if layers == LayerBoth {
+				if remote, ok := p.conflictingRemote(name, info); ok {
+					p.log.Logf("[DEBUG] Stat (remote, conflict): %s", name)
+					return remote, nil
+				}
+			}
+
+			p.log.Logf("[DEBUG] Stat (local): %s", name)
+			return info, nil
+		}
+	}
+
+	if layers&LayerRemote == 0 {
+		return nil, notExist("stat", name)
 	}
 
-	p.log.Logf("[DEBUG] Stat (remote): %s", name)
-	return p.remoteClient.Stat(name)
+	p.log.Logf("[DEBUG] Stat (remote): %s", remoteName)
+	info, err := p.statRemote(name, remoteName)
+	if err != nil {
+		return nil, err
+	}
+
+	if info.IsDir() {
+		return newDirInfo(name, nil, info), nil
+	}
+
+	return info, nil
 }
 
 func (p *PikpakProxy) Readdir(ctx context.Context, name string) ([]os.FileInfo, error) {
-	localPath := p.LocalFilePath(name)
+	entries, err := p.ReaddirLayers(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]os.FileInfo, 0, len(entries))
+	for _, e := range entries {
+		result = append(result, e.FileInfo)
+	}
 
-	p.log.Logf("[DEBUG] Readdir called for: %s (local: %s)", name, localPath)
+	return result, nil
+}
+
+// OpenFile открывает файл. Возвращаемый файл поддерживает ETag, тип
+// содержимого и "мертвые" свойства WebDAV независимо от того, в каком слое он находится
+func (p *PikpakProxy) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	// Место, занятое перезаписываемым файлом, освобождается
+	before := diskSize(p.LocalFilePath(name))
+	var replaced int64
+	if flag&os.O_TRUNC != 0 {
+		replaced = before
+	}
 
-	localFiles, err := os.ReadDir(localPath)
-	if err != nil && !os.IsNotExist(err) {
-		p.log.Logf("[ERROR] ReadDir local error: %v", err)
+	write := flag&(os.O_WRONLY|os.O_RDWR|os.O_APPEND|os.O_CREATE|os.O_TRUNC) != 0
+	if err := p.CheckAccess(name, write); err != nil {
 		return nil, err
 	}
 
-	var result []os.FileInfo
-	localNames := make(map[string]bool)
+	if write && p.hidden(name) {
+		p.log.Logf("[DEBUG] write dropped by filter: %s", name)
+		return &discardFile{name: name}, nil
+	}
+
+	// Новая локальная копия основана на текущей удаленной версии
+	if write {
+		if _, err := os.Lstat(p.LocalFilePath(name)); os.IsNotExist(err) {
+			p.recordBaseline(name)
+		}
+	}
 
-	for _, f := range localFiles {
-		info, err := f.Info()
-		if err != nil {
-			continue
+	// Копии, созданные жесткими ссылками, отделяются перед записью
+	if write && p.hardlinks {
+		if err := p.unshare(p.LocalFilePath(name), flag&os.O_TRUNC != 0); err != nil {
+			return nil, err
 		}
-		result = append(result, info)
-		localNames[f.Name()] = true
-		p.log.Logf("[DEBUG] Local file: %s", f.Name())
 	}
 
-	p.log.Logf("[DEBUG] Fetching remote files for: %s", name)
-	remoteFiles, err := p.remoteClient.ReadDir(name)
+	f, err := p.openFile(name, flag, perm, !write && isStreaming(ctx))
 	if err != nil {
-		p.log.Logf("[WARN] Failed to read remote dir: %v", err)
-	} else {
-		p.log.Logf("[DEBUG] Found %d remote files", len(remoteFiles))
-		for _, f := range remoteFiles {
-			if !localNames[f.Name()] {
-				result = append(result, f)
-				p.log.Logf("[DEBUG] Adding from remote: %s", f.Name())
-			}
+		return nil, err
+	}
+
+	if write {
+		if info, err := f.Stat(); err == nil && info.IsDir() {
+			write = false
 		}
 	}
 
-	p.log.Logf("[DEBUG] Readdir result: %d total files", len(result))
-	return result, nil
+	return &proxyFile{File: f, p: p, name: name, write: write, replaced: replaced, before: before, mode: p.writeMode(name), ctx: ctx}, nil
 }
 
-func (p *PikpakProxy) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+func (p *PikpakProxy) openFile(name string, flag int, perm os.FileMode, streaming bool) (webdav.File, error) {
 	localPath := p.LocalFilePath(name)
 
 	p.log.Logf("[DEBUG] OpenFile called for: %s (flag: %d)", name, flag)
 
+	layers, remoteName := p.resolveLayers(name)
+	if layers == 0 {
+		return nil, notExist("open", name)
+	}
+
+	// Если удаленная версия выигрывает конфликт, читаем ее
+	if flag == 0 && layers == LayerBoth {
+		if info, err := p.crypt.stat(localPath); err == nil {
+			if _, ok := p.conflictingRemote(name, info); ok {
+				p.log.Logf("[DEBUG] Opening remote file (conflict): %s", name)
+				return p.openRemote(remoteName, streaming)
+			}
+		}
+	}
+
 	// Пытаемся открыть локально
-	if f, err := os.OpenFile(localPath, flag, perm); err == nil {
-		// Проверяем, является ли файл директорией
-		if info, err := f.Stat(); err == nil && info.IsDir() {
-			f.Close()
-			p.log.Logf("[DEBUG] Opening directory as proxy: %s", name)
-			return &utils.DirectoryFile{
-				Name:     name,
-				Proxy:    p,
-				FileInfo: info,
-			}, nil
+	if layers&LayerLocal != 0 || flag != 0 {
+		f, err := p.crypt.open(localPath, flag, perm)
+		if errors.Is(err, ErrCorrupted) {
+			// Поврежденная локальная копия не подменяется удаленной
+			return nil, err
 		}
+		if err == nil {
+			// Проверяем, является ли файл директорией
+			if info, err := f.Stat(); err == nil && info.IsDir() {
+				f.Close()
 
-		p.log.Logf("[DEBUG] Opened local file: %s", name)
-		return f, nil
+				p.log.Logf("[DEBUG] Opening directory as proxy: %s", name)
+				return &utils.DirectoryFile{
+					Name:     name,
+					Proxy:    p,
+					FileInfo: newDirInfo(name, info, nil),
+				}, nil
+			}
+
+			p.log.Logf("[DEBUG] Opened local file: %s", name)
+			return f, nil
+		}
 	}
 
 	// Для удаленного файла
-	if flag&os.O_RDONLY != 0 || flag == 0 {
-		p.log.Logf("[DEBUG] Opening remote file: %s", name)
-		return utils.NewRemoteFile(p.remoteClient, name)
+	if (flag&os.O_RDONLY != 0 || flag == 0) && layers&LayerRemote != 0 {
+		p.log.Logf("[DEBUG] Opening remote file: %s", remoteName)
+		return p.openRemote(remoteName, streaming)
 	}
 
 	p.log.Logf("[ERROR] Cannot write to remote file: %s", name)
 	return nil, os.ErrNotExist
 }
+
+// openRemote открывает файл на удаленном сервере. Если имена слоев
+// сопоставляются, файл ищется с учетом нормализации и регистра
+func (p *PikpakProxy) openRemote(remoteName string, streaming bool) (webdav.File, error) {
+	key := p.streamKey(remoteName)
+	if p.matchNames() {
+		if found, _, err := p.lookupRemote(remoteName); err == nil {
+			remoteName = found
+		}
+	}
+
+	if streaming && p.streams != nil {
+		return utils.NewStreamingRemoteFile(p.remoteClient, remoteName, key, p.streams)
+	}
+
+	return utils.NewRemoteFile(p.remoteClient, remoteName)
+}
+
+// streamKey возвращает ключ потоков файла name в пуле. Имя, с которым
+// файл читается с сервера, может быть уточнено сопоставлением имен, а
+// запись и удаление вызывают invalidateStreams с именем клиента, поэтому
+// ключ строится по ключу сравнения имен
+func (p *PikpakProxy) streamKey(name string) string {
+	name = path.Clean("/" + name)
+	if p.matchNames() {
+		return p.nameKey(name)
+	}
+	return name
+}
+
+// invalidateStreams закрывает простаивающие потоки файла name и файлов
+// внутри него после изменения на удаленном сервере
+func (p *PikpakProxy) invalidateStreams(name string) {
+	p.streams.Invalidate(p.streamKey(name))
+}
+
+// writeResult объединяет результаты изменения в двух слоях. В режиме
+// write-through изменение должно пройти в обоих слоях, иначе достаточно
+// одного
+func writeResult(mode WriteMode, localErr, remoteErr error) error {
+	if mode == WriteThrough {
+		if localErr != nil {
+			return localErr
+		}
+		return remoteErr
+	}
+
+	if localErr != nil && remoteErr != nil {
+		return localErr
+	}
+
+	return nil
+}
@@ -545,3 +545,57 @@ func TestLocalFilePath(t *testing.T) {
 		})
 	}
 }
+
+func TestMetaDir_Hidden(t *testing.T) {
+	tmpDir := t.TempDir()
+	log := lgr.New()
+	mockClient := &MockWebdav{}
+
+	proxy := fs.NewPikpakProxy(log, tmpDir, mockClient)
+
+	assert.NoError(t, os.MkdirAll(proxy.MetaPath(), 0755))
+	assert.NoError(t, os.WriteFile(proxy.MetaPath("locks.json"), []byte("{}"), 0644))
+	assert.NoError(t, os.WriteFile(filepath.Join(tmpDir, "file.txt"), []byte("data"), 0644))
+
+	mockClient.On("ReadDir", "/").Return([]os.FileInfo{}, nil)
+
+	f, err := proxy.OpenFile(context.Background(), "/", os.O_RDONLY, 0)
+	assert.NoError(t, err)
+	infos, err := f.Readdir(0)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"file.txt"}, names(infos))
+	f.Close()
+
+	_, err = proxy.Stat(context.Background(), "/"+fs.MetaDir+"/locks.json")
+	assert.True(t, os.IsNotExist(err))
+
+	_, err = proxy.OpenFile(context.Background(), "/"+fs.MetaDir+"/locks.json", os.O_RDWR|os.O_TRUNC, 0644)
+	assert.Error(t, err)
+
+	assert.ErrorIs(t, proxy.RemoveAll(context.Background(), "/"+fs.MetaDir), os.ErrPermission)
+	assert.ErrorIs(t, proxy.Mkdir(context.Background(), "/"+fs.MetaDir+"/x", 0755), os.ErrPermission)
+
+	data, err := os.ReadFile(proxy.MetaPath("locks.json"))
+	assert.NoError(t, err)
+	assert.Equal(t, "{}", string(data))
+}
+
+func TestChtimes(t *testing.T) {
+	tmpDir := t.TempDir()
+	mockClient := &MockWebdav{}
+	mockClient.On("Stat", "/remote.txt").Return(newMockFileInfo("remote.txt", false), nil)
+
+	assert.NoError(t, os.WriteFile(filepath.Join(tmpDir, "local.txt"), []byte("data"), 0644))
+	proxy := fs.NewPikpakProxy(lgr.New(), tmpDir, mockClient)
+
+	mtime := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	assert.NoError(t, proxy.Chtimes(context.Background(), "/local.txt", mtime, mtime))
+
+	info, err := os.Stat(filepath.Join(tmpDir, "local.txt"))
+	assert.NoError(t, err)
+	assert.True(t, info.ModTime().Equal(mtime))
+
+	// Время изменения удаленного файла задать нельзя
+	err = proxy.Chtimes(context.Background(), "/remote.txt", mtime, mtime)
+	assert.ErrorIs(t, err, errors.ErrUnsupported)
+}
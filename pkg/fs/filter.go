@@ -0,0 +1,160 @@
+package fs
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// FilterMode - действие с файлами, попавшими под фильтр
+type FilterMode string
+
+const (
+	// FilterDrop - файлы скрываются из списков, запись в них молча
+	// отбрасывается
+	FilterDrop FilterMode = "drop"
+	// FilterLocalOnly - файлы хранятся только в локальном кеше,
+	// удаленные версии скрываются
+	FilterLocalOnly FilterMode = "local-only"
+	// FilterReject - файлы скрываются из списков, запись в них запрещена
+	FilterReject FilterMode = "reject"
+)
+
+// filterRegexpPrefix - префикс шаблона, заданного регулярным выражением
+const filterRegexpPrefix = "re:"
+
+// FilterRule - фильтр файлов по шаблону пути или регулярному выражению
+type FilterRule struct {
+	Pattern string
+	Mode    FilterMode
+
+	re *regexp.Regexp
+}
+
+// NewFilterRule создает фильтр. Шаблон с префиксом "re:" - регулярное
+// выражение, которое проверяется для полного пути файла, остальные
+// шаблоны обрабатываются так же, как в правилах записи
+func NewFilterRule(pattern string, mode FilterMode) (FilterRule, error) {
+	switch mode {
+	case FilterDrop, FilterLocalOnly, FilterReject:
+	default:
+		return FilterRule{}, fmt.Errorf("unknown filter mode: %s", mode)
+	}
+
+	var (
+		re  *regexp.Regexp
+		err error
+	)
+	if expr, ok := strings.CutPrefix(pattern, filterRegexpPrefix); ok {
+		re, err = regexp.Compile(expr)
+	} else {
+		re, err = compileGlob(pattern)
+	}
+	if err != nil {
+		return FilterRule{}, fmt.Errorf("invalid filter %s: %w", pattern, err)
+	}
+
+	return FilterRule{Pattern: pattern, Mode: mode, re: re}, nil
+}
+
+// ParseFilterRule разбирает фильтр в формате "шаблон:режим"
+func ParseFilterRule(s string) (FilterRule, error) {
+	i := strings.LastIndex(s, ":")
+	if i < 0 {
+		return FilterRule{}, fmt.Errorf("invalid filter %q, expected pattern:mode", s)
+	}
+
+	return NewFilterRule(strings.TrimSpace(s[:i]), FilterMode(strings.TrimSpace(s[i+1:])))
+}
+
+// JunkFilters возвращает встроенный набор фильтров для служебных файлов
+// Synology, macOS и Windows
+func JunkFilters() []FilterRule {
+	patterns := []string{"@eaDir", "._*", ".DS_Store", "Thumbs.db", "desktop.ini"}
+
+	rules := make([]FilterRule, 0, len(patterns))
+	for _, pattern := range patterns {
+		rule, err := NewFilterRule(pattern, FilterDrop)
+		if err != nil {
+			panic(err)
+		}
+		rules = append(rules, rule)
+	}
+
+	return rules
+}
+
+// filterMode возвращает действие для файла name, если он попадает
+// под один из фильтров
+func (p *PikpakProxy) filterMode(name string) (FilterMode, bool) {
+	for _, rule := range p.filters {
+		if matchPath(rule.re, name) {
+			return rule.Mode, true
+		}
+	}
+	return "", false
+}
+
+// hidden проверяет, скрыт ли файл name фильтром
+func (p *PikpakProxy) hidden(name string) bool {
+	mode, ok := p.filterMode(name)
+	return ok && mode != FilterLocalOnly
+}
+
+// localOnly проверяет, хранится ли файл name только в локальном кеше
+func (p *PikpakProxy) localOnly(name string) bool {
+	mode, ok := p.filterMode(name)
+	return ok && mode == FilterLocalOnly
+}
+
+// rejected проверяет, запрещена ли запись в файл name фильтром
+func (p *PikpakProxy) rejected(name string) bool {
+	mode, ok := p.filterMode(name)
+	return ok && mode == FilterReject
+}
+
+// discardFile принимает и отбрасывает запись в отфильтрованный файл
+type discardFile struct {
+	name string
+	size int64
+}
+
+func (f *discardFile) Read(p []byte) (int, error) {
+	return 0, io.EOF
+}
+
+func (f *discardFile) Write(p []byte) (int, error) {
+	f.size += int64(len(p))
+	return len(p), nil
+}
+
+func (f *discardFile) Seek(offset int64, whence int) (int64, error) {
+	return 0, nil
+}
+
+func (f *discardFile) Close() error {
+	return nil
+}
+
+func (f *discardFile) Readdir(count int) ([]os.FileInfo, error) {
+	return nil, os.ErrInvalid
+}
+
+func (f *discardFile) Stat() (os.FileInfo, error) {
+	return discardInfo{f}, nil
+}
+
+type discardInfo struct {
+	f *discardFile
+}
+
+func (i discardInfo) Name() string       { return path.Base(i.f.name) }
+func (i discardInfo) Size() int64        { return i.f.size }
+func (i discardInfo) Mode() os.FileMode  { return 0644 }
+func (i discardInfo) ModTime() time.Time { return time.Now() }
+func (i discardInfo) IsDir() bool        { return false }
+func (i discardInfo) Sys() any           { return nil }
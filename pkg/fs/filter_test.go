@@ -0,0 +1,130 @@
+package fs_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ReanSn0w/pikpak-webdav-proxy/pkg/fs"
+	lgr "github.com/go-pkgz/lgr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func filters(t *testing.T, specs ...string) fs.Option {
+	t.Helper()
+
+	var result []fs.FilterRule
+	for _, spec := range specs {
+		rule, err := fs.ParseFilterRule(spec)
+		require.NoError(t, err)
+		result = append(result, rule)
+	}
+
+	return fs.WithFilters(result...)
+}
+
+func TestParseFilterRule(t *testing.T) {
+	rule, err := fs.ParseFilterRule(`re:\.part$:reject`)
+	require.NoError(t, err)
+	assert.Equal(t, `re:\.part$`, rule.Pattern)
+	assert.Equal(t, fs.FilterReject, rule.Mode)
+
+	_, err = fs.ParseFilterRule("*.tmp:hide")
+	assert.Error(t, err)
+
+	_, err = fs.ParseFilterRule("re:[:drop")
+	assert.Error(t, err)
+}
+
+func TestFilter_JunkHiddenFromListing(t *testing.T) {
+	tmpDir := t.TempDir()
+	mockClient := &MockWebdav{}
+
+	for _, name := range []string{"photo.jpg", ".DS_Store", "._photo.jpg"} {
+		require.NoError(t, os.WriteFile(filepath.Join(tmpDir, name), []byte("x"), 0644))
+	}
+	require.NoError(t, os.MkdirAll(filepath.Join(tmpDir, "@eaDir", "photo.jpg"), 0755))
+
+	mockClient.On("ReadDir", "/").Return([]os.FileInfo{
+		newMockFileInfo("Thumbs.db", false),
+		newMockFileInfo("desktop.ini", false),
+		newMockFileInfo("video.mp4", false),
+	}, nil)
+
+	proxy := fs.NewPikpakProxy(lgr.New(), tmpDir, mockClient, fs.WithFilters(fs.JunkFilters()...))
+
+	infos, err := proxy.Readdir(context.Background(), "/")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"photo.jpg", "video.mp4"}, names(infos))
+
+	_, err = proxy.Stat(context.Background(), "/@eaDir/photo.jpg")
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestFilter_DropWrites(t *testing.T) {
+	tmpDir := t.TempDir()
+	mockClient := &MockWebdav{}
+	proxy := fs.NewPikpakProxy(lgr.New(), tmpDir, mockClient, fs.WithFilters(fs.JunkFilters()...))
+	ctx := context.Background()
+
+	f, err := proxy.OpenFile(ctx, "/dir/.DS_Store", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	require.NoError(t, err)
+	n, err := f.Write([]byte("junk"))
+	require.NoError(t, err)
+	assert.Equal(t, 4, n)
+	require.NoError(t, f.Close())
+
+	require.NoError(t, proxy.Mkdir(ctx, "/@eaDir", 0755))
+
+	assert.NoFileExists(t, filepath.Join(tmpDir, "dir", ".DS_Store"))
+	assert.NoDirExists(t, filepath.Join(tmpDir, "@eaDir"))
+	mockClient.AssertNotCalled(t, "MkdirAll", mock.Anything, mock.Anything)
+}
+
+func TestFilter_Reject(t *testing.T) {
+	tmpDir := t.TempDir()
+	proxy := fs.NewPikpakProxy(lgr.New(), tmpDir, &MockWebdav{}, filters(t, `re:\.part$:reject`))
+
+	_, err := proxy.OpenFile(context.Background(), "/movie.mkv.part", os.O_RDWR|os.O_CREATE, 0644)
+	assert.ErrorIs(t, err, os.ErrPermission)
+	assert.ErrorIs(t, proxy.CheckAccess("/movie.mkv.part", true), os.ErrPermission)
+	assert.NoError(t, proxy.CheckAccess("/movie.mkv", true))
+}
+
+func TestFilter_LocalOnly(t *testing.T) {
+	tmpDir := t.TempDir()
+	mockClient := &MockWebdav{}
+	require.NoError(t, os.WriteFile(filepath.Join(tmpDir, "local.tmp"), []byte("local"), 0644))
+
+	mockClient.On("ReadDir", "/").Return([]os.FileInfo{
+		newMockFileInfo("local.tmp", false),
+		newMockFileInfo("remote.tmp", false),
+		newMockFileInfo("file.txt", false),
+	}, nil)
+
+	proxy := fs.NewPikpakProxy(lgr.New(), tmpDir, mockClient, filters(t, "*.tmp:local-only"))
+	ctx := context.Background()
+
+	entries, err := proxy.ReaddirLayers(ctx, "/")
+	require.NoError(t, err)
+
+	layers := map[string]fs.Layer{}
+	for _, e := range entries {
+		layers[e.Name()] = e.Layer
+	}
+	assert.Equal(t, map[string]fs.Layer{"local.tmp": fs.LayerLocal, "file.txt": fs.LayerRemote}, layers)
+
+	// Удаленная версия не запрашивается
+	_, err = proxy.Stat(ctx, "/remote.tmp")
+	assert.True(t, os.IsNotExist(err))
+
+	// Изменения не попадают на удаленный сервер
+	require.NoError(t, proxy.Mkdir(ctx, "/cache.tmp", 0755))
+	require.NoError(t, proxy.RemoveAll(ctx, "/local.tmp"))
+	mockClient.AssertNotCalled(t, "Stat", mock.Anything)
+	mockClient.AssertNotCalled(t, "MkdirAll", mock.Anything, mock.Anything)
+	mockClient.AssertNotCalled(t, "RemoveAll", mock.Anything)
+}
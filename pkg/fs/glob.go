@@ -0,0 +1,54 @@
+package fs
+
+import (
+	"path"
+	"regexp"
+	"strings"
+)
+
+// compileGlob преобразует шаблон пути в регулярное выражение.
+//
+// "*" соответствует любой части имени, "?" - одному символу имени,
+// "**" - любому количеству директорий. Шаблон без ведущего "/"
+// применяется на любой глубине. Шаблон соответствует также всем файлам
+// внутри подходящей директории
+func compileGlob(pattern string) (*regexp.Regexp, error) {
+	pattern = strings.TrimSuffix(pattern, "/")
+	if !strings.HasPrefix(pattern, "/") {
+		pattern = "/**/" + pattern
+	}
+
+	var b strings.Builder
+	b.WriteString("^")
+
+	skip := 0
+	for i, c := range pattern {
+		if skip > 0 {
+			skip--
+			continue
+		}
+
+		switch {
+		case strings.HasPrefix(pattern[i:], "/**/"):
+			b.WriteString("(/.*)?/")
+			skip = 3
+		case strings.HasPrefix(pattern[i:], "**"):
+			b.WriteString(".*")
+			skip = 1
+		case c == '*':
+			b.WriteString("[^/]*")
+		case c == '?':
+			b.WriteString("[^/]")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+
+	b.WriteString("(/.*)?$")
+	return regexp.Compile(b.String())
+}
+
+// matchPath проверяет, соответствует ли путь name выражению re
+func matchPath(re *regexp.Regexp, name string) bool {
+	return re.MatchString(path.Clean("/" + name))
+}
@@ -0,0 +1,274 @@
+package fs
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+// Layer - слой файловой системы, в котором находится файл
+type Layer int
+
+const (
+	LayerLocal Layer = 1 << iota
+	LayerRemote
+
+	LayerBoth = LayerLocal | LayerRemote
+)
+
+func (l Layer) String() string {
+	switch l {
+	case LayerLocal:
+		return "local"
+	case LayerRemote:
+		return "remote"
+	case LayerBoth:
+		return "both"
+	default:
+		return "unknown"
+	}
+}
+
+// MarshalText представляет слой строкой, как в String
+func (l Layer) MarshalText() ([]byte, error) {
+	return []byte(l.String()), nil
+}
+
+// UnmarshalText разбирает слой из строки
+func (l *Layer) UnmarshalText(text []byte) error {
+	switch string(text) {
+	case "local":
+		*l = LayerLocal
+	case "remote":
+		*l = LayerRemote
+	case "both":
+		*l = LayerBoth
+	default:
+		return fmt.Errorf("unknown layer %q", text)
+	}
+	return nil
+}
+
+// Entry - элемент объединенного списка директории с указанием слоя
+type Entry struct {
+	os.FileInfo
+	Layer Layer
+}
+
+// ReaddirLayers возвращает объединенный, отсортированный по имени список
+// файлов директории с пометкой, в каком из слоев найден каждый элемент
+func (p *PikpakProxy) ReaddirLayers(ctx context.Context, name string) ([]Entry, error) {
+	it, err := p.openDir(name)
+	if err != nil {
+		return nil, err
+	}
+
+	result, _ := it.NextEntries(0)
+
+	p.log.Logf("[DEBUG] Readdir result: %d total files", len(result))
+	return result, nil
+}
+
+// Evict удаляет локальную копию файла, если она совпадает с удаленной
+// версией. В директории удаляются только такие файлы, а измененные
+// и существующие только локально файлы остаются
+func (p *PikpakProxy) Evict(ctx context.Context, name string) error {
+	name = path.Clean("/" + name)
+	if name == "/" || isMeta(name) {
+		return &os.PathError{Op: "evict", Path: name, Err: os.ErrPermission}
+	}
+
+	localPath := p.LocalFilePath(name)
+	info, err := p.crypt.stat(localPath)
+	if err != nil {
+		return err
+	}
+
+	if !info.IsDir() {
+		if !p.isClean(name, info) {
+			return fmt.Errorf("refusing to evict %s: the file is modified or exists only locally", name)
+		}
+		if err := p.evict(name, info); err != nil {
+			return err
+		}
+		p.markEvicted([]string{name})
+		return nil
+	}
+
+	kept := 0
+	var evicted []string
+	clean := p.cleanChecker()
+	defer func() { p.markEvicted(evicted) }()
+
+	for _, f := range p.localFiles(name) {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if !clean.check(f.name, f.info) {
+			kept++
+			continue
+		}
+		if err := p.evict(f.name, f.info); err != nil {
+			return err
+		}
+		evicted = append(evicted, f.name)
+	}
+
+	evicted = p.removeEmptyDirs(name, evicted)
+
+	if kept > 0 {
+		return fmt.Errorf("kept %d modified or local-only files in %s", kept, name)
+	}
+	return nil
+}
+
+// evict удаляет локальную копию чистого файла
+func (p *PikpakProxy) evict(name string, info os.FileInfo) error {
+	p.log.Logf("[INFO] Evict: %s (%d bytes)", name, info.Size())
+	p.conflicts.forget(name)
+	p.baselines.forget(name)
+	p.checksums.forget(name)
+	_, err := p.removeCached(name)
+	return err
+}
+
+// removeEmptyDirs удаляет пустые локальные директории внутри name и саму
+// name и добавляет их в removed. Директории, которых нет на удаленном
+// сервере, остаются
+func (p *PikpakProxy) removeEmptyDirs(name string, removed []string) []string {
+	localPath := p.LocalFilePath(name)
+	entries, err := os.ReadDir(localPath)
+	if err != nil {
+		return removed
+	}
+	for _, e := range entries {
+		if e.IsDir() {
+			removed = p.removeEmptyDirs(path.Join(name, e.Name()), removed)
+		}
+	}
+
+	if info, err := p.remoteClient.Stat(name); err == nil && info.IsDir() {
+		if os.Remove(localPath) == nil {
+			removed = append(removed, name)
+		}
+	}
+	return removed
+}
+
+// Fetch скачивает файл с удаленного сервера в локальный слой. Служебные
+// файлы и локальные копии с изменениями, которых нет на удаленном сервере,
+// не перезаписываются
+func (p *PikpakProxy) Fetch(ctx context.Context, name string) error {
+	name = path.Clean("/" + name)
+	if name == "/" || isMeta(name) {
+		return &os.PathError{Op: "fetch", Path: name, Err: os.ErrPermission}
+	}
+
+	// Скачивание изменяет локальный слой так же, как запись
+	if err := p.CheckAccess(name, true); err != nil {
+		return err
+	}
+
+	info, err := p.remoteClient.Stat(name)
+	if err != nil {
+		return err
+	}
+
+	if local, err := p.crypt.stat(p.LocalFilePath(name)); err == nil {
+		if local.IsDir() || local.Size() != info.Size() || !sameModTime(local.ModTime(), info.ModTime()) {
+			return fmt.Errorf("refusing to fetch %s: the local copy is modified or exists only locally", name)
+		}
+	}
+
+	return p.fetch(ctx, name, info)
+}
+
+// fetch скачивает удаленный файл name поверх локальной копии, если для него
+// есть место в бюджете кеша
+func (p *PikpakProxy) fetch(ctx context.Context, name string, info os.FileInfo) error {
+	if info.IsDir() {
+		return errors.New("fetch of directories is not supported")
+	}
+
+	// Пока новая версия скачивается во временный файл, текущая остается
+	// на диске, поэтому ее место не считается свободным
+	if err := p.reserve(name, p.crypt.storedSize(info.Size()), 0); err != nil {
+		return err
+	}
+	defer p.checkWatermark()
+
+	if err := p.download(name, name, info); err != nil {
+		return err
+	}
+
+	p.baselines.set(name, info)
+	p.usage.markSynced(diskSize(p.LocalFilePath(name)))
+	p.log.Logf("[INFO] Fetch: %s (%d bytes)", name, info.Size())
+	return nil
+}
+
+// download скачивает удаленный файл remoteName одним запросом в локальную
+// копию файла name с временем изменения удаленной версии. Контрольные суммы
+// вычисляются во время скачивания, чтобы не читать файл повторно
+func (p *PikpakProxy) download(remoteName, name string, info os.FileInfo) error {
+	localPath := p.LocalFilePath(name)
+	if err := os.MkdirAll(filepath.Dir(localPath), 0755); err != nil {
+		return err
+	}
+
+	reader, err := p.remoteClient.ReadStreamRange(remoteName, 0, info.Size())
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	defer p.usage.hold(p.crypt.storedSize(info.Size()))()
+
+	tmpPath, err := tempFile(p.MetaPath("tmp"), "fetch")
+	if err != nil {
+		return err
+	}
+
+	f, err := p.crypt.create(tmpPath)
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	sha, md := sha256.New(), md5.New()
+	_, err = io.Copy(io.MultiWriter(f, sha, md), reader)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	if err := os.Chtimes(tmpPath, info.ModTime(), info.ModTime()); err != nil {
+		p.log.Logf("[WARN] failed to set mtime for %s: %v", remoteName, err)
+	}
+
+	size, before := diskSize(tmpPath), diskSize(localPath)
+	if err := os.Rename(tmpPath, localPath); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	p.usage.add(size - before)
+
+	if local, err := p.crypt.stat(localPath); err == nil {
+		p.checksums.set(name, Checksums{
+			SHA256: hex.EncodeToString(sha.Sum(nil)),
+			MD5:    hex.EncodeToString(md.Sum(nil)),
+		}, local, true)
+	}
+	return nil
+}
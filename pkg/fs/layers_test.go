@@ -0,0 +1,240 @@
+package fs_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ReanSn0w/pikpak-webdav-proxy/pkg/fs"
+	lgr "github.com/go-pkgz/lgr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+var testTime = time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+func TestLayer_String(t *testing.T) {
+	assert.Equal(t, "local", fs.LayerLocal.String())
+	assert.Equal(t, "remote", fs.LayerRemote.String())
+	assert.Equal(t, "both", fs.LayerBoth.String())
+}
+
+func TestReaddirLayers(t *testing.T) {
+	tmpDir := t.TempDir()
+	mockClient := &MockWebdav{}
+
+	os.WriteFile(filepath.Join(tmpDir, "local.txt"), []byte("test"), 0644)
+	os.WriteFile(filepath.Join(tmpDir, "shared.txt"), []byte("test"), 0644)
+
+	mockClient.On("ReadDir", "/").Return([]os.FileInfo{
+		newMockFileInfo("shared.txt", false),
+		newMockFileInfo("remote.txt", false),
+	}, nil)
+
+	proxy := fs.NewPikpakProxy(lgr.New(), tmpDir, mockClient)
+
+	entries, err := proxy.ReaddirLayers(context.Background(), "/")
+	require.NoError(t, err)
+
+	layers := make(map[string]fs.Layer)
+	for _, e := range entries {
+		layers[e.Name()] = e.Layer
+	}
+
+	assert.Equal(t, map[string]fs.Layer{
+		"local.txt":  fs.LayerLocal,
+		"shared.txt": fs.LayerBoth,
+		"remote.txt": fs.LayerRemote,
+	}, layers)
+}
+
+func TestEvict_Clean(t *testing.T) {
+	proxy, localDir, remoteDir, _ := setupCopy(t)
+
+	writeLocalFile(t, remoteDir, "file.txt", "test", testTime)
+	writeLocalFile(t, localDir, "file.txt", "test", testTime)
+
+	require.NoError(t, proxy.Evict(context.Background(), "/file.txt"))
+	assert.NoFileExists(t, filepath.Join(localDir, "file.txt"))
+}
+
+func TestEvict_Modified(t *testing.T) {
+	proxy, localDir, remoteDir, _ := setupCopy(t)
+
+	writeLocalFile(t, remoteDir, "file.txt", "test", testTime)
+	writeLocalFile(t, localDir, "file.txt", "changed", testTime)
+
+	assert.Error(t, proxy.Evict(context.Background(), "/file.txt"))
+	assert.FileExists(t, filepath.Join(localDir, "file.txt"))
+}
+
+func TestEvict_Directory(t *testing.T) {
+	proxy, localDir, remoteDir, _ := setupCopy(t)
+
+	for _, dir := range []string{localDir, remoteDir} {
+		require.NoError(t, os.MkdirAll(filepath.Join(dir, "dir", "sub"), 0755))
+		writeLocalFile(t, dir, "dir/sub/clean.txt", "clean", testTime)
+		writeLocalFile(t, dir, "dir/modified.txt", "remote", testTime)
+	}
+	writeLocalFile(t, localDir, "dir/modified.txt", "local changes", testTime)
+	writeLocalFile(t, localDir, "dir/local.txt", "local", testTime)
+
+	// Измененные и локальные файлы остаются
+	assert.Error(t, proxy.Evict(context.Background(), "/dir"))
+	assert.NoDirExists(t, filepath.Join(localDir, "dir", "sub"))
+	assert.FileExists(t, filepath.Join(localDir, "dir", "modified.txt"))
+	assert.FileExists(t, filepath.Join(localDir, "dir", "local.txt"))
+}
+
+func TestEvict_Refused(t *testing.T) {
+	proxy, localDir, _, _ := setupCopy(t)
+
+	writeLocalFile(t, localDir, "file.txt", "test", testTime)
+	require.NoError(t, os.MkdirAll(filepath.Join(localDir, fs.MetaDir), 0755))
+	writeLocalFile(t, localDir, fs.MetaDir+"/locks.json", "{}", testTime)
+
+	for _, name := range []string{"/", "", "/" + fs.MetaDir, "/" + fs.MetaDir + "/locks.json"} {
+		err := proxy.Evict(context.Background(), name)
+		assert.True(t, os.IsPermission(err), name)
+	}
+	assert.FileExists(t, filepath.Join(localDir, "file.txt"))
+	assert.FileExists(t, filepath.Join(localDir, fs.MetaDir, "locks.json"))
+}
+
+func TestEvict_LocalOnly(t *testing.T) {
+	tmpDir := t.TempDir()
+	mockClient := &MockWebdav{}
+
+	localFile := filepath.Join(tmpDir, "file.txt")
+	os.WriteFile(localFile, []byte("test"), 0644)
+
+	mockClient.On("Stat", "/file.txt").Return(nil, os.ErrNotExist)
+
+	proxy := fs.NewPikpakProxy(lgr.New(), tmpDir, mockClient)
+
+	err := proxy.Evict(context.Background(), "/file.txt")
+	assert.Error(t, err)
+	assert.FileExists(t, localFile)
+}
+
+func TestFetch(t *testing.T) {
+	tmpDir := t.TempDir()
+	mockClient := &MockWebdav{}
+
+	info := &MockFileInfo{}
+	info.On("IsDir").Return(false)
+	info.On("Size").Return(int64(7))
+	info.On("ModTime").Return(testTime)
+
+	mockClient.On("Stat", "/dir/file.txt").Return(info, nil)
+	mockClient.On("ReadStreamRange", "/dir/file.txt", int64(0), int64(7)).
+		Return(io.NopCloser(strings.NewReader("content")), nil)
+
+	proxy := fs.NewPikpakProxy(lgr.New(), tmpDir, mockClient)
+
+	err := proxy.Fetch(context.Background(), "/dir/file.txt")
+	require.NoError(t, err)
+
+	data, err := os.ReadFile(filepath.Join(tmpDir, "dir", "file.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, "content", string(data))
+
+	stat, err := os.Stat(filepath.Join(tmpDir, "dir", "file.txt"))
+	require.NoError(t, err)
+	assert.True(t, stat.ModTime().Equal(testTime))
+}
+
+func TestFetch_TempFileHidden(t *testing.T) {
+	tmpDir := t.TempDir()
+	mockClient := &MockWebdav{}
+
+	info := &MockFileInfo{}
+	info.On("IsDir").Return(false)
+	info.On("Size").Return(int64(7))
+	info.On("ModTime").Return(testTime)
+
+	pr, pw := io.Pipe()
+	mockClient.On("Stat", "/dir/file.txt").Return(info, nil)
+	mockClient.On("ReadStreamRange", "/dir/file.txt", int64(0), int64(7)).Return(pr, nil)
+
+	proxy := fs.NewPikpakProxy(lgr.New(), tmpDir, mockClient)
+
+	fetched := make(chan error, 1)
+	go func() { fetched <- proxy.Fetch(context.Background(), "/dir/file.txt") }()
+
+	_, err := pw.Write([]byte("cont"))
+	require.NoError(t, err)
+
+	// Незавершенная загрузка хранится в служебной директории
+	entries, err := os.ReadDir(proxy.MetaPath("tmp"))
+	require.NoError(t, err)
+	assert.Len(t, entries, 1)
+
+	entries, err = os.ReadDir(filepath.Join(tmpDir, "dir"))
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+
+	_, err = pw.Write([]byte("ent"))
+	require.NoError(t, err)
+	require.NoError(t, pw.Close())
+	require.NoError(t, <-fetched)
+
+	assert.Equal(t, "content", readFile(t, tmpDir, "dir/file.txt"))
+	entries, err = os.ReadDir(proxy.MetaPath("tmp"))
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+}
+
+func TestFetch_Refused(t *testing.T) {
+	tmpDir := t.TempDir()
+	mockClient := &MockWebdav{}
+
+	mockClient.On("Stat", "/file.txt").Return(newSizedFileInfo("file.txt", 7, testTime), nil)
+	writeLocalFile(t, tmpDir, "file.txt", "edit", testTime.Add(time.Hour))
+
+	proxy := fs.NewPikpakProxy(lgr.New(), tmpDir, mockClient)
+	ctx := context.Background()
+
+	// Служебные файлы не скачиваются
+	assert.ErrorIs(t, proxy.Fetch(ctx, "/"+fs.MetaDir+"/props.json"), os.ErrPermission)
+
+	// Локальные изменения не перезаписываются
+	assert.Error(t, proxy.Fetch(ctx, "/file.txt"))
+
+	data, err := os.ReadFile(filepath.Join(tmpDir, "file.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, "edit", string(data))
+	mockClient.AssertNotCalled(t, "ReadStreamRange", mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestFetch_Budget(t *testing.T) {
+	tmpDir := t.TempDir()
+	mockClient := &MockWebdav{}
+
+	mockClient.On("Stat", "/big.bin").Return(newSizedFileInfo("big.bin", 100, testTime), nil)
+
+	proxy := fs.NewPikpakProxy(lgr.New(), tmpDir, mockClient, fs.WithCacheBudget(50))
+
+	assert.ErrorIs(t, proxy.Fetch(context.Background(), "/big.bin"), fs.ErrInsufficientStorage)
+	assert.NoFileExists(t, filepath.Join(tmpDir, "big.bin"))
+	mockClient.AssertNotCalled(t, "ReadStreamRange", mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestFetch_RemoteError(t *testing.T) {
+	tmpDir := t.TempDir()
+	mockClient := &MockWebdav{}
+
+	mockClient.On("Stat", "/file.txt").Return(nil, errors.New("remote error"))
+
+	proxy := fs.NewPikpakProxy(lgr.New(), tmpDir, mockClient)
+
+	err := proxy.Fetch(context.Background(), "/file.txt")
+	assert.Error(t, err)
+	assert.NoFileExists(t, filepath.Join(tmpDir, "file.txt"))
+}
@@ -0,0 +1,18 @@
+//go:build !unix
+
+package fs
+
+import (
+	"errors"
+	"os"
+)
+
+// hardlink не используется там, где нельзя узнать число ссылок на файл:
+// без этого прокси не может разделить ссылки перед записью
+func hardlink(srcPath, dstPath string) error {
+	return errors.ErrUnsupported
+}
+
+func linkCount(info os.FileInfo) uint64 {
+	return 1
+}
@@ -0,0 +1,21 @@
+//go:build unix
+
+package fs
+
+import (
+	"os"
+	"syscall"
+)
+
+// hardlink создает жесткую ссылку dstPath на srcPath
+func hardlink(srcPath, dstPath string) error {
+	return os.Link(srcPath, dstPath)
+}
+
+// linkCount возвращает число жестких ссылок на файл
+func linkCount(info os.FileInfo) uint64 {
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		return uint64(st.Nlink)
+	}
+	return 1
+}
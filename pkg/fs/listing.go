@@ -0,0 +1,367 @@
+package fs
+
+import (
+	"context"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"syscall"
+
+	"github.com/ReanSn0w/pikpak-webdav-proxy/pkg/utils"
+)
+
+// dirIterator - объединение содержимого директории из обоих слоев,
+// выдаваемое постранично.
+//
+// Элементы возвращаются отсортированными по имени и без повторов.
+// Локальный слой читается как список имен, информация о файлах запрашивается
+// только для текущей страницы. Удаленный сервер не поддерживает постраничное
+// чтение, поэтому его список загружается целиком и сортируется один раз.
+// Память при этом не ограничена размером страницы, тем более что обработчик
+// WebDAV при PROPFIND запрашивает все страницы сразу через Readdir(0).
+// Удаленная версия конфликтующего файла при политике keep-both занимает
+// в списке место по своему имени.
+type dirIterator struct {
+	p    *PikpakProxy
+	name string
+
+	local  []os.DirEntry
+	remote []os.FileInfo
+	li, ri int
+
+	// remoteListed - список удаленного слоя прочитан, и отсутствие
+	// в нем файла означает, что файла нет на удаленном сервере
+	remoteListed bool
+
+	// aliases - файлы обоих слоев с одинаковыми именами, отсортированные
+	// по имени удаленной версии при конфликте
+	aliases []aliasCandidate
+}
+
+// aliasCandidate - файл, удаленная версия которого при конфликте
+// отображается под именем alias
+type aliasCandidate struct {
+	key    string
+	local  os.DirEntry
+	remote os.FileInfo
+}
+
+// OpenDir открывает директорию для постраничного чтения
+func (p *PikpakProxy) OpenDir(ctx context.Context, name string) (utils.DirectoryIterator, error) {
+	return p.openDir(name)
+}
+
+func (p *PikpakProxy) openDir(name string) (*dirIterator, error) {
+	if err := p.CheckAccess(name, false); err != nil {
+		return nil, err
+	}
+
+	localPath := p.LocalFilePath(name)
+
+	p.log.Logf("[DEBUG] Readdir called for: %s (local: %s)", name, localPath)
+
+	layers, remoteName := p.resolveLayers(name)
+	if layers == 0 {
+		return nil, notExist("readdir", name)
+	}
+
+	// На месте директории в локальном слое может находиться файл
+	if info, err := os.Stat(localPath); err == nil && !info.IsDir() && layers&LayerLocal != 0 {
+		remote, ok := p.conflictingRemote(name, info)
+		if !ok || layers != LayerBoth || !remote.IsDir() {
+			return nil, &os.PathError{Op: "readdir", Path: name, Err: syscall.ENOTDIR}
+		}
+		layers = LayerRemote
+	}
+
+	it := &dirIterator{p: p, name: name}
+
+	if layers&LayerLocal != 0 {
+		// os.ReadDir возвращает элементы, отсортированные по имени
+		localFiles, err := os.ReadDir(localPath)
+		if err != nil && !os.IsNotExist(err) {
+			p.log.Logf("[ERROR] ReadDir local error: %v", err)
+			return nil, err
+		}
+		if p.matchNames() {
+			sortByKey(p, localFiles)
+		}
+		it.local = localFiles
+	}
+
+	if layers&LayerRemote != 0 {
+		p.log.Logf("[DEBUG] Fetching remote files for: %s", remoteName)
+		remoteFiles, err := p.remoteClient.ReadDir(remoteName)
+		if err != nil && p.matchNames() {
+			// Имя директории на удаленном сервере может отличаться
+			// формой нормализации или регистром
+			if found, info, statErr := p.lookupRemote(remoteName); statErr == nil && info.IsDir() {
+				remoteFiles, err = p.remoteClient.ReadDir(found)
+			}
+		}
+		if err != nil {
+			p.log.Logf("[WARN] Failed to read remote dir: %v", err)
+		} else {
+			p.log.Logf("[DEBUG] Found %d remote files", len(remoteFiles))
+			sortByKey(p, remoteFiles)
+			it.remote = remoteFiles
+			it.remoteListed = true
+		}
+	}
+
+	if p.conflictPolicy == ConflictKeepBoth {
+		it.aliases = it.aliasCandidates()
+	}
+
+	return it, nil
+}
+
+// aliasCandidates находит файлы, которые есть в обоих слоях. Информация
+// о локальных файлах запрашивается, только когда список доходит до имени
+// удаленной версии
+func (it *dirIterator) aliasCandidates() []aliasCandidate {
+	var candidates []aliasCandidate
+
+	for li, ri := 0, 0; li < len(it.local) && ri < len(it.remote); {
+		switch lk, rk := it.key(it.local[li]), it.key(it.remote[ri]); {
+		case lk < rk:
+			li++
+		case lk > rk:
+			ri++
+		default:
+			candidates = append(candidates, aliasCandidate{
+				key:    it.p.nameKey(conflictName(it.remote[ri].Name())),
+				local:  it.local[li],
+				remote: it.remote[ri],
+			})
+			li++
+			ri++
+		}
+	}
+
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].key < candidates[j].key })
+	return candidates
+}
+
+// Next возвращает следующие count файлов директории. При count <= 0
+// возвращаются все оставшиеся файлы. Вместе с последней страницей
+// возвращается io.EOF
+func (it *dirIterator) Next(count int) ([]os.FileInfo, error) {
+	entries, err := it.NextEntries(count)
+
+	result := make([]os.FileInfo, 0, len(entries))
+	for _, e := range entries {
+		result = append(result, e.FileInfo)
+	}
+
+	return result, err
+}
+
+// NextEntries работает как Next, но сохраняет информацию о слоях
+func (it *dirIterator) NextEntries(count int) ([]Entry, error) {
+	var result []Entry
+
+	for count <= 0 || len(result) < count {
+		entry, ok := it.next()
+		if !ok {
+			if count <= 0 {
+				return result, nil
+			}
+			return result, io.EOF
+		}
+		result = append(result, entry)
+	}
+
+	if it.done() {
+		return result, io.EOF
+	}
+
+	return result, nil
+}
+
+func (it *dirIterator) done() bool {
+	return len(it.aliases) == 0 && it.li >= len(it.local) && it.ri >= len(it.remote)
+}
+
+// next возвращает следующий элемент объединенного списка
+func (it *dirIterator) next() (Entry, bool) {
+	for {
+		if len(it.aliases) > 0 && it.aliasNext() {
+			candidate := it.aliases[0]
+			it.aliases = it.aliases[1:]
+			if alias, ok := it.alias(candidate); ok {
+				return alias, true
+			}
+			continue
+		}
+
+		if it.li >= len(it.local) && it.ri >= len(it.remote) {
+			return Entry{}, false
+		}
+
+		var local, remote os.FileInfo
+
+		switch {
+		case it.ri >= len(it.remote):
+			local = it.localInfo()
+		case it.li >= len(it.local):
+			remote = it.remote[it.ri]
+			it.ri++
+		case it.key(it.local[it.li]) < it.key(it.remote[it.ri]):
+			local = it.localInfo()
+		case it.key(it.local[it.li]) > it.key(it.remote[it.ri]):
+			remote = it.remote[it.ri]
+			it.ri++
+		default:
+			local = it.localInfo()
+			remote = it.remote[it.ri]
+			it.ri++
+		}
+
+		if local == nil && remote == nil {
+			// Локальный файл был удален во время чтения или скрыт
+			continue
+		}
+
+		entryName := path.Join(it.name, entryBase(local, remote))
+		if it.p.hidden(entryName) || it.p.denied(entryName) {
+			continue
+		}
+		if it.p.localOnly(entryName) {
+			// Удаленная версия файла, хранящегося только локально, скрыта
+			remote = nil
+			if local == nil {
+				continue
+			}
+		}
+
+		if remote == nil && it.remoteListed && !local.IsDir() && it.p.conflictPolicy != ConflictNone {
+			// Локальному файлу не с чем конфликтовать до следующей записи
+			it.p.conflicts.clear(entryName, local)
+		}
+
+		// Удаленная версия конфликтующего файла возвращается в свою очередь
+		return it.p.mergeEntry(it.name, local, remote)[0], true
+	}
+}
+
+// aliasNext проверяет, идет ли имя первого кандидата в список раньше
+// следующих файлов обоих слоев
+func (it *dirIterator) aliasNext() bool {
+	key := it.aliases[0].key
+	if it.li < len(it.local) && it.key(it.local[it.li]) < key {
+		return false
+	}
+	return it.ri >= len(it.remote) || it.key(it.remote[it.ri]) >= key
+}
+
+// alias возвращает удаленную версию файла candidate, если она конфликтует
+// с локальной и ее имя не занято настоящим файлом
+func (it *dirIterator) alias(candidate aliasCandidate) (Entry, bool) {
+	entryName := path.Join(it.name, candidate.local.Name())
+	if it.p.hidden(entryName) || it.p.denied(entryName) || it.p.localOnly(entryName) {
+		return Entry{}, false
+	}
+
+	local := it.info(candidate.local)
+	if local == nil {
+		return Entry{}, false
+	}
+
+	entries := it.p.mergeEntry(it.name, local, candidate.remote)
+	if len(entries) < 2 || it.exists(entries[1].Name()) || it.p.denied(path.Join(it.name, entries[1].Name())) {
+		return Entry{}, false
+	}
+	return entries[1], true
+}
+
+func (it *dirIterator) localInfo() os.FileInfo {
+	f := it.local[it.li]
+	it.li++
+	return it.info(f)
+}
+
+// info возвращает информацию о локальном файле f
+func (it *dirIterator) info(f os.DirEntry) os.FileInfo {
+	if it.name == "/" && f.Name() == MetaDir {
+		return nil
+	}
+
+	info, err := f.Info()
+	if err != nil {
+		return nil
+	}
+	info = it.p.crypt.info(filepath.Join(it.p.LocalFilePath(it.name), f.Name()), info)
+
+	it.p.log.Logf("[DEBUG] Local file: %s", f.Name())
+	return info
+}
+
+func entryBase(local, remote os.FileInfo) string {
+	if local != nil {
+		return local.Name()
+	}
+	return remote.Name()
+}
+
+// key возвращает ключ сравнения имени элемента директории
+func (it *dirIterator) key(f interface{ Name() string }) string {
+	return it.p.nameKey(f.Name())
+}
+
+// exists проверяет, есть ли в одном из слоев настоящий файл с именем name
+func (it *dirIterator) exists(name string) bool {
+	key := it.p.nameKey(name)
+
+	i := sort.Search(len(it.local), func(i int) bool { return it.key(it.local[i]) >= key })
+	if i < len(it.local) && it.key(it.local[i]) == key {
+		return true
+	}
+
+	j := sort.Search(len(it.remote), func(j int) bool { return it.key(it.remote[j]) >= key })
+	return j < len(it.remote) && it.key(it.remote[j]) == key
+}
+
+// mergeEntry объединяет версии элемента директории dir из обоих слоев.
+// Первым возвращается элемент, видимый под исходным именем, за ним
+// может следовать удаленная версия конфликтующего файла
+func (p *PikpakProxy) mergeEntry(dir string, local, remote os.FileInfo) []Entry {
+	switch {
+	case remote == nil:
+		return []Entry{{FileInfo: local, Layer: LayerLocal}}
+	case local == nil:
+		p.log.Logf("[DEBUG] Adding from remote: %s", remote.Name())
+		return []Entry{{FileInfo: remote, Layer: LayerRemote}}
+	}
+
+	if local.IsDir() && remote.IsDir() {
+		return []Entry{{FileInfo: newDirInfo(local.Name(), local, remote), Layer: LayerBoth}}
+	}
+
+	typeMismatch := local.IsDir() != remote.IsDir()
+
+	entry := Entry{FileInfo: local, Layer: LayerBoth}
+	if typeMismatch {
+		entry.Layer = LayerLocal
+	}
+
+	if p.conflictPolicy == ConflictNone || !p.detectConflict(path.Join(dir, remote.Name()), local, remote) {
+		return []Entry{entry}
+	}
+
+	switch {
+	case p.conflictPolicy == ConflictKeepBoth:
+		alias := renamedInfo{FileInfo: remote, name: conflictName(remote.Name())}
+		p.log.Logf("[DEBUG] Adding conflicting remote version: %s", alias.Name())
+		return []Entry{entry, {FileInfo: alias, Layer: LayerRemote}}
+	case p.resolveConflict(local, remote) == LayerRemote:
+		entry.FileInfo = remote
+		if typeMismatch {
+			entry.Layer = LayerRemote
+		}
+	}
+
+	return []Entry{entry}
+}
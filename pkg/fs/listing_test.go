@@ -0,0 +1,129 @@
+package fs_test
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ReanSn0w/pikpak-webdav-proxy/pkg/fs"
+	lgr "github.com/go-pkgz/lgr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func names(infos []os.FileInfo) []string {
+	result := make([]string, 0, len(infos))
+	for _, info := range infos {
+		result = append(result, info.Name())
+	}
+	return result
+}
+
+func TestReaddir_SortedAndDeduplicated(t *testing.T) {
+	tmpDir := t.TempDir()
+	mockClient := &MockWebdav{}
+
+	for _, name := range []string{"d.txt", "b.txt", "f.txt"} {
+		os.WriteFile(filepath.Join(tmpDir, name), []byte("test"), 0644)
+	}
+
+	mockClient.On("ReadDir", "/").Return([]os.FileInfo{
+		newMockFileInfo("e.txt", false),
+		newMockFileInfo("b.txt", false),
+		newMockFileInfo("a.txt", false),
+	}, nil)
+
+	proxy := fs.NewPikpakProxy(lgr.New(), tmpDir, mockClient)
+
+	files, err := proxy.Readdir(context.Background(), "/")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a.txt", "b.txt", "d.txt", "e.txt", "f.txt"}, names(files))
+
+	again, err := proxy.Readdir(context.Background(), "/")
+	require.NoError(t, err)
+	assert.Equal(t, names(files), names(again))
+}
+
+func TestOpenDir_Pages(t *testing.T) {
+	tmpDir := t.TempDir()
+	mockClient := &MockWebdav{}
+
+	for _, name := range []string{"a.txt", "c.txt"} {
+		os.WriteFile(filepath.Join(tmpDir, name), []byte("test"), 0644)
+	}
+
+	mockClient.On("ReadDir", "/").Return([]os.FileInfo{
+		newMockFileInfo("d.txt", false),
+		newMockFileInfo("b.txt", false),
+		newMockFileInfo("e.txt", false),
+	}, nil)
+
+	proxy := fs.NewPikpakProxy(lgr.New(), tmpDir, mockClient)
+
+	it, err := proxy.OpenDir(context.Background(), "/")
+	require.NoError(t, err)
+
+	page, err := it.Next(2)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a.txt", "b.txt"}, names(page))
+
+	page, err = it.Next(2)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"c.txt", "d.txt"}, names(page))
+
+	page, err = it.Next(2)
+	assert.Equal(t, io.EOF, err)
+	assert.Equal(t, []string{"e.txt"}, names(page))
+
+	page, err = it.Next(2)
+	assert.Equal(t, io.EOF, err)
+	assert.Empty(t, page)
+
+	mockClient.AssertNumberOfCalls(t, "ReadDir", 1)
+}
+
+func TestOpenDir_KeepBothAliasSorted(t *testing.T) {
+	tmpDir := t.TempDir()
+	mockClient := &MockWebdav{}
+
+	writeLocalFile(t, tmpDir, "file.txt", "test", testTime)
+
+	mockClient.On("ReadDir", "/").Return([]os.FileInfo{
+		newSizedFileInfo("file.txt", 10, testTime.Add(time.Hour)),
+		newMockFileInfo("file b.txt", false),
+		newMockFileInfo("z.txt", false),
+	}, nil)
+
+	proxy := fs.NewPikpakProxy(lgr.New(), tmpDir, mockClient, fs.WithConflictPolicy(fs.ConflictKeepBoth))
+
+	// Удаленная версия занимает место по своему имени, в том числе
+	// при чтении по одному элементу
+	it, err := proxy.OpenDir(context.Background(), "/")
+	require.NoError(t, err)
+
+	var listed []string
+	for {
+		files, err := it.Next(1)
+		listed = append(listed, names(files)...)
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+	}
+	assert.Equal(t, []string{"file (conflict).txt", "file b.txt", "file.txt", "z.txt"}, listed)
+}
+
+func TestOpenDir_NotDirectory(t *testing.T) {
+	tmpDir := t.TempDir()
+	mockClient := &MockWebdav{}
+
+	os.WriteFile(filepath.Join(tmpDir, "file.txt"), []byte("test"), 0644)
+
+	proxy := fs.NewPikpakProxy(lgr.New(), tmpDir, mockClient)
+
+	_, err := proxy.OpenDir(context.Background(), "/file.txt")
+	assert.Error(t, err)
+}
@@ -0,0 +1,330 @@
+package fs
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	iofs "io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/studio-b12/gowebdav"
+)
+
+// CacheEntry - элемент объединенного дерева файлов с указанием слоя
+type CacheEntry struct {
+	Path    string    `json:"path"`
+	IsDir   bool      `json:"is_dir"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+	Layer   Layer     `json:"layer"`
+}
+
+// CacheState - состояние файла локального кеша относительно удаленного сервера
+type CacheState string
+
+const (
+	// CacheClean - файл совпадает с удаленной версией и может быть вытеснен
+	CacheClean CacheState = "clean"
+	// CacheModified - файл отличается от удаленной версии
+	CacheModified CacheState = "modified"
+	// CacheLocalOnly - файла нет на удаленном сервере
+	CacheLocalOnly CacheState = "local-only"
+)
+
+// CacheFile - файл локального кеша. Reason указывает, чем файл отличается
+// от удаленной версии: size, mtime, type, sha256 или md5
+type CacheFile struct {
+	Path    string     `json:"path"`
+	Size    int64      `json:"size"`
+	ModTime time.Time  `json:"mod_time"`
+	State   CacheState `json:"state"`
+	Reason  string     `json:"reason,omitempty"`
+	SHA256  string     `json:"sha256,omitempty"`
+	MD5     string     `json:"md5,omitempty"`
+}
+
+// GCOptions - условия вытеснения файлов из кеша. Вытесняются чистые файлы,
+// измененные раньше OlderThan назад, и самые старые чистые файлы, пока
+// размер кеша превышает MaxSize. Нулевые значения отключают условие
+type GCOptions struct {
+	OlderThan time.Duration
+	MaxSize   int64
+	DryRun    bool
+}
+
+// GCResult - результат вытеснения. Freed и Size - освобожденное место
+// и размер кеша после вытеснения на диске, как в бюджете кеша
+type GCResult struct {
+	Evicted []CacheFile `json:"evicted"`
+	Freed   int64       `json:"freed"`
+	Size    int64       `json:"size"`
+}
+
+// localFile - файл локального слоя
+type localFile struct {
+	name string
+	info os.FileInfo
+}
+
+// localFiles возвращает файлы локального слоя внутри root, кроме служебной
+// директории
+func (p *PikpakProxy) localFiles(root string) []localFile {
+	var files []localFile
+	filepath.WalkDir(p.LocalFilePath(root), func(localPath string, d iofs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+
+		rel, err := filepath.Rel(p.localPath, localPath)
+		if err != nil {
+			return nil
+		}
+		name := path.Clean("/" + filepath.ToSlash(rel))
+
+		if d.IsDir() {
+			if isMeta(name) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if info, err := d.Info(); err == nil {
+			files = append(files, localFile{name: name, info: p.crypt.info(localPath, info)})
+		}
+		return nil
+	})
+
+	return files
+}
+
+// ListCache возвращает содержимое директории root объединенного дерева
+// с указанием слоя каждого элемента, а с recursive - и вложенных директорий
+func (p *PikpakProxy) ListCache(ctx context.Context, root string, recursive bool) ([]CacheEntry, error) {
+	root = path.Clean("/" + root)
+
+	info, err := p.stat(root)
+	if err != nil {
+		return nil, err
+	}
+
+	if !info.IsDir() {
+		layers, _ := p.resolveLayers(root)
+		return []CacheEntry{{Path: root, Size: info.Size(), ModTime: info.ModTime(), Layer: layers}}, nil
+	}
+
+	entries, err := p.ReaddirLayers(ctx, root)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []CacheEntry
+	for _, e := range entries {
+		name := path.Join(root, e.Name())
+		result = append(result, CacheEntry{
+			Path:    name,
+			IsDir:   e.IsDir(),
+			Size:    e.Size(),
+			ModTime: e.ModTime(),
+			Layer:   e.Layer,
+		})
+
+		if recursive && e.IsDir() {
+			children, err := p.ListCache(ctx, name, true)
+			if err != nil {
+				return nil, err
+			}
+			result = append(result, children...)
+		}
+	}
+
+	return result, nil
+}
+
+// CacheFiles сравнивает файлы локального кеша внутри root с удаленными
+// версиями по размеру и времени изменения. С verify для файлов одинакового
+// размера сравнивается и содержимое: контрольные суммы запрашиваются у
+// удаленного сервера, а если он их не предоставляет - файл загружается
+func (p *PikpakProxy) CacheFiles(ctx context.Context, root string, verify bool) ([]CacheFile, error) {
+	var result []CacheFile
+	for _, f := range p.localFiles(root) {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		file := CacheFile{Path: f.name, Size: f.info.Size(), ModTime: f.info.ModTime(), State: CacheModified}
+
+		remote, err := p.remoteClient.Stat(f.name)
+		switch {
+		case remoteMissing(err):
+			file.State = CacheLocalOnly
+		case err != nil:
+			return nil, err
+		case remote.IsDir():
+			file.Reason = "type"
+		case remote.Size() != f.info.Size():
+			file.Reason = "size"
+		case !sameModTime(remote.ModTime(), f.info.ModTime()):
+			file.Reason = "mtime"
+		case verify:
+			reason, err := p.compareContent(f.name, f.info)
+			if err != nil {
+				return nil, err
+			}
+			file.Reason = reason
+			if reason == "" {
+				file.State = CacheClean
+			}
+		default:
+			file.State = CacheClean
+		}
+
+		result = append(result, file)
+	}
+
+	return result, nil
+}
+
+// compareContent сравнивает содержимое локального файла с удаленным
+// и возвращает название несовпавшей контрольной суммы
+func (p *PikpakProxy) compareContent(name string, local os.FileInfo) (string, error) {
+	localSums, err := p.checksums.get(name, p.LocalFilePath(name), local)
+	if err != nil {
+		return "", err
+	}
+
+	var remoteSums Checksums
+	if c, ok := p.remoteClient.(RemoteChecksummer); ok {
+		remoteSums, _ = c.Checksums(name)
+	}
+
+	if remoteSums.SHA256 == "" && remoteSums.MD5 == "" {
+		p.log.Logf("[DEBUG] downloading %s to verify its checksum", name)
+		reader, err := p.remoteClient.ReadStreamRange(name, 0, local.Size())
+		if err != nil {
+			return "", err
+		}
+		defer reader.Close()
+
+		h := sha256.New()
+		if _, err := io.Copy(h, reader); err != nil {
+			return "", err
+		}
+		remoteSums.SHA256 = hex.EncodeToString(h.Sum(nil))
+	}
+
+	switch {
+	case remoteSums.SHA256 != "" && !strings.EqualFold(remoteSums.SHA256, localSums.SHA256):
+		return "sha256", nil
+	case remoteSums.SHA256 == "" && !strings.EqualFold(remoteSums.MD5, localSums.MD5):
+		return "md5", nil
+	}
+
+	return "", nil
+}
+
+// LocalOnlyFiles возвращает файлы кеша внутри root, которых нет на
+// удаленном сервере, вместе с их контрольными суммами
+func (p *PikpakProxy) LocalOnlyFiles(ctx context.Context, root string) ([]CacheFile, error) {
+	files, err := p.CacheFiles(ctx, root, false)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []CacheFile
+	for _, f := range files {
+		if f.State != CacheLocalOnly {
+			continue
+		}
+
+		localPath := p.LocalFilePath(f.Path)
+		if info, err := p.crypt.stat(localPath); err == nil {
+			if sums, err := p.checksums.get(f.Path, localPath, info); err == nil {
+				f.SHA256, f.MD5 = sums.SHA256, sums.MD5
+			}
+		}
+
+		result = append(result, f)
+	}
+
+	return result, nil
+}
+
+// CollectGarbage вытесняет из кеша чистые файлы по условиям opts, начиная
+// с самых старых. Файлы, которых нет на удаленном сервере или которые
+// отличаются от удаленной версии, не удаляются
+func (p *PikpakProxy) CollectGarbage(ctx context.Context, opts GCOptions) (GCResult, error) {
+	files := p.localFiles("/")
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].info.ModTime().Before(files[j].info.ModTime())
+	})
+
+	var result GCResult
+	for _, f := range files {
+		result.Size += storedSize(f.info)
+	}
+
+	deadline := time.Now().Add(-opts.OlderThan)
+	clean := p.cleanChecker()
+	for _, f := range files {
+		if err := ctx.Err(); err != nil {
+			return result, err
+		}
+
+		expired := opts.OlderThan > 0 && f.info.ModTime().Before(deadline)
+		oversized := opts.MaxSize > 0 && result.Size > opts.MaxSize
+		if !expired && !oversized {
+			break
+		}
+
+		if !clean.check(f.name, f.info) {
+			continue
+		}
+
+		if !opts.DryRun {
+			if _, err := p.removeCached(f.name); err != nil {
+				p.log.Logf("[WARN] failed to evict %s: %v", f.name, err)
+				continue
+			}
+			p.conflicts.forget(f.name)
+			p.checksums.forget(f.name)
+		}
+
+		result.Evicted = append(result.Evicted, CacheFile{
+			Path:    f.name,
+			Size:    f.info.Size(),
+			ModTime: f.info.ModTime(),
+			State:   CacheClean,
+		})
+		result.Freed += storedSize(f.info)
+		result.Size -= storedSize(f.info)
+	}
+
+	if !opts.DryRun {
+		evicted := make([]string, 0, len(result.Evicted))
+		for _, f := range result.Evicted {
+			evicted = append(evicted, f.Path)
+		}
+		p.markEvicted(evicted)
+		p.log.Logf("[INFO] garbage collection evicted %d files, %d bytes", len(result.Evicted), result.Freed)
+	}
+
+	return result, nil
+}
+
+// remoteMissing проверяет, означает ли ошибка удаленного сервера,
+// что файла на нем нет
+func remoteMissing(err error) bool {
+	return err != nil && (errors.Is(err, os.ErrNotExist) || gowebdav.IsErrNotFound(err))
+}
+
+func sameModTime(a, b time.Time) bool {
+	delta := a.Sub(b)
+	return delta <= modTimeTolerance && delta >= -modTimeTolerance
+}
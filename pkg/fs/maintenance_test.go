@@ -0,0 +1,202 @@
+package fs_test
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ReanSn0w/pikpak-webdav-proxy/pkg/fs"
+	lgr "github.com/go-pkgz/lgr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+// setupMaintenance создает кеш с файлами во всех состояниях относительно
+// удаленного сервера
+func setupMaintenance(t *testing.T) (*fs.PikpakProxy, string, *MockWebdav) {
+	tmpDir := t.TempDir()
+	mockClient := &MockWebdav{}
+
+	writeLocalFile(t, tmpDir, "clean.bin", strings.Repeat("c", 40), testTime)
+	writeLocalFile(t, tmpDir, "size.bin", strings.Repeat("s", 10), testTime)
+	writeLocalFile(t, tmpDir, "mtime.bin", strings.Repeat("m", 10), testTime)
+	writeLocalFile(t, tmpDir, "content.bin", strings.Repeat("x", 10), testTime)
+	writeLocalFile(t, tmpDir, "local.bin", "data", testTime)
+
+	mockClient.On("Stat", "/clean.bin").Return(newSizedFileInfo("clean.bin", 40, testTime), nil)
+	mockClient.On("Stat", "/size.bin").Return(newSizedFileInfo("size.bin", 20, testTime), nil)
+	mockClient.On("Stat", "/mtime.bin").Return(newSizedFileInfo("mtime.bin", 10, testTime.Add(time.Hour)), nil)
+	mockClient.On("Stat", "/content.bin").Return(newSizedFileInfo("content.bin", 10, testTime), nil)
+	mockClient.On("Stat", mock.Anything).Return(nil, os.ErrNotExist)
+	mockClient.On("ReadDir", "/").Return([]os.FileInfo{
+		newSizedFileInfo("clean.bin", 40, testTime),
+		newSizedFileInfo("size.bin", 20, testTime),
+		newSizedFileInfo("mtime.bin", 10, testTime.Add(time.Hour)),
+		newSizedFileInfo("content.bin", 10, testTime),
+	}, nil)
+
+	return fs.NewPikpakProxy(lgr.New(), tmpDir, mockClient), tmpDir, mockClient
+}
+
+func states(files []fs.CacheFile) map[string]string {
+	result := make(map[string]string)
+	for _, f := range files {
+		result[f.Path] = string(f.State)
+		if f.Reason != "" {
+			result[f.Path] += ":" + f.Reason
+		}
+	}
+	return result
+}
+
+func TestCacheFiles(t *testing.T) {
+	proxy, _, mockClient := setupMaintenance(t)
+
+	files, err := proxy.CacheFiles(context.Background(), "/", false)
+	require.NoError(t, err)
+
+	assert.Equal(t, map[string]string{
+		"/clean.bin":   "clean",
+		"/content.bin": "clean",
+		"/local.bin":   "local-only",
+		"/mtime.bin":   "modified:mtime",
+		"/size.bin":    "modified:size",
+	}, states(files))
+	mockClient.AssertNotCalled(t, "ReadStreamRange", mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestCacheFiles_Verify(t *testing.T) {
+	proxy, _, mockClient := setupMaintenance(t)
+	mockClient.On("ReadStreamRange", "/clean.bin", int64(0), int64(40)).
+		Return(io.NopCloser(strings.NewReader(strings.Repeat("c", 40))), nil)
+	mockClient.On("ReadStreamRange", "/content.bin", int64(0), int64(10)).
+		Return(io.NopCloser(strings.NewReader(strings.Repeat("y", 10))), nil)
+
+	files, err := proxy.CacheFiles(context.Background(), "/", true)
+	require.NoError(t, err)
+
+	result := states(files)
+	assert.Equal(t, "clean", result["/clean.bin"])
+	assert.Equal(t, "modified:sha256", result["/content.bin"])
+}
+
+func TestCacheFiles_VerifyRemoteChecksums(t *testing.T) {
+	tmpDir := t.TempDir()
+	mockClient := &MockWebdav{}
+	writeLocalFile(t, tmpDir, "file.txt", "data", testTime)
+	mockClient.On("Stat", "/file.txt").Return(newSizedFileInfo("file.txt", 4, testTime), nil)
+
+	// Контрольная сумма сервера сравнивается без загрузки файла
+	client := checksumWebdav{MockWebdav: mockClient, sums: fs.Checksums{MD5: "00000000000000000000000000000000"}}
+	proxy := fs.NewPikpakProxy(lgr.New(), tmpDir, client)
+
+	files, err := proxy.CacheFiles(context.Background(), "/", true)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"/file.txt": "modified:md5"}, states(files))
+
+	client.sums = fs.Checksums{MD5: dataMD5}
+	proxy = fs.NewPikpakProxy(lgr.New(), tmpDir, client)
+	files, err = proxy.CacheFiles(context.Background(), "/", true)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"/file.txt": "clean"}, states(files))
+	mockClient.AssertNotCalled(t, "ReadStreamRange", mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestLocalOnlyFiles(t *testing.T) {
+	proxy, _, _ := setupMaintenance(t)
+
+	files, err := proxy.LocalOnlyFiles(context.Background(), "/")
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+	assert.Equal(t, "/local.bin", files[0].Path)
+	assert.Equal(t, int64(4), files[0].Size)
+	assert.Equal(t, dataSHA256, files[0].SHA256)
+	assert.Equal(t, dataMD5, files[0].MD5)
+}
+
+func TestCollectGarbage(t *testing.T) {
+	proxy, tmpDir, _ := setupMaintenance(t)
+	writeLocalFile(t, tmpDir, "new.bin", "new", time.Now())
+
+	result, err := proxy.CollectGarbage(context.Background(), fs.GCOptions{OlderThan: time.Hour, DryRun: true})
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"/clean.bin", "/content.bin"}, evictedPaths(result))
+	assert.FileExists(t, filepath.Join(tmpDir, "clean.bin"))
+
+	result, err = proxy.CollectGarbage(context.Background(), fs.GCOptions{OlderThan: time.Hour})
+	require.NoError(t, err)
+	assert.Equal(t, int64(50), result.Freed)
+	assert.Equal(t, int64(10+10+4+3), result.Size)
+	assert.NoFileExists(t, filepath.Join(tmpDir, "clean.bin"))
+	assert.NoFileExists(t, filepath.Join(tmpDir, "content.bin"))
+
+	// Измененные и локальные файлы не вытесняются
+	for _, name := range []string{"size.bin", "mtime.bin", "local.bin", "new.bin"} {
+		assert.FileExists(t, filepath.Join(tmpDir, name))
+	}
+}
+
+func TestCollectGarbage_MaxSize(t *testing.T) {
+	proxy, tmpDir, _ := setupMaintenance(t)
+
+	result, err := proxy.CollectGarbage(context.Background(), fs.GCOptions{MaxSize: 1000})
+	require.NoError(t, err)
+	assert.Empty(t, result.Evicted)
+
+	// Вытеснения чистых файлов недостаточно, остальные остаются
+	result, err = proxy.CollectGarbage(context.Background(), fs.GCOptions{MaxSize: 10})
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"/clean.bin", "/content.bin"}, evictedPaths(result))
+	assert.Equal(t, int64(24), result.Size)
+	assert.FileExists(t, filepath.Join(tmpDir, "local.bin"))
+}
+
+func evictedPaths(result fs.GCResult) []string {
+	var paths []string
+	for _, f := range result.Evicted {
+		paths = append(paths, f.Path)
+	}
+	return paths
+}
+
+func TestListCache(t *testing.T) {
+	tmpDir := t.TempDir()
+	mockClient := &MockWebdav{}
+
+	require.NoError(t, os.Mkdir(filepath.Join(tmpDir, "dir"), 0755))
+	writeLocalFile(t, tmpDir, "dir/local.txt", "test", testTime)
+
+	mockClient.On("Stat", "/").Return(newMockFileInfo("", true), nil)
+	mockClient.On("Stat", "/dir").Return(nil, os.ErrNotExist)
+	mockClient.On("ReadDir", "/").Return([]os.FileInfo{newMockFileInfo("remote.txt", false)}, nil)
+	mockClient.On("ReadDir", "/dir").Return(nil, os.ErrNotExist)
+
+	proxy := fs.NewPikpakProxy(lgr.New(), tmpDir, mockClient)
+
+	entries, err := proxy.ListCache(context.Background(), "/", true)
+	require.NoError(t, err)
+
+	layers := make(map[string]fs.Layer)
+	for _, e := range entries {
+		layers[e.Path] = e.Layer
+	}
+	assert.Equal(t, map[string]fs.Layer{
+		"/dir":           fs.LayerLocal,
+		"/dir/local.txt": fs.LayerLocal,
+		"/remote.txt":    fs.LayerRemote,
+	}, layers)
+
+	data, err := json.Marshal(entries[0])
+	require.NoError(t, err)
+	assert.Contains(t, string(data), `"layer":"local"`)
+
+	var decoded fs.CacheEntry
+	require.NoError(t, json.Unmarshal(data, &decoded))
+	assert.Equal(t, entries[0].Layer, decoded.Layer)
+}
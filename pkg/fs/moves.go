@@ -0,0 +1,392 @@
+package fs
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"sync"
+
+	"github.com/ReanSn0w/pikpak-webdav-proxy/pkg/utils"
+	"github.com/go-pkgz/lgr"
+	"github.com/studio-b12/gowebdav"
+)
+
+// moveTable хранит виртуальные перемещения директорий, которые отказался
+// выполнить удаленный сервер: ключ - путь, под которым директория видна
+// клиентам, значение - ее настоящий путь на удаленном сервере
+type moveTable struct {
+	log  lgr.L
+	path string
+
+	mu    sync.Mutex
+	moves map[string]string
+}
+
+func newMoveTable(log lgr.L, path string) *moveTable {
+	t := &moveTable{log: log, path: path, moves: make(map[string]string)}
+
+	data, err := os.ReadFile(path)
+	switch {
+	case os.IsNotExist(err):
+		return t
+	case err != nil:
+		log.Logf("[WARN] failed to read virtual moves: %v", err)
+		return t
+	}
+
+	if err := json.Unmarshal(data, &t.moves); err != nil {
+		log.Logf("[WARN] failed to decode virtual moves: %v", err)
+	}
+
+	return t
+}
+
+// resolve возвращает путь name на удаленном сервере. Пути внутри
+// директорий, перемещенных с этого места, не существуют
+func (t *moveTable) resolve(name string) (string, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.resolveLocked(path.Clean("/" + name))
+}
+
+func (t *moveTable) resolveLocked(name string) (string, bool) {
+	if len(t.moves) == 0 {
+		return name, true
+	}
+
+	// Путь переводится по самому длинному подходящему перемещению
+	key, remote := "", name
+	for k, v := range t.moves {
+		if rel, ok := within(k, name); ok && len(k) > len(key) {
+			key, remote = k, path.Join(v, rel)
+		}
+	}
+
+	// Настоящий путь должен принадлежать тому же перемещению: иначе
+	// он был перемещен в другое место и здесь его больше нет
+	owner, longest := "", ""
+	for k, v := range t.moves {
+		if _, ok := within(v, remote); ok && len(v) > len(longest) {
+			owner, longest = k, v
+		}
+	}
+
+	return remote, owner == key
+}
+
+// children возвращает перемещения, видимые как элементы директории dir
+func (t *moveTable) children(dir string) map[string]string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	dir = path.Clean("/" + dir)
+	result := make(map[string]string)
+	for k, v := range t.moves {
+		if path.Dir(k) == dir {
+			result[path.Base(k)] = v
+		}
+	}
+	return result
+}
+
+// renamed обновляет перемещения после переименования oldName в newName
+// на удаленном сервере: oldRemote и newRemote - их настоящие пути
+func (t *moveTable) renamed(oldName, newName, oldRemote, newRemote string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if len(t.moves) == 0 {
+		return
+	}
+
+	moves := make(map[string]string, len(t.moves))
+	for k, v := range t.moves {
+		if rel, ok := within(oldRemote, v); ok {
+			v = path.Join(newRemote, rel)
+		}
+		if rel, ok := within(oldName, k); ok {
+			k = path.Join(newName, rel)
+		}
+		if k != v {
+			moves[k] = v
+		}
+	}
+
+	t.moves = moves
+	t.save()
+}
+
+// record запоминает виртуальное перемещение oldName, находящейся на
+// удаленном сервере по пути oldRemote, в newName
+func (t *moveTable) record(oldName, newName, oldRemote string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	moves := make(map[string]string, len(t.moves)+1)
+	for k, v := range t.moves {
+		if rel, ok := within(oldName, k); ok {
+			k = path.Join(newName, rel)
+		}
+		moves[k] = v
+	}
+	moves[newName] = oldRemote
+
+	for k, v := range moves {
+		if k == v {
+			delete(moves, k)
+		}
+	}
+
+	t.moves = moves
+	t.save()
+}
+
+// forget удаляет перемещения внутри name после его удаления
+func (t *moveTable) forget(name string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	changed := false
+	for k := range t.moves {
+		if _, ok := within(name, k); ok {
+			delete(t.moves, k)
+			changed = true
+		}
+	}
+
+	if changed {
+		t.save()
+	}
+}
+
+// save записывает перемещения в файл
+func (t *moveTable) save() {
+	if err := utils.WriteJSONAtomic(t.path, t.moves); err != nil {
+		t.log.Logf("[ERROR] failed to save virtual moves: %v", err)
+	}
+}
+
+// movedClient - клиент удаленного сервера, показывающий директории,
+// перемещение которых отклонил сервер, по их новым путям. Если сервер
+// отказывается переместить директорию, перемещение запоминается вместо
+// копирования ее содержимого
+type movedClient struct {
+	Webdav
+	log   lgr.L
+	moves *moveTable
+}
+
+func newMovedClient(log lgr.L, client Webdav, path string) *movedClient {
+	return &movedClient{Webdav: client, log: log, moves: newMoveTable(log, path)}
+}
+
+func (c *movedClient) resolve(op, name string) (string, error) {
+	remote, ok := c.moves.resolve(name)
+	if !ok {
+		return "", notExist(op, name)
+	}
+	return remote, nil
+}
+
+func (c *movedClient) Stat(name string) (os.FileInfo, error) {
+	remote, err := c.resolve("stat", name)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := c.Webdav.Stat(remote)
+	if err != nil {
+		return nil, err
+	}
+
+	if base := path.Base(path.Clean("/" + name)); remote != path.Clean("/"+name) && info.Name() != base {
+		return renamedInfo{FileInfo: info, name: base}, nil
+	}
+	return info, nil
+}
+
+func (c *movedClient) ReadDir(name string) ([]os.FileInfo, error) {
+	remote, err := c.resolve("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+
+	infos, err := c.Webdav.ReadDir(remote)
+	if err != nil {
+		return nil, err
+	}
+
+	// Перемещенные отсюда директории скрываются
+	result := infos[:0]
+	seen := make(map[string]bool)
+	for _, info := range infos {
+		if _, ok := c.moves.resolve(path.Join(name, info.Name())); ok {
+			result = append(result, info)
+			seen[info.Name()] = true
+		}
+	}
+
+	// Перемещенные сюда директории добавляются под новыми именами
+	moved := c.moves.children(name)
+	names := make([]string, 0, len(moved))
+	for base := range moved {
+		names = append(names, base)
+	}
+	sort.Strings(names)
+
+	for _, base := range names {
+		if seen[base] {
+			continue
+		}
+		info, err := c.Webdav.Stat(moved[base])
+		if err != nil {
+			c.log.Logf("[WARN] virtually moved %s is not available: %v", moved[base], err)
+			continue
+		}
+		result = append(result, renamedInfo{FileInfo: info, name: base})
+	}
+
+	return result, nil
+}
+
+func (c *movedClient) ReadStreamRange(name string, offset int64, length int64) (io.ReadCloser, error) {
+	remote, err := c.resolve("open", name)
+	if err != nil {
+		return nil, err
+	}
+	return c.Webdav.ReadStreamRange(remote, offset, length)
+}
+
+func (c *movedClient) MkdirAll(name string, perm os.FileMode) error {
+	remote, err := c.resolve("mkdir", name)
+	if err != nil {
+		// Место перемещенной директории снова свободно
+		remote = path.Clean("/" + name)
+	}
+	return c.Webdav.MkdirAll(remote, perm)
+}
+
+func (c *movedClient) RemoveAll(name string) error {
+	remote, err := c.resolve("remove", name)
+	if err != nil {
+		return err
+	}
+
+	if err := c.Webdav.RemoveAll(remote); err != nil {
+		return err
+	}
+
+	c.moves.forget(path.Clean("/" + name))
+	return nil
+}
+
+// Rename переименовывает файл на удаленном сервере. Если сервер отклоняет
+// перемещение директории, оно запоминается как виртуальное
+func (c *movedClient) Rename(oldName, newName string, overwrite bool) error {
+	oldName, newName = path.Clean("/"+oldName), path.Clean("/"+newName)
+
+	oldRemote, err := c.resolve("rename", oldName)
+	if err != nil {
+		return err
+	}
+	newRemote, ok := c.moves.resolve(newName)
+	if !ok {
+		newRemote = newName
+	}
+
+	err = c.Webdav.Rename(oldRemote, newRemote, overwrite)
+	if err == nil {
+		c.moves.renamed(oldName, newName, oldRemote, newRemote)
+		return nil
+	}
+
+	if !refused(err) {
+		return err
+	}
+
+	info, statErr := c.Webdav.Stat(oldRemote)
+	if statErr != nil || !info.IsDir() {
+		return err
+	}
+
+	c.log.Logf("[WARN] remote server refused to move %s to %s (%v), moving it virtually", oldName, newName, err)
+	c.moves.record(oldName, newName, oldRemote)
+	return nil
+}
+
+func (c *movedClient) WriteStream(name string, stream io.Reader, mode os.FileMode) error {
+	w, ok := c.Webdav.(RemoteWriter)
+	if !ok {
+		return fmt.Errorf("remote client does not support writes: %s", name)
+	}
+
+	remote, err := c.resolve("write", name)
+	if err != nil {
+		remote = path.Clean("/" + name)
+	}
+	return w.WriteStream(remote, stream, mode)
+}
+
+func (c *movedClient) Copy(oldName, newName string, overwrite bool) error {
+	cp, ok := c.Webdav.(RemoteCopier)
+	if !ok {
+		return fmt.Errorf("remote client does not support copy: %w", errors.ErrUnsupported)
+	}
+
+	oldRemote, err := c.resolve("copy", oldName)
+	if err != nil {
+		return err
+	}
+	newRemote, ok := c.moves.resolve(newName)
+	if !ok {
+		newRemote = path.Clean("/" + newName)
+	}
+	return cp.Copy(oldRemote, newRemote, overwrite)
+}
+
+func (c *movedClient) Checksums(name string) (Checksums, error) {
+	cs, ok := c.Webdav.(RemoteChecksummer)
+	if !ok {
+		return Checksums{}, ErrNoChecksum
+	}
+
+	remote, err := c.resolve("checksum", name)
+	if err != nil {
+		return Checksums{}, err
+	}
+	return cs.Checksums(remote)
+}
+
+func (c *movedClient) RemotePath(name string) (string, error) {
+	remote, err := c.resolve("resolve", name)
+	if err != nil {
+		return "", err
+	}
+
+	if r, ok := c.Webdav.(remotePather); ok {
+		return r.RemotePath(remote)
+	}
+	return remote, nil
+}
+
+// refused проверяет, отказался ли удаленный сервер выполнять запрос.
+// Временные ошибки сервера, ошибки авторизации и конфликты путей
+// возвращаются клиенту, а не превращаются в виртуальное перемещение
+func refused(err error) bool {
+	var status gowebdav.StatusError
+	if !errors.As(err, &status) {
+		return false
+	}
+
+	switch status.Status {
+	case http.StatusForbidden, http.StatusMethodNotAllowed, http.StatusNotImplemented, http.StatusInsufficientStorage:
+		return true
+	default:
+		return false
+	}
+}
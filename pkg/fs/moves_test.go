@@ -0,0 +1,189 @@
+package fs_test
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/ReanSn0w/pikpak-webdav-proxy/pkg/fs"
+	lgr "github.com/go-pkgz/lgr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/studio-b12/gowebdav"
+	"golang.org/x/net/webdav"
+)
+
+// setupMoves создает прокси над WebDAV сервером, который отвечает на все
+// запросы MOVE кодом status, если он не равен нулю
+func setupMoves(t *testing.T, status int) (*fs.PikpakProxy, string, string, *methodLog) {
+	localDir, remoteDir := t.TempDir(), t.TempDir()
+	log := &methodLog{}
+
+	handler := &webdav.Handler{FileSystem: webdav.Dir(remoteDir), LockSystem: webdav.NewMemLS()}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		log.mu.Lock()
+		log.methods = append(log.methods, r.Method)
+		log.mu.Unlock()
+
+		if status != 0 && r.Method == "MOVE" {
+			http.Error(w, http.StatusText(status), status)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	t.Cleanup(srv.Close)
+
+	client := newClient(srv.URL)
+	return fs.NewPikpakProxy(lgr.New(), localDir, client), localDir, remoteDir, log
+}
+
+func readProxyFile(t *testing.T, proxy *fs.PikpakProxy, name string) string {
+	f, err := proxy.OpenFile(context.Background(), name, os.O_RDONLY, 0)
+	require.NoError(t, err)
+	defer f.Close()
+
+	data, err := io.ReadAll(f)
+	require.NoError(t, err)
+	return string(data)
+}
+
+func readdirNames(t *testing.T, proxy *fs.PikpakProxy, name string) []string {
+	infos, err := proxy.Readdir(context.Background(), name)
+	require.NoError(t, err)
+
+	names := make([]string, 0, len(infos))
+	for _, info := range infos {
+		names = append(names, info.Name())
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestRename_RemoteDirectory(t *testing.T) {
+	proxy, localDir, remoteDir, log := setupMoves(t, 0)
+
+	require.NoError(t, os.MkdirAll(filepath.Join(remoteDir, "dir", "sub"), 0755))
+	writeLocalFile(t, remoteDir, "dir/a.txt", "aaa", testTime)
+	writeLocalFile(t, remoteDir, "dir/sub/b.txt", "bbb", testTime)
+	require.NoError(t, os.MkdirAll(filepath.Join(remoteDir, "target"), 0755))
+
+	// Локальная копия одного файла переносится вместе с директорией
+	require.NoError(t, os.MkdirAll(filepath.Join(localDir, "dir", "sub"), 0755))
+	writeLocalFile(t, localDir, "dir/sub/b.txt", "bbb", testTime)
+
+	require.NoError(t, proxy.Rename(context.Background(), "/dir", "/target/moved"))
+
+	assert.Equal(t, "aaa", readFile(t, remoteDir, "target/moved/a.txt"))
+	assert.NoDirExists(t, filepath.Join(remoteDir, "dir"))
+	assert.Equal(t, "bbb", readFile(t, localDir, "target/moved/sub/b.txt"))
+	assert.NoFileExists(t, filepath.Join(localDir, "target", "moved", "a.txt"))
+	assert.NoDirExists(t, filepath.Join(localDir, "dir"))
+
+	assert.Equal(t, 1, log.count("MOVE"))
+	assert.Zero(t, log.count(http.MethodGet))
+	assert.Zero(t, log.count(http.MethodPut))
+}
+
+func TestRename_RefusedDirectory(t *testing.T) {
+	proxy, localDir, remoteDir, log := setupMoves(t, http.StatusForbidden)
+	ctx := context.Background()
+
+	require.NoError(t, os.MkdirAll(filepath.Join(remoteDir, "dir", "sub"), 0755))
+	writeLocalFile(t, remoteDir, "dir/a.txt", "aaa", testTime)
+	writeLocalFile(t, remoteDir, "dir/sub/b.txt", "bbb", testTime)
+	require.NoError(t, os.MkdirAll(filepath.Join(localDir, "dir"), 0755))
+	writeLocalFile(t, localDir, "dir/local.txt", "local", testTime)
+
+	require.NoError(t, proxy.Rename(ctx, "/dir", "/moved"))
+
+	// Содержимое не копируется, директория остается на прежнем месте
+	// удаленного сервера
+	assert.Zero(t, log.count(http.MethodGet))
+	assert.Zero(t, log.count(http.MethodPut))
+	assert.Zero(t, log.count("COPY"))
+	assert.DirExists(t, filepath.Join(remoteDir, "dir"))
+	assert.Equal(t, "local", readFile(t, localDir, "moved/local.txt"))
+
+	assert.Equal(t, []string{"moved"}, readdirNames(t, proxy, "/"))
+	assert.Equal(t, []string{"a.txt", "local.txt", "sub"}, readdirNames(t, proxy, "/moved"))
+	assert.Equal(t, "bbb", readProxyFile(t, proxy, "/moved/sub/b.txt"))
+
+	info, err := proxy.Stat(ctx, "/moved")
+	require.NoError(t, err)
+	assert.Equal(t, "moved", info.Name())
+	assert.True(t, info.IsDir())
+
+	_, err = proxy.Stat(ctx, "/dir/a.txt")
+	assert.True(t, os.IsNotExist(err))
+
+	// Перемещение сохраняется между запусками
+	reopened := fs.NewPikpakProxy(lgr.New(), localDir, remoteClient(t, remoteDir))
+	assert.Equal(t, []string{"moved"}, readdirNames(t, reopened, "/"))
+
+	// Повторное перемещение и удаление работают с новыми путями
+	require.NoError(t, proxy.Rename(ctx, "/moved", "/again"))
+	assert.Equal(t, []string{"again"}, readdirNames(t, proxy, "/"))
+	assert.Equal(t, "aaa", readProxyFile(t, proxy, "/again/a.txt"))
+
+	require.NoError(t, proxy.RemoveAll(ctx, "/again"))
+	assert.NoDirExists(t, filepath.Join(remoteDir, "dir"))
+	assert.Empty(t, readdirNames(t, proxy, "/"))
+}
+
+func TestRename_RemotePath(t *testing.T) {
+	proxy, _, remoteDir, _ := setupMoves(t, http.StatusForbidden)
+
+	require.NoError(t, os.MkdirAll(filepath.Join(remoteDir, "dir"), 0755))
+	writeLocalFile(t, remoteDir, "dir/a.txt", "aaa", testTime)
+	require.NoError(t, proxy.Rename(context.Background(), "/dir", "/moved"))
+
+	// Блокировки на удаленном сервере ставятся по исходному пути
+	remote, err := proxy.RemotePath("/moved/a.txt")
+	require.NoError(t, err)
+	assert.Equal(t, "/dir/a.txt", remote)
+
+	_, err = proxy.RemotePath("/dir/a.txt")
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestRename_RefusedFile(t *testing.T) {
+	proxy, _, remoteDir, _ := setupMoves(t, http.StatusForbidden)
+
+	writeLocalFile(t, remoteDir, "a.txt", "aaa", testTime)
+
+	// Файлы не перемещаются виртуально
+	err := proxy.Rename(context.Background(), "/a.txt", "/b.txt")
+	assert.Error(t, err)
+	assert.Equal(t, []string{"a.txt"}, readdirNames(t, proxy, "/"))
+}
+
+func TestRename_ServerError(t *testing.T) {
+	for _, status := range []int{http.StatusInternalServerError, http.StatusBadGateway, http.StatusUnauthorized} {
+		proxy, _, remoteDir, _ := setupMoves(t, status)
+		require.NoError(t, os.MkdirAll(filepath.Join(remoteDir, "dir"), 0755))
+
+		// Ошибка сервера не считается отказом и не запоминается
+		err := proxy.Rename(context.Background(), "/dir", "/moved")
+		assert.Error(t, err, status)
+		assert.Equal(t, []string{"dir"}, readdirNames(t, proxy, "/"), status)
+	}
+}
+
+// newClient создает клиент с заранее заданной авторизацией: без нее
+// gowebdav повторяет первый запрос, и MOVE выполнялся бы дважды
+func newClient(url string) *gowebdav.Client {
+	return gowebdav.NewAuthClient(url, gowebdav.NewPreemptiveAuth(&gowebdav.BasicAuth{}))
+}
+
+// remoteClient создает клиент нового WebDAV сервера над удаленной директорией
+func remoteClient(t *testing.T, remoteDir string) fs.Webdav {
+	handler := &webdav.Handler{FileSystem: webdav.Dir(remoteDir), LockSystem: webdav.NewMemLS()}
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+	return newClient(srv.URL)
+}
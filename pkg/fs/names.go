@@ -0,0 +1,149 @@
+package fs
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"golang.org/x/text/cases"
+	"golang.org/x/text/unicode/norm"
+)
+
+// NameForm - форма нормализации Unicode для имен файлов
+type NameForm string
+
+const (
+	// NameFormNone - имена сравниваются без нормализации
+	NameFormNone NameForm = "none"
+	// NameFormNFC - составная форма, в которой имена возвращает PikPak
+	NameFormNFC NameForm = "nfc"
+	// NameFormNFD - разложенная форма, в которой имена отправляет macOS
+	NameFormNFD NameForm = "nfd"
+)
+
+// ParseNameForm разбирает название формы нормализации имен
+func ParseNameForm(s string) (NameForm, error) {
+	switch form := NameForm(strings.ToLower(s)); form {
+	case NameFormNone, NameFormNFC, NameFormNFD:
+		return form, nil
+	case "":
+		return NameFormNone, nil
+	default:
+		return "", fmt.Errorf("unknown name form: %s", s)
+	}
+}
+
+var foldCase = cases.Fold()
+
+// matchNames возвращает true, если имена слоев сопоставляются
+// с учетом нормализации или без учета регистра
+func (p *PikpakProxy) matchNames() bool {
+	return p.nameForm != NameFormNone || p.caseInsensitive
+}
+
+// normalizeName приводит имя к заданной форме нормализации
+func (p *PikpakProxy) normalizeName(name string) string {
+	switch p.nameForm {
+	case NameFormNFC:
+		return norm.NFC.String(name)
+	case NameFormNFD:
+		return norm.NFD.String(name)
+	default:
+		return name
+	}
+}
+
+// nameKey возвращает ключ, по которому сравниваются имена файлов
+// из разных слоев
+func (p *PikpakProxy) nameKey(name string) string {
+	if p.caseInsensitive {
+		name = foldCase.String(name)
+	}
+	return p.normalizeName(name)
+}
+
+// localName находит в локальном слое путь, соответствующий относительному
+// пути name. Каждый элемент пути ищется сначала по точному имени, затем
+// по ключу сравнения. Несуществующие элементы приводятся к заданной форме,
+// поэтому новые файлы создаются в ней
+func (p *PikpakProxy) localName(name string) string {
+	if name == "" || name == "." {
+		return name
+	}
+
+	parts := strings.Split(name, "/")
+	dir := p.localPath
+	found := true
+
+	for i, part := range parts {
+		if found {
+			parts[i], found = p.lookupLocal(dir, part)
+		} else {
+			parts[i] = p.normalizeName(part)
+		}
+		dir = filepath.Join(dir, parts[i])
+	}
+
+	return strings.Join(parts, "/")
+}
+
+// lookupLocal ищет в директории dir файл с именем part
+func (p *PikpakProxy) lookupLocal(dir, part string) (string, bool) {
+	if _, err := os.Lstat(filepath.Join(dir, part)); err == nil {
+		return part, true
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return p.normalizeName(part), false
+	}
+
+	key := p.nameKey(part)
+	for _, e := range entries {
+		if p.nameKey(e.Name()) == key {
+			return e.Name(), true
+		}
+	}
+
+	return p.normalizeName(part), false
+}
+
+// lookupRemote запрашивает информацию о файле с удаленного сервера.
+// Если файл не найден по точному имени, он ищется в родительской
+// директории по ключу сравнения. Возвращается настоящее имя файла
+func (p *PikpakProxy) lookupRemote(name string) (string, os.FileInfo, error) {
+	info, err := p.remoteClient.Stat(name)
+	if err == nil || !p.matchNames() || name == "/" {
+		return name, info, err
+	}
+
+	dir, base := path.Split(path.Clean(name))
+	dir, parent, dirErr := p.lookupRemote(path.Clean(dir))
+	if dirErr != nil || !parent.IsDir() {
+		return name, nil, err
+	}
+
+	entries, listErr := p.remoteClient.ReadDir(dir)
+	if listErr != nil {
+		return name, nil, err
+	}
+
+	key := p.nameKey(base)
+	for _, e := range entries {
+		if p.nameKey(e.Name()) == key {
+			return path.Join(dir, e.Name()), e, nil
+		}
+	}
+
+	return name, nil, err
+}
+
+// sortByKey сортирует элементы директории по ключу сравнения имен
+func sortByKey[T interface{ Name() string }](p *PikpakProxy, items []T) {
+	sort.SliceStable(items, func(i, j int) bool {
+		return p.nameKey(items[i].Name()) < p.nameKey(items[j].Name())
+	})
+}
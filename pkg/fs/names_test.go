@@ -0,0 +1,110 @@
+package fs_test
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ReanSn0w/pikpak-webdav-proxy/pkg/fs"
+	lgr "github.com/go-pkgz/lgr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/text/unicode/norm"
+)
+
+var (
+	cafeNFC = norm.NFC.String("Café.txt")
+	cafeNFD = norm.NFD.String("Café.txt")
+)
+
+func TestParseNameForm(t *testing.T) {
+	form, err := fs.ParseNameForm("NFC")
+	require.NoError(t, err)
+	assert.Equal(t, fs.NameFormNFC, form)
+
+	form, err = fs.ParseNameForm("")
+	require.NoError(t, err)
+	assert.Equal(t, fs.NameFormNone, form)
+
+	_, err = fs.ParseNameForm("nfkc")
+	assert.Error(t, err)
+}
+
+func TestNames_ReaddirMergesForms(t *testing.T) {
+	tmpDir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(tmpDir, cafeNFD), []byte("local"), 0644))
+
+	mockClient := &MockWebdav{}
+	mockClient.On("ReadDir", "/").Return([]os.FileInfo{newMockFileInfo(cafeNFC, false)}, nil)
+
+	// Без нормализации файл отображается дважды
+	proxy := fs.NewPikpakProxy(lgr.New(), tmpDir, mockClient)
+	entries, err := proxy.ReaddirLayers(context.Background(), "/")
+	require.NoError(t, err)
+	assert.Len(t, entries, 2)
+
+	proxy = fs.NewPikpakProxy(lgr.New(), tmpDir, mockClient, fs.WithNameForm(fs.NameFormNFC))
+	entries, err = proxy.ReaddirLayers(context.Background(), "/")
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, cafeNFD, entries[0].Name())
+	assert.Equal(t, fs.LayerBoth, entries[0].Layer)
+}
+
+func TestNames_OpenFindsLocalCopy(t *testing.T) {
+	tmpDir := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(tmpDir, "Docs"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(tmpDir, "Docs", cafeNFD), []byte("local"), 0644))
+
+	proxy := fs.NewPikpakProxy(lgr.New(), tmpDir, &MockWebdav{},
+		fs.WithNameForm(fs.NameFormNFC),
+		fs.WithCaseInsensitive(true),
+	)
+
+	name := "/docs/" + norm.NFC.String("CAFÉ.TXT")
+
+	info, err := proxy.Stat(context.Background(), name)
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), info.Size())
+
+	f, err := proxy.OpenFile(context.Background(), name, os.O_RDONLY, 0)
+	require.NoError(t, err)
+	defer f.Close()
+
+	data, err := io.ReadAll(f)
+	require.NoError(t, err)
+	assert.Equal(t, "local", string(data))
+}
+
+func TestNames_NewFilesNormalized(t *testing.T) {
+	tmpDir := t.TempDir()
+	proxy := fs.NewPikpakProxy(lgr.New(), tmpDir, &MockWebdav{},
+		fs.WithNameForm(fs.NameFormNFC),
+		rules(t, "/**:local-only"),
+	)
+
+	f, err := proxy.OpenFile(context.Background(), "/"+cafeNFD, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	require.NoError(t, err)
+	_, err = f.Write([]byte("new"))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	assert.FileExists(t, filepath.Join(tmpDir, cafeNFC))
+	assert.NoFileExists(t, filepath.Join(tmpDir, cafeNFD))
+}
+
+func TestNames_RemoteCaseInsensitive(t *testing.T) {
+	mockClient := &MockWebdav{}
+	mockClient.On("Stat", "/Video").Return(newMockFileInfo("Video", true), nil)
+	mockClient.On("Stat", "/Video/movie.mkv").Return(nil, os.ErrNotExist)
+	mockClient.On("ReadDir", "/Video").Return([]os.FileInfo{newMockFileInfo("Movie.MKV", false)}, nil)
+
+	proxy := fs.NewPikpakProxy(lgr.New(), t.TempDir(), mockClient, fs.WithCaseInsensitive(true))
+
+	info, err := proxy.Stat(context.Background(), "/Video/movie.mkv")
+	require.NoError(t, err)
+	assert.Equal(t, "movie.mkv", info.Name())
+	assert.False(t, info.IsDir())
+}
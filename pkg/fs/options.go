@@ -0,0 +1,122 @@
+package fs
+
+import (
+	"time"
+
+	"github.com/ReanSn0w/pikpak-webdav-proxy/pkg/quota"
+	"github.com/ReanSn0w/pikpak-webdav-proxy/pkg/utils"
+)
+
+// Option - функция настройки PikpakProxy
+type Option func(*PikpakProxy)
+
+// WithConflictPolicy включает обнаружение конфликтов между локальной
+// и удаленной версией файла и задает политику их разрешения
+func WithConflictPolicy(policy ConflictPolicy) Option {
+	return func(p *PikpakProxy) {
+		p.conflictPolicy = policy
+	}
+}
+
+// WithMIMETypes задает таблицу типов содержимого файлов
+func WithMIMETypes(types *MIMETypes) Option {
+	return func(p *PikpakProxy) {
+		p.mimeTypes = types
+	}
+}
+
+// WithQuota задает источник квоты удаленного сервера
+func WithQuota(source quota.Source) Option {
+	return func(p *PikpakProxy) {
+		p.quotaSource = source
+	}
+}
+
+// WithCacheBudget задает максимальный размер локального кеша в байтах.
+// Ноль означает отсутствие ограничения
+func WithCacheBudget(size int64) Option {
+	return func(p *PikpakProxy) {
+		p.cacheBudget = size
+	}
+}
+
+// WithWatermarks задает доли бюджета кеша, при превышении первой из которых
+// чистые файлы вытесняются, пока размер кеша не опустится до второй
+func WithWatermarks(high, low float64) Option {
+	return func(p *PikpakProxy) {
+		p.highWatermark, p.lowWatermark = clampWatermarks(high, low)
+	}
+}
+
+// WithPolicies задает правила записи. Правила проверяются по порядку,
+// применяется первое подходящее
+func WithPolicies(rules ...PolicyRule) Option {
+	return func(p *PikpakProxy) {
+		p.policies = append(p.policies, rules...)
+	}
+}
+
+// WithFilters задает фильтры файлов. Фильтры проверяются по порядку,
+// применяется первый подходящий
+func WithFilters(rules ...FilterRule) Option {
+	return func(p *PikpakProxy) {
+		p.filters = append(p.filters, rules...)
+	}
+}
+
+// WithNameForm задает форму нормализации Unicode, с учетом которой
+// сопоставляются имена файлов в разных слоях. В этой форме создаются
+// новые локальные файлы и запрашиваются файлы на удаленном сервере
+func WithNameForm(form NameForm) Option {
+	return func(p *PikpakProxy) {
+		p.nameForm = form
+	}
+}
+
+// WithCaseInsensitive включает сопоставление имен файлов без учета регистра
+func WithCaseInsensitive(enabled bool) Option {
+	return func(p *PikpakProxy) {
+		p.caseInsensitive = enabled
+	}
+}
+
+// WithNameEncoding включает кодирование имен файлов, которые не принимает
+// удаленный сервер: символы из набора enc заменяются, а имена длиннее
+// maxLength байт сокращаются. Ноль отключает ограничение длины
+func WithNameEncoding(enc NameEncoding, maxLength int) Option {
+	return func(p *PikpakProxy) {
+		p.nameEncoding = enc
+		p.maxNameLength = maxLength
+	}
+}
+
+// WithStreaming включает потоковое чтение удаленных файлов в запросах,
+// помеченных StreamingContext: файл читается одним запросом с опережением
+// на readAhead байт, а поток закрытого файла ждет следующего запроса
+// с соседним диапазоном не дольше idle. Буферы ожидающих потоков всех
+// файлов занимают не больше idleMemory байт. Ноль readAhead отключает режим
+func WithStreaming(readAhead int, idle time.Duration, idleMemory int64) Option {
+	return func(p *PikpakProxy) {
+		if readAhead > 0 {
+			p.streams = utils.NewStreamPool(readAhead, idle, idleMemory)
+		}
+	}
+}
+
+// WithHardlinks разрешает копировать локальные файлы жесткими ссылками,
+// если файловая система не поддерживает reflink. Прокси разделяет ссылки
+// перед записью, но изменения файлов в LOCAL_PATH в обход прокси будут
+// видны во всех копиях
+func WithHardlinks(enabled bool) Option {
+	return func(p *PikpakProxy) {
+		p.hardlinks = enabled
+	}
+}
+
+// WithEncryption включает шифрование содержимого локального кеша ключом
+// key. Незашифрованные файлы читаются как есть и шифруются при изменении
+func WithEncryption(key EncryptionKey) Option {
+	return func(p *PikpakProxy) {
+		p.crypt = newLocalCrypt(key)
+	}
+}
@@ -0,0 +1,147 @@
+package fs
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// WriteMode - режим записи для части дерева файлов
+type WriteMode string
+
+const (
+	// WriteDefault - файлы записываются в локальный слой, создание,
+	// удаление и переименование выполняются в обоих слоях
+	WriteDefault WriteMode = ""
+	// WriteReadOnly - запись запрещена, чтение разрешено
+	WriteReadOnly WriteMode = "read-only"
+	// WriteLocalOnly - все изменения выполняются только в локальном слое
+	WriteLocalOnly WriteMode = "local-only"
+	// WriteThrough - все изменения, включая содержимое файлов,
+	// выполняются в обоих слоях
+	WriteThrough WriteMode = "write-through"
+	// WriteDeny - доступ запрещен полностью
+	WriteDeny WriteMode = "deny"
+)
+
+// PolicyRule - правило записи для файлов, соответствующих шаблону
+type PolicyRule struct {
+	Pattern string
+	Mode    WriteMode
+
+	re *regexp.Regexp
+}
+
+// NewPolicyRule создает правило записи для шаблона pattern
+func NewPolicyRule(pattern string, mode WriteMode) (PolicyRule, error) {
+	switch mode {
+	case WriteReadOnly, WriteLocalOnly, WriteThrough, WriteDeny:
+	default:
+		return PolicyRule{}, fmt.Errorf("unknown write mode: %s", mode)
+	}
+
+	re, err := compileGlob(pattern)
+	if err != nil {
+		return PolicyRule{}, fmt.Errorf("invalid pattern %s: %w", pattern, err)
+	}
+
+	return PolicyRule{Pattern: pattern, Mode: mode, re: re}, nil
+}
+
+// ParsePolicyRule разбирает правило в формате "шаблон:режим"
+func ParsePolicyRule(s string) (PolicyRule, error) {
+	i := strings.LastIndex(s, ":")
+	if i < 0 {
+		return PolicyRule{}, fmt.Errorf("invalid write policy %q, expected pattern:mode", s)
+	}
+
+	return NewPolicyRule(strings.TrimSpace(s[:i]), WriteMode(strings.TrimSpace(s[i+1:])))
+}
+
+// writeMode возвращает режим записи для файла name. Правила проверяются
+// по порядку, применяется первое подходящее
+func (p *PikpakProxy) writeMode(name string) WriteMode {
+	if isMeta(name) {
+		return WriteDeny
+	}
+
+	mode := WriteDefault
+	for _, rule := range p.policies {
+		if matchPath(rule.re, name) {
+			mode = rule.Mode
+			break
+		}
+	}
+
+	// Фильтр local-only не дает изменениям попасть на удаленный сервер
+	if p.localOnly(name) && (mode == WriteDefault || mode == WriteThrough) {
+		return WriteLocalOnly
+	}
+
+	return mode
+}
+
+// CheckAccess проверяет, разрешено ли чтение или запись файла name
+func (p *PikpakProxy) CheckAccess(name string, write bool) error {
+	switch mode := p.writeMode(name); {
+	case mode == WriteDeny:
+		return &os.PathError{Op: "access", Path: name, Err: os.ErrPermission}
+	case write && mode == WriteReadOnly:
+		return &os.PathError{Op: "write", Path: name, Err: os.ErrPermission}
+	case write && p.rejected(name):
+		return &os.PathError{Op: "write", Path: name, Err: os.ErrPermission}
+	default:
+		return nil
+	}
+}
+
+// denied проверяет, запрещен ли доступ к файлу name полностью. Такие файлы
+// не показываются в списках директорий
+func (p *PikpakProxy) denied(name string) bool {
+	return p.writeMode(name) == WriteDeny
+}
+
+// RemoteWriter - необязательный интерфейс клиента удаленного сервера,
+// позволяющий загружать файлы в режиме write-through
+type RemoteWriter interface {
+	WriteStream(path string, stream io.Reader, mode os.FileMode) error
+}
+
+// upload загружает локальную версию файла name на удаленный сервер
+func (p *PikpakProxy) upload(name string) error {
+	w, ok := p.remoteClient.(RemoteWriter)
+	if !ok {
+		return fmt.Errorf("remote client does not support writes: %s", name)
+	}
+
+	f, err := p.crypt.open(p.LocalFilePath(name), os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	defer p.invalidateStreams(name)
+	if err := w.WriteStream(name, f, info.Mode()); err != nil {
+		p.log.Logf("[ERROR] write-through upload of %s failed: %v", name, err)
+		return err
+	}
+
+	p.log.Logf("[DEBUG] uploaded %s (%d bytes)", name, info.Size())
+	if p.conflictPolicy != ConflictNone {
+		p.recordUploaded(name)
+	}
+	return nil
+}
+
+// remoteWrites возвращает true, если изменения файла name должны
+// выполняться и на удаленном сервере
+func remoteWrites(mode WriteMode) bool {
+	return mode != WriteLocalOnly
+}
@@ -0,0 +1,237 @@
+package fs_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ReanSn0w/pikpak-webdav-proxy/pkg/fs"
+	lgr "github.com/go-pkgz/lgr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+// writableWebdav - удаленный сервер с поддержкой загрузки файлов
+type writableWebdav struct {
+	*MockWebdav
+	uploaded map[string]string
+}
+
+func (w writableWebdav) WriteStream(path string, stream io.Reader, mode os.FileMode) error {
+	var buf bytes.Buffer
+	if _, err := io.Copy(&buf, stream); err != nil {
+		return err
+	}
+	w.uploaded[path] = buf.String()
+	return nil
+}
+
+func rules(t *testing.T, specs ...string) fs.Option {
+	t.Helper()
+
+	var result []fs.PolicyRule
+	for _, spec := range specs {
+		rule, err := fs.ParsePolicyRule(spec)
+		require.NoError(t, err)
+		result = append(result, rule)
+	}
+
+	return fs.WithPolicies(result...)
+}
+
+func TestParsePolicyRule(t *testing.T) {
+	rule, err := fs.ParsePolicyRule("/Uploads/**:local-only")
+	require.NoError(t, err)
+	assert.Equal(t, "/Uploads/**", rule.Pattern)
+	assert.Equal(t, fs.WriteLocalOnly, rule.Mode)
+
+	_, err = fs.ParsePolicyRule("/Uploads")
+	assert.Error(t, err)
+
+	_, err = fs.ParsePolicyRule("/Uploads:everything")
+	assert.Error(t, err)
+}
+
+func TestCheckAccess(t *testing.T) {
+	proxy := fs.NewPikpakProxy(lgr.New(), t.TempDir(), &MockWebdav{},
+		rules(t, "/Uploads:local-only", "/Private:deny", "*.tmp:deny", "/**:read-only"),
+	)
+
+	tests := []struct {
+		name    string
+		write   bool
+		allowed bool
+	}{
+		{"/Uploads", true, true},
+		{"/Uploads/photo.jpg", true, true},
+		{"/Uploads/sub/dir/file.txt", true, true},
+		{"/UploadsOther/file.txt", true, false},
+		{"/Movies/film.mkv", false, true},
+		{"/Movies/film.mkv", true, false},
+		{"/Private/secret.txt", false, false},
+		{"/Movies/partial.tmp", false, false},
+		{"/", false, true},
+		{"/" + fs.MetaDir + "/locks.json", false, false},
+	}
+
+	for _, tt := range tests {
+		err := proxy.CheckAccess(tt.name, tt.write)
+		if tt.allowed {
+			assert.NoError(t, err, tt.name)
+		} else {
+			assert.ErrorIs(t, err, os.ErrPermission, tt.name)
+		}
+	}
+}
+
+func TestCheckAccess_NonASCII(t *testing.T) {
+	proxy := fs.NewPikpakProxy(lgr.New(), t.TempDir(), &MockWebdav{},
+		rules(t, "/Загрузки/**:read-only", "/Фото/снимок-?.jpg:deny"),
+	)
+
+	assert.ErrorIs(t, proxy.CheckAccess("/Загрузки/файл.txt", true), os.ErrPermission)
+	assert.NoError(t, proxy.CheckAccess("/Загрузки/файл.txt", false))
+	assert.NoError(t, proxy.CheckAccess("/Документы/файл.txt", true))
+
+	assert.ErrorIs(t, proxy.CheckAccess("/Фото/снимок-я.jpg", false), os.ErrPermission)
+	assert.NoError(t, proxy.CheckAccess("/Фото/снимок-яя.jpg", false))
+}
+
+func TestPolicy_ReadOnly(t *testing.T) {
+	tmpDir := t.TempDir()
+	mockClient := &MockWebdav{}
+	require.NoError(t, os.WriteFile(filepath.Join(tmpDir, "file.txt"), []byte("data"), 0644))
+
+	proxy := fs.NewPikpakProxy(lgr.New(), tmpDir, mockClient, rules(t, "/**:read-only"))
+	ctx := context.Background()
+
+	_, err := proxy.OpenFile(ctx, "/file.txt", os.O_RDWR|os.O_TRUNC, 0644)
+	assert.ErrorIs(t, err, os.ErrPermission)
+
+	f, err := proxy.OpenFile(ctx, "/file.txt", os.O_RDONLY, 0)
+	require.NoError(t, err)
+	f.Close()
+
+	assert.ErrorIs(t, proxy.Mkdir(ctx, "/dir", 0755), os.ErrPermission)
+	assert.ErrorIs(t, proxy.RemoveAll(ctx, "/file.txt"), os.ErrPermission)
+	assert.ErrorIs(t, proxy.Rename(ctx, "/file.txt", "/other.txt"), os.ErrPermission)
+
+	assert.FileExists(t, filepath.Join(tmpDir, "file.txt"))
+	mockClient.AssertNotCalled(t, "MkdirAll", mock.Anything, mock.Anything)
+}
+
+func TestPolicy_DenyHiddenInListings(t *testing.T) {
+	tmpDir := t.TempDir()
+	mockClient := &MockWebdav{}
+	require.NoError(t, os.WriteFile(filepath.Join(tmpDir, "file.txt"), []byte("data"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(tmpDir, "secret.key"), []byte("key"), 0644))
+	require.NoError(t, os.MkdirAll(filepath.Join(tmpDir, "private"), 0755))
+	mockClient.On("ReadDir", "/").Return([]os.FileInfo{
+		newMockFileInfo("remote.key", false),
+		newMockFileInfo("remote.txt", false),
+	}, nil)
+
+	proxy := fs.NewPikpakProxy(lgr.New(), tmpDir, mockClient, rules(t, "/**/*.key:deny", "/private/**:deny", "/private:deny"))
+	ctx := context.Background()
+
+	infos, err := proxy.Readdir(ctx, "/")
+	require.NoError(t, err)
+	var names []string
+	for _, info := range infos {
+		names = append(names, info.Name())
+	}
+	assert.Equal(t, []string{"file.txt", "remote.txt"}, names)
+
+	entries, err := proxy.ReaddirLayers(ctx, "/")
+	require.NoError(t, err)
+	assert.Len(t, entries, 2)
+
+	_, err = proxy.ReaddirLayers(ctx, "/private")
+	assert.ErrorIs(t, err, os.ErrPermission)
+}
+
+func TestPolicy_FetchReadOnly(t *testing.T) {
+	tmpDir := t.TempDir()
+	mockClient := &MockWebdav{}
+	mockClient.On("Stat", "/file.txt").Return(newSizedFileInfo("file.txt", 4, testTime), nil)
+
+	proxy := fs.NewPikpakProxy(lgr.New(), tmpDir, mockClient, rules(t, "/**:read-only"))
+
+	assert.ErrorIs(t, proxy.Fetch(context.Background(), "/file.txt"), os.ErrPermission)
+	assert.NoFileExists(t, filepath.Join(tmpDir, "file.txt"))
+	mockClient.AssertNotCalled(t, "ReadStreamRange", mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestPolicy_LocalOnly(t *testing.T) {
+	tmpDir := t.TempDir()
+	mockClient := &MockWebdav{}
+	proxy := fs.NewPikpakProxy(lgr.New(), tmpDir, mockClient, rules(t, "/Uploads:local-only"))
+	ctx := context.Background()
+
+	require.NoError(t, proxy.Mkdir(ctx, "/Uploads/new", 0755))
+	assert.DirExists(t, filepath.Join(tmpDir, "Uploads", "new"))
+
+	require.NoError(t, proxy.Rename(ctx, "/Uploads/new", "/Uploads/renamed"))
+	require.NoError(t, proxy.RemoveAll(ctx, "/Uploads/renamed"))
+
+	// Удаленный сервер не затрагивается
+	mockClient.AssertNotCalled(t, "MkdirAll", mock.Anything, mock.Anything)
+	mockClient.AssertNotCalled(t, "Rename", mock.Anything, mock.Anything, mock.Anything)
+	mockClient.AssertNotCalled(t, "RemoveAll", mock.Anything)
+}
+
+func TestPolicy_LocalOnlyRenameOut(t *testing.T) {
+	tmpDir := t.TempDir()
+	mockClient := &MockWebdav{}
+	require.NoError(t, os.MkdirAll(filepath.Join(tmpDir, "Uploads"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(tmpDir, "Uploads", "file.txt"), []byte("data"), 0644))
+
+	proxy := fs.NewPikpakProxy(lgr.New(), tmpDir, mockClient, rules(t, "/Uploads:local-only"))
+
+	// Файл из local-only поддерева переносится только локально
+	require.NoError(t, proxy.Rename(context.Background(), "/Uploads/file.txt", "/file.txt"))
+	assert.FileExists(t, filepath.Join(tmpDir, "file.txt"))
+	mockClient.AssertNotCalled(t, "Rename", mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestPolicy_WriteThrough(t *testing.T) {
+	tmpDir := t.TempDir()
+	mockClient := &MockWebdav{}
+	client := writableWebdav{MockWebdav: mockClient, uploaded: map[string]string{}}
+	mockClient.On("Stat", mock.Anything).Return(nil, os.ErrNotExist)
+
+	proxy := fs.NewPikpakProxy(lgr.New(), tmpDir, client, rules(t, "/Sync:write-through"))
+	ctx := context.Background()
+
+	mockClient.On("MkdirAll", "/Sync", os.FileMode(0755)).Return(nil)
+	require.NoError(t, proxy.Mkdir(ctx, "/Sync", 0755))
+
+	f, err := proxy.OpenFile(ctx, "/Sync/file.txt", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	require.NoError(t, err)
+	_, err = f.Write([]byte("data"))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	assert.Equal(t, "data", client.uploaded["/Sync/file.txt"])
+
+	// Ошибка на удаленном сервере не скрывается
+	mockClient.On("RemoveAll", "/Sync/file.txt").Return(errors.New("remote failed"))
+	assert.Error(t, proxy.RemoveAll(ctx, "/Sync/file.txt"))
+}
+
+func TestPolicy_WriteThroughUnsupported(t *testing.T) {
+	tmpDir := t.TempDir()
+	mockClient := &MockWebdav{}
+	mockClient.On("Stat", mock.Anything).Return(nil, os.ErrNotExist)
+
+	proxy := fs.NewPikpakProxy(lgr.New(), tmpDir, mockClient, rules(t, "/**:write-through"))
+
+	f, err := proxy.OpenFile(context.Background(), "/file.txt", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	require.NoError(t, err)
+	assert.Error(t, f.Close())
+}
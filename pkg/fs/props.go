@@ -0,0 +1,202 @@
+package fs
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/ReanSn0w/pikpak-webdav-proxy/pkg/utils"
+	"github.com/go-pkgz/lgr"
+	"golang.org/x/net/webdav"
+)
+
+// propStore - хранилище "мертвых" свойств WebDAV (PROPPATCH), сохраняемое
+// в служебной директории. Ни локальные, ни удаленные файлы не умеют хранить
+// свойства, поэтому они хранятся отдельно по пути файла
+type propStore struct {
+	log  lgr.L
+	path string
+
+	mu    sync.Mutex
+	items map[string][]webdav.Property
+}
+
+func newPropStore(log lgr.L, path string) *propStore {
+	s := &propStore{
+		log:   log,
+		path:  path,
+		items: make(map[string][]webdav.Property),
+	}
+
+	data, err := os.ReadFile(path)
+	switch {
+	case os.IsNotExist(err):
+		return s
+	case err != nil:
+		log.Logf("[WARN] failed to read dead properties: %v", err)
+		return s
+	}
+
+	if err := json.Unmarshal(data, &s.items); err != nil {
+		log.Logf("[WARN] failed to decode dead properties: %v", err)
+	}
+
+	return s
+}
+
+// get возвращает свойства файла name
+func (s *propStore) get(name string) map[xml.Name]webdav.Property {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	result := make(map[xml.Name]webdav.Property)
+	for _, prop := range s.items[path.Clean("/"+name)] {
+		result[prop.XMLName] = prop
+	}
+
+	return result
+}
+
+// patch применяет изменения свойств файла name
+func (s *propStore) patch(name string, patches []webdav.Proppatch) []webdav.Propstat {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	name = path.Clean("/" + name)
+
+	props := make(map[xml.Name]webdav.Property)
+	for _, prop := range s.items[name] {
+		props[prop.XMLName] = prop
+	}
+
+	stat := webdav.Propstat{Status: http.StatusOK}
+	for _, patch := range patches {
+		for _, prop := range patch.Props {
+			stat.Props = append(stat.Props, webdav.Property{XMLName: prop.XMLName})
+			if patch.Remove {
+				delete(props, prop.XMLName)
+			} else {
+				props[prop.XMLName] = prop
+			}
+		}
+	}
+
+	if len(props) == 0 {
+		delete(s.items, name)
+	} else {
+		list := make([]webdav.Property, 0, len(props))
+		for _, prop := range props {
+			list = append(list, prop)
+		}
+		s.items[name] = list
+	}
+
+	s.save()
+	return []webdav.Propstat{stat}
+}
+
+// move переносит свойства файла и всех вложенных в него файлов
+func (s *propStore) move(oldName, newName string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	oldName, newName = path.Clean("/"+oldName), path.Clean("/"+newName)
+
+	changed := false
+	moved := make(map[string][]webdav.Property)
+	for key, props := range s.items {
+		if rel, ok := within(oldName, key); ok {
+			delete(s.items, key)
+			moved[path.Join(newName, rel)] = props
+			changed = true
+		} else if _, ok := within(newName, key); ok {
+			// Перезаписанный файл теряет свои свойства
+			delete(s.items, key)
+			changed = true
+		}
+	}
+
+	if !changed {
+		return
+	}
+
+	for key, props := range moved {
+		s.items[key] = props
+	}
+
+	s.save()
+}
+
+// copy копирует свойства файла src в dst, а с recursive - и свойства
+// всех вложенных в src файлов
+func (s *propStore) copy(src, dst string, recursive bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	src, dst = path.Clean("/"+src), path.Clean("/"+dst)
+
+	copied := make(map[string][]webdav.Property)
+	for key, props := range s.items {
+		rel, ok := within(src, key)
+		if !ok || (rel != "" && !recursive) {
+			continue
+		}
+		copied[path.Join(dst, rel)] = append([]webdav.Property(nil), props...)
+	}
+
+	if len(copied) == 0 {
+		return
+	}
+
+	for key, props := range copied {
+		s.items[key] = props
+	}
+
+	s.save()
+}
+
+// forget удаляет свойства файла и всех вложенных в него файлов
+func (s *propStore) forget(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	name = path.Clean("/" + name)
+
+	changed := false
+	for key := range s.items {
+		if _, ok := within(name, key); ok {
+			delete(s.items, key)
+			changed = true
+		}
+	}
+
+	if changed {
+		s.save()
+	}
+}
+
+// save записывает свойства в файл, ошибки только логируются
+func (s *propStore) save() {
+	if err := utils.WriteJSONAtomic(s.path, s.items); err != nil {
+		s.log.Logf("[ERROR] failed to save dead properties: %v", err)
+	}
+}
+
+// within проверяет, совпадает ли name с root или вложен в него,
+// и возвращает путь относительно root
+func within(root, name string) (string, bool) {
+	switch {
+	case name == root:
+		return "", true
+	case root == "/":
+		return strings.TrimPrefix(name, "/"), true
+	case strings.HasPrefix(name, root+"/"):
+		return strings.TrimPrefix(name, root+"/"), true
+	default:
+		return "", false
+	}
+}
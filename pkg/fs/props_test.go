@@ -0,0 +1,126 @@
+package fs_test
+
+import (
+	"context"
+	"encoding/xml"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ReanSn0w/pikpak-webdav-proxy/pkg/fs"
+	lgr "github.com/go-pkgz/lgr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/webdav"
+)
+
+var win32Time = xml.Name{Space: "urn:schemas-microsoft-com:", Local: "Win32LastModifiedTime"}
+
+func patchProp(t *testing.T, proxy *fs.PikpakProxy, name string, remove bool, props ...webdav.Property) {
+	t.Helper()
+
+	f, err := proxy.OpenFile(context.Background(), name, os.O_RDONLY, 0)
+	require.NoError(t, err)
+	defer f.Close()
+
+	holder, ok := f.(webdav.DeadPropsHolder)
+	require.True(t, ok)
+
+	stats, err := holder.Patch([]webdav.Proppatch{{Remove: remove, Props: props}})
+	require.NoError(t, err)
+	require.Len(t, stats, 1)
+	assert.Equal(t, http.StatusOK, stats[0].Status)
+}
+
+func deadProps(t *testing.T, proxy *fs.PikpakProxy, name string) map[xml.Name]webdav.Property {
+	t.Helper()
+
+	f, err := proxy.OpenFile(context.Background(), name, os.O_RDONLY, 0)
+	require.NoError(t, err)
+	defer f.Close()
+
+	props, err := f.(webdav.DeadPropsHolder).DeadProps()
+	require.NoError(t, err)
+	return props
+}
+
+func TestDeadProps_PatchAndPersist(t *testing.T) {
+	tmpDir := t.TempDir()
+	mockClient := &MockWebdav{}
+	require.NoError(t, os.WriteFile(filepath.Join(tmpDir, "file.txt"), []byte("data"), 0644))
+
+	proxy := fs.NewPikpakProxy(lgr.New(), tmpDir, mockClient)
+	patchProp(t, proxy, "/file.txt", false, webdav.Property{XMLName: win32Time, InnerXML: []byte("Mon, 01 Jan 2024 00:00:00 GMT")})
+
+	// Свойства сохраняются между перезапусками
+	restarted := fs.NewPikpakProxy(lgr.New(), tmpDir, mockClient)
+	props := deadProps(t, restarted, "/file.txt")
+	require.Contains(t, props, win32Time)
+	assert.Equal(t, "Mon, 01 Jan 2024 00:00:00 GMT", string(props[win32Time].InnerXML))
+
+	patchProp(t, restarted, "/file.txt", true, webdav.Property{XMLName: win32Time})
+	assert.Empty(t, deadProps(t, restarted, "/file.txt"))
+}
+
+func TestDeadProps_RemoteFile(t *testing.T) {
+	tmpDir := t.TempDir()
+	mockClient := &MockWebdav{}
+	mockClient.On("Stat", "/remote.txt").Return(newMockFileInfo("remote.txt", false), nil)
+
+	proxy := fs.NewPikpakProxy(lgr.New(), tmpDir, mockClient)
+	patchProp(t, proxy, "/remote.txt", false, webdav.Property{XMLName: win32Time, InnerXML: []byte("x")})
+
+	assert.Contains(t, deadProps(t, proxy, "/remote.txt"), win32Time)
+}
+
+func TestDeadProps_MovedOnRename(t *testing.T) {
+	tmpDir := t.TempDir()
+	mockClient := &MockWebdav{}
+	require.NoError(t, os.MkdirAll(filepath.Join(tmpDir, "dir"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(tmpDir, "dir", "file.txt"), []byte("data"), 0644))
+
+	proxy := fs.NewPikpakProxy(lgr.New(), tmpDir, mockClient)
+	patchProp(t, proxy, "/dir/file.txt", false, webdav.Property{XMLName: win32Time, InnerXML: []byte("x")})
+
+	mockClient.On("Rename", "/dir", "/moved", true).Return(nil)
+	require.NoError(t, proxy.Rename(context.Background(), "/dir", "/moved"))
+
+	assert.Contains(t, deadProps(t, proxy, "/moved/file.txt"), win32Time)
+
+	require.NoError(t, os.MkdirAll(filepath.Join(tmpDir, "dir"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(tmpDir, "dir", "file.txt"), []byte("new"), 0644))
+	assert.Empty(t, deadProps(t, proxy, "/dir/file.txt"))
+}
+
+func TestDeadProps_DroppedOnRemoveAll(t *testing.T) {
+	tmpDir := t.TempDir()
+	mockClient := &MockWebdav{}
+	require.NoError(t, os.WriteFile(filepath.Join(tmpDir, "file.txt"), []byte("data"), 0644))
+
+	proxy := fs.NewPikpakProxy(lgr.New(), tmpDir, mockClient)
+	patchProp(t, proxy, "/file.txt", false, webdav.Property{XMLName: win32Time, InnerXML: []byte("x")})
+
+	mockClient.On("RemoveAll", "/file.txt").Return(nil)
+	require.NoError(t, proxy.RemoveAll(context.Background(), "/file.txt"))
+
+	require.NoError(t, os.WriteFile(filepath.Join(tmpDir, "file.txt"), []byte("data"), 0644))
+	assert.Empty(t, deadProps(t, proxy, "/file.txt"))
+}
+
+func TestDeadProps_DroppedOnOverwrite(t *testing.T) {
+	tmpDir := t.TempDir()
+	mockClient := &MockWebdav{}
+	require.NoError(t, os.WriteFile(filepath.Join(tmpDir, "a.txt"), []byte("a"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(tmpDir, "b.txt"), []byte("b"), 0644))
+
+	proxy := fs.NewPikpakProxy(lgr.New(), tmpDir, mockClient)
+	patchProp(t, proxy, "/b.txt", false, webdav.Property{XMLName: win32Time, InnerXML: []byte("x")})
+
+	// Файл без свойств заменяет файл со свойствами
+	mockClient.On("Rename", "/a.txt", "/b.txt", true).Return(nil)
+	require.NoError(t, proxy.Rename(context.Background(), "/a.txt", "/b.txt"))
+
+	restarted := fs.NewPikpakProxy(lgr.New(), tmpDir, mockClient)
+	assert.Empty(t, deadProps(t, restarted, "/b.txt"))
+}
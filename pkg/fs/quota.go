@@ -0,0 +1,355 @@
+package fs
+
+import (
+	"context"
+	"encoding/xml"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ReanSn0w/pikpak-webdav-proxy/pkg/quota"
+	"golang.org/x/net/webdav"
+)
+
+// usageTTL - время, через которое размер кеша пересчитывается обходом
+// директории. Между пересчетами изменения через прокси учитываются
+// по мере их выполнения, а изменения в обход прокси - при пересчете
+const usageTTL = 10 * time.Minute
+
+var (
+	quotaAvailableName = xml.Name{Space: "DAV:", Local: "quota-available-bytes"}
+	quotaUsedName      = xml.Name{Space: "DAV:", Local: "quota-used-bytes"}
+)
+
+// cacheUsage подсчитывает размер файлов в локальном слое в байтах на диске.
+// Временные файлы в MetaPath("tmp") тоже занимают место в кеше: они
+// учитываются при обходе и, пока записываются, резервом hold
+type cacheUsage struct {
+	root string
+	// syncedCheck возвращает для обхода проверку, есть ли локальный файл
+	// уже на удаленном сервере
+	syncedCheck func() func(path string, info os.FileInfo) bool
+
+	// walk не дает запускать несколько обходов одновременно
+	walk sync.Mutex
+
+	mu      sync.Mutex
+	value   int64
+	known   bool
+	counted time.Time
+	// temp - место, зарезервированное под записываемые временные файлы
+	temp int64
+	// synced - часть value, занятая файлами, которые уже есть на удаленном
+	// сервере. Подсчитывается при обходе и уменьшается при вытеснении
+	synced int64
+}
+
+func newCacheUsage(root string) *cacheUsage {
+	return &cacheUsage{root: root}
+}
+
+// get возвращает размер кеша. Обход директории выполняется без удержания
+// мьютекса: пока он идет, остальные получают прежнее значение
+func (u *cacheUsage) get() (int64, error) {
+	if value, ok := u.cached(); ok {
+		return value, nil
+	}
+
+	u.mu.Lock()
+	known := u.known
+	u.mu.Unlock()
+
+	if known {
+		if !u.walk.TryLock() {
+			value, _ := u.cached()
+			return value, nil
+		}
+	} else {
+		u.walk.Lock()
+	}
+	defer u.walk.Unlock()
+
+	// Пока ждали, размер мог подсчитать другой вызов
+	if value, ok := u.cached(); ok {
+		return value, nil
+	}
+
+	total, synced, err := u.count()
+	if err != nil {
+		return 0, err
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.value, u.synced, u.known, u.counted = total, synced, true, time.Now()
+	return total + u.temp, nil
+}
+
+// unsynced возвращает размер кеша без файлов, которые уже есть
+// на удаленном сервере
+func (u *cacheUsage) unsynced() (int64, error) {
+	used, err := u.get()
+	if err != nil {
+		return 0, err
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return max(used-u.synced, 0), nil
+}
+
+// cached возвращает размер, если он подсчитан и не устарел. Если он
+// известен, но устарел, возвращается он же и false
+func (u *cacheUsage) cached() (int64, bool) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.value + u.temp, u.known && time.Since(u.counted) < usageTTL
+}
+
+// count обходит локальный слой и суммирует размеры файлов: всех и тех,
+// что уже есть на удаленном сервере. Из служебной директории учитываются
+// только временные файлы: остальное в ней - небольшие файлы состояния
+func (u *cacheUsage) count() (total, synced int64, err error) {
+	meta := filepath.Join(filepath.Clean(u.root), MetaDir)
+	tmp := filepath.Join(meta, "tmp")
+
+	var isSynced func(string, os.FileInfo) bool
+	if u.syncedCheck != nil {
+		isSynced = u.syncedCheck()
+	}
+
+	err = filepath.WalkDir(u.root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+
+		if filepath.Dir(path) == meta && path != tmp {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+
+		total += info.Size()
+		if isSynced != nil && !strings.HasPrefix(path, meta+string(filepath.Separator)) && isSynced(path, info) {
+			synced += info.Size()
+		}
+		return nil
+	})
+	return total, synced, err
+}
+
+// add учитывает изменение размера кеша на delta байт
+func (u *cacheUsage) add(delta int64) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.known {
+		u.value = max(u.value+delta, 0)
+	}
+}
+
+// removeSynced учитывает удаление файла размером size, который уже есть
+// на удаленном сервере
+func (u *cacheUsage) removeSynced(size int64) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.known {
+		u.value = max(u.value-size, 0)
+		u.synced = max(u.synced-size, 0)
+	}
+}
+
+// markSynced отмечает, что size байт кеша уже есть на удаленном сервере
+func (u *cacheUsage) markSynced(size int64) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.known {
+		u.synced = min(u.synced+size, u.value)
+	}
+}
+
+// hold резервирует size байт под записываемый временный файл. Возвращаемая
+// функция снимает резерв, повторные вызовы ничего не делают. Если файл
+// попадет в пересчет раньше, он учитывается дважды, то есть размер
+// завышается до снятия резерва, но не занижается
+func (u *cacheUsage) hold(size int64) func() {
+	u.mu.Lock()
+	u.temp += size
+	u.mu.Unlock()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			u.mu.Lock()
+			u.temp -= size
+			u.mu.Unlock()
+		})
+	}
+}
+
+// invalidate запрашивает пересчет размера после изменений, размер которых
+// сложно учесть, например копирования или синхронизации директорий
+func (u *cacheUsage) invalidate() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.counted = time.Time{}
+}
+
+// CacheUsage возвращает размер файлов в локальном слое
+func (p *PikpakProxy) CacheUsage() (int64, error) {
+	return p.usage.get()
+}
+
+// Quota возвращает объединенную квоту: квоту удаленного сервера и бюджет
+// локального кеша. Файлы кеша, которые уже есть на удаленном сервере,
+// входят в его квоту и второй раз не учитываются. Если удаленный сервер
+// не сообщает квоту, а бюджет не ограничен, свободное место неизвестно
+func (p *PikpakProxy) Quota(ctx context.Context) (quota.Quota, error) {
+	used, err := p.usage.get()
+	if err != nil {
+		return quota.Quota{}, err
+	}
+
+	result := quota.Quota{Used: used, Available: -1}
+
+	if p.quotaSource != nil {
+		upstream, err := p.quotaSource.Quota(ctx)
+		if err != nil {
+			p.log.Logf("[WARN] failed to get upstream quota: %v", err)
+		} else {
+			unsynced, err := p.usage.unsynced()
+			if err != nil {
+				return quota.Quota{}, err
+			}
+			result.Used = upstream.Used + unsynced
+			result.Available = upstream.Available
+		}
+	}
+
+	if p.cacheBudget > 0 {
+		local := max(p.cacheBudget-used, 0)
+		if result.Available < 0 {
+			result.Available = local
+		} else {
+			result.Available += local
+		}
+	}
+
+	return result, nil
+}
+
+// quotaProps возвращает свойства квоты RFC 4331 для директории
+func (p *PikpakProxy) quotaProps(ctx context.Context) map[xml.Name]webdav.Property {
+	q, err := p.Quota(ctx)
+	if err != nil {
+		p.log.Logf("[WARN] failed to get quota: %v", err)
+		return nil
+	}
+
+	props := map[xml.Name]webdav.Property{
+		quotaUsedName: {XMLName: quotaUsedName, InnerXML: []byte(strconv.FormatInt(q.Used, 10))},
+	}
+
+	if q.Available >= 0 {
+		props[quotaAvailableName] = webdav.Property{
+			XMLName:  quotaAvailableName,
+			InnerXML: []byte(strconv.FormatInt(q.Available, 10)),
+		}
+	}
+
+	return props
+}
+
+// protectedProp проверяет, является ли свойство вычисляемым, которое
+// нельзя изменить через PROPPATCH
+func protectedProp(name xml.Name) bool {
+	return name == quotaAvailableName || name == quotaUsedName
+}
+
+// filterProtected убирает вычисляемые свойства из изменений и возвращает
+// их статус 403. Остальные изменения применяются, чтобы COPY, который
+// переносит все свойства, не терял свойства клиентов
+func filterProtected(patches []webdav.Proppatch) ([]webdav.Proppatch, *webdav.Propstat) {
+	var denied webdav.Propstat
+
+	result := make([]webdav.Proppatch, 0, len(patches))
+	for _, patch := range patches {
+		filtered := webdav.Proppatch{Remove: patch.Remove}
+		for _, prop := range patch.Props {
+			if protectedProp(prop.XMLName) {
+				denied.Props = append(denied.Props, webdav.Property{XMLName: prop.XMLName})
+				continue
+			}
+			filtered.Props = append(filtered.Props, prop)
+		}
+		result = append(result, filtered)
+	}
+
+	if len(denied.Props) == 0 {
+		return result, nil
+	}
+
+	denied.Status = http.StatusForbidden
+	denied.XMLError = "<D:cannot-modify-protected-property xmlns:D=\"DAV:\"/>"
+	return result, &denied
+}
+
+// diskSize возвращает размер локального файла на диске или 0, если файла нет
+func diskSize(path string) int64 {
+	info, err := os.Lstat(path)
+	if err != nil || info.IsDir() {
+		return 0
+	}
+	return info.Size()
+}
+
+// storedSize возвращает место на диске, которое занимает локальный файл
+// с информацией info: для зашифрованных файлов это размер шифротекста
+func storedSize(info os.FileInfo) int64 {
+	if i, ok := info.(cryptInfo); ok {
+		return i.FileInfo.Size()
+	}
+	return info.Size()
+}
+
+// removeCached удаляет локальную копию файла и возвращает освобожденный
+// размер на диске
+func (p *PikpakProxy) removeCached(name string) (int64, error) {
+	path := p.LocalFilePath(name)
+	size := diskSize(path)
+	if err := os.Remove(path); err != nil {
+		return 0, err
+	}
+
+	// Вытесняются только файлы, совпадающие с удаленной версией
+	p.usage.removeSynced(size)
+	return size, nil
+}
+
+// syncedCheck возвращает проверку для подсчета размера кеша: совпадает ли
+// локальный файл по записанному состоянию с версией на удаленном сервере
+func (p *PikpakProxy) syncedCheck() func(string, os.FileInfo) bool {
+	state := loadSyncState(p.log, p.MetaPath("sync.json"))
+	return func(localPath string, info os.FileInfo) bool {
+		rel, err := filepath.Rel(p.localPath, localPath)
+		if err != nil {
+			return false
+		}
+		name := path.Clean("/" + filepath.ToSlash(rel))
+		return p.recordedClean(state, name, p.crypt.info(localPath, info))
+	}
+}
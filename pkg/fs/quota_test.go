@@ -0,0 +1,235 @@
+package fs_test
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ReanSn0w/pikpak-webdav-proxy/pkg/fs"
+	"github.com/ReanSn0w/pikpak-webdav-proxy/pkg/quota"
+	lgr "github.com/go-pkgz/lgr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/webdav"
+)
+
+var quotaUsed = xml.Name{Space: "DAV:", Local: "quota-used-bytes"}
+
+// staticQuota - источник квоты с фиксированным значением
+type staticQuota struct {
+	quota quota.Quota
+	err   error
+}
+
+func (s staticQuota) Quota(ctx context.Context) (quota.Quota, error) {
+	return s.quota, s.err
+}
+
+func newQuotaProxy(t *testing.T, opts ...fs.Option) *fs.PikpakProxy {
+	tmpDir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(tmpDir, "file.bin"), make([]byte, 100), 0644))
+	mockClient := &MockWebdav{}
+	mockClient.On("Stat", mock.Anything).Return(nil, os.ErrNotExist)
+
+	return fs.NewPikpakProxy(lgr.New(), tmpDir, mockClient, opts...)
+}
+
+func TestQuota(t *testing.T) {
+	tests := []struct {
+		name     string
+		opts     []fs.Option
+		expected quota.Quota
+	}{
+		{
+			name:     "local only, unlimited",
+			expected: quota.Quota{Used: 100, Available: -1},
+		},
+		{
+			name:     "local budget",
+			opts:     []fs.Option{fs.WithCacheBudget(1000)},
+			expected: quota.Quota{Used: 100, Available: 900},
+		},
+		{
+			name:     "upstream and budget",
+			opts:     []fs.Option{fs.WithCacheBudget(1000), fs.WithQuota(staticQuota{quota: quota.Quota{Used: 50, Available: 5000}})},
+			expected: quota.Quota{Used: 150, Available: 5900},
+		},
+		{
+			name:     "budget exceeded",
+			opts:     []fs.Option{fs.WithCacheBudget(10), fs.WithQuota(staticQuota{quota: quota.Quota{Used: 50, Available: 5000}})},
+			expected: quota.Quota{Used: 150, Available: 5000},
+		},
+		{
+			name:     "upstream unavailable",
+			opts:     []fs.Option{fs.WithCacheBudget(1000), fs.WithQuota(staticQuota{err: errors.New("down")})},
+			expected: quota.Quota{Used: 100, Available: 900},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q, err := newQuotaProxy(t, tt.opts...).Quota(context.Background())
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, q)
+		})
+	}
+}
+
+func TestQuota_SyncedNotCountedTwice(t *testing.T) {
+	for _, budget := range []int64{0, 1000} {
+		localDir, remoteDir := t.TempDir(), t.TempDir()
+		require.NoError(t, os.WriteFile(filepath.Join(localDir, "local.bin"), make([]byte, 100), 0644))
+		writeLocalFile(t, remoteDir, "synced.bin", strings.Repeat("s", 300), testTime)
+
+		upstream := staticQuota{quota: quota.Quota{Used: 300, Available: 5000}}
+		proxy := fs.NewPikpakProxy(lgr.New(), localDir, remoteClient(t, remoteDir), fs.WithCacheBudget(budget), fs.WithQuota(upstream))
+		require.NoError(t, proxy.Fetch(context.Background(), "/synced.bin"))
+
+		// Скачанный файл уже входит в квоту удаленного сервера
+		q, err := proxy.Quota(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, int64(400), q.Used, "budget %d", budget)
+
+		used, err := proxy.CacheUsage()
+		require.NoError(t, err)
+		assert.Equal(t, int64(400), used, "budget %d", budget)
+	}
+}
+
+func TestQuota_MetaDirNotCounted(t *testing.T) {
+	proxy := newQuotaProxy(t)
+	require.NoError(t, os.MkdirAll(proxy.MetaPath(), 0755))
+	require.NoError(t, os.WriteFile(proxy.MetaPath("big"), make([]byte, 1000), 0644))
+
+	used, err := proxy.CacheUsage()
+	require.NoError(t, err)
+	assert.Equal(t, int64(100), used)
+}
+
+func TestQuota_TempFilesCounted(t *testing.T) {
+	tmpDir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(tmpDir, "file.bin"), make([]byte, 100), 0644))
+	mockClient := &MockWebdav{}
+	mockClient.On("ReadDir", "/").Return([]os.FileInfo{}, nil)
+	proxy := fs.NewPikpakProxy(lgr.New(), tmpDir, mockClient, fs.WithCacheBudget(1000))
+
+	require.NoError(t, os.MkdirAll(proxy.MetaPath("tmp"), 0755))
+	require.NoError(t, os.WriteFile(proxy.MetaPath("tmp", "upload-1"), make([]byte, 300), 0644))
+
+	used, err := proxy.CacheUsage()
+	require.NoError(t, err)
+	assert.Equal(t, int64(400), used)
+
+	// Записываемый временный файл учитывается до снятия резерва
+	release, err := proxy.ReserveTemp(context.Background(), 500)
+	require.NoError(t, err)
+	used, err = proxy.CacheUsage()
+	require.NoError(t, err)
+	assert.Equal(t, int64(900), used)
+
+	_, err = proxy.ReserveTemp(context.Background(), 200)
+	assert.ErrorIs(t, err, fs.ErrInsufficientStorage)
+	assert.ErrorIs(t, proxy.Reserve(context.Background(), "/new.bin", 200), fs.ErrInsufficientStorage)
+
+	release()
+	release()
+	used, err = proxy.CacheUsage()
+	require.NoError(t, err)
+	assert.Equal(t, int64(400), used)
+}
+
+func TestQuota_Incremental(t *testing.T) {
+	tmpDir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(tmpDir, "file.bin"), make([]byte, 100), 0644))
+	mockClient := &MockWebdav{}
+	mockClient.On("Stat", mock.Anything).Return(nil, os.ErrNotExist)
+	mockClient.On("Rename", mock.Anything, mock.Anything, true).Return(os.ErrNotExist)
+	mockClient.On("RemoveAll", mock.Anything).Return(os.ErrNotExist)
+
+	proxy := fs.NewPikpakProxy(lgr.New(), tmpDir, mockClient)
+	ctx := context.Background()
+
+	used, err := proxy.CacheUsage()
+	require.NoError(t, err)
+	require.Equal(t, int64(100), used)
+
+	// Файлы, измененные в обход прокси, учитываются только при пересчете
+	require.NoError(t, os.WriteFile(filepath.Join(tmpDir, "outside.bin"), make([]byte, 1000), 0644))
+
+	write := func(name string, size int) {
+		f, err := proxy.OpenFile(ctx, name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+		require.NoError(t, err)
+		_, err = f.Write(make([]byte, size))
+		require.NoError(t, err)
+		require.NoError(t, f.Close())
+	}
+
+	steps := []struct {
+		name     string
+		apply    func()
+		expected int64
+	}{
+		{"new file", func() { write("/new.bin", 50) }, 150},
+		{"overwrite", func() { write("/file.bin", 20) }, 70},
+		{"rename over", func() { require.NoError(t, proxy.Rename(ctx, "/new.bin", "/file.bin")) }, 50},
+		{"remove", func() { require.NoError(t, proxy.RemoveAll(ctx, "/file.bin")) }, 0},
+	}
+
+	for _, step := range steps {
+		step.apply()
+		used, err := proxy.CacheUsage()
+		require.NoError(t, err)
+		assert.Equal(t, step.expected, used, step.name)
+	}
+}
+
+func TestQuota_Propfind(t *testing.T) {
+	proxy := newQuotaProxy(t, fs.WithCacheBudget(1000))
+
+	handler := &webdav.Handler{FileSystem: proxy, LockSystem: webdav.NewMemLS()}
+
+	propfind := func(name string) string {
+		req := httptest.NewRequest("PROPFIND", name, strings.NewReader(`<?xml version="1.0"?>
+<D:propfind xmlns:D="DAV:"><D:prop><D:quota-available-bytes/><D:quota-used-bytes/></D:prop></D:propfind>`))
+		req.Header.Set("Depth", "0")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Body.String()
+	}
+
+	body := propfind("/")
+	assert.Contains(t, body, "<D:quota-available-bytes>900</D:quota-available-bytes>")
+	assert.Contains(t, body, "<D:quota-used-bytes>100</D:quota-used-bytes>")
+
+	// У файлов квоты нет
+	assert.NotContains(t, propfind("/file.bin"), "<D:quota-used-bytes>100")
+}
+
+func TestQuota_ProtectedFromPatch(t *testing.T) {
+	proxy := newQuotaProxy(t)
+
+	f, err := proxy.OpenFile(context.Background(), "/", os.O_RDONLY, 0)
+	require.NoError(t, err)
+	defer f.Close()
+
+	stats, err := f.(webdav.DeadPropsHolder).Patch([]webdav.Proppatch{{Props: []webdav.Property{
+		{XMLName: win32Time, InnerXML: []byte("x")},
+		{XMLName: quotaUsed, InnerXML: []byte("0")},
+	}}})
+	require.NoError(t, err)
+	require.Len(t, stats, 2)
+	assert.Equal(t, http.StatusOK, stats[0].Status)
+	assert.Equal(t, http.StatusForbidden, stats[1].Status)
+
+	props, err := f.(webdav.DeadPropsHolder).DeadProps()
+	require.NoError(t, err)
+	assert.Contains(t, props, win32Time)
+	assert.Equal(t, "100", string(props[quotaUsed].InnerXML))
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package fs
+
+import "errors"
+
+// reflink не поддерживается на этой платформе
+func reflink(srcPath, dstPath string) error {
+	return errors.ErrUnsupported
+}
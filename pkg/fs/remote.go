@@ -0,0 +1,188 @@
+package fs
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/studio-b12/gowebdav"
+)
+
+// RemoteClient - клиент удаленного WebDAV сервера, который дополнительно
+// запрашивает контрольные суммы файлов из свойства oc:checksums,
+// которое отдают Nextcloud, ownCloud и rclone
+type RemoteClient struct {
+	*gowebdav.Client
+
+	baseURL string
+	user    string
+	pass    string
+	client  *http.Client
+}
+
+func NewRemoteClient(baseURL, user, pass string) *RemoteClient {
+	return &RemoteClient{
+		Client:  gowebdav.NewClient(baseURL, user, pass),
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		user:    user,
+		pass:    pass,
+		client:  &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+const checksumsPropfind = `<?xml version="1.0" encoding="utf-8"?>
+<d:propfind xmlns:d="DAV:" xmlns:oc="http://owncloud.org/ns">
+  <d:prop><oc:checksums/></d:prop>
+</d:propfind>`
+
+// checksumsMultistatus - ответ PROPFIND со свойством oc:checksums.
+// Значение свойства - список сумм вида "SHA1:… MD5:…" через пробел
+type checksumsMultistatus struct {
+	Responses []struct {
+		Propstats []struct {
+			Checksums []string `xml:"prop>checksums>checksum"`
+		} `xml:"propstat"`
+	} `xml:"response"`
+}
+
+// Checksums запрашивает контрольные суммы файла name. Если сервер
+// не знает ни SHA-256, ни MD5 файла, возвращается ErrNoChecksum
+func (c *RemoteClient) Checksums(name string) (Checksums, error) {
+	target := c.baseURL + (&url.URL{Path: "/" + strings.TrimPrefix(name, "/")}).EscapedPath()
+
+	req, err := http.NewRequest("PROPFIND", target, strings.NewReader(checksumsPropfind))
+	if err != nil {
+		return Checksums{}, err
+	}
+
+	req.Header.Set("Content-Type", "application/xml; charset=utf-8")
+	req.Header.Set("Depth", "0")
+	if c.user != "" || c.pass != "" {
+		req.SetBasicAuth(c.user, c.pass)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return Checksums{}, err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		io.Copy(io.Discard, resp.Body)
+		return Checksums{}, notExist("checksum", name)
+	case resp.StatusCode != http.StatusMultiStatus:
+		io.Copy(io.Discard, resp.Body)
+		return Checksums{}, fmt.Errorf("remote PROPFIND %s: %s", name, resp.Status)
+	}
+
+	var ms checksumsMultistatus
+	if err := xml.NewDecoder(resp.Body).Decode(&ms); err != nil {
+		return Checksums{}, fmt.Errorf("remote PROPFIND %s: %w", name, err)
+	}
+
+	var sums Checksums
+	for _, r := range ms.Responses {
+		for _, ps := range r.Propstats {
+			for _, value := range ps.Checksums {
+				parseRemoteChecksums(value, &sums)
+			}
+		}
+	}
+
+	if sums.SHA256 == "" && sums.MD5 == "" {
+		return Checksums{}, ErrNoChecksum
+	}
+	return sums, nil
+}
+
+// parseRemoteChecksums разбирает значение oc:checksum и заполняет известные суммы
+func parseRemoteChecksums(value string, sums *Checksums) {
+	for _, field := range strings.Fields(value) {
+		algo, sum, ok := strings.Cut(field, ":")
+		if !ok || sum == "" {
+			continue
+		}
+
+		switch strings.ToUpper(strings.ReplaceAll(algo, "-", "")) {
+		case "SHA256":
+			sums.SHA256 = strings.ToLower(sum)
+		case "MD5":
+			sums.MD5 = strings.ToLower(sum)
+		}
+	}
+}
+
+// missingClient - клиент удаленного сервера, заменяющий ответ 404 ошибкой
+// os.ErrNotExist. gowebdav возвращает его как StatusError, который
+// os.IsNotExist не распознает, и без замены отсутствующий файл выглядел
+// бы для обработчиков WebDAV, S3 и SFTP как ошибка сервера
+type missingClient struct {
+	Webdav
+}
+
+func (c *missingClient) Stat(name string) (os.FileInfo, error) {
+	info, err := c.Webdav.Stat(name)
+	return info, missingError("stat", name, err)
+}
+
+func (c *missingClient) ReadDir(name string) ([]os.FileInfo, error) {
+	infos, err := c.Webdav.ReadDir(name)
+	return infos, missingError("readdir", name, err)
+}
+
+func (c *missingClient) ReadStreamRange(name string, offset int64, length int64) (io.ReadCloser, error) {
+	rc, err := c.Webdav.ReadStreamRange(name, offset, length)
+	return rc, missingError("open", name, err)
+}
+
+func (c *missingClient) MkdirAll(name string, perm os.FileMode) error {
+	return missingError("mkdir", name, c.Webdav.MkdirAll(name, perm))
+}
+
+func (c *missingClient) RemoveAll(name string) error {
+	return missingError("remove", name, c.Webdav.RemoveAll(name))
+}
+
+func (c *missingClient) Rename(oldName, newName string, overwrite bool) error {
+	return missingError("rename", oldName, c.Webdav.Rename(oldName, newName, overwrite))
+}
+
+func (c *missingClient) WriteStream(name string, stream io.Reader, mode os.FileMode) error {
+	w, ok := c.Webdav.(RemoteWriter)
+	if !ok {
+		return fmt.Errorf("remote client does not support writes: %s", name)
+	}
+	return missingError("write", name, w.WriteStream(name, stream, mode))
+}
+
+func (c *missingClient) Copy(oldName, newName string, overwrite bool) error {
+	cp, ok := c.Webdav.(RemoteCopier)
+	if !ok {
+		return fmt.Errorf("remote client does not support copy: %w", errors.ErrUnsupported)
+	}
+	return missingError("copy", oldName, cp.Copy(oldName, newName, overwrite))
+}
+
+func (c *missingClient) Checksums(name string) (Checksums, error) {
+	cs, ok := c.Webdav.(RemoteChecksummer)
+	if !ok {
+		return Checksums{}, ErrNoChecksum
+	}
+	sums, err := cs.Checksums(name)
+	return sums, missingError("checksum", name, err)
+}
+
+// missingError заменяет ответ 404 удаленного сервера ошибкой os.ErrNotExist
+func missingError(op, name string, err error) error {
+	if err != nil && !errors.Is(err, os.ErrNotExist) && gowebdav.IsErrNotFound(err) {
+		return notExist(op, name)
+	}
+	return err
+}
@@ -0,0 +1,109 @@
+package fs_test
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/ReanSn0w/pikpak-webdav-proxy/pkg/fs"
+	lgr "github.com/go-pkgz/lgr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/webdav"
+)
+
+const checksumsResponse = `<?xml version="1.0" encoding="utf-8"?>
+<d:multistatus xmlns:d="DAV:" xmlns:oc="http://owncloud.org/ns">
+  <d:response>
+    <d:href>%s</d:href>
+    <d:propstat>
+      <d:prop><oc:checksums><oc:checksum>%s</oc:checksum></oc:checksums></d:prop>
+      <d:status>HTTP/1.1 200 OK</d:status>
+    </d:propstat>
+  </d:response>
+</d:multistatus>`
+
+// newChecksumServer запускает WebDAV сервер с файлами из files, который
+// отвечает на запрос oc:checksums значениями из sums
+func newChecksumServer(t *testing.T, files map[string]string, sums map[string]string) *httptest.Server {
+	mem := webdav.NewMemFS()
+	for name, content := range files {
+		f, err := mem.OpenFile(context.Background(), name, os.O_RDWR|os.O_CREATE, 0644)
+		require.NoError(t, err)
+		f.Write([]byte(content))
+		f.Close()
+	}
+	handler := &webdav.Handler{FileSystem: mem, LockSystem: webdav.NewMemLS()}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "PROPFIND" {
+			body, _ := io.ReadAll(r.Body)
+			if strings.Contains(string(body), "checksums") {
+				sum, ok := sums[r.URL.Path]
+				if !ok {
+					http.NotFound(w, r)
+					return
+				}
+				w.WriteHeader(http.StatusMultiStatus)
+				fmt.Fprintf(w, checksumsResponse, r.URL.EscapedPath(), sum)
+				return
+			}
+			r.Body = io.NopCloser(strings.NewReader(string(body)))
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestRemoteClient_Checksums(t *testing.T) {
+	server := newChecksumServer(t, nil, map[string]string{
+		"/dir/a file.txt": "SHA1:aaa MD5:ABC SHA256:DEF ADLER32:1",
+		"/sha1.txt":       "SHA1:aaa",
+	})
+	client := fs.NewRemoteClient(server.URL, "", "")
+
+	sums, err := client.Checksums("/dir/a file.txt")
+	require.NoError(t, err)
+	assert.Equal(t, fs.Checksums{SHA256: "def", MD5: "abc"}, sums)
+
+	_, err = client.Checksums("/sha1.txt")
+	assert.ErrorIs(t, err, fs.ErrNoChecksum)
+
+	_, err = client.Checksums("/missing.txt")
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestRemoteClient_ProxyChecksums(t *testing.T) {
+	server := newChecksumServer(t,
+		map[string]string{"/remote.txt": "data"},
+		map[string]string{"/remote.txt": "MD5:8d777f385d3dfec8815d20f7496026dc"},
+	)
+	proxy := fs.NewPikpakProxy(lgr.New(), t.TempDir(), fs.NewRemoteClient(server.URL, "", ""))
+
+	sums, err := proxy.Checksums(context.Background(), "/remote.txt")
+	require.NoError(t, err)
+	assert.Equal(t, "8d777f385d3dfec8815d20f7496026dc", sums.MD5)
+}
+
+// TestRemoteClient_Missing тестирует, что ответ 404 удаленного сервера
+// распознается как os.ErrNotExist с кодированием имен и без него
+func TestRemoteClient_Missing(t *testing.T) {
+	for _, opts := range [][]fs.Option{nil, {fs.WithNameEncoding(fs.EncodeCtl, 0)}} {
+		proxy := fs.NewPikpakProxy(lgr.New(), t.TempDir(), remoteClient(t, t.TempDir()), opts...)
+
+		_, err := proxy.Stat(context.Background(), "/missing.txt")
+		assert.True(t, os.IsNotExist(err), "stat: %v", err)
+
+		_, err = proxy.OpenFile(context.Background(), "/missing.txt", os.O_RDONLY, 0)
+		assert.True(t, os.IsNotExist(err), "open: %v", err)
+
+		err = proxy.RemoveAll(context.Background(), "/missing.txt")
+		assert.True(t, err == nil || os.IsNotExist(err), "remove: %v", err)
+	}
+}
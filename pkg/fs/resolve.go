@@ -0,0 +1,181 @@
+package fs
+
+import (
+	"os"
+	"path"
+	"strings"
+)
+
+// resolveLayers определяет, в каких слоях следует искать файл с учетом
+// конфликтов типов у родительских директорий, и возвращает имя файла
+// на удаленном сервере. Нулевое значение слоя означает, что путь скрыт
+// файлом, победившим в конфликте с директорией другого слоя, скрыт фильтром
+// или относится к служебной директории
+func (p *PikpakProxy) resolveLayers(name string) (Layer, string) {
+	name = path.Clean("/" + name)
+	if name == "/" {
+		return LayerBoth, name
+	}
+
+	if isMeta(name) || p.hidden(name) {
+		return 0, name
+	}
+
+	parts := strings.Split(strings.TrimPrefix(name, "/"), "/")
+	layers := LayerBoth
+	dir, remoteDir := "/", "/"
+
+	for i, part := range parts {
+		cur, remoteCur := path.Join(dir, part), path.Join(remoteDir, p.normalizeName(part))
+
+		if layers == LayerBoth && p.conflictPolicy == ConflictKeepBoth {
+			if original, ok := p.conflictAlias(dir, part); ok {
+				layers = LayerRemote
+				remoteCur = path.Join(remoteDir, original)
+			}
+		}
+
+		if i < len(parts)-1 && layers == LayerBoth {
+			layers = p.childLayers(cur)
+			if layers == 0 {
+				p.log.Logf("[DEBUG] %s is hidden by a file in %s", name, cur)
+				return 0, name
+			}
+		}
+
+		dir, remoteDir = cur, remoteCur
+	}
+
+	if p.localOnly(name) {
+		layers &= LayerLocal
+	}
+
+	return layers, remoteDir
+}
+
+// conflictAlias проверяет, является ли имя part в директории dir именем
+// удаленной версии конфликтующего файла, и возвращает исходное имя
+func (p *PikpakProxy) conflictAlias(dir, part string) (string, bool) {
+	original, ok := conflictOriginal(part)
+	if !ok {
+		return "", false
+	}
+
+	// Настоящий локальный файл с таким именем имеет приоритет
+	if _, err := os.Stat(p.LocalFilePath(path.Join(dir, part))); err == nil {
+		return "", false
+	}
+
+	if !p.hasConflict(path.Join(dir, original)) {
+		return "", false
+	}
+
+	return original, true
+}
+
+// childLayers определяет, в каких слоях могут находиться файлы внутри
+// директории name, если в одном из слоев на ее месте находится файл
+func (p *PikpakProxy) childLayers(name string) Layer {
+	local, err := p.crypt.stat(p.LocalFilePath(name))
+	if err != nil {
+		return LayerBoth
+	}
+
+	if !p.remoteMayWin() {
+		// Локальная версия всегда побеждает: локальный файл скрывает
+		// удаленную директорию, а у удаленного файла нет вложенных файлов
+		if local.IsDir() {
+			return LayerBoth
+		}
+		return 0
+	}
+
+	remote, err := p.remoteClient.Stat(name)
+	if err != nil || local.IsDir() == remote.IsDir() {
+		if local.IsDir() {
+			return LayerBoth
+		}
+		return 0
+	}
+
+	p.detectConflict(name, local, remote)
+
+	winner, info := LayerLocal, local
+	if p.resolveConflict(local, remote) == LayerRemote {
+		winner, info = LayerRemote, remote
+	}
+
+	if !info.IsDir() {
+		return 0
+	}
+
+	return winner
+}
+
+// hasConflict проверяет, различаются ли локальная и удаленная версии файла
+func (p *PikpakProxy) hasConflict(name string) bool {
+	local, err := p.crypt.stat(p.LocalFilePath(name))
+	if err != nil {
+		return false
+	}
+
+	remote, err := p.remoteClient.Stat(name)
+	if err != nil || (local.IsDir() && remote.IsDir()) {
+		return false
+	}
+
+	return p.detectConflict(name, local, remote)
+}
+
+// remoteMayWin возвращает true, если политика позволяет удаленной версии
+// скрывать локальную
+func (p *PikpakProxy) remoteMayWin() bool {
+	return p.conflictPolicy == ConflictRemote || p.conflictPolicy == ConflictNewest
+}
+
+// statRemote возвращает информацию о файле с удаленного сервера под именем name
+func (p *PikpakProxy) statRemote(name, remoteName string) (os.FileInfo, error) {
+	remoteName, info, err := p.lookupRemote(remoteName)
+	if err != nil {
+		return nil, err
+	}
+
+	if path.Base(remoteName) != path.Base(path.Clean("/"+name)) {
+		return renamedInfo{FileInfo: info, name: path.Base(name)}, nil
+	}
+
+	return info, nil
+}
+
+func notExist(op, name string) error {
+	return &os.PathError{Op: op, Path: name, Err: os.ErrNotExist}
+}
+
+// remotePather - клиент удаленного сервера, который изменяет имена
+// файлов перед запросом: кодирует их или учитывает виртуальные перемещения
+type remotePather interface {
+	RemotePath(name string) (string, error)
+}
+
+// RemotePath возвращает путь файла name в запросах к удаленному серверу
+// с учетом конфликтов, кодирования имен и виртуальных перемещений. Для
+// путей, которых нет на удаленном сервере, возвращается os.ErrNotExist
+func (p *PikpakProxy) RemotePath(name string) (string, error) {
+	layers, remoteName := p.resolveLayers(name)
+	if layers&LayerRemote == 0 {
+		return "", notExist("resolve", name)
+	}
+
+	// Для несуществующих путей resolveLayers возвращает оба слоя, а LOCK
+	// такого пути создал бы на сервере пустой ресурс (RFC 4918, 9.10.4)
+	if _, err := p.remoteClient.Stat(remoteName); remoteMissing(err) {
+		return "", notExist("resolve", name)
+	} else if err != nil {
+		return "", err
+	}
+
+	if c, ok := p.remoteClient.(remotePather); ok {
+		return c.RemotePath(remoteName)
+	}
+	return remoteName, nil
+}
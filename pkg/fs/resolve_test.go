@@ -0,0 +1,241 @@
+package fs_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ReanSn0w/pikpak-webdav-proxy/pkg/fs"
+	lgr "github.com/go-pkgz/lgr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newDirInfo(name string, modTime time.Time) *MockFileInfo {
+	m := &MockFileInfo{name: name, isDir: true}
+	m.On("Name").Return(name)
+	m.On("IsDir").Return(true)
+	m.On("Size").Return(int64(0))
+	m.On("Mode").Return(os.ModeDir | 0755)
+	m.On("ModTime").Return(modTime)
+	m.On("Sys").Return(nil)
+	return m
+}
+
+// setupLocalFileRemoteDir создает локальный файл /x, в то время как
+// на удаленном сервере /x является директорией с файлом child.txt
+func setupLocalFileRemoteDir(t *testing.T, policy fs.ConflictPolicy) (*fs.PikpakProxy, *MockWebdav) {
+	tmpDir := t.TempDir()
+	mockClient := &MockWebdav{}
+
+	writeLocalFile(t, tmpDir, "x", "local", testTime)
+
+	child := newSizedFileInfo("child.txt", 5, testTime)
+	mockClient.On("Stat", "/x").Return(newDirInfo("x", testTime.Add(time.Hour)), nil)
+	mockClient.On("Stat", "/x/child.txt").Return(child, nil)
+	mockClient.On("ReadDir", "/").Return([]os.FileInfo{newDirInfo("x", testTime.Add(time.Hour))}, nil)
+	mockClient.On("ReadDir", "/x").Return([]os.FileInfo{child}, nil)
+
+	return fs.NewPikpakProxy(lgr.New(), tmpDir, mockClient, fs.WithConflictPolicy(policy)), mockClient
+}
+
+// setupLocalDirRemoteFile создает локальную директорию /x с файлом
+// child.txt, в то время как на удаленном сервере /x является файлом
+func setupLocalDirRemoteFile(t *testing.T, policy fs.ConflictPolicy) (*fs.PikpakProxy, *MockWebdav) {
+	tmpDir := t.TempDir()
+	mockClient := &MockWebdav{}
+
+	require.NoError(t, os.Mkdir(filepath.Join(tmpDir, "x"), 0755))
+	writeLocalFile(t, filepath.Join(tmpDir, "x"), "child.txt", "local", testTime)
+	require.NoError(t, os.Chtimes(filepath.Join(tmpDir, "x"), testTime, testTime))
+
+	remote := newSizedFileInfo("x", 10, testTime.Add(time.Hour))
+	mockClient.On("Stat", "/x").Return(remote, nil)
+	mockClient.On("Stat", "/x/child.txt").Return(nil, os.ErrNotExist)
+	mockClient.On("ReadDir", "/").Return([]os.FileInfo{remote}, nil)
+	mockClient.On("ReadDir", "/x").Return(nil, errors.New("not a directory"))
+
+	return fs.NewPikpakProxy(lgr.New(), tmpDir, mockClient, fs.WithConflictPolicy(policy)), mockClient
+}
+
+func readdirLayers(t *testing.T, proxy *fs.PikpakProxy, name string) map[string]fs.Layer {
+	t.Helper()
+
+	entries, err := proxy.ReaddirLayers(context.Background(), name)
+	require.NoError(t, err)
+
+	result := make(map[string]fs.Layer)
+	for _, e := range entries {
+		result[e.Name()] = e.Layer
+	}
+	return result
+}
+
+func TestTypeConflict_LocalFileRemoteDir_NoDetection(t *testing.T) {
+	proxy, mockClient := setupLocalFileRemoteDir(t, fs.ConflictNone)
+	ctx := context.Background()
+
+	info, err := proxy.Stat(ctx, "/x")
+	require.NoError(t, err)
+	assert.False(t, info.IsDir())
+
+	_, err = proxy.Stat(ctx, "/x/child.txt")
+	assert.ErrorIs(t, err, os.ErrNotExist)
+
+	_, err = proxy.OpenFile(ctx, "/x/child.txt", os.O_RDONLY, 0)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+
+	assert.Equal(t, map[string]fs.Layer{"x": fs.LayerLocal}, readdirLayers(t, proxy, "/"))
+	mockClient.AssertNotCalled(t, "Stat", "/x/child.txt")
+	mockClient.AssertNotCalled(t, "Stat", "/x")
+}
+
+func TestTypeConflict_LocalFileRemoteDir_LocalWins(t *testing.T) {
+	proxy, mockClient := setupLocalFileRemoteDir(t, fs.ConflictLocal)
+	ctx := context.Background()
+
+	info, err := proxy.Stat(ctx, "/x")
+	require.NoError(t, err)
+	assert.False(t, info.IsDir())
+
+	_, err = proxy.Stat(ctx, "/x/child.txt")
+	assert.ErrorIs(t, err, os.ErrNotExist)
+
+	_, err = proxy.ReaddirLayers(ctx, "/x")
+	assert.Error(t, err)
+
+	assert.Equal(t, map[string]fs.Layer{"x": fs.LayerLocal}, readdirLayers(t, proxy, "/"))
+	mockClient.AssertNotCalled(t, "Stat", "/x/child.txt")
+
+	conflicts := proxy.Conflicts()
+	require.Len(t, conflicts, 1)
+	assert.True(t, conflicts[0].TypeMismatch)
+}
+
+func TestTypeConflict_LocalFileRemoteDir_RemoteWins(t *testing.T) {
+	proxy, _ := setupLocalFileRemoteDir(t, fs.ConflictRemote)
+	ctx := context.Background()
+
+	info, err := proxy.Stat(ctx, "/x")
+	require.NoError(t, err)
+	assert.True(t, info.IsDir())
+
+	info, err = proxy.Stat(ctx, "/x/child.txt")
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), info.Size())
+
+	f, err := proxy.OpenFile(ctx, "/x/child.txt", os.O_RDONLY, 0)
+	require.NoError(t, err)
+	f.Close()
+
+	assert.Equal(t, map[string]fs.Layer{"x": fs.LayerRemote}, readdirLayers(t, proxy, "/"))
+	assert.Equal(t, map[string]fs.Layer{"child.txt": fs.LayerRemote}, readdirLayers(t, proxy, "/x"))
+}
+
+func TestTypeConflict_LocalFileRemoteDir_Newest(t *testing.T) {
+	proxy, _ := setupLocalFileRemoteDir(t, fs.ConflictNewest)
+	ctx := context.Background()
+
+	// Удаленная директория изменена позже локального файла
+	info, err := proxy.Stat(ctx, "/x")
+	require.NoError(t, err)
+	assert.True(t, info.IsDir())
+
+	_, err = proxy.Stat(ctx, "/x/child.txt")
+	assert.NoError(t, err)
+}
+
+func TestTypeConflict_LocalFileRemoteDir_KeepBoth(t *testing.T) {
+	proxy, _ := setupLocalFileRemoteDir(t, fs.ConflictKeepBoth)
+	ctx := context.Background()
+
+	assert.Equal(t, map[string]fs.Layer{
+		"x":            fs.LayerLocal,
+		"x (conflict)": fs.LayerRemote,
+	}, readdirLayers(t, proxy, "/"))
+
+	info, err := proxy.Stat(ctx, "/x")
+	require.NoError(t, err)
+	assert.False(t, info.IsDir())
+
+	info, err = proxy.Stat(ctx, "/x (conflict)")
+	require.NoError(t, err)
+	assert.True(t, info.IsDir())
+	assert.Equal(t, "x (conflict)", info.Name())
+
+	info, err = proxy.Stat(ctx, "/x (conflict)/child.txt")
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), info.Size())
+
+	assert.Equal(t, map[string]fs.Layer{"child.txt": fs.LayerRemote}, readdirLayers(t, proxy, "/x (conflict)"))
+
+	f, err := proxy.OpenFile(ctx, "/x (conflict)/child.txt", os.O_RDONLY, 0)
+	require.NoError(t, err)
+	f.Close()
+
+	_, err = proxy.Stat(ctx, "/x/child.txt")
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestTypeConflict_LocalDirRemoteFile_LocalWins(t *testing.T) {
+	proxy, _ := setupLocalDirRemoteFile(t, fs.ConflictLocal)
+	ctx := context.Background()
+
+	info, err := proxy.Stat(ctx, "/x")
+	require.NoError(t, err)
+	assert.True(t, info.IsDir())
+
+	info, err = proxy.Stat(ctx, "/x/child.txt")
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), info.Size())
+
+	assert.Equal(t, map[string]fs.Layer{"x": fs.LayerLocal}, readdirLayers(t, proxy, "/"))
+	assert.Equal(t, map[string]fs.Layer{"child.txt": fs.LayerLocal}, readdirLayers(t, proxy, "/x"))
+}
+
+func TestTypeConflict_LocalDirRemoteFile_RemoteWins(t *testing.T) {
+	proxy, _ := setupLocalDirRemoteFile(t, fs.ConflictRemote)
+	ctx := context.Background()
+
+	info, err := proxy.Stat(ctx, "/x")
+	require.NoError(t, err)
+	assert.False(t, info.IsDir())
+	assert.Equal(t, int64(10), info.Size())
+
+	_, err = proxy.Stat(ctx, "/x/child.txt")
+	assert.ErrorIs(t, err, os.ErrNotExist)
+
+	_, err = proxy.OpenFile(ctx, "/x/child.txt", os.O_RDONLY, 0)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+
+	f, err := proxy.OpenFile(ctx, "/x", os.O_RDONLY, 0)
+	require.NoError(t, err)
+	stat, err := f.Stat()
+	require.NoError(t, err)
+	assert.False(t, stat.IsDir())
+	f.Close()
+
+	assert.Equal(t, map[string]fs.Layer{"x": fs.LayerRemote}, readdirLayers(t, proxy, "/"))
+}
+
+func TestTypeConflict_LocalDirRemoteFile_KeepBoth(t *testing.T) {
+	proxy, _ := setupLocalDirRemoteFile(t, fs.ConflictKeepBoth)
+	ctx := context.Background()
+
+	assert.Equal(t, map[string]fs.Layer{
+		"x":            fs.LayerLocal,
+		"x (conflict)": fs.LayerRemote,
+	}, readdirLayers(t, proxy, "/"))
+
+	info, err := proxy.Stat(ctx, "/x (conflict)")
+	require.NoError(t, err)
+	assert.False(t, info.IsDir())
+	assert.Equal(t, int64(10), info.Size())
+
+	info, err = proxy.Stat(ctx, "/x/child.txt")
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), info.Size())
+}
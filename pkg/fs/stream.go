@@ -0,0 +1,17 @@
+package fs
+
+import "context"
+
+type streamingKey struct{}
+
+// StreamingContext помечает запрос как потоковое чтение, например
+// воспроизведение видео. Удаленные файлы, открытые с таким контекстом,
+// читаются с опережением, если оно включено через WithStreaming
+func StreamingContext(ctx context.Context) context.Context {
+	return context.WithValue(ctx, streamingKey{}, true)
+}
+
+func isStreaming(ctx context.Context) bool {
+	streaming, _ := ctx.Value(streamingKey{}).(bool)
+	return streaming
+}
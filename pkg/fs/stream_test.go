@@ -0,0 +1,80 @@
+package fs_test
+
+import (
+	"context"
+	"io"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ReanSn0w/pikpak-webdav-proxy/pkg/fs"
+	"github.com/go-pkgz/lgr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStreaming_SingleRemoteRequest(t *testing.T) {
+	data := strings.Repeat("0123456789", 50000)
+
+	mockClient := &MockWebdav{}
+	info := &MockFileInfo{}
+	info.On("Name").Return("movie.mkv")
+	info.On("IsDir").Return(false)
+	info.On("Size").Return(int64(len(data)))
+	info.On("ModTime").Return(testTime)
+	info.On("Mode").Return(os.FileMode(0644))
+
+	mockClient.On("Stat", "/movie.mkv").Return(info, nil)
+	mockClient.On("ReadStreamRange", "/movie.mkv", int64(0), int64(len(data))).
+		Return(io.NopCloser(strings.NewReader(data)), nil).Once()
+
+	proxy := fs.NewPikpakProxy(lgr.New(), t.TempDir(), mockClient, fs.WithStreaming(1<<20, time.Minute, 64<<20))
+
+	f, err := proxy.OpenFile(fs.StreamingContext(context.Background()), "/movie.mkv", os.O_RDONLY, 0)
+	require.NoError(t, err)
+	defer f.Close()
+
+	// Чтение небольшими блоками, как в http.ServeContent
+	var b strings.Builder
+	_, err = io.CopyBuffer(&b, struct{ io.Reader }{f}, make([]byte, 32<<10))
+	require.NoError(t, err)
+	assert.Equal(t, data, b.String())
+
+	mockClient.AssertNumberOfCalls(t, "ReadStreamRange", 1)
+}
+
+func TestStreaming_InvalidateMatchedName(t *testing.T) {
+	remoteDir := t.TempDir()
+	size := 200 << 10
+	writeLocalFile(t, remoteDir, "Movie.mkv", strings.Repeat("a", size), testTime)
+
+	proxy := fs.NewPikpakProxy(lgr.New(), t.TempDir(), remoteClient(t, remoteDir),
+		fs.WithStreaming(64<<10, time.Minute, 64<<20),
+		fs.WithNameEncoding(fs.DefaultNameEncoding, 0),
+		fs.WithCaseInsensitive(true))
+	ctx := fs.StreamingContext(context.Background())
+
+	// Поток остается в пуле под именем, которое запросил клиент,
+	// хотя с сервера читается Movie.mkv
+	f, err := proxy.OpenFile(ctx, "/movie.mkv", os.O_RDONLY, 0)
+	require.NoError(t, err)
+	buf := make([]byte, 10)
+	_, err = io.ReadFull(f, buf)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	// Клиент удаляет файл под своим именем, после чего на сервере
+	// появляется другой файл с тем же размером и временем изменения
+	require.NoError(t, proxy.RemoveAll(context.Background(), "/movie.mkv"))
+	writeLocalFile(t, remoteDir, "Movie.mkv", strings.Repeat("b", size), testTime)
+
+	f, err = proxy.OpenFile(ctx, "/movie.mkv", os.O_RDONLY, 0)
+	require.NoError(t, err)
+	defer f.Close()
+	_, err = f.Seek(10, io.SeekStart)
+	require.NoError(t, err)
+	_, err = io.ReadFull(f, buf)
+	require.NoError(t, err)
+	assert.Equal(t, strings.Repeat("b", 10), string(buf))
+}
@@ -0,0 +1,831 @@
+package fs
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	iofs "io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/ReanSn0w/pikpak-webdav-proxy/pkg/utils"
+	"github.com/go-pkgz/lgr"
+)
+
+// SyncDirection - направление синхронизации локального слоя с удаленным
+type SyncDirection string
+
+const (
+	// SyncBoth - изменения переносятся в обе стороны
+	SyncBoth SyncDirection = "both"
+	// SyncUpload - локальные изменения переносятся на удаленный сервер
+	SyncUpload SyncDirection = "upload"
+	// SyncDownload - удаленные изменения переносятся в локальный слой
+	SyncDownload SyncDirection = "download"
+)
+
+// ParseSyncDirection разбирает направление синхронизации
+func ParseSyncDirection(s string) (SyncDirection, error) {
+	switch d := SyncDirection(s); d {
+	case SyncBoth, SyncUpload, SyncDownload:
+		return d, nil
+	case "":
+		return SyncBoth, nil
+	default:
+		return "", fmt.Errorf("unknown sync direction: %s", s)
+	}
+}
+
+// SyncOp - действие синхронизации
+type SyncOp string
+
+const (
+	// SyncOpUpload - загрузить файл или создать директорию на удаленном сервере
+	SyncOpUpload SyncOp = "upload"
+	// SyncOpDownload - скачать файл или создать директорию в локальном слое
+	SyncOpDownload SyncOp = "download"
+	// SyncOpDeleteLocal - удалить файл из локального слоя
+	SyncOpDeleteLocal SyncOp = "delete-local"
+	// SyncOpDeleteRemote - удалить файл с удаленного сервера
+	SyncOpDeleteRemote SyncOp = "delete-remote"
+	// SyncOpMoveLocal - повторить в локальном слое перемещение на удаленном сервере
+	SyncOpMoveLocal SyncOp = "move-local"
+	// SyncOpMoveRemote - повторить на удаленном сервере локальное перемещение
+	SyncOpMoveRemote SyncOp = "move-remote"
+	// SyncOpKeepBoth - сохранить удаленную версию под именем "name (conflict).ext",
+	// а локальную загрузить под исходным именем
+	SyncOpKeepBoth SyncOp = "keep-both"
+	// SyncOpConflict - файл изменен в обоих слоях и пропущен
+	SyncOpConflict SyncOp = "conflict"
+)
+
+// SyncOptions - параметры синхронизации. Conflicts задает политику для
+// файлов, измененных в обоих слоях, ConflictNone оставляет их без изменений
+type SyncOptions struct {
+	Root      string
+	Direction SyncDirection
+	Conflicts ConflictPolicy
+	DryRun    bool
+}
+
+// SyncAction - действие синхронизации над файлом Path. From - исходный путь
+// перемещения, Reason - изменение, вызвавшее действие: added, modified,
+// deleted, moved или conflict
+type SyncAction struct {
+	Op     SyncOp `json:"op"`
+	Path   string `json:"path"`
+	From   string `json:"from,omitempty"`
+	IsDir  bool   `json:"is_dir"`
+	Size   int64  `json:"size"`
+	Reason string `json:"reason"`
+	Error  string `json:"error,omitempty"`
+}
+
+// SyncResult - результат синхронизации. Conflicts - число пропущенных
+// конфликтов, Failed - число действий, завершившихся ошибкой
+type SyncResult struct {
+	Actions   []SyncAction `json:"actions"`
+	Conflicts int          `json:"conflicts"`
+	Failed    int          `json:"failed"`
+}
+
+// syncChange - изменение файла в слое с момента прошлой синхронизации
+type syncChange int
+
+const (
+	syncAbsent syncChange = iota
+	syncUnchanged
+	syncAdded
+	syncModified
+	syncDeleted
+)
+
+func (c syncChange) String() string {
+	switch c {
+	case syncAdded:
+		return "added"
+	case syncModified:
+		return "modified"
+	case syncDeleted:
+		return "deleted"
+	default:
+		return "unchanged"
+	}
+}
+
+// changed возвращает true для добавленных и измененных файлов
+func (c syncChange) changed() bool {
+	return c == syncAdded || c == syncModified
+}
+
+// syncItem - файл, найденный в одном из слоев или в состоянии синхронизации
+type syncItem struct {
+	key    string
+	name   string
+	local  os.FileInfo
+	remote os.FileInfo
+	base   *syncEntry
+
+	localChange  syncChange
+	remoteChange syncChange
+}
+
+// Sync сравнивает локальный слой и удаленное дерево внутри opts.Root
+// с состоянием прошлой синхронизации и переносит добавленные, измененные,
+// удаленные и перемещенные файлы в другой слой. Состояние хранится
+// в служебной директории, поэтому повторный запуск переносит только
+// изменения, сделанные после предыдущего
+func (p *PikpakProxy) Sync(ctx context.Context, opts SyncOptions) (SyncResult, error) {
+	root := path.Clean("/" + opts.Root)
+	if opts.Direction == "" {
+		opts.Direction = SyncBoth
+	}
+
+	state := loadSyncState(p.log, p.MetaPath("sync.json"))
+
+	local, err := p.localTree(root)
+	if err != nil {
+		return SyncResult{}, fmt.Errorf("failed to read local tree: %w", err)
+	}
+
+	remote, err := p.remoteTree(ctx, root)
+	if err != nil {
+		return SyncResult{}, fmt.Errorf("failed to read remote tree: %w", err)
+	}
+
+	items := p.syncItems(root, state, local, remote)
+	actions := p.planSync(items, opts)
+
+	result := SyncResult{Actions: actions}
+	for _, a := range actions {
+		if a.Op == SyncOpConflict {
+			result.Conflicts++
+		}
+	}
+
+	if opts.DryRun {
+		return result, nil
+	}
+
+	for _, it := range items {
+		// Файлы, удаленные из обоих слоев, больше не отслеживаются
+		if it.base != nil && it.local == nil && it.remote == nil {
+			delete(state.Items, it.key)
+		}
+		// Совпадающие версии, измененные в обоих слоях, считаются
+		// синхронизированными
+		if it.localChange.changed() && it.remoteChange.changed() && sameSyncContent(it.local, it.remote) {
+			state.record(it.key, it.local, it.remote)
+		}
+	}
+
+	for i := range result.Actions {
+		if err := ctx.Err(); err != nil {
+			state.save()
+			return result, err
+		}
+
+		a := &result.Actions[i]
+		if a.Op == SyncOpConflict {
+			continue
+		}
+
+		if err := p.applySync(*a); err != nil {
+			p.log.Logf("[ERROR] sync %s %s: %v", a.Op, a.Path, err)
+			a.Error = err.Error()
+			result.Failed++
+			continue
+		}
+
+		if a.From != "" {
+			p.updateSyncState(state, a.From)
+		}
+		p.updateSyncState(state, a.Path)
+		if a.Op == SyncOpKeepBoth {
+			p.updateSyncState(state, conflictName(a.Path))
+		}
+	}
+
+	state.save()
+	p.usage.invalidate()
+	p.log.Logf("[INFO] sync of %s: %d actions, %d conflicts, %d failed",
+		root, len(result.Actions), result.Conflicts, result.Failed)
+
+	return result, nil
+}
+
+// localTree возвращает файлы и директории локального слоя внутри root,
+// кроме служебной директории, незавершенных загрузок и скрытых фильтрами
+// файлов. В отличие от localFiles, ошибки чтения не пропускаются, иначе
+// нечитаемые файлы были бы приняты за удаленные
+func (p *PikpakProxy) localTree(root string) (map[string]os.FileInfo, error) {
+	tree := make(map[string]os.FileInfo)
+	rootPath := p.LocalFilePath(root)
+
+	err := filepath.WalkDir(rootPath, func(localPath string, d iofs.DirEntry, err error) error {
+		if err != nil {
+			if localPath == rootPath && os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if localPath == rootPath {
+			return nil
+		}
+
+		rel, err := filepath.Rel(p.localPath, localPath)
+		if err != nil {
+			return err
+		}
+		name := path.Clean("/" + filepath.ToSlash(rel))
+
+		if isMeta(name) || p.hidden(name) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		tree[name] = p.crypt.info(localPath, info)
+		return nil
+	})
+
+	return tree, err
+}
+
+// remoteTree возвращает файлы и директории удаленного сервера внутри root
+func (p *PikpakProxy) remoteTree(ctx context.Context, root string) (map[string]os.FileInfo, error) {
+	tree := make(map[string]os.FileInfo)
+
+	var walk func(dir string) error
+	walk = func(dir string) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		infos, err := p.remoteClient.ReadDir(dir)
+		if err != nil {
+			if dir == root && remoteMissing(err) {
+				return nil
+			}
+			return err
+		}
+
+		for _, info := range infos {
+			name := path.Join(dir, info.Name())
+			if p.hidden(name) {
+				continue
+			}
+
+			tree[name] = info
+			if info.IsDir() {
+				if err := walk(name); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+
+	return tree, walk(root)
+}
+
+// syncItems сопоставляет файлы слоев и состояния синхронизации внутри root
+func (p *PikpakProxy) syncItems(root string, state *syncState, local, remote map[string]os.FileInfo) []*syncItem {
+	items := make(map[string]*syncItem)
+	item := func(name string) *syncItem {
+		key := name
+		if p.matchNames() {
+			key = p.nameKey(name)
+		}
+		if it, ok := items[key]; ok {
+			return it
+		}
+		it := &syncItem{key: key, name: name}
+		items[key] = it
+		return it
+	}
+
+	for name, e := range state.Items {
+		if _, ok := within(root, name); ok && name != root {
+			entry := e
+			item(name).base = &entry
+		}
+	}
+	for name, info := range remote {
+		it := item(name)
+		it.name, it.remote = name, info
+	}
+	for name, info := range local {
+		item(name).local = info
+	}
+
+	result := make([]*syncItem, 0, len(items))
+	for _, it := range items {
+		var base *syncSnapshot
+		if it.base != nil {
+			base = &it.base.Local
+		}
+		it.localChange = syncDiff(it.base, base, it.local)
+		if it.evicted() {
+			it.localChange = syncUnchanged
+		}
+
+		if it.base != nil {
+			base = &it.base.Remote
+		}
+		it.remoteChange = syncDiff(it.base, base, it.remote)
+
+		result = append(result, it)
+	}
+
+	sort.Slice(result, func(i, j int) bool { return result[i].name < result[j].name })
+	return result
+}
+
+// evicted проверяет, удалена ли локальная копия вытеснением из кеша.
+// Такое удаление не переносится на удаленный сервер
+func (it *syncItem) evicted() bool {
+	return it.local == nil && it.base != nil && it.base.Evicted
+}
+
+// syncDiff определяет изменение файла в слое относительно снимка base
+func syncDiff(entry *syncEntry, base *syncSnapshot, info os.FileInfo) syncChange {
+	switch {
+	case entry == nil && info == nil:
+		return syncAbsent
+	case entry == nil:
+		return syncAdded
+	case info == nil:
+		return syncDeleted
+	case entry.IsDir != info.IsDir():
+		return syncModified
+	case info.IsDir():
+		return syncUnchanged
+	case info.Size() != base.Size || !sameModTime(info.ModTime(), base.ModTime):
+		return syncModified
+	default:
+		return syncUnchanged
+	}
+}
+
+// sameSyncContent проверяет, совпадают ли версии файла в слоях
+func sameSyncContent(local, remote os.FileInfo) bool {
+	if local.IsDir() || remote.IsDir() {
+		return local.IsDir() == remote.IsDir()
+	}
+	return local.Size() == remote.Size() && sameModTime(local.ModTime(), remote.ModTime())
+}
+
+// planSync составляет список действий синхронизации. Директории создаются
+// раньше файлов, а удаляются после них
+func (p *PikpakProxy) planSync(items []*syncItem, opts SyncOptions) []SyncAction {
+	var moves, creates, deletes []SyncAction
+	moved := p.detectMoves(items)
+
+	for _, it := range items {
+		if m, ok := moved[it.key]; ok {
+			if m.Op != "" {
+				moves = append(moves, m)
+			}
+			continue
+		}
+
+		a, ok := p.syncAction(it, opts.Conflicts)
+		if !ok || !p.syncAllowed(a, opts.Direction) {
+			continue
+		}
+
+		switch a.Op {
+		case SyncOpDeleteLocal, SyncOpDeleteRemote:
+			deletes = append(deletes, a)
+		default:
+			creates = append(creates, a)
+		}
+	}
+
+	moves = filterSyncActions(moves, func(a SyncAction) bool { return p.syncAllowed(a, opts.Direction) })
+
+	// Удаление начинается с самых глубоких путей, чтобы директории
+	// удалялись после своего содержимого
+	sort.SliceStable(deletes, func(i, j int) bool { return deletes[i].Path > deletes[j].Path })
+
+	return append(append(moves, creates...), deletes...)
+}
+
+// syncAction определяет действие для файла по изменениям в слоях
+func (p *PikpakProxy) syncAction(it *syncItem, policy ConflictPolicy) (SyncAction, bool) {
+	a := SyncAction{Path: it.name}
+	lc, rc := it.localChange, it.remoteChange
+
+	// Вытесненная копия не скачивается заново: кеш заполняется по мере
+	// чтения файлов
+	if it.evicted() {
+		return a, false
+	}
+
+	switch {
+	case lc.changed() && rc.changed():
+		if sameSyncContent(it.local, it.remote) {
+			return a, false
+		}
+		return p.resolveSyncConflict(it, policy), true
+	case lc.changed():
+		a.Op, a.Reason = SyncOpUpload, lc.String()
+	case rc.changed():
+		a.Op, a.Reason = SyncOpDownload, rc.String()
+	case lc == syncDeleted && rc == syncUnchanged:
+		a.Op, a.Reason = SyncOpDeleteRemote, lc.String()
+	case rc == syncDeleted && lc == syncUnchanged:
+		a.Op, a.Reason = SyncOpDeleteLocal, rc.String()
+	default:
+		return a, false
+	}
+
+	fillSyncAction(&a, it)
+	return a, true
+}
+
+// resolveSyncConflict выбирает действие для файла, измененного в обоих слоях
+func (p *PikpakProxy) resolveSyncConflict(it *syncItem, policy ConflictPolicy) SyncAction {
+	a := SyncAction{Path: it.name, Reason: "conflict"}
+
+	switch policy {
+	case ConflictLocal:
+		a.Op = SyncOpUpload
+	case ConflictRemote:
+		a.Op = SyncOpDownload
+	case ConflictNewest:
+		a.Op = SyncOpDownload
+		if it.local.ModTime().After(it.remote.ModTime()) {
+			a.Op = SyncOpUpload
+		}
+	case ConflictKeepBoth:
+		a.Op = SyncOpKeepBoth
+		if it.local.IsDir() || it.remote.IsDir() {
+			a.Op = SyncOpConflict
+		}
+	default:
+		a.Op = SyncOpConflict
+	}
+
+	fillSyncAction(&a, it)
+	return a
+}
+
+// fillSyncAction заполняет тип и размер файла из слоя, откуда переносится
+// изменение
+func fillSyncAction(a *SyncAction, it *syncItem) {
+	info := it.local
+	if a.Op == SyncOpDownload || a.Op == SyncOpDeleteRemote || info == nil {
+		info = it.remote
+	}
+	if info == nil && it.base != nil {
+		a.IsDir = it.base.IsDir
+		return
+	}
+	if info != nil {
+		a.IsDir, a.Size = info.IsDir(), info.Size()
+	}
+}
+
+// detectMoves находит файлы, удаленные в одном слое и появившиеся в нем
+// же под другим именем с тем же размером и временем изменения. Для таких
+// пар возвращается одно действие перемещения под ключом нового файла
+// и пустое действие под ключом старого
+func (p *PikpakProxy) detectMoves(items []*syncItem) map[string]SyncAction {
+	moves := make(map[string]SyncAction)
+
+	// moveKey - размер и время изменения с точностью до секунды. Время
+	// сравнивается как число, так как снимки из состояния и из слоев
+	// хранят его в разных часовых поясах
+	type moveKey struct {
+		size  int64
+		mtime int64
+	}
+
+	match := func(op SyncOp, deleted, added func(*syncItem) bool, snapshot func(*syncEntry) syncSnapshot, info func(*syncItem) os.FileInfo) {
+		sources := make(map[moveKey][]*syncItem)
+		for _, it := range items {
+			if deleted(it) && !it.base.IsDir {
+				s := snapshot(it.base)
+				k := moveKey{size: s.Size, mtime: s.ModTime.Unix()}
+				sources[k] = append(sources[k], it)
+			}
+		}
+
+		targets := make(map[moveKey][]*syncItem)
+		for _, it := range items {
+			if !added(it) || info(it).IsDir() {
+				continue
+			}
+			k := moveKey{size: info(it).Size(), mtime: info(it).ModTime().Unix()}
+			targets[k] = append(targets[k], it)
+		}
+
+		// Неоднозначные совпадения переносятся как удаление и загрузка
+		for k, from := range sources {
+			to := targets[k]
+			if len(from) != 1 || len(to) != 1 {
+				continue
+			}
+			moves[from[0].key] = SyncAction{}
+			moves[to[0].key] = SyncAction{Op: op, Path: to[0].name, From: from[0].name, Size: k.size, Reason: "moved"}
+		}
+	}
+
+	match(SyncOpMoveRemote,
+		func(it *syncItem) bool { return it.localChange == syncDeleted && it.remoteChange == syncUnchanged },
+		func(it *syncItem) bool { return it.localChange == syncAdded && it.remoteChange == syncAbsent },
+		func(e *syncEntry) syncSnapshot { return e.Local },
+		func(it *syncItem) os.FileInfo { return it.local },
+	)
+	match(SyncOpMoveLocal,
+		func(it *syncItem) bool { return it.remoteChange == syncDeleted && it.localChange == syncUnchanged },
+		func(it *syncItem) bool { return it.remoteChange == syncAdded && it.localChange == syncAbsent },
+		func(e *syncEntry) syncSnapshot { return e.Remote },
+		func(it *syncItem) os.FileInfo { return it.remote },
+	)
+
+	return moves
+}
+
+// syncAllowed проверяет, разрешено ли действие направлением синхронизации
+// и правилами записи
+func (p *PikpakProxy) syncAllowed(a SyncAction, direction SyncDirection) bool {
+	toRemote := false
+	switch a.Op {
+	case SyncOpConflict:
+		return true
+	case SyncOpUpload, SyncOpDeleteRemote, SyncOpMoveRemote, SyncOpKeepBoth:
+		toRemote = true
+	}
+
+	if toRemote && direction == SyncDownload || !toRemote && direction == SyncUpload {
+		return false
+	}
+
+	for _, name := range []string{a.Path, a.From} {
+		if name == "" {
+			continue
+		}
+		switch mode := p.writeMode(name); {
+		case mode == WriteReadOnly || mode == WriteDeny:
+			return false
+		case toRemote && mode == WriteLocalOnly:
+			return false
+		}
+	}
+
+	return true
+}
+
+func filterSyncActions(actions []SyncAction, keep func(SyncAction) bool) []SyncAction {
+	result := actions[:0]
+	for _, a := range actions {
+		if keep(a) {
+			result = append(result, a)
+		}
+	}
+	return result
+}
+
+// applySync выполняет действие синхронизации
+func (p *PikpakProxy) applySync(a SyncAction) error {
+	p.log.Logf("[DEBUG] sync %s %s", a.Op, a.Path)
+
+	switch a.Op {
+	case SyncOpUpload:
+		return p.syncUpload(a.Path, a.IsDir)
+	case SyncOpDownload:
+		return p.syncDownload(a.Path, a.IsDir)
+	case SyncOpDeleteRemote:
+		return p.syncDeleteRemote(a.Path, a.IsDir)
+	case SyncOpDeleteLocal:
+		return p.syncDeleteLocal(a.Path, a.IsDir)
+	case SyncOpMoveRemote:
+		if err := p.remoteClient.MkdirAll(path.Dir(a.Path), 0755); err != nil {
+			return err
+		}
+		defer p.invalidateStreams(a.From)
+		return p.remoteClient.Rename(a.From, a.Path, false)
+	case SyncOpMoveLocal:
+		newPath := p.LocalFilePath(a.Path)
+		if err := os.MkdirAll(filepath.Dir(newPath), 0755); err != nil {
+			return err
+		}
+		if err := os.Rename(p.LocalFilePath(a.From), newPath); err != nil {
+			return err
+		}
+		p.checksums.move(a.From, a.Path)
+		p.props.move(a.From, a.Path)
+		return nil
+	case SyncOpKeepBoth:
+		alias := conflictName(a.Path)
+		err := p.remoteClient.Rename(a.Path, alias, false)
+		p.invalidateStreams(a.Path)
+		if err != nil {
+			return err
+		}
+		if err := p.upload(a.Path); err != nil {
+			return err
+		}
+		info, err := p.remoteClient.Stat(alias)
+		if err != nil {
+			return err
+		}
+		return p.fetch(context.Background(), alias, info)
+	default:
+		return fmt.Errorf("unknown sync action: %s", a.Op)
+	}
+}
+
+func (p *PikpakProxy) syncUpload(name string, isDir bool) error {
+	// Файл заменяет директорию или директория - файл
+	if remote, err := p.remoteClient.Stat(name); err == nil && remote.IsDir() != isDir {
+		err := p.remoteClient.RemoveAll(name)
+		p.invalidateStreams(name)
+		if err != nil {
+			return err
+		}
+	}
+
+	if isDir {
+		return p.remoteClient.MkdirAll(name, 0755)
+	}
+	if err := p.remoteClient.MkdirAll(path.Dir(name), 0755); err != nil {
+		return err
+	}
+	return p.upload(name)
+}
+
+func (p *PikpakProxy) syncDownload(name string, isDir bool) error {
+	localPath := p.LocalFilePath(name)
+	if local, err := os.Stat(localPath); err == nil && local.IsDir() != isDir {
+		if err := os.RemoveAll(localPath); err != nil {
+			return err
+		}
+	}
+
+	if isDir {
+		return os.MkdirAll(localPath, 0755)
+	}
+
+	// Локальная копия не менялась с прошлой синхронизации и заменяется
+	// новой удаленной версией
+	info, err := p.remoteClient.Stat(name)
+	if err != nil {
+		return err
+	}
+	return p.fetch(context.Background(), name, info)
+}
+
+// syncDeleteRemote удаляет файл с удаленного сервера. Директория удаляется,
+// только если в ней не осталось файлов
+func (p *PikpakProxy) syncDeleteRemote(name string, isDir bool) error {
+	if isDir {
+		infos, err := p.remoteClient.ReadDir(name)
+		if err != nil {
+			return err
+		}
+		if len(infos) > 0 {
+			p.log.Logf("[DEBUG] sync: remote directory %s is not empty, keeping it", name)
+			return nil
+		}
+	}
+	defer p.invalidateStreams(name)
+	return p.remoteClient.RemoveAll(name)
+}
+
+// syncDeleteLocal удаляет файл из локального слоя. Директория удаляется,
+// только если в ней не осталось файлов
+func (p *PikpakProxy) syncDeleteLocal(name string, isDir bool) error {
+	if isDir {
+		entries, err := os.ReadDir(p.LocalFilePath(name))
+		if err != nil {
+			return err
+		}
+		if len(entries) > 0 {
+			p.log.Logf("[DEBUG] sync: local directory %s is not empty, keeping it", name)
+			return nil
+		}
+	}
+
+	if err := os.Remove(p.LocalFilePath(name)); err != nil {
+		return err
+	}
+	p.checksums.forget(name)
+	p.props.forget(name)
+	p.conflicts.forget(name)
+	return nil
+}
+
+// markEvicted отмечает в состоянии синхронизации файлы names, локальные
+// копии которых вытеснены из кеша, чтобы синхронизация не приняла их
+// отсутствие за удаление
+func (p *PikpakProxy) markEvicted(names []string) {
+	if len(names) == 0 {
+		return
+	}
+
+	state := loadSyncState(p.log, p.MetaPath("sync.json"))
+	changed := false
+	for _, name := range names {
+		key := name
+		if p.matchNames() {
+			key = p.nameKey(name)
+		}
+
+		if e, ok := state.Items[key]; ok && !e.Evicted {
+			e.Evicted = true
+			state.Items[key] = e
+			changed = true
+		}
+	}
+
+	if changed {
+		state.save()
+	}
+}
+
+// updateSyncState записывает в состояние текущие версии файла в слоях.
+// Если файл есть только в одном слое, он перестает отслеживаться и при
+// следующей синхронизации считается новым
+func (p *PikpakProxy) updateSyncState(state *syncState, name string) {
+	key := name
+	if p.matchNames() {
+		key = p.nameKey(name)
+	}
+
+	local, localErr := p.crypt.stat(p.LocalFilePath(name))
+	remote, remoteErr := p.remoteClient.Stat(name)
+	if localErr != nil || remoteErr != nil {
+		delete(state.Items, key)
+		return
+	}
+
+	state.record(key, local, remote)
+}
+
+// syncState - состояние синхронизации: версии файлов в обоих слоях
+// на момент последнего успешного переноса
+type syncState struct {
+	log   lgr.L
+	path  string
+	Items map[string]syncEntry
+}
+
+type syncEntry struct {
+	IsDir  bool         `json:"dir,omitempty"`
+	Local  syncSnapshot `json:"local"`
+	Remote syncSnapshot `json:"remote"`
+	// Evicted - локальная копия вытеснена из кеша после синхронизации
+	Evicted bool `json:"evicted,omitempty"`
+}
+
+// syncSnapshot - размер и время изменения версии файла в слое
+type syncSnapshot struct {
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mtime"`
+}
+
+func loadSyncState(log lgr.L, path string) *syncState {
+	s := &syncState{log: log, path: path, Items: make(map[string]syncEntry)}
+
+	data, err := os.ReadFile(path)
+	switch {
+	case os.IsNotExist(err):
+		return s
+	case err != nil:
+		log.Logf("[WARN] failed to read sync state: %v", err)
+		return s
+	}
+
+	if err := json.Unmarshal(data, &s.Items); err != nil {
+		log.Logf("[WARN] failed to decode sync state: %v", err)
+	}
+
+	return s
+}
+
+func (s *syncState) record(key string, local, remote os.FileInfo) {
+	s.Items[key] = syncEntry{
+		IsDir:  local.IsDir(),
+		Local:  syncSnapshot{Size: local.Size(), ModTime: local.ModTime()},
+		Remote: syncSnapshot{Size: remote.Size(), ModTime: remote.ModTime()},
+	}
+}
+
+// save записывает состояние синхронизации в файл
+func (s *syncState) save() {
+	if err := utils.WriteJSONAtomic(s.path, s.Items); err != nil {
+		s.log.Logf("[ERROR] failed to save sync state: %v", err)
+	}
+}
@@ -0,0 +1,292 @@
+package fs_test
+
+import (
+	"context"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ReanSn0w/pikpak-webdav-proxy/pkg/fs"
+	lgr "github.com/go-pkgz/lgr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/studio-b12/gowebdav"
+	"golang.org/x/net/webdav"
+)
+
+// setupSync создает прокси, удаленный слой которого - WebDAV сервер
+// над временной директорией
+func setupSync(t *testing.T, opts ...fs.Option) (*fs.PikpakProxy, string, string) {
+	localDir, remoteDir := t.TempDir(), t.TempDir()
+
+	srv := httptest.NewServer(&webdav.Handler{
+		FileSystem: webdav.Dir(remoteDir),
+		LockSystem: webdav.NewMemLS(),
+	})
+	t.Cleanup(srv.Close)
+
+	client := gowebdav.NewClient(srv.URL, "", "")
+	return fs.NewPikpakProxy(lgr.New(), localDir, client, opts...), localDir, remoteDir
+}
+
+func runSync(t *testing.T, proxy *fs.PikpakProxy, opts fs.SyncOptions) map[string]fs.SyncOp {
+	result, err := proxy.Sync(context.Background(), opts)
+	require.NoError(t, err)
+	assert.Zero(t, result.Failed)
+
+	ops := make(map[string]fs.SyncOp)
+	for _, a := range result.Actions {
+		ops[a.Path] = a.Op
+	}
+	return ops
+}
+
+func readFile(t *testing.T, dir, name string) string {
+	data, err := os.ReadFile(filepath.Join(dir, name))
+	require.NoError(t, err)
+	return string(data)
+}
+
+func TestSync_Initial(t *testing.T) {
+	proxy, localDir, remoteDir := setupSync(t)
+
+	require.NoError(t, os.Mkdir(filepath.Join(localDir, "docs"), 0755))
+	writeLocalFile(t, localDir, "docs/local.txt", "local", testTime)
+	writeLocalFile(t, remoteDir, "remote.txt", "remote", testTime)
+	writeLocalFile(t, localDir, "same.txt", "same", testTime)
+	writeLocalFile(t, remoteDir, "same.txt", "same", testTime)
+
+	ops := runSync(t, proxy, fs.SyncOptions{})
+	assert.Equal(t, map[string]fs.SyncOp{
+		"/docs":           fs.SyncOpUpload,
+		"/docs/local.txt": fs.SyncOpUpload,
+		"/remote.txt":     fs.SyncOpDownload,
+	}, ops)
+
+	assert.Equal(t, "local", readFile(t, remoteDir, "docs/local.txt"))
+	assert.Equal(t, "remote", readFile(t, localDir, "remote.txt"))
+
+	info, err := os.Stat(filepath.Join(localDir, "remote.txt"))
+	require.NoError(t, err)
+	assert.True(t, info.ModTime().Equal(testTime))
+
+	// Повторная синхронизация ничего не переносит
+	assert.Empty(t, runSync(t, proxy, fs.SyncOptions{}))
+}
+
+func TestSync_Changes(t *testing.T) {
+	proxy, localDir, remoteDir := setupSync(t)
+
+	writeLocalFile(t, localDir, "a.txt", "a", testTime)
+	writeLocalFile(t, localDir, "b.txt", "b", testTime)
+	writeLocalFile(t, localDir, "c.txt", "c", testTime)
+	writeLocalFile(t, localDir, "d.txt", "d", testTime)
+	runSync(t, proxy, fs.SyncOptions{})
+
+	writeLocalFile(t, localDir, "a.txt", "local change", testTime.Add(time.Hour))
+	writeLocalFile(t, remoteDir, "b.txt", "remote change", testTime.Add(time.Hour))
+	require.NoError(t, os.Remove(filepath.Join(localDir, "c.txt")))
+	require.NoError(t, os.Remove(filepath.Join(remoteDir, "d.txt")))
+
+	ops := runSync(t, proxy, fs.SyncOptions{})
+	assert.Equal(t, map[string]fs.SyncOp{
+		"/a.txt": fs.SyncOpUpload,
+		"/b.txt": fs.SyncOpDownload,
+		"/c.txt": fs.SyncOpDeleteRemote,
+		"/d.txt": fs.SyncOpDeleteLocal,
+	}, ops)
+
+	assert.Equal(t, "local change", readFile(t, remoteDir, "a.txt"))
+	assert.Equal(t, "remote change", readFile(t, localDir, "b.txt"))
+	assert.NoFileExists(t, filepath.Join(remoteDir, "c.txt"))
+	assert.NoFileExists(t, filepath.Join(localDir, "d.txt"))
+
+	assert.Empty(t, runSync(t, proxy, fs.SyncOptions{}))
+}
+
+func TestSync_Moves(t *testing.T) {
+	proxy, localDir, remoteDir := setupSync(t)
+
+	writeLocalFile(t, localDir, "a.txt", "aaa", testTime)
+	writeLocalFile(t, localDir, "b.txt", "bbbb", testTime.Add(time.Minute))
+	runSync(t, proxy, fs.SyncOptions{})
+
+	require.NoError(t, os.Mkdir(filepath.Join(localDir, "dir"), 0755))
+	require.NoError(t, os.Rename(filepath.Join(localDir, "a.txt"), filepath.Join(localDir, "dir", "a.txt")))
+	require.NoError(t, os.Rename(filepath.Join(remoteDir, "b.txt"), filepath.Join(remoteDir, "c.txt")))
+
+	result, err := proxy.Sync(context.Background(), fs.SyncOptions{})
+	require.NoError(t, err)
+
+	var moves []fs.SyncAction
+	for _, a := range result.Actions {
+		if a.Op == fs.SyncOpMoveLocal || a.Op == fs.SyncOpMoveRemote {
+			moves = append(moves, a)
+		}
+	}
+	assert.ElementsMatch(t, []fs.SyncAction{
+		{Op: fs.SyncOpMoveRemote, Path: "/dir/a.txt", From: "/a.txt", Size: 3, Reason: "moved"},
+		{Op: fs.SyncOpMoveLocal, Path: "/c.txt", From: "/b.txt", Size: 4, Reason: "moved"},
+	}, moves)
+
+	assert.Equal(t, "aaa", readFile(t, remoteDir, "dir/a.txt"))
+	assert.NoFileExists(t, filepath.Join(remoteDir, "a.txt"))
+	assert.Equal(t, "bbbb", readFile(t, localDir, "c.txt"))
+	assert.NoFileExists(t, filepath.Join(localDir, "b.txt"))
+
+	assert.Empty(t, runSync(t, proxy, fs.SyncOptions{}))
+}
+
+func TestSync_Conflicts(t *testing.T) {
+	proxy, localDir, remoteDir := setupSync(t)
+
+	writeLocalFile(t, localDir, "a.txt", "base", testTime)
+	runSync(t, proxy, fs.SyncOptions{})
+
+	writeLocalFile(t, localDir, "a.txt", "local", testTime.Add(time.Hour))
+	writeLocalFile(t, remoteDir, "a.txt", "remote!", testTime.Add(2*time.Hour))
+
+	result, err := proxy.Sync(context.Background(), fs.SyncOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, 1, result.Conflicts)
+	assert.Equal(t, "local", readFile(t, localDir, "a.txt"))
+	assert.Equal(t, "remote!", readFile(t, remoteDir, "a.txt"))
+
+	ops := runSync(t, proxy, fs.SyncOptions{Conflicts: fs.ConflictKeepBoth})
+	assert.Equal(t, map[string]fs.SyncOp{"/a.txt": fs.SyncOpKeepBoth}, ops)
+
+	assert.Equal(t, "local", readFile(t, remoteDir, "a.txt"))
+	assert.Equal(t, "remote!", readFile(t, remoteDir, "a (conflict).txt"))
+	assert.Equal(t, "remote!", readFile(t, localDir, "a (conflict).txt"))
+
+	assert.Empty(t, runSync(t, proxy, fs.SyncOptions{}))
+}
+
+func TestSync_ConflictNewest(t *testing.T) {
+	proxy, localDir, remoteDir := setupSync(t)
+
+	writeLocalFile(t, localDir, "a.txt", "base", testTime)
+	runSync(t, proxy, fs.SyncOptions{})
+
+	writeLocalFile(t, localDir, "a.txt", "local", testTime.Add(time.Hour))
+	writeLocalFile(t, remoteDir, "a.txt", "remote!", time.Now().Add(time.Hour))
+
+	ops := runSync(t, proxy, fs.SyncOptions{Conflicts: fs.ConflictNewest})
+	assert.Equal(t, map[string]fs.SyncOp{"/a.txt": fs.SyncOpDownload}, ops)
+	assert.Equal(t, "remote!", readFile(t, localDir, "a.txt"))
+}
+
+func TestSync_DryRunAndDirection(t *testing.T) {
+	proxy, localDir, remoteDir := setupSync(t)
+
+	writeLocalFile(t, localDir, "local.txt", "local", testTime)
+	writeLocalFile(t, remoteDir, "remote.txt", "remote", testTime)
+
+	ops := runSync(t, proxy, fs.SyncOptions{DryRun: true})
+	assert.Len(t, ops, 2)
+	assert.NoFileExists(t, filepath.Join(remoteDir, "local.txt"))
+	assert.NoFileExists(t, filepath.Join(localDir, "remote.txt"))
+	assert.NoFileExists(t, proxy.MetaPath("sync.json"))
+
+	ops = runSync(t, proxy, fs.SyncOptions{Direction: fs.SyncUpload})
+	assert.Equal(t, map[string]fs.SyncOp{"/local.txt": fs.SyncOpUpload}, ops)
+	assert.NoFileExists(t, filepath.Join(localDir, "remote.txt"))
+
+	ops = runSync(t, proxy, fs.SyncOptions{})
+	assert.Equal(t, map[string]fs.SyncOp{"/remote.txt": fs.SyncOpDownload}, ops)
+}
+
+func TestSync_WritePolicies(t *testing.T) {
+	localDir, remoteDir := t.TempDir(), t.TempDir()
+	srv := httptest.NewServer(&webdav.Handler{FileSystem: webdav.Dir(remoteDir), LockSystem: webdav.NewMemLS()})
+	defer srv.Close()
+
+	rule, err := fs.NewPolicyRule("/private/**", fs.WriteLocalOnly)
+	require.NoError(t, err)
+	proxy := fs.NewPikpakProxy(lgr.New(), localDir, gowebdav.NewClient(srv.URL, "", ""), fs.WithPolicies(rule))
+
+	require.NoError(t, os.Mkdir(filepath.Join(localDir, "private"), 0755))
+	writeLocalFile(t, localDir, "private/secret.txt", "secret", testTime)
+
+	ops := runSync(t, proxy, fs.SyncOptions{})
+	assert.NotContains(t, ops, "/private/secret.txt")
+	assert.NoFileExists(t, filepath.Join(remoteDir, "private", "secret.txt"))
+}
+
+func TestSync_Evicted(t *testing.T) {
+	proxy, localDir, remoteDir := setupSync(t)
+	ctx := context.Background()
+
+	require.NoError(t, os.Mkdir(filepath.Join(remoteDir, "dir"), 0755))
+	writeLocalFile(t, remoteDir, "remote.txt", "remote", testTime)
+	writeLocalFile(t, remoteDir, "dir/a.txt", "aaa", testTime)
+	writeLocalFile(t, remoteDir, "gone.txt", "gone", testTime)
+	runSync(t, proxy, fs.SyncOptions{})
+
+	// Вытеснение из кеша не удаляет файлы с удаленного сервера
+	require.NoError(t, proxy.Evict(ctx, "/remote.txt"))
+	require.NoError(t, proxy.Evict(ctx, "/dir"))
+	require.NoError(t, proxy.Evict(ctx, "/gone.txt"))
+	assert.Empty(t, runSync(t, proxy, fs.SyncOptions{}))
+	assert.Equal(t, "remote", readFile(t, remoteDir, "remote.txt"))
+	assert.Equal(t, "aaa", readFile(t, remoteDir, "dir/a.txt"))
+
+	// Вытесненные копии не скачиваются заново
+	writeLocalFile(t, remoteDir, "remote.txt", "changed", testTime.Add(time.Hour))
+	require.NoError(t, os.Remove(filepath.Join(remoteDir, "gone.txt")))
+	assert.Empty(t, runSync(t, proxy, fs.SyncOptions{}))
+	assert.NoFileExists(t, filepath.Join(localDir, "remote.txt"))
+
+	// Файл, снова попавший в кеш, синхронизируется как обычно
+	require.NoError(t, proxy.Fetch(ctx, "/remote.txt"))
+	assert.Empty(t, runSync(t, proxy, fs.SyncOptions{}))
+	require.NoError(t, os.Remove(filepath.Join(localDir, "remote.txt")))
+	assert.Equal(t, map[string]fs.SyncOp{"/remote.txt": fs.SyncOpDeleteRemote}, runSync(t, proxy, fs.SyncOptions{}))
+}
+
+func TestParseSyncDirection(t *testing.T) {
+	d, err := fs.ParseSyncDirection("")
+	require.NoError(t, err)
+	assert.Equal(t, fs.SyncBoth, d)
+
+	d, err = fs.ParseSyncDirection("download")
+	require.NoError(t, err)
+	assert.Equal(t, fs.SyncDownload, d)
+
+	_, err = fs.ParseSyncDirection("sideways")
+	assert.Error(t, err)
+}
+
+func TestSync_Budget(t *testing.T) {
+	proxy, localDir, remoteDir := setupSync(t, fs.WithCacheBudget(8))
+
+	writeLocalFile(t, remoteDir, "small.txt", "small", testTime)
+	writeLocalFile(t, remoteDir, "large.txt", "too large for the cache", testTime)
+
+	result, err := proxy.Sync(context.Background(), fs.SyncOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, 1, result.Failed)
+
+	assert.Equal(t, "small", readFile(t, localDir, "small.txt"))
+	assert.NoFileExists(t, filepath.Join(localDir, "large.txt"))
+}
+
+func TestLockCache(t *testing.T) {
+	dir := t.TempDir()
+	first := fs.NewPikpakProxy(lgr.New(), dir, &MockWebdav{})
+	second := fs.NewPikpakProxy(lgr.New(), dir, &MockWebdav{})
+
+	unlock, err := first.LockCache()
+	require.NoError(t, err)
+
+	// Сервер и команда синхронизации не работают с кешем одновременно
+	_, err = second.LockCache()
+	assert.ErrorIs(t, err, fs.ErrCacheLocked)
+
+	unlock()
+	unlock, err = second.LockCache()
+	require.NoError(t, err)
+	unlock()
+}
@@ -0,0 +1,456 @@
+package lock
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ReanSn0w/pikpak-webdav-proxy/pkg/utils"
+	"github.com/go-pkgz/lgr"
+	"golang.org/x/net/webdav"
+)
+
+// Upstream - удаленный сервер, на который дублируются блокировки. Lock
+// возвращает пустой токен, если ресурса нет на удаленном сервере
+type Upstream interface {
+	Lock(root string, details webdav.LockDetails) (token string, err error)
+	Refresh(root, token string, duration time.Duration) error
+	Unlock(root, token string) error
+}
+
+// ErrUpstreamLocked возвращается Upstream, если ресурс уже заблокирован
+// на удаленном сервере
+var ErrUpstreamLocked = errors.New("resource is locked upstream")
+
+// lockEntry - сохраняемое состояние блокировки
+type lockEntry struct {
+	Details webdav.LockDetails `json:"details"`
+	Expiry  time.Time          `json:"expiry,omitempty"`
+	// Upstream - токен блокировки на удаленном сервере
+	Upstream string `json:"upstream,omitempty"`
+
+	held bool
+	// internal - блокировка создана обработчиком WebDAV на время запроса
+	internal bool
+}
+
+func (e *lockEntry) expired(now time.Time) bool {
+	return !e.Expiry.IsZero() && !now.Before(e.Expiry)
+}
+
+// FileLS - реализация webdav.LockSystem, сохраняющая блокировки в файл,
+// чтобы они переживали перезапуск сервера
+type FileLS struct {
+	log      lgr.L
+	path     string
+	upstream Upstream
+
+	mu    sync.Mutex
+	locks map[string]*lockEntry
+}
+
+// NewFileLS загружает блокировки из файла path. Если upstream не nil,
+// блокировки дублируются на удаленный сервер
+func NewFileLS(log lgr.L, path string, upstream Upstream) (*FileLS, error) {
+	l := &FileLS{
+		log:      log,
+		path:     path,
+		upstream: upstream,
+		locks:    make(map[string]*lockEntry),
+	}
+
+	data, err := os.ReadFile(path)
+	switch {
+	case os.IsNotExist(err):
+		return l, nil
+	case err != nil:
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, &l.locks); err != nil {
+		return nil, err
+	}
+
+	l.log.Logf("[INFO] loaded %d locks from %s", len(l.locks), path)
+	return l, nil
+}
+
+// Sweep периодически удаляет истекшие блокировки до отмены контекста
+func (l *FileLS) Sweep(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			l.mu.Lock()
+			expired := l.collectExpired(now)
+			l.saveExpired(expired)
+			l.mu.Unlock()
+
+			l.unlockUpstream(expired)
+		}
+	}
+}
+
+func (l *FileLS) Confirm(now time.Time, name0, name1 string, conditions ...webdav.Condition) (func(), error) {
+	release, expired, err := l.confirm(now, name0, name1, conditions...)
+	l.unlockUpstream(expired)
+	return release, err
+}
+
+func (l *FileLS) confirm(now time.Time, name0, name1 string, conditions ...webdav.Condition) (func(), []*lockEntry, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	expired := l.collectExpired(now)
+	l.saveExpired(expired)
+
+	var e0, e1 *lockEntry
+	if name0 != "" {
+		if e0 = l.lookup(cleanName(name0), conditions...); e0 == nil {
+			return nil, expired, webdav.ErrConfirmationFailed
+		}
+	}
+	if name1 != "" {
+		if e1 = l.lookup(cleanName(name1), conditions...); e1 == nil {
+			return nil, expired, webdav.ErrConfirmationFailed
+		}
+	}
+
+	// Одна и та же блокировка не удерживается дважды
+	if e1 == e0 {
+		e1 = nil
+	}
+
+	for _, e := range []*lockEntry{e0, e1} {
+		if e != nil {
+			e.held = true
+		}
+	}
+
+	return func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+
+		for _, e := range []*lockEntry{e0, e1} {
+			if e != nil {
+				e.held = false
+			}
+		}
+	}, expired, nil
+}
+
+// lookup возвращает блокировку, покрывающую ресурс name и соответствующую
+// одному из условий, если она не удерживается другим запросом
+func (l *FileLS) lookup(name string, conditions ...webdav.Condition) *lockEntry {
+	for _, c := range conditions {
+		e := l.locks[c.Token]
+		if e == nil || e.held {
+			continue
+		}
+
+		if covers(e.Details, name) {
+			return e
+		}
+	}
+
+	return nil
+}
+
+// Create создает блокировку по запросу клиента: она сохраняется в файл
+// и дублируется на удаленный сервер. Запрос к удаленному серверу
+// выполняется без удержания мьютекса: пока он идет, блокировка уже
+// занимает ресурс
+func (l *FileLS) Create(now time.Time, details webdav.LockDetails) (string, error) {
+	return l.create(now, details, false)
+}
+
+// Internal возвращает систему блокировок для обработчика WebDAV. Он сам
+// блокирует ресурс на время каждого изменяющего запроса, и такие
+// блокировки не сохраняются в файл и не дублируются на удаленный
+// сервер. Остальные методы работают с общими блокировками FileLS
+func (l *FileLS) Internal() webdav.LockSystem {
+	return internalLS{l}
+}
+
+type internalLS struct {
+	*FileLS
+}
+
+func (l internalLS) Create(now time.Time, details webdav.LockDetails) (string, error) {
+	return l.create(now, details, true)
+}
+
+func (l *FileLS) create(now time.Time, details webdav.LockDetails, internal bool) (string, error) {
+	details.Root = cleanName(details.Root)
+	mirror := l.upstream != nil && !internal
+
+	token, expired, err := l.reserve(now, details, internal, !mirror && !internal)
+	l.unlockUpstream(expired)
+	if err != nil {
+		return "", err
+	}
+
+	if mirror {
+		upstreamToken, err := l.upstream.Lock(details.Root, details)
+		if err := l.attach(token, details.Root, upstreamToken, err); err != nil {
+			return "", err
+		}
+	}
+
+	l.log.Logf("[DEBUG] lock created: %s (%s)", details.Root, token)
+	return token, nil
+}
+
+// reserve добавляет блокировку, если она не конфликтует с существующими
+func (l *FileLS) reserve(now time.Time, details webdav.LockDetails, internal, save bool) (string, []*lockEntry, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	expired := l.collectExpired(now)
+	token, err := l.add(now, details, internal)
+
+	if len(expired) > 0 || (err == nil && save) {
+		l.save()
+	}
+	return token, expired, err
+}
+
+func (l *FileLS) add(now time.Time, details webdav.LockDetails, internal bool) (string, error) {
+	for _, e := range l.locks {
+		if conflicts(e.Details, details) {
+			return "", webdav.ErrLocked
+		}
+	}
+
+	token, err := newToken()
+	if err != nil {
+		return "", err
+	}
+
+	e := &lockEntry{Details: details, internal: internal}
+	if details.Duration >= 0 {
+		e.Expiry = now.Add(details.Duration)
+	}
+	l.locks[token] = e
+	return token, nil
+}
+
+// attach сохраняет результат блокировки ресурса root на удаленном сервере
+// для блокировки token
+func (l *FileLS) attach(token, root, upstreamToken string, upstreamErr error) error {
+	if errors.Is(upstreamErr, ErrUpstreamLocked) {
+		l.mu.Lock()
+		delete(l.locks, token)
+		l.save()
+		l.mu.Unlock()
+		return webdav.ErrLocked
+	}
+
+	if upstreamErr != nil {
+		l.log.Logf("[WARN] upstream lock %s: %v", root, upstreamErr)
+		upstreamToken = ""
+	}
+
+	l.mu.Lock()
+	e := l.locks[token]
+	if e != nil {
+		e.Upstream = upstreamToken
+		l.save()
+	}
+	l.mu.Unlock()
+
+	// Блокировка истекла, пока выполнялся запрос к удаленному серверу
+	if e == nil && upstreamToken != "" {
+		l.unlockUpstream([]*lockEntry{{Details: webdav.LockDetails{Root: root}, Upstream: upstreamToken}})
+	}
+	return nil
+}
+
+func (l *FileLS) Refresh(now time.Time, token string, duration time.Duration) (webdav.LockDetails, error) {
+	details, upstreamToken, expired, err := l.refresh(now, token, duration)
+	l.unlockUpstream(expired)
+	if err != nil {
+		return webdav.LockDetails{}, err
+	}
+
+	if l.upstream != nil && upstreamToken != "" {
+		if err := l.upstream.Refresh(details.Root, upstreamToken, duration); err != nil {
+			l.log.Logf("[WARN] upstream lock refresh %s: %v", details.Root, err)
+		}
+	}
+
+	return details, nil
+}
+
+func (l *FileLS) refresh(now time.Time, token string, duration time.Duration) (webdav.LockDetails, string, []*lockEntry, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	expired := l.collectExpired(now)
+
+	e := l.locks[token]
+	switch {
+	case e == nil:
+		l.saveExpired(expired)
+		return webdav.LockDetails{}, "", expired, webdav.ErrNoSuchLock
+	case e.held:
+		l.saveExpired(expired)
+		return webdav.LockDetails{}, "", expired, webdav.ErrLocked
+	}
+
+	e.Details.Duration = duration
+	e.Expiry = time.Time{}
+	if duration >= 0 {
+		e.Expiry = now.Add(duration)
+	}
+
+	l.save()
+	return e.Details, e.Upstream, expired, nil
+}
+
+func (l *FileLS) Unlock(now time.Time, token string) error {
+	e, expired, err := l.release(now, token)
+	if e != nil {
+		expired = append(expired, e)
+	}
+	l.unlockUpstream(expired)
+	if err != nil {
+		return err
+	}
+
+	l.log.Logf("[DEBUG] lock released: %s (%s)", e.Details.Root, token)
+	return nil
+}
+
+// release удаляет блокировку token и возвращает ее
+func (l *FileLS) release(now time.Time, token string) (*lockEntry, []*lockEntry, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	expired := l.collectExpired(now)
+
+	e := l.locks[token]
+	switch {
+	case e == nil:
+		l.saveExpired(expired)
+		return nil, expired, webdav.ErrNoSuchLock
+	case e.held:
+		l.saveExpired(expired)
+		return nil, expired, webdav.ErrLocked
+	}
+
+	delete(l.locks, token)
+	if len(expired) > 0 || !e.internal {
+		l.save()
+	}
+	return e, expired, nil
+}
+
+// collectExpired удаляет истекшие блокировки и возвращает их, чтобы
+// после освобождения мьютекса снять их копии на удаленном сервере
+func (l *FileLS) collectExpired(now time.Time) []*lockEntry {
+	var expired []*lockEntry
+	for token, e := range l.locks {
+		if e.held || !e.expired(now) {
+			continue
+		}
+
+		l.log.Logf("[DEBUG] lock expired: %s (%s)", e.Details.Root, token)
+		delete(l.locks, token)
+		expired = append(expired, e)
+	}
+	return expired
+}
+
+// saveExpired сохраняет блокировки, если какие-то из них истекли
+func (l *FileLS) saveExpired(expired []*lockEntry) {
+	if len(expired) > 0 {
+		l.save()
+	}
+}
+
+// unlockUpstream снимает копии блокировок на удаленном сервере. Вызывается
+// без удержания мьютекса, так как запросы могут выполняться долго
+func (l *FileLS) unlockUpstream(entries []*lockEntry) {
+	if l.upstream == nil {
+		return
+	}
+
+	for _, e := range entries {
+		if e.Upstream == "" {
+			continue
+		}
+		if err := l.upstream.Unlock(e.Details.Root, e.Upstream); err != nil {
+			l.log.Logf("[WARN] upstream unlock %s: %v", e.Details.Root, err)
+		}
+	}
+}
+
+// save записывает блокировки в файл. Ошибки записи не мешают работе
+// блокировок в памяти, поэтому только логируются
+func (l *FileLS) save() {
+	locks := make(map[string]*lockEntry, len(l.locks))
+	for token, e := range l.locks {
+		if !e.internal {
+			locks[token] = e
+		}
+	}
+
+	if err := utils.WriteJSONAtomic(l.path, locks); err != nil {
+		l.log.Logf("[ERROR] failed to save locks: %v", err)
+	}
+}
+
+// covers проверяет, распространяется ли блокировка на ресурс name
+func covers(details webdav.LockDetails, name string) bool {
+	if name == details.Root {
+		return true
+	}
+	if details.ZeroDepth {
+		return false
+	}
+	return isAncestor(details.Root, name)
+}
+
+// conflicts проверяет, мешает ли существующая блокировка создать новую
+func conflicts(existing, requested webdav.LockDetails) bool {
+	switch {
+	case existing.Root == requested.Root:
+		return true
+	case !existing.ZeroDepth && isAncestor(existing.Root, requested.Root):
+		return true
+	case !requested.ZeroDepth && isAncestor(requested.Root, existing.Root):
+		return true
+	default:
+		return false
+	}
+}
+
+func isAncestor(parent, name string) bool {
+	return parent == "/" || strings.HasPrefix(name, parent+"/")
+}
+
+func cleanName(name string) string {
+	return path.Clean("/" + name)
+}
+
+func newToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	h := hex.EncodeToString(b)
+	return "urn:uuid:" + h[0:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:], nil
+}
@@ -0,0 +1,237 @@
+package lock_test
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ReanSn0w/pikpak-webdav-proxy/pkg/lock"
+	lgr "github.com/go-pkgz/lgr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/webdav"
+)
+
+// MockUpstream - мок для удаленного сервера блокировок
+type MockUpstream struct {
+	mock.Mock
+}
+
+func (m *MockUpstream) Lock(root string, details webdav.LockDetails) (string, error) {
+	args := m.Called(root, details)
+	return args.String(0), args.Error(1)
+}
+
+func (m *MockUpstream) Refresh(root, token string, duration time.Duration) error {
+	return m.Called(root, token, duration).Error(0)
+}
+
+func (m *MockUpstream) Unlock(root, token string) error {
+	return m.Called(root, token).Error(0)
+}
+
+var now = time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+func newFileLS(t *testing.T, path string, upstream lock.Upstream) *lock.FileLS {
+	t.Helper()
+	ls, err := lock.NewFileLS(lgr.New(), path, upstream)
+	require.NoError(t, err)
+	return ls
+}
+
+func TestFileLS_CreateConfirmUnlock(t *testing.T) {
+	ls := newFileLS(t, filepath.Join(t.TempDir(), "locks.json"), nil)
+
+	token, err := ls.Create(now, webdav.LockDetails{Root: "/a", Duration: time.Minute})
+	require.NoError(t, err)
+	assert.NotEmpty(t, token)
+
+	_, err = ls.Confirm(now, "/a", "")
+	assert.Equal(t, webdav.ErrConfirmationFailed, err)
+
+	release, err := ls.Confirm(now, "/a/b", "", webdav.Condition{Token: token})
+	require.NoError(t, err)
+
+	// Удерживаемую блокировку нельзя снять
+	assert.Equal(t, webdav.ErrLocked, ls.Unlock(now, token))
+	release()
+
+	assert.NoError(t, ls.Unlock(now, token))
+	assert.Equal(t, webdav.ErrNoSuchLock, ls.Unlock(now, token))
+}
+
+func TestFileLS_Conflicts(t *testing.T) {
+	ls := newFileLS(t, filepath.Join(t.TempDir(), "locks.json"), nil)
+
+	_, err := ls.Create(now, webdav.LockDetails{Root: "/a", Duration: -1})
+	require.NoError(t, err)
+
+	_, err = ls.Create(now, webdav.LockDetails{Root: "/a/b", Duration: -1, ZeroDepth: true})
+	assert.Equal(t, webdav.ErrLocked, err)
+
+	_, err = ls.Create(now, webdav.LockDetails{Root: "/c/d", Duration: -1, ZeroDepth: true})
+	require.NoError(t, err)
+
+	// Блокировка с бесконечной глубиной конфликтует с вложенной
+	_, err = ls.Create(now, webdav.LockDetails{Root: "/c", Duration: -1})
+	assert.Equal(t, webdav.ErrLocked, err)
+
+	// Блокировка нулевой глубины - нет
+	_, err = ls.Create(now, webdav.LockDetails{Root: "/c", Duration: -1, ZeroDepth: true})
+	assert.NoError(t, err)
+}
+
+func TestFileLS_Persistence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "meta", "locks.json")
+
+	ls := newFileLS(t, path, nil)
+	token, err := ls.Create(now, webdav.LockDetails{Root: "/file.txt", Duration: time.Hour, OwnerXML: "<owner/>"})
+	require.NoError(t, err)
+
+	restarted := newFileLS(t, path, nil)
+
+	_, err = restarted.Create(now, webdav.LockDetails{Root: "/file.txt", Duration: time.Hour})
+	assert.Equal(t, webdav.ErrLocked, err)
+
+	details, err := restarted.Refresh(now, token, 2*time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, "<owner/>", details.OwnerXML)
+
+	release, err := restarted.Confirm(now, "/file.txt", "", webdav.Condition{Token: token})
+	require.NoError(t, err)
+	release()
+}
+
+func TestFileLS_Expiry(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "locks.json")
+	ls := newFileLS(t, path, nil)
+
+	token, err := ls.Create(now, webdav.LockDetails{Root: "/a", Duration: time.Second})
+	require.NoError(t, err)
+
+	_, err = ls.Confirm(now.Add(2*time.Second), "/a", "", webdav.Condition{Token: token})
+	assert.Equal(t, webdav.ErrConfirmationFailed, err)
+
+	_, err = ls.Create(now.Add(2*time.Second), webdav.LockDetails{Root: "/a", Duration: time.Second})
+	assert.NoError(t, err)
+}
+
+func TestFileLS_Sweep(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "locks.json")
+	ls := newFileLS(t, path, nil)
+
+	_, err := ls.Create(time.Now(), webdav.LockDetails{Root: "/a", Duration: time.Millisecond})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go ls.Sweep(ctx, 5*time.Millisecond)
+
+	assert.Eventually(t, func() bool {
+		restarted, err := lock.NewFileLS(lgr.New(), path, nil)
+		if err != nil {
+			return false
+		}
+		_, err = restarted.Create(time.Now().Add(-time.Hour), webdav.LockDetails{Root: "/a", Duration: time.Minute})
+		return err == nil
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestFileLS_Upstream(t *testing.T) {
+	upstream := &MockUpstream{}
+	ls := newFileLS(t, filepath.Join(t.TempDir(), "locks.json"), upstream)
+
+	details := webdav.LockDetails{Root: "/doc.docx", Duration: time.Minute}
+	upstream.On("Lock", "/doc.docx", details).Return("opaquelocktoken:remote", nil)
+	upstream.On("Refresh", "/doc.docx", "opaquelocktoken:remote", 2*time.Minute).Return(nil)
+	upstream.On("Unlock", "/doc.docx", "opaquelocktoken:remote").Return(nil)
+
+	token, err := ls.Create(now, details)
+	require.NoError(t, err)
+
+	_, err = ls.Refresh(now, token, 2*time.Minute)
+	require.NoError(t, err)
+
+	require.NoError(t, ls.Unlock(now, token))
+	upstream.AssertExpectations(t)
+}
+
+func TestFileLS_UpstreamLocked(t *testing.T) {
+	upstream := &MockUpstream{}
+	ls := newFileLS(t, filepath.Join(t.TempDir(), "locks.json"), upstream)
+
+	upstream.On("Lock", "/doc.docx", mock.Anything).Return("", lock.ErrUpstreamLocked)
+
+	_, err := ls.Create(now, webdav.LockDetails{Root: "/doc.docx", Duration: time.Minute})
+	assert.Equal(t, webdav.ErrLocked, err)
+}
+
+func TestFileLS_TemporaryLocks(t *testing.T) {
+	upstream := &MockUpstream{}
+	path := filepath.Join(t.TempDir(), "locks.json")
+	ls := newFileLS(t, path, upstream)
+
+	// Такие блокировки создает webdav.Handler на время одного запроса
+	token, err := ls.Internal().Create(now, webdav.LockDetails{Root: "/a", Duration: -1, ZeroDepth: true})
+	require.NoError(t, err)
+
+	_, err = ls.Create(now, webdav.LockDetails{Root: "/a", Duration: time.Minute})
+	assert.Equal(t, webdav.ErrLocked, err)
+
+	// Блокировка не переживает перезапуск
+	restarted := newFileLS(t, path, nil)
+	_, err = restarted.Create(now, webdav.LockDetails{Root: "/a", Duration: time.Minute})
+	assert.NoError(t, err)
+
+	require.NoError(t, ls.Unlock(now, token))
+	upstream.AssertNotCalled(t, "Lock", mock.Anything, mock.Anything)
+	upstream.AssertNotCalled(t, "Unlock", mock.Anything, mock.Anything)
+}
+
+func TestFileLS_InfiniteClientLock(t *testing.T) {
+	upstream := &MockUpstream{}
+	path := filepath.Join(t.TempDir(), "locks.json")
+	ls := newFileLS(t, path, upstream)
+
+	// Клиент может запросить блокировку без срока, глубины и владельца,
+	// она совпадает по полям с блокировкой запроса, но должна сохраниться
+	upstream.On("Lock", "/a", mock.Anything).Return("opaquelocktoken:remote", nil)
+
+	_, err := ls.Create(now, webdav.LockDetails{Root: "/a", Duration: -1, ZeroDepth: true})
+	require.NoError(t, err)
+	upstream.AssertExpectations(t)
+
+	restarted := newFileLS(t, path, nil)
+	_, err = restarted.Create(now, webdav.LockDetails{Root: "/a", Duration: time.Minute})
+	assert.Equal(t, webdav.ErrLocked, err)
+}
+
+func TestFileLS_SlowUpstream(t *testing.T) {
+	upstream := &MockUpstream{}
+	ls := newFileLS(t, filepath.Join(t.TempDir(), "locks.json"), upstream)
+
+	unblock := make(chan time.Time)
+	upstream.On("Lock", "/slow", mock.Anything).WaitUntil(unblock).Return("opaquelocktoken:remote", nil)
+
+	created := make(chan error, 1)
+	go func() {
+		_, err := ls.Create(now, webdav.LockDetails{Root: "/slow", Duration: time.Minute})
+		created <- err
+	}()
+
+	// Пока идет запрос к удаленному серверу, ресурс уже занят, а другие
+	// блокировки создаются без ожидания
+	assert.Eventually(t, func() bool {
+		_, err := ls.Internal().Create(now, webdav.LockDetails{Root: "/slow", Duration: -1, ZeroDepth: true})
+		return err == webdav.ErrLocked
+	}, time.Second, 5*time.Millisecond)
+
+	token, err := ls.Internal().Create(now, webdav.LockDetails{Root: "/other", Duration: -1, ZeroDepth: true})
+	require.NoError(t, err)
+	require.NoError(t, ls.Unlock(now, token))
+
+	close(unblock)
+	require.NoError(t, <-created)
+}
@@ -0,0 +1,157 @@
+package lock
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/net/webdav"
+)
+
+// Resolver возвращает путь ресурса на удаленном сервере. Файловая система
+// прокси кодирует имена и учитывает виртуальные перемещения, поэтому путь
+// в запросе клиента может не совпадать с путем на удаленном сервере
+type Resolver interface {
+	RemotePath(name string) (string, error)
+}
+
+// HTTPUpstream дублирует блокировки на удаленный WebDAV сервер
+// с помощью запросов LOCK и UNLOCK
+type HTTPUpstream struct {
+	baseURL  string
+	user     string
+	pass     string
+	resolver Resolver
+	client   *http.Client
+}
+
+// NewHTTPUpstream создает клиент блокировок удаленного сервера. Если
+// resolver равен nil, пути ресурсов передаются серверу без изменений
+func NewHTTPUpstream(baseURL, user, pass string, resolver Resolver) *HTTPUpstream {
+	return &HTTPUpstream{
+		baseURL:  strings.TrimSuffix(baseURL, "/"),
+		user:     user,
+		pass:     pass,
+		resolver: resolver,
+		client:   &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+const lockInfoBody = `<?xml version="1.0" encoding="utf-8"?>
+<D:lockinfo xmlns:D="DAV:">
+  <D:lockscope><D:exclusive/></D:lockscope>
+  <D:locktype><D:write/></D:locktype>
+  %s
+</D:lockinfo>`
+
+func (u *HTTPUpstream) Lock(root string, details webdav.LockDetails) (string, error) {
+	body := fmt.Sprintf(lockInfoBody, details.OwnerXML)
+
+	req, err := u.request("LOCK", root, strings.NewReader(body))
+	if errors.Is(err, os.ErrNotExist) {
+		// Ресурс есть только в локальном слое, блокировать на сервере нечего
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	req.Header.Set("Content-Type", "application/xml; charset=utf-8")
+	req.Header.Set("Timeout", timeoutHeader(details.Duration))
+	if details.ZeroDepth {
+		req.Header.Set("Depth", "0")
+	} else {
+		req.Header.Set("Depth", "infinity")
+	}
+
+	resp, err := u.do(req)
+	if err != nil {
+		return "", err
+	}
+
+	token := strings.Trim(resp.Header.Get("Lock-Token"), "<>")
+	if token == "" {
+		return "", fmt.Errorf("upstream returned no lock token")
+	}
+
+	return token, nil
+}
+
+func (u *HTTPUpstream) Refresh(root, token string, duration time.Duration) error {
+	req, err := u.request("LOCK", root, nil)
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("If", "(<"+token+">)")
+	req.Header.Set("Timeout", timeoutHeader(duration))
+
+	_, err = u.do(req)
+	return err
+}
+
+func (u *HTTPUpstream) Unlock(root, token string) error {
+	req, err := u.request("UNLOCK", root, nil)
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Lock-Token", "<"+token+">")
+
+	_, err = u.do(req)
+	return err
+}
+
+func (u *HTTPUpstream) request(method, name string, body io.Reader) (*http.Request, error) {
+	if u.resolver != nil {
+		remote, err := u.resolver.RemotePath(name)
+		if err != nil {
+			return nil, err
+		}
+		name = remote
+	}
+
+	target := u.baseURL + (&url.URL{Path: name}).EscapedPath()
+
+	req, err := http.NewRequest(method, target, body)
+	if err != nil {
+		return nil, err
+	}
+
+	if u.user != "" || u.pass != "" {
+		req.SetBasicAuth(u.user, u.pass)
+	}
+
+	return req, nil
+}
+
+func (u *HTTPUpstream) do(req *http.Request) (*http.Response, error) {
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusLocked:
+		return nil, ErrUpstreamLocked
+	case resp.StatusCode >= 300:
+		return nil, fmt.Errorf("upstream %s %s: %s", req.Method, req.URL.Path, resp.Status)
+	default:
+		return resp, nil
+	}
+}
+
+func timeoutHeader(d time.Duration) string {
+	if d < 0 {
+		return "Infinite"
+	}
+	return fmt.Sprintf("Second-%d", int64(d/time.Second))
+}
@@ -0,0 +1,148 @@
+package lock_test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/ReanSn0w/pikpak-webdav-proxy/pkg/fs"
+	"github.com/ReanSn0w/pikpak-webdav-proxy/pkg/lock"
+	lgr "github.com/go-pkgz/lgr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/webdav"
+)
+
+func TestHTTPUpstream_LockUnlock(t *testing.T) {
+	var requests []*http.Request
+	var lockBody string
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r)
+
+		user, pass, _ := r.BasicAuth()
+		assert.Equal(t, "user", user)
+		assert.Equal(t, "pass", pass)
+
+		switch r.Method {
+		case "LOCK":
+			body, _ := io.ReadAll(r.Body)
+			if len(body) > 0 {
+				lockBody = string(body)
+			}
+			w.Header().Set("Lock-Token", "<opaquelocktoken:42>")
+			w.WriteHeader(http.StatusOK)
+		case "UNLOCK":
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	defer server.Close()
+
+	upstream := lock.NewHTTPUpstream(server.URL+"/", "user", "pass", nil)
+
+	token, err := upstream.Lock("/dir/my file.txt", webdav.LockDetails{
+		Duration:  time.Minute,
+		ZeroDepth: true,
+		OwnerXML:  "<D:owner>me</D:owner>",
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "opaquelocktoken:42", token)
+
+	require.NoError(t, upstream.Refresh("/dir/my file.txt", token, -1))
+	require.NoError(t, upstream.Unlock("/dir/my file.txt", token))
+
+	require.Len(t, requests, 3)
+
+	assert.Equal(t, "/dir/my file.txt", requests[0].URL.Path)
+	assert.Equal(t, "0", requests[0].Header.Get("Depth"))
+	assert.Equal(t, "Second-60", requests[0].Header.Get("Timeout"))
+	assert.Contains(t, lockBody, "<D:owner>me</D:owner>")
+
+	assert.Equal(t, "(<opaquelocktoken:42>)", requests[1].Header.Get("If"))
+	assert.Equal(t, "Infinite", requests[1].Header.Get("Timeout"))
+
+	assert.Equal(t, "UNLOCK", requests[2].Method)
+	assert.Equal(t, "<opaquelocktoken:42>", requests[2].Header.Get("Lock-Token"))
+}
+
+func TestHTTPUpstream_Locked(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusLocked)
+	}))
+	defer server.Close()
+
+	upstream := lock.NewHTTPUpstream(server.URL, "", "", nil)
+
+	_, err := upstream.Lock("/file.txt", webdav.LockDetails{Duration: -1})
+	assert.ErrorIs(t, err, lock.ErrUpstreamLocked)
+}
+
+func TestHTTPUpstream_NotSupported(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}))
+	defer server.Close()
+
+	upstream := lock.NewHTTPUpstream(server.URL, "", "", nil)
+
+	_, err := upstream.Lock("/file.txt", webdav.LockDetails{Duration: -1})
+	assert.Error(t, err)
+	assert.NotErrorIs(t, err, lock.ErrUpstreamLocked)
+}
+
+type mapResolver map[string]string
+
+func (r mapResolver) RemotePath(name string) (string, error) {
+	remote, ok := r[name]
+	if !ok {
+		return "", os.ErrNotExist
+	}
+	return remote, nil
+}
+
+func TestHTTPUpstream_Resolver(t *testing.T) {
+	var paths []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+		w.Header().Set("Lock-Token", "<opaquelocktoken:42>")
+	}))
+	defer server.Close()
+
+	upstream := lock.NewHTTPUpstream(server.URL, "", "", mapResolver{"/moved.txt": "/original.txt"})
+
+	token, err := upstream.Lock("/moved.txt", webdav.LockDetails{Duration: -1})
+	require.NoError(t, err)
+	require.NoError(t, upstream.Unlock("/moved.txt", token))
+
+	// Файла нет на удаленном сервере, блокировка остается локальной
+	token, err = upstream.Lock("/local.txt", webdav.LockDetails{Duration: -1})
+	require.NoError(t, err)
+	assert.Empty(t, token)
+
+	assert.Equal(t, []string{"/original.txt", "/original.txt"}, paths)
+}
+
+func TestHTTPUpstream_MissingRemotePath(t *testing.T) {
+	var methods []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		methods = append(methods, r.Method)
+		if r.Method == "LOCK" {
+			w.Header().Set("Lock-Token", "<opaquelocktoken:42>")
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer server.Close()
+
+	proxy := fs.NewPikpakProxy(lgr.New(), t.TempDir(), fs.NewRemoteClient(server.URL, "", ""))
+	upstream := lock.NewHTTPUpstream(server.URL, "", "", proxy)
+
+	// LOCK нового пути создал бы на сервере пустой ресурс
+	token, err := upstream.Lock("/new.txt", webdav.LockDetails{Duration: -1})
+	require.NoError(t, err)
+	assert.Empty(t, token)
+	assert.NotContains(t, methods, "LOCK")
+}
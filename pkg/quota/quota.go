@@ -0,0 +1,115 @@
+package quota
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/go-pkgz/lgr"
+)
+
+// Quota - использование дискового пространства (RFC 4331).
+// Отрицательное значение Available означает, что свободное место неизвестно
+type Quota struct {
+	Used      int64
+	Available int64
+}
+
+// Source - источник сведений о квоте
+type Source interface {
+	Quota(ctx context.Context) (Quota, error)
+}
+
+// failureTTL - время, в течение которого источник не запрашивается
+// повторно после ошибки
+const failureTTL = 30 * time.Second
+
+// Cached кеширует квоту источника на время ttl. Если источник недоступен,
+// возвращается последнее полученное значение, а ошибка запоминается
+// на failureTTL. Источник запрашивается одновременно не более одного раза
+// и без блокировки остальных вызовов: пока идет запрос, они получают
+// последнее значение
+type Cached struct {
+	log    lgr.L
+	source Source
+	ttl    time.Duration
+
+	mu      sync.Mutex
+	value   Quota
+	fetched time.Time
+	ok      bool
+	// err и failed - последняя ошибка источника и время ее получения
+	err    error
+	failed time.Time
+	// inflight закрывается по завершении текущего запроса к источнику
+	inflight chan struct{}
+}
+
+func NewCached(log lgr.L, source Source, ttl time.Duration) *Cached {
+	return &Cached{log: log, source: source, ttl: ttl}
+}
+
+func (c *Cached) Quota(ctx context.Context) (Quota, error) {
+	c.mu.Lock()
+	for {
+		switch {
+		case c.ok && time.Since(c.fetched) < c.ttl:
+			defer c.mu.Unlock()
+			return c.value, nil
+		case c.err != nil && time.Since(c.failed) < failureTTL:
+			defer c.mu.Unlock()
+			return c.stale()
+		case c.inflight != nil && c.ok:
+			defer c.mu.Unlock()
+			return c.value, nil
+		}
+
+		if c.inflight == nil {
+			break
+		}
+
+		// Значения еще нет, ждем запрос, начатый другим вызовом
+		wait := c.inflight
+		c.mu.Unlock()
+		select {
+		case <-wait:
+		case <-ctx.Done():
+			return Quota{}, ctx.Err()
+		}
+		c.mu.Lock()
+	}
+
+	done := make(chan struct{})
+	c.inflight = done
+	c.mu.Unlock()
+
+	// Результат нужен и другим вызовам, поэтому отмена запроса клиента
+	// не прерывает обращение к источнику
+	q, err := c.source.Quota(context.WithoutCancel(ctx))
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.inflight = nil
+	close(done)
+
+	if err != nil {
+		c.err, c.failed = err, time.Now()
+		if c.ok {
+			c.log.Logf("[WARN] failed to fetch quota, using cached value: %v", err)
+		}
+		return c.stale()
+	}
+
+	c.value, c.fetched, c.ok, c.err = q, time.Now(), true, nil
+	return q, nil
+}
+
+// stale возвращает последнее полученное значение после ошибки источника.
+// Вызывается под c.mu
+func (c *Cached) stale() (Quota, error) {
+	if !c.ok {
+		return Quota{}, c.err
+	}
+	return c.value, nil
+}
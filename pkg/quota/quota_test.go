@@ -0,0 +1,108 @@
+package quota_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ReanSn0w/pikpak-webdav-proxy/pkg/quota"
+	lgr "github.com/go-pkgz/lgr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeSource возвращает заданную квоту и считает обращения
+type fakeSource struct {
+	quota quota.Quota
+	err   error
+	calls int
+}
+
+func (f *fakeSource) Quota(ctx context.Context) (quota.Quota, error) {
+	f.calls++
+	return f.quota, f.err
+}
+
+func TestCached(t *testing.T) {
+	source := &fakeSource{quota: quota.Quota{Used: 10, Available: 90}}
+	cached := quota.NewCached(lgr.New(), source, time.Hour)
+
+	for range 3 {
+		q, err := cached.Quota(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, quota.Quota{Used: 10, Available: 90}, q)
+	}
+
+	assert.Equal(t, 1, source.calls)
+}
+
+func TestCached_StaleOnError(t *testing.T) {
+	source := &fakeSource{quota: quota.Quota{Used: 10, Available: 90}}
+	cached := quota.NewCached(lgr.New(), source, 0)
+
+	_, err := cached.Quota(context.Background())
+	require.NoError(t, err)
+
+	source.err = errors.New("unavailable")
+	q, err := cached.Quota(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, int64(90), q.Available)
+	assert.Equal(t, 2, source.calls)
+}
+
+func TestCached_Error(t *testing.T) {
+	source := &fakeSource{err: errors.New("unavailable")}
+	cached := quota.NewCached(lgr.New(), source, time.Hour)
+
+	_, err := cached.Quota(context.Background())
+	assert.Error(t, err)
+}
+
+func TestCached_ErrorCached(t *testing.T) {
+	source := &fakeSource{err: errors.New("unavailable")}
+	cached := quota.NewCached(lgr.New(), source, 0)
+
+	for range 3 {
+		_, err := cached.Quota(context.Background())
+		assert.Error(t, err)
+	}
+
+	assert.Equal(t, 1, source.calls)
+}
+
+// slowSource отвечает, только когда закрыт канал release
+type slowSource struct {
+	release chan struct{}
+	calls   atomic.Int32
+}
+
+func (s *slowSource) Quota(ctx context.Context) (quota.Quota, error) {
+	s.calls.Add(1)
+	<-s.release
+	return quota.Quota{Used: 1, Available: 2}, nil
+}
+
+func TestCached_SingleFetch(t *testing.T) {
+	source := &slowSource{release: make(chan struct{})}
+	cached := quota.NewCached(lgr.New(), source, time.Hour)
+
+	var wg sync.WaitGroup
+	for range 5 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			q, err := cached.Quota(context.Background())
+			assert.NoError(t, err)
+			assert.Equal(t, int64(2), q.Available)
+		}()
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	close(source.release)
+	wg.Wait()
+
+	assert.Equal(t, int32(1), source.calls.Load())
+}
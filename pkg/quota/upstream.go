@@ -0,0 +1,99 @@
+package quota
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// HTTPSource запрашивает квоту у удаленного WebDAV сервера
+// свойствами quota-available-bytes и quota-used-bytes
+type HTTPSource struct {
+	baseURL string
+	user    string
+	pass    string
+	client  *http.Client
+}
+
+func NewHTTPSource(baseURL, user, pass string) *HTTPSource {
+	return &HTTPSource{
+		baseURL: strings.TrimSuffix(baseURL, "/") + "/",
+		user:    user,
+		pass:    pass,
+		client:  &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+const quotaRequestBody = `<?xml version="1.0" encoding="utf-8"?>
+<D:propfind xmlns:D="DAV:">
+  <D:prop>
+    <D:quota-available-bytes/>
+    <D:quota-used-bytes/>
+  </D:prop>
+</D:propfind>`
+
+type multistatus struct {
+	Responses []struct {
+		Propstats []struct {
+			Status    string `xml:"status"`
+			Available string `xml:"prop>quota-available-bytes"`
+			Used      string `xml:"prop>quota-used-bytes"`
+		} `xml:"propstat"`
+	} `xml:"response"`
+}
+
+func (s *HTTPSource) Quota(ctx context.Context) (Quota, error) {
+	req, err := http.NewRequestWithContext(ctx, "PROPFIND", s.baseURL, strings.NewReader(quotaRequestBody))
+	if err != nil {
+		return Quota{}, err
+	}
+
+	req.Header.Set("Content-Type", "application/xml; charset=utf-8")
+	req.Header.Set("Depth", "0")
+	if s.user != "" || s.pass != "" {
+		req.SetBasicAuth(s.user, s.pass)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return Quota{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusMultiStatus && resp.StatusCode != http.StatusOK {
+		io.Copy(io.Discard, resp.Body)
+		return Quota{}, fmt.Errorf("upstream PROPFIND quota: %s", resp.Status)
+	}
+
+	var ms multistatus
+	if err := xml.NewDecoder(resp.Body).Decode(&ms); err != nil {
+		return Quota{}, err
+	}
+
+	result := Quota{Used: -1, Available: -1}
+	for _, r := range ms.Responses {
+		for _, ps := range r.Propstats {
+			if v, err := strconv.ParseInt(strings.TrimSpace(ps.Available), 10, 64); err == nil {
+				result.Available = v
+			}
+			if v, err := strconv.ParseInt(strings.TrimSpace(ps.Used), 10, 64); err == nil {
+				result.Used = v
+			}
+		}
+	}
+
+	if result.Used < 0 && result.Available < 0 {
+		return Quota{}, fmt.Errorf("upstream does not report quota")
+	}
+
+	if result.Used < 0 {
+		result.Used = 0
+	}
+
+	return result, nil
+}
@@ -0,0 +1,74 @@
+package quota_test
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ReanSn0w/pikpak-webdav-proxy/pkg/quota"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHTTPSource(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "PROPFIND", r.Method)
+		assert.Equal(t, "/dav/", r.URL.Path)
+		assert.Equal(t, "0", r.Header.Get("Depth"))
+
+		body, _ := io.ReadAll(r.Body)
+		assert.Contains(t, string(body), "quota-available-bytes")
+
+		w.WriteHeader(http.StatusMultiStatus)
+		io.WriteString(w, `<?xml version="1.0"?>
+<d:multistatus xmlns:d="DAV:">
+  <d:response>
+    <d:href>/dav/</d:href>
+    <d:propstat>
+      <d:prop>
+        <d:quota-available-bytes>1000</d:quota-available-bytes>
+        <d:quota-used-bytes>250</d:quota-used-bytes>
+      </d:prop>
+      <d:status>HTTP/1.1 200 OK</d:status>
+    </d:propstat>
+  </d:response>
+</d:multistatus>`)
+	}))
+	defer server.Close()
+
+	q, err := quota.NewHTTPSource(server.URL+"/dav", "user", "pass").Quota(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, quota.Quota{Used: 250, Available: 1000}, q)
+}
+
+func TestHTTPSource_NotReported(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusMultiStatus)
+		io.WriteString(w, `<?xml version="1.0"?>
+<d:multistatus xmlns:d="DAV:">
+  <d:response>
+    <d:href>/</d:href>
+    <d:propstat>
+      <d:prop><d:quota-available-bytes/><d:quota-used-bytes/></d:prop>
+      <d:status>HTTP/1.1 404 Not Found</d:status>
+    </d:propstat>
+  </d:response>
+</d:multistatus>`)
+	}))
+	defer server.Close()
+
+	_, err := quota.NewHTTPSource(server.URL, "", "").Quota(context.Background())
+	assert.Error(t, err)
+}
+
+func TestHTTPSource_Error(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer server.Close()
+
+	_, err := quota.NewHTTPSource(server.URL, "", "").Quota(context.Background())
+	assert.Error(t, err)
+}
@@ -0,0 +1,86 @@
+package s3
+
+import (
+	"encoding/xml"
+	"errors"
+	"net/http"
+	"os"
+
+	"github.com/ReanSn0w/pikpak-webdav-proxy/pkg/fs"
+)
+
+// apiError - ошибка S3 API с кодом и статусом ответа
+type apiError struct {
+	Code    string
+	Message string
+	Status  int
+}
+
+func (e *apiError) Error() string {
+	return e.Code + ": " + e.Message
+}
+
+var (
+	errAccessDenied          = &apiError{"AccessDenied", "Access Denied", http.StatusForbidden}
+	errInvalidAccessKey      = &apiError{"InvalidAccessKeyId", "The AWS access key ID you provided does not exist in our records.", http.StatusForbidden}
+	errSignatureMismatch     = &apiError{"SignatureDoesNotMatch", "The request signature we calculated does not match the signature you provided.", http.StatusForbidden}
+	errMalformedAuth         = &apiError{"AuthorizationHeaderMalformed", "The authorization header is malformed.", http.StatusBadRequest}
+	errTimeSkewed            = &apiError{"RequestTimeTooSkewed", "The difference between the request time and the server's time is too large.", http.StatusForbidden}
+	errExpiredRequest        = &apiError{"AccessDenied", "Request has expired.", http.StatusForbidden}
+	errPresignNotYetValid    = &apiError{"AccessDenied", "Request is not valid yet.", http.StatusForbidden}
+	errPresignExpires        = &apiError{"AuthorizationQueryParametersError", "X-Amz-Expires must be less than a week (in seconds) that is 604800.", http.StatusBadRequest}
+	errContentSHA256Mismatch = &apiError{"XAmzContentSHA256Mismatch", "The provided 'x-amz-content-sha256' header does not match what was computed.", http.StatusBadRequest}
+	errIncompleteBody        = &apiError{"IncompleteBody", "You did not provide the number of bytes specified by the Content-Length HTTP header.", http.StatusBadRequest}
+	errBadDigest             = &apiError{"BadDigest", "The Content-MD5 you specified did not match what we received.", http.StatusBadRequest}
+	errBadChecksum           = &apiError{"BadDigest", "The checksum you specified did not match the calculated checksum.", http.StatusBadRequest}
+	errNoSuchBucket          = &apiError{"NoSuchBucket", "The specified bucket does not exist.", http.StatusNotFound}
+	errNoSuchKey             = &apiError{"NoSuchKey", "The specified key does not exist.", http.StatusNotFound}
+	errNoSuchUpload          = &apiError{"NoSuchUpload", "The specified multipart upload does not exist.", http.StatusNotFound}
+	errInvalidPart           = &apiError{"InvalidPart", "One or more of the specified parts could not be found.", http.StatusBadRequest}
+	errInvalidPartOrder      = &apiError{"InvalidPartOrder", "The list of parts was not in ascending order.", http.StatusBadRequest}
+	errInvalidArgument       = &apiError{"InvalidArgument", "Invalid argument.", http.StatusBadRequest}
+	errMalformedXML          = &apiError{"MalformedXML", "The XML you provided was not well-formed.", http.StatusBadRequest}
+	errMethodNotAllowed      = &apiError{"MethodNotAllowed", "The specified method is not allowed against this resource.", http.StatusMethodNotAllowed}
+	errNotImplemented        = &apiError{"NotImplemented", "A header or query you provided implies functionality that is not implemented.", http.StatusNotImplemented}
+	errStorageFull           = &apiError{"InsufficientStorage", "The local cache does not have enough space for the object.", http.StatusInsufficientStorage}
+	errInternal              = &apiError{"InternalError", "We encountered an internal error. Please try again.", http.StatusInternalServerError}
+)
+
+type errorResponse struct {
+	XMLName  xml.Name `xml:"Error"`
+	Code     string   `xml:"Code"`
+	Message  string   `xml:"Message"`
+	Resource string   `xml:"Resource"`
+}
+
+// writeError отвечает ошибкой S3. Ошибки файловой системы переводятся
+// в коды S3
+func (g *Gateway) writeError(w http.ResponseWriter, r *http.Request, err error) {
+	var e *apiError
+	switch {
+	case errors.As(err, &e):
+	case os.IsNotExist(err):
+		e = errNoSuchKey
+	case errors.Is(err, os.ErrPermission):
+		e = errAccessDenied
+	case errors.Is(err, fs.ErrInsufficientStorage):
+		e = errStorageFull
+	default:
+		g.log.Logf("[ERROR] s3 %s %s: %v", r.Method, r.URL.Path, err)
+		e = errInternal
+	}
+
+	if r.Method == http.MethodHead {
+		w.WriteHeader(e.Status)
+		return
+	}
+
+	writeXML(w, e.Status, errorResponse{Code: e.Code, Message: e.Message, Resource: r.URL.Path})
+}
+
+func writeXML(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	w.Write([]byte(xml.Header))
+	xml.NewEncoder(w).Encode(v)
+}
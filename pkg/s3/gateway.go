@@ -0,0 +1,223 @@
+package s3
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/ReanSn0w/pikpak-webdav-proxy/pkg/fs"
+	"github.com/go-pkgz/lgr"
+	"golang.org/x/net/webdav"
+)
+
+// Bucket - корзина S3, отображаемая на директорию файловой системы
+type Bucket struct {
+	Name string
+	Root string
+}
+
+// ParseBucket разбирает корзину в формате "имя:путь"
+func ParseBucket(s string) (Bucket, error) {
+	name, root, ok := strings.Cut(s, ":")
+	if !ok || name == "" || strings.Contains(name, "/") {
+		return Bucket{}, fmt.Errorf("invalid bucket %q, expected name:path", s)
+	}
+
+	return Bucket{Name: name, Root: path.Clean("/" + root)}, nil
+}
+
+// Checksummer - файловая система, знающая MD5 сохраненных файлов.
+// Клиенты S3 ожидают MD5 содержимого в ETag объекта
+type Checksummer interface {
+	CachedChecksums(ctx context.Context, name string) (fs.Checksums, error)
+}
+
+// Reserver - файловая система с ограниченным местом для записи
+type Reserver interface {
+	Reserve(ctx context.Context, name string, size int64) error
+}
+
+// TempReserver - файловая система, учитывающая временные файлы
+// в бюджете локального кеша
+type TempReserver interface {
+	ReserveTemp(ctx context.Context, size int64) (func(), error)
+}
+
+// Gateway - подмножество S3 API поверх webdav.FileSystem. Поддерживаются
+// только запросы в стиле пути (http://host/bucket/key) с подписью SigV4
+type Gateway struct {
+	log     lgr.L
+	fs      webdav.FileSystem
+	keys    map[string]string
+	buckets []Bucket
+	uploads *uploads
+	tmpDir  string
+}
+
+// New создает шлюз S3. keys - секретные ключи по идентификатору ключа
+// доступа, tmpDir - директория для временных файлов загрузок. Если
+// корзины не заданы, корзинами считаются директории верхнего уровня
+func New(log lgr.L, fs webdav.FileSystem, keys map[string]string, tmpDir string, buckets ...Bucket) *Gateway {
+	return &Gateway{
+		log:     log,
+		fs:      fs,
+		keys:    keys,
+		buckets: buckets,
+		uploads: newUploads(log, tmpDir),
+		tmpDir:  tmpDir,
+	}
+}
+
+func (g *Gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := g.authenticate(r)
+	if err != nil {
+		g.log.Logf("[WARN] s3 %s %s: %v", r.Method, r.URL.Path, err)
+		g.writeError(w, r, err)
+		return
+	}
+	r.Body = body
+
+	g.log.Logf("[INFO] s3 %s %s?%s", r.Method, r.URL.Path, r.URL.RawQuery)
+
+	if err := g.route(w, r); err != nil {
+		g.writeError(w, r, err)
+	}
+}
+
+// route выбирает операцию по методу, пути и параметрам запроса
+func (g *Gateway) route(w http.ResponseWriter, r *http.Request) error {
+	bucketName, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	q := r.URL.Query()
+
+	if bucketName == "" {
+		if r.Method != http.MethodGet {
+			return errMethodNotAllowed
+		}
+		return g.listBuckets(w, r)
+	}
+
+	bucket, err := g.bucket(r.Context(), bucketName)
+	if err != nil {
+		return err
+	}
+
+	if key == "" {
+		switch {
+		case r.Method == http.MethodHead:
+			w.WriteHeader(http.StatusOK)
+			return nil
+		case r.Method == http.MethodGet && q.Has("location"):
+			return g.bucketLocation(w)
+		case r.Method == http.MethodGet && !hasSubresource(q):
+			return g.listObjects(w, r, bucket)
+		default:
+			return errNotImplemented
+		}
+	}
+
+	name, err := objectPath(bucket, key)
+	if err != nil {
+		return err
+	}
+
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		return g.getObject(w, r, name)
+	case http.MethodPut:
+		switch {
+		case q.Has("uploadId"):
+			return g.uploadPart(w, r, q.Get("uploadId"), q.Get("partNumber"))
+		case r.Header.Get("X-Amz-Copy-Source") != "":
+			return errNotImplemented
+		default:
+			return g.putObject(w, r, name, key)
+		}
+	case http.MethodDelete:
+		if q.Has("uploadId") {
+			return g.abortUpload(w, q.Get("uploadId"))
+		}
+		return g.deleteObject(w, r, name, key)
+	case http.MethodPost:
+		switch {
+		case q.Has("uploads"):
+			return g.createUpload(w, bucket, key, name)
+		case q.Has("uploadId"):
+			return g.completeUpload(w, r, q.Get("uploadId"))
+		}
+	}
+
+	return errNotImplemented
+}
+
+// unsupportedSubresources - параметры запросов к корзине, которые
+// обращаются не к списку объектов
+var unsupportedSubresources = []string{
+	"acl", "cors", "lifecycle", "policy", "tagging", "uploads", "versioning", "versions",
+}
+
+func hasSubresource(q url.Values) bool {
+	for _, name := range unsupportedSubresources {
+		if q.Has(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// bucket находит корзину по имени
+func (g *Gateway) bucket(ctx context.Context, name string) (Bucket, error) {
+	if len(g.buckets) == 0 {
+		root := path.Join("/", name)
+		info, err := g.fs.Stat(ctx, root)
+		if err != nil || !info.IsDir() || path.Base(root) != name {
+			return Bucket{}, errNoSuchBucket
+		}
+		return Bucket{Name: name, Root: root}, nil
+	}
+
+	for _, b := range g.buckets {
+		if b.Name == name {
+			return b, nil
+		}
+	}
+
+	return Bucket{}, errNoSuchBucket
+}
+
+// objectPath возвращает путь объекта в файловой системе. Ключи,
+// выходящие за пределы корзины, отклоняются
+func objectPath(bucket Bucket, key string) (string, error) {
+	name := path.Join(bucket.Root, key)
+	if name == bucket.Root || !strings.HasPrefix(name, strings.TrimSuffix(bucket.Root, "/")+"/") {
+		return "", errInvalidArgument
+	}
+	return name, nil
+}
+
+// mkdirAll создает директорию name вместе с родительскими
+func (g *Gateway) mkdirAll(ctx context.Context, name string) error {
+	name = path.Clean("/" + name)
+	if name == "/" {
+		return nil
+	}
+
+	info, err := g.fs.Stat(ctx, name)
+	switch {
+	case err == nil && info.IsDir():
+		return nil
+	case err == nil:
+		return &os.PathError{Op: "mkdir", Path: name, Err: os.ErrExist}
+	case !os.IsNotExist(err):
+		return err
+	}
+
+	if err := g.mkdirAll(ctx, path.Dir(name)); err != nil {
+		return err
+	}
+
+	return g.fs.Mkdir(ctx, name, 0755)
+}
@@ -0,0 +1,496 @@
+package s3_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ReanSn0w/pikpak-webdav-proxy/pkg/fs"
+	"github.com/ReanSn0w/pikpak-webdav-proxy/pkg/s3"
+	"github.com/go-pkgz/lgr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/studio-b12/gowebdav"
+	"golang.org/x/net/webdav"
+)
+
+const (
+	accessKey = "AKIDEXAMPLE"
+	secretKey = "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY"
+)
+
+func newGateway(t *testing.T, buckets ...s3.Bucket) (*s3.Gateway, webdav.FileSystem) {
+	t.Helper()
+
+	fs := webdav.NewMemFS()
+	require.NoError(t, fs.Mkdir(context.Background(), "/media", 0755))
+
+	g := s3.New(lgr.New(), fs, map[string]string{accessKey: secretKey}, t.TempDir(), buckets...)
+	return g, fs
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// signature - параметры подписи, нужные для подписи фрагментов aws-chunked
+type signature struct {
+	key     []byte
+	amzDate string
+	scope   string
+	seed    string
+}
+
+// sign подписывает запрос SigV4 так же, как это делают клиенты S3
+func sign(r *http.Request, secret, payloadHash string) signature {
+	amzDate := time.Now().UTC().Format("20060102T150405Z")
+	scope := amzDate[:8] + "/us-east-1/s3/aws4_request"
+
+	r.Header.Set("X-Amz-Date", amzDate)
+	r.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	canonical := strings.Join([]string{
+		r.Method,
+		r.URL.EscapedPath(),
+		strings.ReplaceAll(r.URL.Query().Encode(), "+", "%20"),
+		"host:" + r.Host + "\nx-amz-content-sha256:" + payloadHash + "\nx-amz-date:" + amzDate + "\n",
+		"host;x-amz-content-sha256;x-amz-date",
+		payloadHash,
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+secret), amzDate[:8])
+	for _, part := range []string{"us-east-1", "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+
+	sig := hex.EncodeToString(hmacSHA256(key, "AWS4-HMAC-SHA256\n"+amzDate+"\n"+scope+"\n"+sha256Hex([]byte(canonical))))
+	r.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=host;x-amz-content-sha256;x-amz-date, Signature=%s",
+		accessKey, scope, sig))
+
+	return signature{key: key, amzDate: amzDate, scope: scope, seed: sig}
+}
+
+func do(t *testing.T, g http.Handler, method, target string, body []byte, header http.Header) *httptest.ResponseRecorder {
+	t.Helper()
+
+	r := httptest.NewRequest(method, target, bytes.NewReader(body))
+	for name, values := range header {
+		r.Header[name] = values
+	}
+	sign(r, secretKey, "UNSIGNED-PAYLOAD")
+
+	w := httptest.NewRecorder()
+	g.ServeHTTP(w, r)
+	return w
+}
+
+func errorCode(t *testing.T, w *httptest.ResponseRecorder) string {
+	t.Helper()
+
+	var resp struct {
+		Code string `xml:"Code"`
+	}
+	require.NoError(t, xml.Unmarshal(w.Body.Bytes(), &resp))
+	return resp.Code
+}
+
+func TestGateway_Authentication(t *testing.T) {
+	g, _ := newGateway(t)
+
+	w := httptest.NewRecorder()
+	g.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Equal(t, "AccessDenied", errorCode(t, w))
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	sign(r, "wrong-secret", "UNSIGNED-PAYLOAD")
+	w = httptest.NewRecorder()
+	g.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Equal(t, "SignatureDoesNotMatch", errorCode(t, w))
+
+	w = do(t, g, http.MethodGet, "/", nil, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "<Name>media</Name>")
+}
+
+// presign возвращает подписанную ссылку на target, созданную в signed
+func presign(t *testing.T, target string, signed time.Time, expires int) string {
+	t.Helper()
+
+	r := httptest.NewRequest(http.MethodGet, target, nil)
+	amzDate := signed.UTC().Format("20060102T150405Z")
+	scope := amzDate[:8] + "/us-east-1/s3/aws4_request"
+
+	q := url.Values{}
+	q.Set("X-Amz-Algorithm", "AWS4-HMAC-SHA256")
+	q.Set("X-Amz-Credential", accessKey+"/"+scope)
+	q.Set("X-Amz-Date", amzDate)
+	q.Set("X-Amz-Expires", strconv.Itoa(expires))
+	q.Set("X-Amz-SignedHeaders", "host")
+	query := strings.ReplaceAll(q.Encode(), "+", "%20")
+
+	canonical := strings.Join([]string{
+		http.MethodGet,
+		r.URL.EscapedPath(),
+		query,
+		"host:" + r.Host + "\n",
+		"host",
+		"UNSIGNED-PAYLOAD",
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+secretKey), amzDate[:8])
+	for _, part := range []string{"us-east-1", "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	sig := hex.EncodeToString(hmacSHA256(key, "AWS4-HMAC-SHA256\n"+amzDate+"\n"+scope+"\n"+sha256Hex([]byte(canonical))))
+
+	return target + "?" + query + "&X-Amz-Signature=" + sig
+}
+
+func TestGateway_PresignedExpires(t *testing.T) {
+	g, _ := newGateway(t)
+
+	get := func(target string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		g.ServeHTTP(w, httptest.NewRequest(http.MethodGet, target, nil))
+		return w
+	}
+
+	w := get(presign(t, "/", time.Now(), 3600))
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = get(presign(t, "/", time.Now(), 604800))
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = get(presign(t, "/", time.Now(), 604801))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, "AuthorizationQueryParametersError", errorCode(t, w))
+
+	// Дата подписи в будущем не продлевает действие ссылки
+	w = get(presign(t, "/", time.Now().AddDate(1, 0, 0), 3600))
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	w = get(presign(t, "/", time.Now().Add(-2*time.Hour), 3600))
+	assert.Equal(t, http.StatusForbidden, w.Code)
+}
+
+func TestGateway_PutGetObject(t *testing.T) {
+	g, fs := newGateway(t)
+	body := []byte("hello from s3")
+	sum := md5.Sum(body)
+
+	w := do(t, g, http.MethodPut, "/media/dir/file.txt", body, nil)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Equal(t, `"`+hex.EncodeToString(sum[:])+`"`, w.Header().Get("ETag"))
+
+	info, err := fs.Stat(context.Background(), "/media/dir/file.txt")
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(body)), info.Size())
+
+	w = do(t, g, http.MethodGet, "/media/dir/file.txt", nil, http.Header{"Range": {"bytes=6-9"}})
+	assert.Equal(t, http.StatusPartialContent, w.Code)
+	assert.Equal(t, "from", w.Body.String())
+
+	w = do(t, g, http.MethodHead, "/media/dir/file.txt", nil, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "13", w.Header().Get("Content-Length"))
+
+	w = do(t, g, http.MethodGet, "/media/missing.txt", nil, nil)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.Equal(t, "NoSuchKey", errorCode(t, w))
+
+	w = do(t, g, http.MethodDelete, "/media/dir/file.txt", nil, nil)
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	_, err = fs.Stat(context.Background(), "/media/dir/file.txt")
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestGateway_PutVerifiesBody(t *testing.T) {
+	g, fs := newGateway(t)
+	body := []byte("payload")
+
+	w := do(t, g, http.MethodPut, "/media/a.txt", body, http.Header{
+		"Content-Md5": {base64.StdEncoding.EncodeToString(make([]byte, 16))},
+	})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, "BadDigest", errorCode(t, w))
+
+	r := httptest.NewRequest(http.MethodPut, "/media/a.txt", bytes.NewReader(body))
+	sign(r, secretKey, sha256Hex([]byte("other")))
+	w = httptest.NewRecorder()
+	g.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, "XAmzContentSHA256Mismatch", errorCode(t, w))
+
+	_, err := fs.Stat(context.Background(), "/media/a.txt")
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestGateway_ChunkedUpload(t *testing.T) {
+	g, fs := newGateway(t)
+
+	chunks := [][]byte{bytes.Repeat([]byte("a"), 1024), []byte("tail"), {}}
+
+	r := httptest.NewRequest(http.MethodPut, "/media/chunked.bin", nil)
+	s := sign(r, secretKey, "STREAMING-AWS4-HMAC-SHA256-PAYLOAD")
+
+	var body bytes.Buffer
+	prev := s.seed
+	for _, chunk := range chunks {
+		sts := strings.Join([]string{
+			"AWS4-HMAC-SHA256-PAYLOAD", s.amzDate, s.scope, prev, sha256Hex(nil), sha256Hex(chunk),
+		}, "\n")
+		prev = hex.EncodeToString(hmacSHA256(s.key, sts))
+		fmt.Fprintf(&body, "%x;chunk-signature=%s\r\n%s\r\n", len(chunk), prev, chunk)
+	}
+	r.Body = io.NopCloser(&body)
+
+	w := httptest.NewRecorder()
+	g.ServeHTTP(w, r)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	info, err := fs.Stat(context.Background(), "/media/chunked.bin")
+	require.NoError(t, err)
+	assert.Equal(t, int64(1028), info.Size())
+}
+
+// crc32Base64 возвращает контрольную сумму в формате x-amz-checksum-crc32
+func crc32Base64(data []byte) string {
+	h := crc32.NewIEEE()
+	h.Write(data)
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+func TestGateway_ChunkedUploadTrailer(t *testing.T) {
+	g, fs := newGateway(t)
+
+	data := append(bytes.Repeat([]byte("a"), 1024), "tail"...)
+
+	upload := func(checksum string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPut, "/media/trailer.bin", nil)
+		r.Header.Set("X-Amz-Trailer", "x-amz-checksum-crc32")
+		s := sign(r, secretKey, "STREAMING-AWS4-HMAC-SHA256-PAYLOAD-TRAILER")
+
+		var body bytes.Buffer
+		prev := s.seed
+		for _, chunk := range [][]byte{data[:1024], data[1024:], {}} {
+			sts := strings.Join([]string{
+				"AWS4-HMAC-SHA256-PAYLOAD", s.amzDate, s.scope, prev, sha256Hex(nil), sha256Hex(chunk),
+			}, "\n")
+			prev = hex.EncodeToString(hmacSHA256(s.key, sts))
+			fmt.Fprintf(&body, "%x;chunk-signature=%s\r\n", len(chunk), prev)
+			if len(chunk) > 0 {
+				fmt.Fprintf(&body, "%s\r\n", chunk)
+			}
+		}
+
+		trailer := "x-amz-checksum-crc32:" + checksum + "\n"
+		sts := strings.Join([]string{
+			"AWS4-HMAC-SHA256-TRAILER", s.amzDate, s.scope, prev, sha256Hex([]byte(trailer)),
+		}, "\n")
+		fmt.Fprintf(&body, "x-amz-checksum-crc32:%s\r\nx-amz-trailer-signature:%s\r\n\r\n",
+			checksum, hex.EncodeToString(hmacSHA256(s.key, sts)))
+		r.Body = io.NopCloser(&body)
+
+		w := httptest.NewRecorder()
+		g.ServeHTTP(w, r)
+		return w
+	}
+
+	w := upload(crc32Base64(data))
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	info, err := fs.Stat(context.Background(), "/media/trailer.bin")
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(data)), info.Size())
+
+	w = upload(crc32Base64([]byte("other")))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, "BadDigest", errorCode(t, w))
+}
+
+func TestGateway_UnsignedTrailer(t *testing.T) {
+	g, fs := newGateway(t)
+
+	data := []byte("unsigned trailer body")
+
+	r := httptest.NewRequest(http.MethodPut, "/media/unsigned.bin", strings.NewReader(fmt.Sprintf(
+		"%x\r\n%s\r\n0\r\nx-amz-checksum-crc32:%s\r\n\r\n", len(data), data, crc32Base64(data))))
+	r.Header.Set("X-Amz-Trailer", "x-amz-checksum-crc32")
+	r.Header.Set("X-Amz-Decoded-Content-Length", fmt.Sprint(len(data)))
+	sign(r, secretKey, "STREAMING-UNSIGNED-PAYLOAD-TRAILER")
+
+	w := httptest.NewRecorder()
+	g.ServeHTTP(w, r)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	f, err := fs.OpenFile(context.Background(), "/media/unsigned.bin", os.O_RDONLY, 0)
+	require.NoError(t, err)
+	defer f.Close()
+
+	content, err := io.ReadAll(f)
+	require.NoError(t, err)
+	assert.Equal(t, data, content)
+}
+
+func TestGateway_ListObjectsV2(t *testing.T) {
+	g, _ := newGateway(t)
+	for _, key := range []string{"a.txt", "docs/b.txt", "docs/c.txt", "docs/sub/d.txt", "e.txt"} {
+		require.Equal(t, http.StatusOK, do(t, g, http.MethodPut, "/media/"+key, []byte(key), nil).Code)
+	}
+
+	type result struct {
+		Keys                  []string `xml:"Contents>Key"`
+		Prefixes              []string `xml:"CommonPrefixes>Prefix"`
+		IsTruncated           bool     `xml:"IsTruncated"`
+		NextContinuationToken string   `xml:"NextContinuationToken"`
+	}
+	list := func(query string) result {
+		w := do(t, g, http.MethodGet, "/media?list-type=2&"+query, nil, nil)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		var res result
+		require.NoError(t, xml.Unmarshal(w.Body.Bytes(), &res))
+		return res
+	}
+
+	res := list("delimiter=%2F")
+	assert.Equal(t, []string{"a.txt", "e.txt"}, res.Keys)
+	assert.Equal(t, []string{"docs/"}, res.Prefixes)
+
+	res = list("prefix=docs%2F")
+	assert.Equal(t, []string{"docs/b.txt", "docs/c.txt", "docs/sub/d.txt"}, res.Keys)
+
+	res = list("max-keys=2")
+	assert.Equal(t, []string{"a.txt", "docs/b.txt"}, res.Keys)
+	assert.True(t, res.IsTruncated)
+
+	res = list("max-keys=10&continuation-token=" + res.NextContinuationToken)
+	assert.Equal(t, []string{"docs/c.txt", "docs/sub/d.txt", "e.txt"}, res.Keys)
+	assert.False(t, res.IsTruncated)
+}
+
+func TestGateway_Buckets(t *testing.T) {
+	g, _ := newGateway(t, s3.Bucket{Name: "photos", Root: "/media"})
+
+	w := do(t, g, http.MethodPut, "/photos/p.jpg", []byte("jpeg"), nil)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	w = do(t, g, http.MethodGet, "/media/p.jpg", nil, nil)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.Equal(t, "NoSuchBucket", errorCode(t, w))
+
+	// Ключ не может выходить за пределы корзины
+	w = do(t, g, http.MethodGet, "/photos/../secret", nil, nil)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	bucket, err := s3.ParseBucket("photos:/media")
+	require.NoError(t, err)
+	assert.Equal(t, s3.Bucket{Name: "photos", Root: "/media"}, bucket)
+
+	_, err = s3.ParseBucket("photos")
+	assert.Error(t, err)
+}
+
+func TestGateway_MultipartUpload(t *testing.T) {
+	g, fs := newGateway(t)
+
+	w := do(t, g, http.MethodPost, "/media/big.bin?uploads", nil, nil)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	var initiated struct {
+		UploadID string `xml:"UploadId"`
+	}
+	require.NoError(t, xml.Unmarshal(w.Body.Bytes(), &initiated))
+
+	parts := [][]byte{bytes.Repeat([]byte("1"), 100), bytes.Repeat([]byte("2"), 50)}
+	var complete strings.Builder
+	complete.WriteString("<CompleteMultipartUpload>")
+	for i, part := range parts {
+		w = do(t, g, http.MethodPut, fmt.Sprintf("/media/big.bin?partNumber=%d&uploadId=%s", i+1, initiated.UploadID), part, nil)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		fmt.Fprintf(&complete, "<Part><PartNumber>%d</PartNumber><ETag>%s</ETag></Part>", i+1, w.Header().Get("ETag"))
+	}
+	complete.WriteString("</CompleteMultipartUpload>")
+
+	w = do(t, g, http.MethodPost, "/media/big.bin?uploadId="+initiated.UploadID, []byte(complete.String()), nil)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Contains(t, w.Body.String(), "-2&#34;</ETag>")
+
+	f, err := fs.OpenFile(context.Background(), "/media/big.bin", os.O_RDONLY, 0)
+	require.NoError(t, err)
+	data, err := io.ReadAll(f)
+	require.NoError(t, err)
+	f.Close()
+	assert.Equal(t, append(parts[0], parts[1]...), data)
+
+	// Завершенная загрузка больше не существует
+	w = do(t, g, http.MethodDelete, "/media/big.bin?uploadId="+initiated.UploadID, nil, nil)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.Equal(t, "NoSuchUpload", errorCode(t, w))
+}
+
+// newProxyGateway создает шлюз над прокси, удаленный сервер которого
+// отвечает 404 на запросы отсутствующих файлов, как PikPak
+func newProxyGateway(t *testing.T) http.Handler {
+	t.Helper()
+
+	remoteDir := t.TempDir()
+	require.NoError(t, os.Mkdir(filepath.Join(remoteDir, "media"), 0755))
+	srv := httptest.NewServer(&webdav.Handler{FileSystem: webdav.Dir(remoteDir), LockSystem: webdav.NewMemLS()})
+	t.Cleanup(srv.Close)
+
+	client := gowebdav.NewAuthClient(srv.URL, gowebdav.NewPreemptiveAuth(&gowebdav.BasicAuth{}))
+	proxy := fs.NewPikpakProxy(lgr.New(), t.TempDir(), client)
+	return s3.New(lgr.New(), proxy, map[string]string{accessKey: secretKey}, t.TempDir())
+}
+
+func TestGateway_ProxyMissingKeys(t *testing.T) {
+	g := newProxyGateway(t)
+
+	w := do(t, g, http.MethodHead, "/media/missing.txt", nil, nil)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	w = do(t, g, http.MethodGet, "/media/missing.txt", nil, nil)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.Equal(t, "NoSuchKey", errorCode(t, w))
+
+	w = do(t, g, http.MethodDelete, "/media/missing.txt", nil, nil)
+	assert.Equal(t, http.StatusNoContent, w.Code)
+
+	// Запись под новым префиксом создает недостающие директории
+	w = do(t, g, http.MethodPut, "/media/newdir/file.bin", []byte("data"), nil)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	w = do(t, g, http.MethodGet, "/media/newdir/file.bin", nil, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "data", w.Body.String())
+
+	w = do(t, g, http.MethodGet, "/media?list-type=2&prefix=absent%2F", nil, nil)
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+}
@@ -0,0 +1,310 @@
+package s3
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	s3Namespace    = "http://s3.amazonaws.com/doc/2006-03-01/"
+	defaultMaxKeys = 1000
+)
+
+type listBucketsResult struct {
+	XMLName xml.Name       `xml:"ListAllMyBucketsResult"`
+	Xmlns   string         `xml:"xmlns,attr"`
+	Owner   owner          `xml:"Owner"`
+	Buckets []bucketResult `xml:"Buckets>Bucket"`
+}
+
+type owner struct {
+	ID          string `xml:"ID"`
+	DisplayName string `xml:"DisplayName"`
+}
+
+type bucketResult struct {
+	Name         string `xml:"Name"`
+	CreationDate string `xml:"CreationDate"`
+}
+
+// listBuckets отвечает на ListBuckets
+func (g *Gateway) listBuckets(w http.ResponseWriter, r *http.Request) error {
+	buckets := g.buckets
+	if len(buckets) == 0 {
+		entries, err := g.readdir(r.Context(), "/")
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			if e.IsDir() {
+				buckets = append(buckets, Bucket{Name: e.Name(), Root: path.Join("/", e.Name())})
+			}
+		}
+	}
+
+	result := listBucketsResult{Xmlns: s3Namespace, Owner: owner{ID: "proxy", DisplayName: "proxy"}}
+	for _, b := range buckets {
+		created := time.Time{}
+		if info, err := g.fs.Stat(r.Context(), b.Root); err == nil {
+			created = info.ModTime()
+		}
+		result.Buckets = append(result.Buckets, bucketResult{Name: b.Name, CreationDate: formatTime(created)})
+	}
+
+	writeXML(w, http.StatusOK, result)
+	return nil
+}
+
+type locationResult struct {
+	XMLName xml.Name `xml:"LocationConstraint"`
+	Xmlns   string   `xml:"xmlns,attr"`
+}
+
+// bucketLocation отвечает на GetBucketLocation. Пустой регион
+// означает us-east-1, подпись принимается для любого региона
+func (g *Gateway) bucketLocation(w http.ResponseWriter) error {
+	writeXML(w, http.StatusOK, locationResult{Xmlns: s3Namespace})
+	return nil
+}
+
+type listObjectsResult struct {
+	XMLName               xml.Name       `xml:"ListBucketResult"`
+	Xmlns                 string         `xml:"xmlns,attr"`
+	Name                  string         `xml:"Name"`
+	Prefix                string         `xml:"Prefix"`
+	Delimiter             string         `xml:"Delimiter,omitempty"`
+	EncodingType          string         `xml:"EncodingType,omitempty"`
+	MaxKeys               int            `xml:"MaxKeys"`
+	IsTruncated           bool           `xml:"IsTruncated"`
+	Marker                *string        `xml:"Marker"`
+	NextMarker            string         `xml:"NextMarker,omitempty"`
+	KeyCount              *int           `xml:"KeyCount"`
+	ContinuationToken     string         `xml:"ContinuationToken,omitempty"`
+	NextContinuationToken string         `xml:"NextContinuationToken,omitempty"`
+	StartAfter            string         `xml:"StartAfter,omitempty"`
+	Contents              []objectResult `xml:"Contents"`
+	CommonPrefixes        []prefixResult `xml:"CommonPrefixes"`
+}
+
+type objectResult struct {
+	Key          string `xml:"Key"`
+	LastModified string `xml:"LastModified"`
+	ETag         string `xml:"ETag"`
+	Size         int64  `xml:"Size"`
+	StorageClass string `xml:"StorageClass"`
+}
+
+type prefixResult struct {
+	Prefix string `xml:"Prefix"`
+}
+
+// listItem - объект или общий префикс в списке объектов
+type listItem struct {
+	key    string
+	name   string
+	info   os.FileInfo
+	prefix bool
+}
+
+// listObjects отвечает на ListObjects и ListObjectsV2
+func (g *Gateway) listObjects(w http.ResponseWriter, r *http.Request, bucket Bucket) error {
+	q := r.URL.Query()
+	v2 := q.Get("list-type") == "2"
+	prefix, delimiter := q.Get("prefix"), q.Get("delimiter")
+
+	maxKeys := defaultMaxKeys
+	if v := q.Get("max-keys"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return errInvalidArgument
+		}
+		maxKeys = min(n, defaultMaxKeys)
+	}
+
+	after := q.Get("marker")
+	if v2 {
+		after = q.Get("start-after")
+		if token := q.Get("continuation-token"); token != "" {
+			decoded, err := base64.StdEncoding.DecodeString(token)
+			if err != nil {
+				return errInvalidArgument
+			}
+			after = string(decoded)
+		}
+	}
+
+	items, err := g.listKeys(r.Context(), bucket, prefix, delimiter)
+	if err != nil {
+		return err
+	}
+
+	start := sort.Search(len(items), func(i int) bool { return items[i].key > after })
+	items = items[start:]
+
+	truncated := len(items) > maxKeys
+	if truncated {
+		items = items[:maxKeys]
+	}
+
+	encode := func(s string) string { return s }
+	if q.Get("encoding-type") == "url" {
+		encode = url.QueryEscape
+	}
+
+	result := listObjectsResult{
+		Xmlns:        s3Namespace,
+		Name:         bucket.Name,
+		Prefix:       encode(prefix),
+		Delimiter:    encode(delimiter),
+		EncodingType: q.Get("encoding-type"),
+		MaxKeys:      maxKeys,
+		IsTruncated:  truncated,
+	}
+
+	for _, item := range items {
+		if item.prefix {
+			result.CommonPrefixes = append(result.CommonPrefixes, prefixResult{Prefix: encode(item.key)})
+			continue
+		}
+
+		result.Contents = append(result.Contents, objectResult{
+			Key:          encode(item.key),
+			LastModified: formatTime(item.info.ModTime()),
+			ETag:         g.etag(r.Context(), item.name, item.info),
+			Size:         item.info.Size(),
+			StorageClass: "STANDARD",
+		})
+	}
+
+	var last string
+	if len(items) > 0 {
+		last = items[len(items)-1].key
+	}
+
+	if v2 {
+		count := len(items)
+		result.KeyCount = &count
+		result.ContinuationToken = q.Get("continuation-token")
+		result.StartAfter = encode(q.Get("start-after"))
+		if truncated {
+			result.NextContinuationToken = base64.StdEncoding.EncodeToString([]byte(last))
+		}
+	} else {
+		marker := encode(q.Get("marker"))
+		result.Marker = &marker
+		if truncated && delimiter != "" {
+			result.NextMarker = encode(last)
+		}
+	}
+
+	writeXML(w, http.StatusOK, result)
+	return nil
+}
+
+// listKeys возвращает отсортированные по ключу объекты корзины с префиксом
+// prefix. Ключи, содержащие delimiter после префикса, объединяются в общие
+// префиксы. С разделителем "/" читается только одна директория
+func (g *Gateway) listKeys(ctx context.Context, bucket Bucket, prefix, delimiter string) ([]listItem, error) {
+	dir := ""
+	if i := strings.LastIndex(prefix, "/"); i >= 0 {
+		dir = prefix[:i]
+	}
+
+	var items []listItem
+	seen := make(map[string]bool)
+
+	add := func(item listItem) {
+		if !strings.HasPrefix(item.key, prefix) {
+			return
+		}
+
+		if delimiter != "" {
+			if i := strings.Index(item.key[len(prefix):], delimiter); i >= 0 {
+				item = listItem{key: item.key[:len(prefix)+i+len(delimiter)], prefix: true}
+			}
+		}
+
+		if item.prefix {
+			if seen[item.key] {
+				return
+			}
+			seen[item.key] = true
+		}
+
+		items = append(items, item)
+	}
+
+	var walk func(key string) error
+	walk = func(key string) error {
+		name := path.Join(bucket.Root, key)
+		entries, err := g.readdir(ctx, name)
+		if err != nil {
+			return err
+		}
+
+		for _, e := range entries {
+			childKey := path.Join(key, e.Name())
+			if !e.IsDir() {
+				add(listItem{key: childKey, name: path.Join(name, e.Name()), info: e})
+				continue
+			}
+
+			// Директория с разделителем "/" - общий префикс, ее содержимое
+			// читать не нужно
+			if delimiter == "/" && strings.HasPrefix(childKey+"/", prefix) {
+				add(listItem{key: childKey + "/", prefix: true})
+				continue
+			}
+
+			if strings.HasPrefix(childKey+"/", prefix) || strings.HasPrefix(prefix, childKey+"/") {
+				if err := walk(childKey); err != nil {
+					return err
+				}
+			}
+		}
+
+		return nil
+	}
+
+	err := walk(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(items, func(i, j int) bool { return items[i].key < items[j].key })
+	return items, nil
+}
+
+// readdir возвращает содержимое директории name
+func (g *Gateway) readdir(ctx context.Context, name string) ([]os.FileInfo, error) {
+	f, err := g.fs.OpenFile(ctx, name, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	entries, err := f.Readdir(0)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+
+	return entries, nil
+}
+
+func formatTime(t time.Time) string {
+	return t.UTC().Format("2006-01-02T15:04:05.000Z")
+}
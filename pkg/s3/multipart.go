@@ -0,0 +1,297 @@
+package s3
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/go-pkgz/lgr"
+)
+
+const maxPartNumber = 10000
+
+// upload - незавершенная составная загрузка. Части хранятся
+// во временной директории до завершения загрузки
+type upload struct {
+	bucket string
+	key    string
+	name   string
+	dir    string
+
+	mu    sync.Mutex
+	parts map[int]string
+
+	// reserved снимает резерв места в кеше под сохраненные части,
+	// released - загрузка завершена или отменена
+	reservedMu sync.Mutex
+	reserved   map[int]func()
+	released   bool
+}
+
+// hold запоминает резерв под часть n, снимая резерв ее прежней версии
+func (up *upload) hold(n int, release func()) {
+	up.reservedMu.Lock()
+	defer up.reservedMu.Unlock()
+
+	if up.released {
+		release()
+		return
+	}
+	if prev, ok := up.reserved[n]; ok {
+		prev()
+	}
+	up.reserved[n] = release
+}
+
+// release снимает резерв под все части
+func (up *upload) release() {
+	up.reservedMu.Lock()
+	defer up.reservedMu.Unlock()
+
+	up.released = true
+	for n, release := range up.reserved {
+		release()
+		delete(up.reserved, n)
+	}
+}
+
+// uploads - реестр составных загрузок. Загрузки не переживают
+// перезапуск, поэтому оставшиеся от прошлого запуска части удаляются
+type uploads struct {
+	dir string
+
+	mu    sync.Mutex
+	items map[string]*upload
+}
+
+func newUploads(log lgr.L, tmpDir string) *uploads {
+	dir := filepath.Join(tmpDir, "s3-uploads")
+	if err := os.RemoveAll(dir); err != nil {
+		log.Logf("[WARN] failed to remove stale multipart uploads: %v", err)
+	}
+
+	return &uploads{dir: dir, items: make(map[string]*upload)}
+}
+
+func (u *uploads) get(id string) (*upload, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	up, ok := u.items[id]
+	if !ok {
+		return nil, errNoSuchUpload
+	}
+	return up, nil
+}
+
+func (u *uploads) remove(id string) {
+	u.mu.Lock()
+	up, ok := u.items[id]
+	delete(u.items, id)
+	u.mu.Unlock()
+
+	if ok {
+		os.RemoveAll(up.dir)
+		up.release()
+	}
+}
+
+type initiateUploadResult struct {
+	XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+	Xmlns    string   `xml:"xmlns,attr"`
+	Bucket   string   `xml:"Bucket"`
+	Key      string   `xml:"Key"`
+	UploadID string   `xml:"UploadId"`
+}
+
+// createUpload отвечает на CreateMultipartUpload
+func (g *Gateway) createUpload(w http.ResponseWriter, bucket Bucket, key, name string) error {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return err
+	}
+	id := hex.EncodeToString(buf)
+
+	up := &upload{
+		bucket:   bucket.Name,
+		key:      key,
+		name:     name,
+		dir:      filepath.Join(g.uploads.dir, id),
+		parts:    make(map[int]string),
+		reserved: make(map[int]func()),
+	}
+	if err := os.MkdirAll(up.dir, 0755); err != nil {
+		return err
+	}
+
+	g.uploads.mu.Lock()
+	g.uploads.items[id] = up
+	g.uploads.mu.Unlock()
+
+	writeXML(w, http.StatusOK, initiateUploadResult{Xmlns: s3Namespace, Bucket: bucket.Name, Key: key, UploadID: id})
+	return nil
+}
+
+// uploadPart отвечает на UploadPart
+func (g *Gateway) uploadPart(w http.ResponseWriter, r *http.Request, id, partNumber string) error {
+	up, err := g.uploads.get(id)
+	if err != nil {
+		return err
+	}
+
+	n, err := strconv.Atoi(partNumber)
+	if err != nil || n < 1 || n > maxPartNumber {
+		return errInvalidArgument
+	}
+
+	// Части занимают место в кеше до завершения или отмены загрузки
+	release, err := g.reserveTemp(r.Context(), contentLength(r))
+	if err != nil {
+		return err
+	}
+
+	tmp, sum, err := spool(up.dir, r.Body)
+	if tmp != nil {
+		defer cleanup(tmp)
+	}
+	if err != nil {
+		release()
+		return err
+	}
+
+	if err := checkContentMD5(r, sum); err != nil {
+		release()
+		return err
+	}
+
+	tmp.Close()
+	if err := os.Rename(tmp.Name(), up.partPath(n)); err != nil {
+		release()
+		return err
+	}
+	up.hold(n, release)
+
+	etag := hex.EncodeToString(sum)
+	up.mu.Lock()
+	up.parts[n] = etag
+	up.mu.Unlock()
+
+	w.Header().Set("ETag", `"`+etag+`"`)
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+func (up *upload) partPath(n int) string {
+	return filepath.Join(up.dir, fmt.Sprintf("part-%05d", n))
+}
+
+type completeUploadRequest struct {
+	Parts []struct {
+		PartNumber int    `xml:"PartNumber"`
+		ETag       string `xml:"ETag"`
+	} `xml:"Part"`
+}
+
+type completeUploadResult struct {
+	XMLName  xml.Name `xml:"CompleteMultipartUploadResult"`
+	Xmlns    string   `xml:"xmlns,attr"`
+	Location string   `xml:"Location"`
+	Bucket   string   `xml:"Bucket"`
+	Key      string   `xml:"Key"`
+	ETag     string   `xml:"ETag"`
+}
+
+// completeUpload отвечает на CompleteMultipartUpload: части объединяются
+// в объект в указанном порядке. ETag объекта, как и в S3, - MD5 от
+// MD5 частей с числом частей через дефис
+func (g *Gateway) completeUpload(w http.ResponseWriter, r *http.Request, id string) error {
+	up, err := g.uploads.get(id)
+	if err != nil {
+		return err
+	}
+
+	var req completeUploadRequest
+	if err := xml.NewDecoder(r.Body).Decode(&req); err != nil || len(req.Parts) == 0 {
+		return errMalformedXML
+	}
+
+	up.mu.Lock()
+	defer up.mu.Unlock()
+
+	var (
+		files []io.Reader
+		size  int64
+		sums  []byte
+	)
+
+	prev := 0
+	for _, part := range req.Parts {
+		if part.PartNumber <= prev {
+			return errInvalidPartOrder
+		}
+		prev = part.PartNumber
+
+		etag, ok := up.parts[part.PartNumber]
+		if !ok || strings.Trim(part.ETag, `"`) != etag {
+			return errInvalidPart
+		}
+
+		f, err := os.Open(up.partPath(part.PartNumber))
+		if err != nil {
+			return errInvalidPart
+		}
+		defer f.Close()
+
+		info, err := f.Stat()
+		if err != nil {
+			return err
+		}
+
+		sum, _ := hex.DecodeString(etag)
+		sums = append(sums, sum...)
+		size += info.Size()
+		files = append(files, f)
+	}
+
+	if err := g.reserve(r.Context(), up.name, size); err != nil {
+		return err
+	}
+
+	if err := g.writeObject(r.Context(), up.name, io.MultiReader(files...)); err != nil {
+		return err
+	}
+
+	sum := md5.Sum(sums)
+	etag := fmt.Sprintf(`"%s-%d"`, hex.EncodeToString(sum[:]), len(req.Parts))
+
+	g.uploads.remove(id)
+
+	writeXML(w, http.StatusOK, completeUploadResult{
+		Xmlns:    s3Namespace,
+		Location: "/" + up.bucket + "/" + up.key,
+		Bucket:   up.bucket,
+		Key:      up.key,
+		ETag:     etag,
+	})
+	return nil
+}
+
+// abortUpload отвечает на AbortMultipartUpload
+func (g *Gateway) abortUpload(w http.ResponseWriter, id string) error {
+	if _, err := g.uploads.get(id); err != nil {
+		return err
+	}
+
+	g.uploads.remove(id)
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
@@ -0,0 +1,256 @@
+package s3
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/webdav"
+)
+
+// getObject отвечает на GetObject и HeadObject. Range и условные
+// заголовки обрабатывает http.ServeContent
+func (g *Gateway) getObject(w http.ResponseWriter, r *http.Request, name string) error {
+	f, err := g.fs.OpenFile(r.Context(), name, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return errNoSuchKey
+	}
+
+	if etag := g.etag(r.Context(), name, info); etag != "" {
+		w.Header().Set("ETag", etag)
+	}
+
+	// Тип удаленного файла не определяется по содержимому, чтобы
+	// не загружать начало файла
+	ctype := "application/octet-stream"
+	if ct, ok := info.(webdav.ContentTyper); ok {
+		if t, err := ct.ContentType(r.Context()); err == nil && t != "" {
+			ctype = t
+		}
+	}
+	w.Header().Set("Content-Type", ctype)
+	w.Header().Set("Accept-Ranges", "bytes")
+
+	http.ServeContent(w, r, info.Name(), info.ModTime(), f)
+	return nil
+}
+
+// etag возвращает ETag объекта: MD5 содержимого, если он известен,
+// иначе ETag файловой системы
+func (g *Gateway) etag(ctx context.Context, name string, info os.FileInfo) string {
+	if cs, ok := g.fs.(Checksummer); ok {
+		if sums, err := cs.CachedChecksums(ctx, name); err == nil && sums.MD5 != "" {
+			return `"` + sums.MD5 + `"`
+		}
+	}
+
+	if e, ok := info.(webdav.ETager); ok {
+		if etag, err := e.ETag(ctx); err == nil {
+			return etag
+		}
+	}
+
+	if e, ok := info.(interface{ ETag() string }); ok && e.ETag() != "" {
+		return `"` + strings.Trim(e.ETag(), `"`) + `"`
+	}
+
+	return ""
+}
+
+// putObject отвечает на PutObject. Тело сначала сохраняется во временный
+// файл, чтобы объект с неверной контрольной суммой не заменил существующий.
+// Ключ, оканчивающийся на "/", создает директорию
+func (g *Gateway) putObject(w http.ResponseWriter, r *http.Request, name, key string) error {
+	ctx := r.Context()
+
+	if strings.HasSuffix(key, "/") {
+		if _, err := io.Copy(io.Discard, r.Body); err != nil {
+			return err
+		}
+		if err := g.mkdirAll(ctx, name); err != nil {
+			return err
+		}
+		sum := md5.Sum(nil)
+		w.Header().Set("ETag", `"`+hex.EncodeToString(sum[:])+`"`)
+		w.WriteHeader(http.StatusOK)
+		return nil
+	}
+
+	if err := g.reserve(ctx, name, contentLength(r)); err != nil {
+		return err
+	}
+
+	release, err := g.reserveTemp(ctx, contentLength(r))
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	tmp, sum, err := spool(g.tmpDir, r.Body)
+	if tmp != nil {
+		defer cleanup(tmp)
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := checkContentMD5(r, sum); err != nil {
+		return err
+	}
+
+	if err := g.writeObject(ctx, name, tmp); err != nil {
+		return err
+	}
+
+	w.Header().Set("ETag", `"`+hex.EncodeToString(sum)+`"`)
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+// writeObject записывает содержимое src в файл name, создавая
+// родительские директории
+func (g *Gateway) writeObject(ctx context.Context, name string, src io.Reader) error {
+	if err := g.mkdirAll(ctx, path.Dir(name)); err != nil {
+		return err
+	}
+
+	f, err := g.fs.OpenFile(ctx, name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(f, src)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
+
+// deleteObject отвечает на DeleteObject. Удаление несуществующего объекта
+// не считается ошибкой. Директория удаляется, только если она пуста
+// и ключ оканчивается на "/"
+func (g *Gateway) deleteObject(w http.ResponseWriter, r *http.Request, name, key string) error {
+	ctx := r.Context()
+
+	info, err := g.fs.Stat(ctx, name)
+	switch {
+	case os.IsNotExist(err):
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	case err != nil:
+		return err
+	}
+
+	if info.IsDir() {
+		if !strings.HasSuffix(key, "/") {
+			w.WriteHeader(http.StatusNoContent)
+			return nil
+		}
+
+		entries, err := g.readdir(ctx, name)
+		if err != nil {
+			return err
+		}
+		if len(entries) > 0 {
+			return &apiError{"BucketNotEmpty", "The directory you tried to delete is not empty.", http.StatusConflict}
+		}
+	}
+
+	if err := g.fs.RemoveAll(ctx, name); err != nil {
+		return err
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// reserve проверяет, поместится ли объект в локальный кеш
+func (g *Gateway) reserve(ctx context.Context, name string, size int64) error {
+	r, ok := g.fs.(Reserver)
+	if !ok || size <= 0 {
+		return nil
+	}
+	return r.Reserve(ctx, name, size)
+}
+
+// reserveTemp резервирует в локальном кеше место под временный файл
+// с телом запроса. Возвращаемая функция снимает резерв
+func (g *Gateway) reserveTemp(ctx context.Context, size int64) (func(), error) {
+	r, ok := g.fs.(TempReserver)
+	if !ok || size <= 0 {
+		return func() {}, nil
+	}
+	return r.ReserveTemp(ctx, size)
+}
+
+// contentLength возвращает размер содержимого без кодирования aws-chunked
+func contentLength(r *http.Request) int64 {
+	if v := r.Header.Get("X-Amz-Decoded-Content-Length"); v != "" {
+		if size, err := strconv.ParseInt(v, 10, 64); err == nil {
+			return size
+		}
+	}
+	return r.ContentLength
+}
+
+// checkContentMD5 сверяет MD5 тела с заголовком Content-MD5, если он передан
+func checkContentMD5(r *http.Request, sum []byte) error {
+	header := r.Header.Get("Content-MD5")
+	if header == "" {
+		return nil
+	}
+
+	expected, err := base64.StdEncoding.DecodeString(header)
+	if err != nil || !bytes.Equal(expected, sum) {
+		return errBadDigest
+	}
+
+	return nil
+}
+
+// spool сохраняет тело запроса во временный файл в dir и возвращает
+// его, перемотанный в начало, вместе с MD5 содержимого
+func spool(dir string, body io.Reader) (*os.File, []byte, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, nil, err
+	}
+
+	f, err := os.CreateTemp(dir, "s3-*")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	h := md5.New()
+	if _, err := io.Copy(io.MultiWriter(f, h), body); err != nil {
+		return f, nil, err
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return f, nil, err
+	}
+
+	return f, h.Sum(nil), nil
+}
+
+func cleanup(f *os.File) {
+	f.Close()
+	os.Remove(f.Name())
+}
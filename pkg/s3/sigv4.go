@@ -0,0 +1,503 @@
+package s3
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	sigAlgorithm      = "AWS4-HMAC-SHA256"
+	chunkAlgorithm    = "AWS4-HMAC-SHA256-PAYLOAD"
+	trailerAlgorithm  = "AWS4-HMAC-SHA256-TRAILER"
+	unsignedPayload   = "UNSIGNED-PAYLOAD"
+	streamingPayload  = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD"
+	streamingTrailer  = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD-TRAILER"
+	unsignedTrailer   = "STREAMING-UNSIGNED-PAYLOAD-TRAILER"
+	trailerSigHeader  = "x-amz-trailer-signature"
+	amzDateFormat     = "20060102T150405Z"
+	maxClockSkew      = 15 * time.Minute
+	maxPresignExpires = 604800 // 7 дней, как у S3
+	maxChunkSize      = 16 << 20
+	emptyPayloadHash  = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	scopeTerminator   = "aws4_request"
+	presignedSigParam = "X-Amz-Signature"
+)
+
+// signedRequest - разобранные параметры подписи SigV4 запроса
+type signedRequest struct {
+	accessKey     string
+	date          string
+	region        string
+	service       string
+	amzDate       string
+	signedHeaders []string
+	signature     string
+	payloadHash   string
+	presigned     bool
+}
+
+func (s *signedRequest) scope() string {
+	return strings.Join([]string{s.date, s.region, s.service, scopeTerminator}, "/")
+}
+
+// authenticate проверяет подпись SigV4 запроса по заголовку Authorization
+// или параметрам подписанной ссылки и возвращает тело запроса, которое
+// проверяет хеш содержимого при чтении
+func (g *Gateway) authenticate(r *http.Request) (io.ReadCloser, error) {
+	req, err := parseSignature(r)
+	if err != nil {
+		return nil, err
+	}
+
+	secret, ok := g.keys[req.accessKey]
+	if !ok {
+		return nil, errInvalidAccessKey
+	}
+
+	signed, err := time.Parse(amzDateFormat, req.amzDate)
+	if err != nil {
+		return nil, errMalformedAuth
+	}
+
+	if req.presigned {
+		expires, err := strconv.Atoi(r.URL.Query().Get("X-Amz-Expires"))
+		if err != nil || expires < 0 {
+			return nil, errMalformedAuth
+		}
+		if expires > maxPresignExpires {
+			return nil, errPresignExpires
+		}
+		// Дата подписи в будущем продлила бы действие ссылки
+		if time.Until(signed) > maxClockSkew {
+			return nil, errPresignNotYetValid
+		}
+		if time.Now().After(signed.Add(time.Duration(expires) * time.Second)) {
+			return nil, errExpiredRequest
+		}
+	} else if d := time.Since(signed); d > maxClockSkew || d < -maxClockSkew {
+		return nil, errTimeSkewed
+	}
+
+	key := signingKey(secret, req.date, req.region, req.service)
+	stringToSign := strings.Join([]string{
+		sigAlgorithm,
+		req.amzDate,
+		req.scope(),
+		hexSHA256([]byte(canonicalRequest(r, req))),
+	}, "\n")
+
+	expected := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	if subtle.ConstantTimeCompare([]byte(expected), []byte(req.signature)) != 1 {
+		return nil, errSignatureMismatch
+	}
+
+	switch {
+	case req.payloadHash == unsignedPayload:
+		return r.Body, nil
+	case req.payloadHash == streamingPayload:
+		return newChunkedReader(r.Body, key, req.amzDate, req.scope(), req.signature), nil
+	case req.payloadHash == streamingTrailer:
+		c := newChunkedReader(r.Body, key, req.amzDate, req.scope(), req.signature)
+		return c.withTrailer(r.Header.Get("X-Amz-Trailer")), nil
+	case req.payloadHash == unsignedTrailer:
+		c := newChunkedReader(r.Body, nil, "", "", "")
+		return c.withTrailer(r.Header.Get("X-Amz-Trailer")), nil
+	case len(req.payloadHash) == sha256.Size*2:
+		return &verifiedBody{ReadCloser: r.Body, hash: sha256.New(), expected: req.payloadHash}, nil
+	default:
+		return nil, errNotImplemented
+	}
+}
+
+// parseSignature извлекает параметры подписи из запроса
+func parseSignature(r *http.Request) (*signedRequest, error) {
+	q := r.URL.Query()
+	if q.Get("X-Amz-Algorithm") != "" {
+		if q.Get("X-Amz-Algorithm") != sigAlgorithm {
+			return nil, errMalformedAuth
+		}
+
+		req := &signedRequest{
+			amzDate:       q.Get("X-Amz-Date"),
+			signedHeaders: strings.Split(q.Get("X-Amz-SignedHeaders"), ";"),
+			signature:     q.Get(presignedSigParam),
+			payloadHash:   unsignedPayload,
+			presigned:     true,
+		}
+		if err := req.parseCredential(q.Get("X-Amz-Credential")); err != nil {
+			return nil, err
+		}
+		return req, nil
+	}
+
+	auth := r.Header.Get("Authorization")
+	if auth == "" {
+		return nil, errAccessDenied
+	}
+
+	params, ok := strings.CutPrefix(auth, sigAlgorithm+" ")
+	if !ok {
+		return nil, errMalformedAuth
+	}
+
+	req := &signedRequest{
+		amzDate:     r.Header.Get("X-Amz-Date"),
+		payloadHash: r.Header.Get("X-Amz-Content-Sha256"),
+	}
+	if req.payloadHash == "" {
+		req.payloadHash = emptyPayloadHash
+	}
+
+	for _, param := range strings.Split(params, ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+		switch name {
+		case "Credential":
+			if err := req.parseCredential(value); err != nil {
+				return nil, err
+			}
+		case "SignedHeaders":
+			req.signedHeaders = strings.Split(value, ";")
+		case "Signature":
+			req.signature = value
+		}
+	}
+
+	if req.accessKey == "" || req.signature == "" || len(req.signedHeaders) == 0 || req.amzDate == "" {
+		return nil, errMalformedAuth
+	}
+
+	return req, nil
+}
+
+// parseCredential разбирает строку вида AKID/20130524/us-east-1/s3/aws4_request
+func (s *signedRequest) parseCredential(value string) error {
+	parts := strings.Split(value, "/")
+	if len(parts) != 5 || parts[4] != scopeTerminator {
+		return errMalformedAuth
+	}
+
+	s.accessKey, s.date, s.region, s.service = parts[0], parts[1], parts[2], parts[3]
+	return nil
+}
+
+// canonicalRequest строит каноническую форму запроса
+func canonicalRequest(r *http.Request, req *signedRequest) string {
+	var headers strings.Builder
+	for _, name := range req.signedHeaders {
+		headers.WriteString(name)
+		headers.WriteByte(':')
+		headers.WriteString(headerValue(r, name))
+		headers.WriteByte('\n')
+	}
+
+	return strings.Join([]string{
+		r.Method,
+		r.URL.EscapedPath(),
+		canonicalQuery(r.URL.RawQuery, req.presigned),
+		headers.String(),
+		strings.Join(req.signedHeaders, ";"),
+		req.payloadHash,
+	}, "\n")
+}
+
+// headerValue возвращает значение заголовка в канонической форме. Заголовки
+// Host и Content-Length net/http хранит отдельно от остальных
+func headerValue(r *http.Request, name string) string {
+	switch name {
+	case "host":
+		return r.Host
+	case "content-length":
+		if v := r.Header.Get("Content-Length"); v != "" {
+			return v
+		}
+		return strconv.FormatInt(r.ContentLength, 10)
+	}
+
+	values := r.Header.Values(name)
+	for i, v := range values {
+		values[i] = strings.Join(strings.Fields(v), " ")
+	}
+	return strings.Join(values, ",")
+}
+
+// canonicalQuery сортирует параметры запроса и кодирует их по правилам SigV4
+func canonicalQuery(rawQuery string, presigned bool) string {
+	var pairs []string
+	for _, param := range strings.Split(rawQuery, "&") {
+		if param == "" {
+			continue
+		}
+
+		name, value, _ := strings.Cut(param, "=")
+		name, _ = url.QueryUnescape(name)
+		value, _ = url.QueryUnescape(value)
+		if presigned && name == presignedSigParam {
+			continue
+		}
+
+		pairs = append(pairs, awsEscape(name)+"="+awsEscape(value))
+	}
+
+	sort.Strings(pairs)
+	return strings.Join(pairs, "&")
+}
+
+// awsEscape кодирует строку, оставляя без изменений только
+// незарезервированные символы RFC 3986
+func awsEscape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '_' || c == '.' || c == '~' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func signingKey(secret, date, region, service string) []byte {
+	key := hmacSHA256([]byte("AWS4"+secret), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	return hmacSHA256(key, scopeTerminator)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func hexSHA256(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// verifiedBody сверяет SHA-256 тела с заголовком X-Amz-Content-Sha256
+// после чтения последнего байта
+type verifiedBody struct {
+	io.ReadCloser
+	hash     hash.Hash
+	expected string
+}
+
+func (b *verifiedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.hash.Write(p[:n])
+
+	if err == io.EOF && hex.EncodeToString(b.hash.Sum(nil)) != b.expected {
+		return n, errContentSHA256Mismatch
+	}
+	return n, err
+}
+
+// chunkedReader декодирует тело aws-chunked и проверяет подпись
+// каждого фрагмента, начиная с подписи заголовка запроса. Без ключа
+// фрагменты не подписаны. В режиме trailer после последнего фрагмента
+// идут заголовки с контрольной суммой тела
+type chunkedReader struct {
+	body    io.ReadCloser
+	r       *bufio.Reader
+	key     []byte
+	amzDate string
+	scope   string
+	prevSig string
+
+	trailer      bool
+	checksumName string
+	checksum     hash.Hash
+
+	chunk []byte
+	done  bool
+}
+
+func newChunkedReader(body io.ReadCloser, key []byte, amzDate, scope, seedSignature string) *chunkedReader {
+	return &chunkedReader{
+		body:    body,
+		r:       bufio.NewReader(body),
+		key:     key,
+		amzDate: amzDate,
+		scope:   scope,
+		prevSig: seedSignature,
+	}
+}
+
+// withTrailer включает чтение заголовков после последнего фрагмента.
+// name - заголовок X-Amz-Trailer с именем контрольной суммы: известные
+// суммы проверяются, остальные игнорируются
+func (c *chunkedReader) withTrailer(name string) *chunkedReader {
+	c.trailer = true
+	c.checksumName = strings.ToLower(strings.TrimSpace(name))
+	c.checksum = newChecksum(c.checksumName)
+	return c
+}
+
+// newChecksum возвращает хеш для заголовка контрольной суммы или nil,
+// если алгоритм не поддерживается
+func newChecksum(name string) hash.Hash {
+	switch name {
+	case "x-amz-checksum-crc32":
+		return crc32.NewIEEE()
+	case "x-amz-checksum-crc32c":
+		return crc32.New(crc32.MakeTable(crc32.Castagnoli))
+	case "x-amz-checksum-sha1":
+		return sha1.New()
+	case "x-amz-checksum-sha256":
+		return sha256.New()
+	default:
+		return nil
+	}
+}
+
+func (c *chunkedReader) Read(p []byte) (int, error) {
+	for len(c.chunk) == 0 {
+		if c.done {
+			return 0, io.EOF
+		}
+		if err := c.next(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, c.chunk)
+	c.chunk = c.chunk[n:]
+	return n, nil
+}
+
+func (c *chunkedReader) Close() error {
+	return c.body.Close()
+}
+
+// next читает и проверяет следующий фрагмент вида
+// "размер;chunk-signature=подпись\r\nданные\r\n". Неподписанные
+// фрагменты не содержат ";chunk-signature=подпись"
+func (c *chunkedReader) next() error {
+	header, err := c.r.ReadString('\n')
+	if err != nil {
+		return errIncompleteBody
+	}
+
+	sizeHex, ext, _ := strings.Cut(strings.TrimRight(header, "\r\n"), ";")
+	sig, ok := strings.CutPrefix(ext, "chunk-signature=")
+	if c.key != nil && !ok {
+		return errIncompleteBody
+	}
+
+	size, err := strconv.ParseInt(sizeHex, 16, 64)
+	if err != nil || size < 0 || size > maxChunkSize {
+		return errIncompleteBody
+	}
+
+	// В режиме trailer за последним фрагментом сразу следуют заголовки
+	var data []byte
+	if size > 0 || !c.trailer {
+		data = make([]byte, size+2)
+		if _, err := io.ReadFull(c.r, data); err != nil || !bytes.HasSuffix(data, []byte("\r\n")) {
+			return errIncompleteBody
+		}
+		data = data[:size]
+	}
+
+	if c.key != nil {
+		if err := c.verify(chunkAlgorithm, sig, emptyPayloadHash, hexSHA256(data)); err != nil {
+			return err
+		}
+	}
+
+	if c.checksum != nil {
+		c.checksum.Write(data)
+	}
+
+	c.chunk = data
+	c.done = size == 0
+	if c.done && c.trailer {
+		return c.readTrailer()
+	}
+	return nil
+}
+
+// readTrailer читает заголовки после последнего фрагмента, проверяет
+// их подпись и контрольную сумму тела
+func (c *chunkedReader) readTrailer() error {
+	var canonical strings.Builder
+	var sig string
+	values := make(map[string]string)
+
+	for {
+		line, err := c.r.ReadString('\n')
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			if err != nil && err != io.EOF {
+				return errIncompleteBody
+			}
+			break
+		}
+		if err != nil {
+			return errIncompleteBody
+		}
+
+		name, value, ok := strings.Cut(line, ":")
+		if !ok {
+			return errIncompleteBody
+		}
+		name, value = strings.ToLower(strings.TrimSpace(name)), strings.TrimSpace(value)
+
+		if name == trailerSigHeader {
+			sig = value
+			continue
+		}
+		values[name] = value
+		canonical.WriteString(name + ":" + value + "\n")
+	}
+
+	if c.key != nil {
+		if err := c.verify(trailerAlgorithm, sig, hexSHA256([]byte(canonical.String()))); err != nil {
+			return err
+		}
+	}
+
+	if c.checksum != nil {
+		expected, ok := values[c.checksumName]
+		if !ok {
+			return errIncompleteBody
+		}
+		if base64.StdEncoding.EncodeToString(c.checksum.Sum(nil)) != expected {
+			return errBadChecksum
+		}
+	}
+
+	return nil
+}
+
+// verify проверяет подпись фрагмента или заголовков после него по цепочке
+// от предыдущей подписи
+func (c *chunkedReader) verify(algorithm, sig string, hashes ...string) error {
+	stringToSign := strings.Join(append([]string{algorithm, c.amzDate, c.scope, c.prevSig}, hashes...), "\n")
+
+	expected := hex.EncodeToString(hmacSHA256(c.key, stringToSign))
+	if subtle.ConstantTimeCompare([]byte(expected), []byte(sig)) != 1 {
+		return errSignatureMismatch
+	}
+
+	c.prevSig = sig
+	return nil
+}
@@ -0,0 +1,269 @@
+package sftpd
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/go-pkgz/lgr"
+	"github.com/pkg/sftp"
+	"github.com/studio-b12/gowebdav"
+	"golang.org/x/net/webdav"
+)
+
+// chtimeser - файловая система, позволяющая задать время изменения файла
+type chtimeser interface {
+	Chtimes(ctx context.Context, name string, atime, mtime time.Time) error
+}
+
+// handlers переводит запросы SFTP в вызовы webdav.FileSystem
+type handlers struct {
+	log lgr.L
+	fs  webdav.FileSystem
+}
+
+func newHandlers(log lgr.L, fs webdav.FileSystem) sftp.Handlers {
+	h := &handlers{log: log, fs: fs}
+	return sftp.Handlers{FileGet: h, FilePut: h, FileCmd: h, FileList: h}
+}
+
+func (h *handlers) Fileread(r *sftp.Request) (io.ReaderAt, error) {
+	h.log.Logf("[DEBUG] sftp read: %s", r.Filepath)
+
+	f, err := h.fs.OpenFile(r.Context(), r.Filepath, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, sftpError(err)
+	}
+
+	return &file{f: f}, nil
+}
+
+func (h *handlers) Filewrite(r *sftp.Request) (io.WriterAt, error) {
+	h.log.Logf("[DEBUG] sftp write: %s", r.Filepath)
+
+	flags := r.Pflags()
+	flag := os.O_WRONLY
+	if flags.Creat {
+		flag |= os.O_CREATE
+	}
+	if flags.Trunc {
+		flag |= os.O_TRUNC
+	}
+	if flags.Excl {
+		flag |= os.O_EXCL
+	}
+	if flags.Append {
+		flag |= os.O_APPEND
+	}
+
+	f, err := h.fs.OpenFile(r.Context(), r.Filepath, flag, 0644)
+	if err != nil {
+		return nil, sftpError(err)
+	}
+
+	return &file{f: f}, nil
+}
+
+func (h *handlers) Filecmd(r *sftp.Request) error {
+	h.log.Logf("[DEBUG] sftp %s: %s", r.Method, r.Filepath)
+	ctx := r.Context()
+
+	switch r.Method {
+	case "Setstat":
+		return h.setstat(r)
+	case "Rename":
+		return sftpError(h.fs.Rename(ctx, r.Filepath, r.Target))
+	case "Mkdir":
+		return sftpError(h.fs.Mkdir(ctx, r.Filepath, 0755))
+	case "Rmdir", "Remove":
+		if err := h.checkRemove(r); err != nil {
+			return err
+		}
+		return sftpError(h.fs.RemoveAll(ctx, r.Filepath))
+	default:
+		return sftp.ErrSSHFxOpUnsupported
+	}
+}
+
+// setstat изменяет размер и время изменения файла. Права доступа
+// и владелец не хранятся ни в одном из слоев и пропускаются
+func (h *handlers) setstat(r *sftp.Request) error {
+	flags, attrs := r.AttrFlags(), r.Attributes()
+	ctx := r.Context()
+
+	if flags.Size {
+		if err := h.truncate(ctx, r.Filepath, int64(attrs.Size)); err != nil {
+			return err
+		}
+	}
+
+	if flags.Acmodtime {
+		c, ok := h.fs.(chtimeser)
+		if !ok {
+			return sftp.ErrSSHFxOpUnsupported
+		}
+		err := c.Chtimes(ctx, r.Filepath, attrs.AccessTime(), attrs.ModTime())
+		if errors.Is(err, errors.ErrUnsupported) {
+			return sftp.ErrSSHFxOpUnsupported
+		}
+		return sftpError(err)
+	}
+
+	return nil
+}
+
+// truncate изменяет размер файла. webdav.FileSystem умеет только обрезать
+// файл до нуля при открытии, поэтому другие размеры не поддерживаются
+func (h *handlers) truncate(ctx context.Context, name string, size int64) error {
+	info, err := h.fs.Stat(ctx, name)
+	if err != nil {
+		return sftpError(err)
+	}
+
+	switch {
+	case info.Size() == size:
+		return nil
+	case size != 0:
+		return sftp.ErrSSHFxOpUnsupported
+	}
+
+	f, err := h.fs.OpenFile(ctx, name, os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return sftpError(err)
+	}
+	return sftpError(f.Close())
+}
+
+// checkRemove проверяет, что Remove удаляет файл, а Rmdir - пустую
+// директорию, так как RemoveAll удаляет и то, и другое целиком
+func (h *handlers) checkRemove(r *sftp.Request) error {
+	info, err := h.fs.Stat(r.Context(), r.Filepath)
+	if err != nil {
+		return sftpError(err)
+	}
+
+	if r.Method == "Remove" {
+		if info.IsDir() {
+			return sftp.ErrSSHFxFailure
+		}
+		return nil
+	}
+
+	if !info.IsDir() {
+		return sftp.ErrSSHFxFailure
+	}
+
+	entries, err := h.readdir(r)
+	if err != nil {
+		return err
+	}
+	if len(entries) > 0 {
+		return sftp.ErrSSHFxFailure
+	}
+
+	return nil
+}
+
+func (h *handlers) Filelist(r *sftp.Request) (sftp.ListerAt, error) {
+	switch r.Method {
+	case "List":
+		entries, err := h.readdir(r)
+		if err != nil {
+			return nil, err
+		}
+		return lister(entries), nil
+	case "Stat", "Lstat":
+		info, err := h.fs.Stat(r.Context(), r.Filepath)
+		if err != nil {
+			return nil, sftpError(err)
+		}
+		return lister{info}, nil
+	default:
+		return nil, sftp.ErrSSHFxOpUnsupported
+	}
+}
+
+func (h *handlers) readdir(r *sftp.Request) ([]os.FileInfo, error) {
+	f, err := h.fs.OpenFile(r.Context(), r.Filepath, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, sftpError(err)
+	}
+	defer f.Close()
+
+	entries, err := f.Readdir(0)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, sftpError(err)
+	}
+
+	return entries, nil
+}
+
+// sftpError переводит ошибку файловой системы в статус SFTP. Библиотека
+// распознает только ошибки, для которых верно os.IsNotExist, поэтому
+// обернутые ошибки и ответ 404 удаленного сервера переводятся явно:
+// иначе клиент получил бы общую ошибку вместо «файл не найден»
+func sftpError(err error) error {
+	switch {
+	case errors.Is(err, os.ErrPermission):
+		return sftp.ErrSSHFxPermissionDenied
+	case errors.Is(err, os.ErrNotExist) || gowebdav.IsErrNotFound(err):
+		return sftp.ErrSSHFxNoSuchFile
+	}
+	return err
+}
+
+// file - файл webdav.FileSystem с произвольным доступом, которого
+// требует SFTP
+type file struct {
+	mu sync.Mutex
+	f  webdav.File
+}
+
+func (f *file) ReadAt(b []byte, off int64) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, err := f.f.Seek(off, io.SeekStart); err != nil {
+		return 0, err
+	}
+
+	n, err := io.ReadFull(f.f, b)
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (f *file) WriteAt(b []byte, off int64) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, err := f.f.Seek(off, io.SeekStart); err != nil {
+		return 0, err
+	}
+
+	n, err := f.f.Write(b)
+	return n, sftpError(err)
+}
+
+func (f *file) Close() error {
+	return sftpError(f.f.Close())
+}
+
+// lister - список файлов для постраничной выдачи
+type lister []os.FileInfo
+
+func (l lister) ListAt(ls []os.FileInfo, offset int64) (int, error) {
+	if offset >= int64(len(l)) {
+		return 0, io.EOF
+	}
+
+	n := copy(ls, l[offset:])
+	if n < len(ls) {
+		return n, io.EOF
+	}
+	return n, nil
+}
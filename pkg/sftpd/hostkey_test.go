@@ -0,0 +1,22 @@
+package sftpd_test
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/ReanSn0w/pikpak-webdav-proxy/pkg/sftpd"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadHostKey_Persistent(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys", "ssh_host_ed25519_key")
+
+	first, err := sftpd.LoadHostKey(path)
+	require.NoError(t, err)
+	assert.FileExists(t, path)
+
+	second, err := sftpd.LoadHostKey(path)
+	require.NoError(t, err)
+	assert.Equal(t, first.PublicKey().Marshal(), second.PublicKey().Marshal())
+}
@@ -0,0 +1,148 @@
+package sftpd
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/go-pkgz/lgr"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/net/webdav"
+)
+
+// Server - SFTP сервер, предоставляющий доступ к той же файловой системе,
+// что и WebDAV обработчик. Правила записи, фильтры и бюджет кеша
+// применяются файловой системой, поэтому действуют одинаково
+type Server struct {
+	log    lgr.L
+	fs     webdav.FileSystem
+	config *ssh.ServerConfig
+}
+
+// New создает SFTP сервер с ключом хоста hostKey. Если user пустой,
+// аутентификация не требуется, иначе клиент должен передать
+// пользователя и пароль
+func New(log lgr.L, fs webdav.FileSystem, hostKey ssh.Signer, user, pass string) *Server {
+	config := &ssh.ServerConfig{}
+
+	if user == "" {
+		config.NoClientAuth = true
+	} else {
+		config.PasswordCallback = func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			userOK := subtle.ConstantTimeCompare([]byte(conn.User()), []byte(user)) == 1
+			passOK := subtle.ConstantTimeCompare(password, []byte(pass)) == 1
+			if !userOK || !passOK {
+				return nil, fmt.Errorf("invalid credentials for %s", conn.User())
+			}
+			return nil, nil
+		}
+	}
+
+	config.AddHostKey(hostKey)
+
+	return &Server{log: log, fs: fs, config: config}
+}
+
+// ListenAndServe принимает соединения на адресе addr до отмены ctx
+func (s *Server) ListenAndServe(ctx context.Context, addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	return s.Serve(ctx, l)
+}
+
+// Serve принимает соединения на l до отмены ctx
+func (s *Server) Serve(ctx context.Context, l net.Listener) error {
+	go func() {
+		<-ctx.Done()
+		l.Close()
+	}()
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if ctx.Err() != nil || errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.handleConn(ctx, conn)
+		}()
+	}
+}
+
+func (s *Server) handleConn(ctx context.Context, conn net.Conn) {
+	defer conn.Close()
+
+	// Соединение закрывается при остановке сервера
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	sshConn, chans, reqs, err := ssh.NewServerConn(conn, s.config)
+	if err != nil {
+		s.log.Logf("[WARN] sftp handshake with %s failed: %v", conn.RemoteAddr(), err)
+		return
+	}
+	defer sshConn.Close()
+
+	s.log.Logf("[INFO] sftp connection from %s (%s)", sshConn.RemoteAddr(), sshConn.User())
+	go ssh.DiscardRequests(reqs)
+
+	for newChan := range chans {
+		if newChan.ChannelType() != "session" {
+			newChan.Reject(ssh.UnknownChannelType, "unknown channel type")
+			continue
+		}
+
+		channel, requests, err := newChan.Accept()
+		if err != nil {
+			s.log.Logf("[WARN] sftp channel error: %v", err)
+			continue
+		}
+
+		go s.handleSession(ctx, channel, requests)
+	}
+}
+
+// handleSession обслуживает сессию, в которой разрешена только
+// подсистема sftp
+func (s *Server) handleSession(ctx context.Context, channel ssh.Channel, requests <-chan *ssh.Request) {
+	defer channel.Close()
+
+	for req := range requests {
+		// Полезная нагрузка subsystem - строка с длиной: uint32 + "sftp"
+		ok := req.Type == "subsystem" && len(req.Payload) > 4 && string(req.Payload[4:]) == "sftp"
+		req.Reply(ok, nil)
+		if !ok {
+			continue
+		}
+
+		server := sftp.NewRequestServer(channel, newHandlers(s.log, s.fs))
+		if err := server.Serve(); err != nil && !errors.Is(err, io.EOF) {
+			s.log.Logf("[DEBUG] sftp session closed: %v", err)
+		}
+		server.Close()
+		return
+	}
+}
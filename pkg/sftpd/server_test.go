@@ -0,0 +1,223 @@
+package sftpd_test
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/ReanSn0w/pikpak-webdav-proxy/pkg/sftpd"
+	"github.com/go-pkgz/lgr"
+	"github.com/pkg/sftp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/studio-b12/gowebdav"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/net/webdav"
+)
+
+func startServer(t *testing.T, fs webdav.FileSystem) string {
+	t.Helper()
+
+	key, err := sftpd.LoadHostKey(filepath.Join(t.TempDir(), "host_key"))
+	require.NoError(t, err)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		sftpd.New(lgr.New(), fs, key, "user", "secret").Serve(ctx, l)
+	}()
+
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+
+	return l.Addr().String()
+}
+
+func dial(t *testing.T, addr, pass string) (*sftp.Client, error) {
+	t.Helper()
+
+	conn, err := ssh.Dial("tcp", addr, &ssh.ClientConfig{
+		User:            "user",
+		Auth:            []ssh.AuthMethod{ssh.Password(pass)},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := sftp.NewClient(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	t.Cleanup(func() {
+		client.Close()
+		conn.Close()
+	})
+
+	return client, nil
+}
+
+func TestServer_RejectsWrongPassword(t *testing.T) {
+	addr := startServer(t, webdav.NewMemFS())
+
+	_, err := dial(t, addr, "wrong")
+	assert.Error(t, err)
+}
+
+func TestServer_FileOperations(t *testing.T) {
+	fs := webdav.NewMemFS()
+	addr := startServer(t, fs)
+
+	client, err := dial(t, addr, "secret")
+	require.NoError(t, err)
+
+	require.NoError(t, client.Mkdir("/docs"))
+
+	f, err := client.Create("/docs/a.txt")
+	require.NoError(t, err)
+	_, err = f.Write([]byte("hello sftp"))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	// Файл записан в общую файловую систему
+	wf, err := fs.OpenFile(context.Background(), "/docs/a.txt", os.O_RDONLY, 0)
+	require.NoError(t, err)
+	data, err := io.ReadAll(wf)
+	require.NoError(t, err)
+	wf.Close()
+	assert.Equal(t, "hello sftp", string(data))
+
+	require.NoError(t, client.Rename("/docs/a.txt", "/docs/b.txt"))
+
+	infos, err := client.ReadDir("/docs")
+	require.NoError(t, err)
+	var names []string
+	for _, info := range infos {
+		names = append(names, info.Name())
+	}
+	sort.Strings(names)
+	assert.Equal(t, []string{"b.txt"}, names)
+
+	rf, err := client.Open("/docs/b.txt")
+	require.NoError(t, err)
+	buf := make([]byte, 4)
+	n, err := rf.ReadAt(buf, 6)
+	require.NoError(t, err)
+	assert.Equal(t, "sftp", string(buf[:n]))
+	require.NoError(t, rf.Close())
+
+	// Непустая директория не удаляется через rmdir
+	assert.Error(t, client.RemoveDirectory("/docs"))
+	require.NoError(t, client.Remove("/docs/b.txt"))
+	require.NoError(t, client.RemoveDirectory("/docs"))
+
+	_, err = client.Stat("/docs")
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
+
+// readOnlyFS запрещает любую запись
+type readOnlyFS struct {
+	webdav.FileSystem
+}
+
+func (readOnlyFS) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	return &os.PathError{Op: "mkdir", Path: name, Err: os.ErrPermission}
+}
+
+func TestServer_PermissionDenied(t *testing.T) {
+	addr := startServer(t, readOnlyFS{webdav.NewMemFS()})
+
+	client, err := dial(t, addr, "secret")
+	require.NoError(t, err)
+
+	err = client.Mkdir("/docs")
+	assert.ErrorIs(t, err, os.ErrPermission)
+}
+
+// timesFS запоминает время изменения, заданное через Chtimes
+type timesFS struct {
+	webdav.FileSystem
+	mtimes map[string]time.Time
+}
+
+func (t timesFS) Chtimes(ctx context.Context, name string, atime, mtime time.Time) error {
+	t.mtimes[name] = mtime
+	return nil
+}
+
+func TestServer_Setstat(t *testing.T) {
+	mem := webdav.NewMemFS()
+	fs := timesFS{FileSystem: mem, mtimes: map[string]time.Time{}}
+	addr := startServer(t, fs)
+
+	client, err := dial(t, addr, "secret")
+	require.NoError(t, err)
+
+	f, err := client.Create("/a.txt")
+	require.NoError(t, err)
+	_, err = f.Write([]byte("hello"))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	mtime := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	require.NoError(t, client.Chtimes("/a.txt", mtime, mtime))
+	assert.True(t, fs.mtimes["/a.txt"].Equal(mtime))
+
+	// Произвольный размер не поддерживается и не сообщается как успех
+	assert.Error(t, client.Truncate("/a.txt", 2))
+
+	require.NoError(t, client.Truncate("/a.txt", 0))
+	info, err := client.Stat("/a.txt")
+	require.NoError(t, err)
+	assert.Zero(t, info.Size())
+
+	// Без Chtimes время изменения задать нельзя
+	addr = startServer(t, mem)
+	client, err = dial(t, addr, "secret")
+	require.NoError(t, err)
+	assert.Error(t, client.Chtimes("/a.txt", mtime, mtime))
+}
+
+// remoteMissingFS отвечает на обращения к отсутствующим файлам ошибкой
+// 404 удаленного сервера, как gowebdav
+type remoteMissingFS struct {
+	webdav.FileSystem
+}
+
+func (f remoteMissingFS) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	return nil, gowebdav.NewPathError("PROPFIND", name, 404)
+}
+
+func (f remoteMissingFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	return nil, fmt.Errorf("open remote file: %w", &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist})
+}
+
+func TestServer_NoSuchFile(t *testing.T) {
+	addr := startServer(t, remoteMissingFS{webdav.NewMemFS()})
+
+	client, err := dial(t, addr, "secret")
+	require.NoError(t, err)
+
+	_, err = client.Stat("/missing.txt")
+	assert.ErrorIs(t, err, os.ErrNotExist)
+
+	_, err = client.Open("/missing.txt")
+	assert.ErrorIs(t, err, os.ErrNotExist)
+
+	err = client.Remove("/missing.txt")
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
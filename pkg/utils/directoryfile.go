@@ -10,12 +10,26 @@ type DirectoryProxy interface {
 	Readdir(ctx context.Context, name string) ([]os.FileInfo, error)
 }
 
+// DirectoryIterator - постраничное чтение содержимого директории
+type DirectoryIterator interface {
+	// Next возвращает следующие count файлов. При count <= 0 возвращаются
+	// все оставшиеся файлы. Вместе с последней страницей возвращается io.EOF
+	Next(count int) ([]os.FileInfo, error)
+}
+
+// DirectoryLister - DirectoryProxy, поддерживающий постраничное чтение директорий
+type DirectoryLister interface {
+	OpenDir(ctx context.Context, name string) (DirectoryIterator, error)
+}
+
 type DirectoryFile struct {
 	Name      string
 	Proxy     DirectoryProxy
 	FileInfo  os.FileInfo
 	Files     []os.FileInfo
 	FileIndex int
+
+	iterator DirectoryIterator
 }
 
 func (d *DirectoryFile) Close() error {
@@ -35,6 +49,19 @@ func (d *DirectoryFile) Stat() (os.FileInfo, error) {
 }
 
 func (d *DirectoryFile) Readdir(count int) ([]os.FileInfo, error) {
+	// Если прокси поддерживает постраничное чтение, загружаем файлы по мере запроса
+	if lister, ok := d.Proxy.(DirectoryLister); ok && d.Files == nil {
+		if d.iterator == nil {
+			iterator, err := lister.OpenDir(context.Background(), d.Name)
+			if err != nil {
+				return nil, err
+			}
+			d.iterator = iterator
+		}
+
+		return d.iterator.Next(count)
+	}
+
 	// Если файлы еще не загружены
 	if d.Files == nil {
 		files, err := d.Proxy.Readdir(context.Background(), d.Name)
@@ -293,3 +293,77 @@ func (m *mockFileInfo) Mode() os.FileMode  { return 0644 }
 func (m *mockFileInfo) ModTime() time.Time { return time.Now() }
 func (m *mockFileInfo) IsDir() bool        { return m.isDir }
 func (m *mockFileInfo) Sys() interface{}   { return nil }
+
+// MockDirectoryLister - мок для DirectoryProxy с постраничным чтением
+type MockDirectoryLister struct {
+	MockDirectoryProxy
+}
+
+func (m *MockDirectoryLister) OpenDir(ctx context.Context, name string) (utils.DirectoryIterator, error) {
+	args := m.Called(ctx, name)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(utils.DirectoryIterator), args.Error(1)
+}
+
+// sliceIterator - итератор по заранее заданному списку файлов
+type sliceIterator struct {
+	files []os.FileInfo
+	calls []int
+}
+
+func (s *sliceIterator) Next(count int) ([]os.FileInfo, error) {
+	s.calls = append(s.calls, count)
+
+	if count <= 0 || count >= len(s.files) {
+		result := s.files
+		s.files = nil
+		if count > 0 {
+			return result, io.EOF
+		}
+		return result, nil
+	}
+
+	result := s.files[:count]
+	s.files = s.files[count:]
+	return result, nil
+}
+
+// TestReaddirUsesIterator проверяет постраничное чтение через DirectoryLister
+func TestReaddirUsesIterator(t *testing.T) {
+	mockProxy := new(MockDirectoryLister)
+	iterator := &sliceIterator{files: []os.FileInfo{
+		createMockFileInfo("a", false),
+		createMockFileInfo("b", false),
+		createMockFileInfo("c", false),
+	}}
+
+	mockProxy.On("OpenDir", mock.Anything, "/test").Return(iterator, nil).Once()
+
+	df := createDirectoryFile(mockProxy, "/test")
+
+	files, err := df.Readdir(2)
+	assert.NoError(t, err)
+	assert.Len(t, files, 2)
+
+	files, err = df.Readdir(2)
+	assert.Equal(t, io.EOF, err)
+	assert.Len(t, files, 1)
+
+	assert.Equal(t, []int{2, 2}, iterator.calls)
+	mockProxy.AssertExpectations(t)
+	mockProxy.AssertNotCalled(t, "Readdir", mock.Anything, mock.Anything)
+}
+
+// TestReaddirIteratorError проверяет ошибку открытия директории
+func TestReaddirIteratorError(t *testing.T) {
+	mockProxy := new(MockDirectoryLister)
+	mockProxy.On("OpenDir", mock.Anything, "/test").Return(nil, errors.New("open failed"))
+
+	df := createDirectoryFile(mockProxy, "/test")
+
+	files, err := df.Readdir(0)
+	assert.Error(t, err)
+	assert.Nil(t, files)
+}
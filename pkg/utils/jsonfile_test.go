@@ -0,0 +1,29 @@
+package utils_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ReanSn0w/pikpak-webdav-proxy/pkg/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteJSONAtomic(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "meta", "state.json")
+
+	require.NoError(t, utils.WriteJSONAtomic(path, map[string]int{"a": 1}))
+	require.NoError(t, utils.WriteJSONAtomic(path, map[string]int{"b": 2}))
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"b":2}`, string(data))
+	assert.NoFileExists(t, path+".tmp")
+
+	// Значение, которое нельзя закодировать, не портит прежний файл
+	assert.Error(t, utils.WriteJSONAtomic(path, func() {}))
+	data, err = os.ReadFile(path)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"b":2}`, string(data))
+}
@@ -1,6 +1,7 @@
 package utils
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -25,6 +26,13 @@ type remoteFile struct {
 	IsDir          bool
 	FileInfo       os.FileInfo
 
+	// Пул потоков для потокового чтения. Без него каждый Read
+	// выполняет отдельный запрос диапазона. Потоки хранятся в пуле
+	// под ключом streamKey, по которому их закрывает Invalidate
+	streams   *StreamPool
+	streamKey string
+	stream    *Stream
+
 	// Защита от race conditions при параллельных читаниях
 	mu sync.RWMutex
 }
@@ -48,6 +56,22 @@ func NewRemoteFile(client WebDav, filepath string) (webdav.File, error) {
 	}, nil
 }
 
+// NewStreamingRemoteFile открывает удаленный файл для потокового чтения:
+// данные читаются одним запросом до конца файла с опережением, а после
+// закрытия файла поток остается в пуле для следующего запроса. key - имя
+// файла, с которым для него вызывается StreamPool.Invalidate. Оно может
+// отличаться от filepath, если имя для запроса к серверу уточнено
+func NewStreamingRemoteFile(client WebDav, filepath, key string, streams *StreamPool) (webdav.File, error) {
+	f, err := NewRemoteFile(client, filepath)
+	if err != nil {
+		return nil, err
+	}
+
+	f.(*remoteFile).streams = streams
+	f.(*remoteFile).streamKey = key
+	return f, nil
+}
+
 // Read читает данные с поддержкой Range запросов
 func (f *remoteFile) Read(p []byte) (n int, err error) {
 	f.mu.Lock()
@@ -57,6 +81,10 @@ func (f *remoteFile) Read(p []byte) (n int, err error) {
 		return 0, os.ErrInvalid
 	}
 
+	if f.streams != nil {
+		return f.readStream(p)
+	}
+
 	// Если достигли конца файла
 	if f.Offset >= f.Size {
 		log.Printf("[DEBUG] remoteFile.Read: EOF (offset=%d, size=%d)", f.Offset, f.Size)
@@ -85,6 +113,49 @@ func (f *remoteFile) Read(p []byte) (n int, err error) {
 	return n, err
 }
 
+// readStream читает данные из потока, начинающегося с текущей позиции.
+// После Seek поток с другой позицией возвращается в пул
+func (f *remoteFile) readStream(p []byte) (int, error) {
+	if f.Offset >= f.Size {
+		return 0, io.EOF
+	}
+
+	if f.stream != nil && f.stream.Offset() != f.Offset {
+		f.streams.put(f.streamKey, f.version(), f.stream)
+		f.stream = nil
+	}
+
+	if f.stream == nil {
+		stream, err := f.streams.open(f.Client, f.streamKey, f.Filepath, f.version(), f.Offset)
+		if err != nil {
+			log.Printf("[ERROR] remoteFile.Read: open stream failed: %v", err)
+			return 0, err
+		}
+		f.stream = stream
+	}
+
+	n, err := f.stream.Read(p[:min(int64(len(p)), f.Size-f.Offset)])
+	f.Offset += int64(n)
+
+	if err != nil {
+		f.stream.Close()
+		f.stream = nil
+		if errors.Is(err, io.EOF) && f.Offset < f.Size {
+			err = io.ErrUnexpectedEOF
+		}
+		if n > 0 {
+			err = nil
+		}
+	}
+
+	return n, err
+}
+
+// version возвращает версию файла, из которой читаются потоки
+func (f *remoteFile) version() streamVersion {
+	return streamVersion{size: f.Size, modTime: f.FileInfo.ModTime()}
+}
+
 // Seek изменяет позицию в файле
 func (f *remoteFile) Seek(offset int64, whence int) (int64, error) {
 	f.mu.Lock()
@@ -124,8 +195,20 @@ func (f *remoteFile) Write(p []byte) (n int, err error) {
 	return 0, fmt.Errorf("write to remote file not enabled")
 }
 
-// Close закрывает файл
+// Close закрывает файл. Незавершенный поток возвращается в пул
 func (f *remoteFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.stream != nil {
+		if f.stream.Offset() < f.Size {
+			f.streams.put(f.streamKey, f.version(), f.stream)
+		} else {
+			f.stream.Close()
+		}
+		f.stream = nil
+	}
+
 	return nil
 }
 
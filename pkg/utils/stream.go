@@ -0,0 +1,313 @@
+package utils
+
+import (
+	"errors"
+	"io"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// streamChunkSize - размер блока, которыми читается удаленный поток
+	streamChunkSize = 64 << 10
+
+	// maxIdleStreams - число простаивающих потоков одного файла
+	maxIdleStreams = 4
+)
+
+// Stream - открытый поток чтения удаленного файла с опережающим чтением.
+// Блоки читаются в фоне, пока клиент отправляет уже прочитанные,
+// поэтому медленный ответ сервера не приводит к паузам воспроизведения
+type Stream struct {
+	rc     io.ReadCloser
+	offset int64
+
+	chunks chan []byte
+	cur    []byte
+	err    error
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// newStream запускает опережающее чтение rc, начинающегося с offset.
+// readAhead - объем данных, который читается заранее
+func newStream(rc io.ReadCloser, offset int64, readAhead int) *Stream {
+	s := &Stream{
+		rc:     rc,
+		offset: offset,
+		chunks: make(chan []byte, max(readAhead/streamChunkSize, 1)),
+		done:   make(chan struct{}),
+	}
+
+	go s.fill()
+	return s
+}
+
+func (s *Stream) fill() {
+	defer close(s.chunks)
+
+	for {
+		buf := make([]byte, streamChunkSize)
+		n, err := io.ReadFull(s.rc, buf)
+		if n > 0 {
+			select {
+			case s.chunks <- buf[:n]:
+			case <-s.done:
+				s.err = io.ErrClosedPipe
+				return
+			}
+		}
+
+		if err != nil {
+			if errors.Is(err, io.ErrUnexpectedEOF) {
+				err = io.EOF
+			}
+			s.err = err
+			return
+		}
+	}
+}
+
+// Offset возвращает позицию следующего байта потока в файле
+func (s *Stream) Offset() int64 {
+	return s.offset
+}
+
+func (s *Stream) Read(p []byte) (int, error) {
+	if len(s.cur) == 0 {
+		chunk, ok := <-s.chunks
+		if !ok {
+			return 0, s.err
+		}
+		s.cur = chunk
+	}
+
+	n := copy(p, s.cur)
+	s.cur = s.cur[n:]
+	s.offset += int64(n)
+	return n, nil
+}
+
+// skip пропускает n байт потока
+func (s *Stream) skip(n int64) error {
+	_, err := io.CopyN(io.Discard, s, n)
+	return err
+}
+
+// Close останавливает опережающее чтение и закрывает поток
+func (s *Stream) Close() error {
+	var err error
+	s.closeOnce.Do(func() {
+		close(s.done)
+		err = s.rc.Close()
+	})
+	return err
+}
+
+// streamVersion - версия файла, из которой читается поток. Поток другой
+// версии содержит устаревшие данные и не продолжается
+type streamVersion struct {
+	size    int64
+	modTime time.Time
+}
+
+func (v streamVersion) equal(other streamVersion) bool {
+	return v.size == other.size && v.modTime.Equal(other.modTime)
+}
+
+// idleStream - поток, ожидающий следующего запроса к файлу
+type idleStream struct {
+	path    string
+	stream  *Stream
+	version streamVersion
+	timer   *time.Timer
+	seq     uint64
+}
+
+// StreamPool хранит потоки закрытых файлов, чтобы следующий запрос
+// с соседним диапазоном продолжил чтение, а не открывал новый запрос
+// к серверу. Плееры запрашивают файл множеством последовательных Range
+type StreamPool struct {
+	readAhead int
+	maxSkip   int64
+	idleTime  time.Duration
+	maxIdle   int
+
+	mu    sync.Mutex
+	idle  map[string][]*idleStream
+	count int
+	seq   uint64
+}
+
+// NewStreamPool создает пул потоков с опережающим чтением readAhead байт.
+// Простаивающий поток закрывается через idleTime. Буферы простаивающих
+// потоков всех файлов вместе занимают не больше idleMemory байт: каждый
+// такой поток держит соединение с сервером, и при превышении закрывается
+// самый старый. Ноль idleMemory отключает продолжение потоков
+func NewStreamPool(readAhead int, idleTime time.Duration, idleMemory int64) *StreamPool {
+	// Кроме блоков опережающего чтения поток держит текущий блок
+	// и блок, ожидающий места в очереди
+	streamMemory := int64(max(readAhead/streamChunkSize, 1)+2) * streamChunkSize
+
+	return &StreamPool{
+		readAhead: readAhead,
+		maxSkip:   int64(readAhead),
+		idleTime:  idleTime,
+		maxIdle:   int(max(idleMemory, 0) / streamMemory),
+		idle:      make(map[string][]*idleStream),
+	}
+}
+
+// open возвращает поток файла path версии version с позиции offset до
+// конца файла. Поток с ключом key той же версии, остановившийся не дальше
+// maxSkip байт до offset, продолжается
+func (p *StreamPool) open(client WebDav, key, path string, version streamVersion, offset int64) (*Stream, error) {
+	if s := p.take(key, version, offset); s != nil {
+		return s, nil
+	}
+
+	rc, err := client.ReadStreamRange(path, offset, version.size-offset)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("[DEBUG] stream opened: %s at %d", path, offset)
+	return newStream(rc, offset, p.readAhead), nil
+}
+
+func (p *StreamPool) take(path string, version streamVersion, offset int64) *Stream {
+	p.mu.Lock()
+	var found *Stream
+	for _, idle := range p.idle[path] {
+		if !idle.version.equal(version) {
+			continue
+		}
+		if idle.stream.offset <= offset && offset-idle.stream.offset <= p.maxSkip && idle.timer.Stop() {
+			found = idle.stream
+			p.remove(idle)
+			break
+		}
+	}
+	p.mu.Unlock()
+
+	if found == nil {
+		return nil
+	}
+
+	if err := found.skip(offset - found.offset); err != nil {
+		found.Close()
+		return nil
+	}
+
+	log.Printf("[DEBUG] stream reused: %s at %d", path, offset)
+	return found
+}
+
+// put возвращает поток в пул. Самый старый поток файла закрывается,
+// если их слишком много, а самый старый поток пула - если превышен
+// общий объем буферов
+func (p *StreamPool) put(path string, version streamVersion, s *Stream) {
+	if p.maxIdle == 0 {
+		s.Close()
+		return
+	}
+
+	idle := &idleStream{path: path, stream: s, version: version}
+
+	var closed []*idleStream
+	p.mu.Lock()
+	p.seq++
+	idle.seq = p.seq
+	idle.timer = time.AfterFunc(p.idleTime, func() { p.expire(idle) })
+	p.idle[path] = append(p.idle[path], idle)
+	p.count++
+
+	if streams := p.idle[path]; len(streams) > maxIdleStreams {
+		closed = p.evict(closed, streams[0])
+	}
+	for p.count > p.maxIdle {
+		closed = p.evict(closed, p.oldest())
+	}
+	p.mu.Unlock()
+
+	for _, idle := range closed {
+		idle.stream.Close()
+	}
+}
+
+// oldest возвращает поток, дольше всех ожидающий в пуле. Вызывается под mu
+func (p *StreamPool) oldest() *idleStream {
+	var found *idleStream
+	for _, streams := range p.idle {
+		for _, idle := range streams {
+			if found == nil || idle.seq < found.seq {
+				found = idle
+			}
+		}
+	}
+	return found
+}
+
+// evict убирает поток из пула и добавляет его к закрываемым, если
+// его не закрывает истекший таймер. Вызывается под mu
+func (p *StreamPool) evict(closed []*idleStream, idle *idleStream) []*idleStream {
+	p.remove(idle)
+	if idle.timer.Stop() {
+		closed = append(closed, idle)
+	}
+	return closed
+}
+
+// remove убирает поток из пула, если он еще там. Вызывается под mu
+func (p *StreamPool) remove(idle *idleStream) {
+	streams := p.idle[idle.path]
+	for i, s := range streams {
+		if s == idle {
+			p.idle[idle.path] = append(streams[:i:i], streams[i+1:]...)
+			p.count--
+			break
+		}
+	}
+	if len(p.idle[idle.path]) == 0 {
+		delete(p.idle, idle.path)
+	}
+}
+
+// Invalidate закрывает простаивающие потоки файла name и файлов внутри
+// него. Вызывается при записи, перемещении и удалении на удаленном сервере
+func (p *StreamPool) Invalidate(name string) {
+	if p == nil {
+		return
+	}
+
+	var closed []*idleStream
+	p.mu.Lock()
+	for path, streams := range p.idle {
+		if path != name && !strings.HasPrefix(path, strings.TrimSuffix(name, "/")+"/") {
+			continue
+		}
+		for _, idle := range streams {
+			if idle.timer.Stop() {
+				closed = append(closed, idle)
+			}
+		}
+		p.count -= len(streams)
+		delete(p.idle, path)
+	}
+	p.mu.Unlock()
+
+	for _, idle := range closed {
+		idle.stream.Close()
+	}
+}
+
+func (p *StreamPool) expire(idle *idleStream) {
+	p.mu.Lock()
+	p.remove(idle)
+	p.mu.Unlock()
+
+	idle.stream.Close()
+}
@@ -0,0 +1,238 @@
+package utils_test
+
+import (
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ReanSn0w/pikpak-webdav-proxy/pkg/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func streamingClient(t *testing.T, data string) *MockWebDav {
+	return versionedClient(t, data, time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+}
+
+// versionedClient возвращает клиент с файлом /movie.mkv, измененным в modTime
+func versionedClient(t *testing.T, data string, modTime time.Time) *MockWebDav {
+	mockClient := new(MockWebDav)
+	mockFileInfo := new(MockFileInfo)
+
+	mockFileInfo.On("Size").Return(int64(len(data)))
+	mockFileInfo.On("IsDir").Return(false)
+	mockFileInfo.On("ModTime").Return(modTime)
+
+	mockClient.On("Stat", "/movie.mkv").Return(mockFileInfo, nil)
+	return mockClient
+}
+
+// TestStreamingRemoteFile_SingleRequest тестирует чтение всего файла одним запросом
+func TestStreamingRemoteFile_SingleRequest(t *testing.T) {
+	data := strings.Repeat("0123456789", 20000)
+	mockClient := streamingClient(t, data)
+	mockClient.On("ReadStreamRange", "/movie.mkv", int64(0), int64(len(data))).
+		Return(&ReadCloserMock{strings.NewReader(data)}, nil).Once()
+
+	pool := utils.NewStreamPool(1<<20, time.Minute, 64<<20)
+	file, err := utils.NewStreamingRemoteFile(mockClient, "/movie.mkv", "/movie.mkv", pool)
+	require.NoError(t, err)
+
+	// io.Copy читает блоками по 32 КБ, но запрос к серверу один
+	var b strings.Builder
+	_, err = io.Copy(&b, file)
+	require.NoError(t, err)
+	assert.Equal(t, data, b.String())
+	require.NoError(t, file.Close())
+
+	mockClient.AssertNumberOfCalls(t, "ReadStreamRange", 1)
+}
+
+// TestStreamingRemoteFile_AdjacentRanges тестирует продолжение потока
+// следующим запросом с соседним диапазоном
+func TestStreamingRemoteFile_AdjacentRanges(t *testing.T) {
+	data := strings.Repeat("abcdefghij", 1000)
+	mockClient := streamingClient(t, data)
+	mockClient.On("ReadStreamRange", "/movie.mkv", int64(0), int64(len(data))).
+		Return(&ReadCloserMock{strings.NewReader(data)}, nil).Once()
+
+	pool := utils.NewStreamPool(1<<20, time.Minute, 64<<20)
+
+	read := func(offset, length int64) string {
+		file, err := utils.NewStreamingRemoteFile(mockClient, "/movie.mkv", "/movie.mkv", pool)
+		require.NoError(t, err)
+		defer file.Close()
+
+		_, err = file.Seek(offset, io.SeekStart)
+		require.NoError(t, err)
+
+		buf := make([]byte, length)
+		_, err = io.ReadFull(file, buf)
+		require.NoError(t, err)
+		return string(buf)
+	}
+
+	assert.Equal(t, data[:100], read(0, 100))
+	assert.Equal(t, data[100:300], read(100, 200))
+
+	// Небольшой пропуск вперед тоже продолжает поток
+	assert.Equal(t, data[500:600], read(500, 100))
+
+	mockClient.AssertNumberOfCalls(t, "ReadStreamRange", 1)
+}
+
+// TestStreamingRemoteFile_SeekBackward тестирует открытие нового потока
+// при перемотке назад
+func TestStreamingRemoteFile_SeekBackward(t *testing.T) {
+	data := strings.Repeat("abcdefghij", 1000)
+	mockClient := streamingClient(t, data)
+	mockClient.On("ReadStreamRange", "/movie.mkv", int64(0), int64(len(data))).
+		Return(&ReadCloserMock{strings.NewReader(data)}, nil).Once()
+	mockClient.On("ReadStreamRange", "/movie.mkv", int64(10), int64(len(data)-10)).
+		Return(&ReadCloserMock{strings.NewReader(data[10:])}, nil).Once()
+
+	pool := utils.NewStreamPool(1<<20, time.Minute, 64<<20)
+	file, err := utils.NewStreamingRemoteFile(mockClient, "/movie.mkv", "/movie.mkv", pool)
+	require.NoError(t, err)
+	defer file.Close()
+
+	buf := make([]byte, 50)
+	_, err = io.ReadFull(file, buf)
+	require.NoError(t, err)
+
+	_, err = file.Seek(10, io.SeekStart)
+	require.NoError(t, err)
+
+	_, err = io.ReadFull(file, buf[:5])
+	require.NoError(t, err)
+	assert.Equal(t, data[10:15], string(buf[:5]))
+
+	mockClient.AssertNumberOfCalls(t, "ReadStreamRange", 2)
+}
+
+// TestStreamingRemoteFile_IdleExpired тестирует закрытие простаивающего потока
+func TestStreamingRemoteFile_IdleExpired(t *testing.T) {
+	data := strings.Repeat("abcdefghij", 1000)
+	mockClient := streamingClient(t, data)
+	mockClient.On("ReadStreamRange", "/movie.mkv", int64(0), int64(len(data))).
+		Return(&ReadCloserMock{strings.NewReader(data)}, nil).Once()
+	mockClient.On("ReadStreamRange", "/movie.mkv", int64(10), int64(len(data)-10)).
+		Return(&ReadCloserMock{strings.NewReader(data[10:])}, nil).Once()
+
+	pool := utils.NewStreamPool(1<<20, 10*time.Millisecond, 64<<20)
+
+	file, err := utils.NewStreamingRemoteFile(mockClient, "/movie.mkv", "/movie.mkv", pool)
+	require.NoError(t, err)
+	buf := make([]byte, 10)
+	_, err = io.ReadFull(file, buf)
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+
+	time.Sleep(50 * time.Millisecond)
+
+	file, err = utils.NewStreamingRemoteFile(mockClient, "/movie.mkv", "/movie.mkv", pool)
+	require.NoError(t, err)
+	defer file.Close()
+
+	_, err = file.Seek(10, io.SeekStart)
+	require.NoError(t, err)
+	_, err = io.ReadFull(file, buf)
+	require.NoError(t, err)
+	assert.Equal(t, data[10:20], string(buf))
+
+	mockClient.AssertNumberOfCalls(t, "ReadStreamRange", 2)
+}
+
+// readMovie читает length байт файла /movie.mkv с позиции offset
+func readMovie(t *testing.T, client utils.WebDav, pool *utils.StreamPool, offset, length int64) string {
+	file, err := utils.NewStreamingRemoteFile(client, "/movie.mkv", "/movie.mkv", pool)
+	require.NoError(t, err)
+	defer file.Close()
+
+	_, err = file.Seek(offset, io.SeekStart)
+	require.NoError(t, err)
+
+	buf := make([]byte, length)
+	_, err = io.ReadFull(file, buf)
+	require.NoError(t, err)
+	return string(buf)
+}
+
+// TestStreamingRemoteFile_Overwritten тестирует, что поток старой версии
+// файла не продолжается после его перезаписи
+func TestStreamingRemoteFile_Overwritten(t *testing.T) {
+	oldData := strings.Repeat("a", 10000)
+	newData := strings.Repeat("b", 10000)
+
+	oldClient := versionedClient(t, oldData, time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	oldClient.On("ReadStreamRange", "/movie.mkv", int64(0), int64(len(oldData))).
+		Return(&ReadCloserMock{strings.NewReader(oldData)}, nil).Once()
+
+	newClient := versionedClient(t, newData, time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC))
+	newClient.On("ReadStreamRange", "/movie.mkv", int64(100), int64(len(newData)-100)).
+		Return(&ReadCloserMock{strings.NewReader(newData[100:])}, nil).Once()
+
+	pool := utils.NewStreamPool(1<<20, time.Minute, 64<<20)
+	assert.Equal(t, oldData[:100], readMovie(t, oldClient, pool, 0, 100))
+	assert.Equal(t, newData[100:200], readMovie(t, newClient, pool, 100, 100))
+
+	newClient.AssertNumberOfCalls(t, "ReadStreamRange", 1)
+}
+
+// TestStreamPool_Invalidate тестирует закрытие потоков измененного файла
+func TestStreamPool_Invalidate(t *testing.T) {
+	data := strings.Repeat("abcdefghij", 1000)
+	mockClient := streamingClient(t, data)
+	mockClient.On("ReadStreamRange", "/movie.mkv", int64(0), int64(len(data))).
+		Return(&ReadCloserMock{strings.NewReader(data)}, nil).Once()
+	mockClient.On("ReadStreamRange", "/movie.mkv", int64(100), int64(len(data)-100)).
+		Return(&ReadCloserMock{strings.NewReader(data[100:])}, nil).Once()
+
+	pool := utils.NewStreamPool(1<<20, time.Minute, 64<<20)
+	assert.Equal(t, data[:100], readMovie(t, mockClient, pool, 0, 100))
+
+	// Потоки файлов внутри директории тоже закрываются
+	pool.Invalidate("/")
+	assert.Equal(t, data[100:200], readMovie(t, mockClient, pool, 100, 100))
+
+	mockClient.AssertNumberOfCalls(t, "ReadStreamRange", 2)
+
+	// Пул может быть выключен
+	var disabled *utils.StreamPool
+	disabled.Invalidate("/movie.mkv")
+}
+
+// TestStreamPool_IdleMemory тестирует закрытие самого старого потока,
+// когда буферы простаивающих потоков всех файлов превышают лимит
+func TestStreamPool_IdleMemory(t *testing.T) {
+	data := strings.Repeat("abcdefghij", 1000)
+	mockClient := streamingClient(t, data)
+	mockFileInfo := new(MockFileInfo)
+	mockFileInfo.On("Size").Return(int64(len(data)))
+	mockFileInfo.On("IsDir").Return(false)
+	mockFileInfo.On("ModTime").Return(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	mockClient.On("Stat", "/other.mkv").Return(mockFileInfo, nil)
+
+	mockClient.On("ReadStreamRange", "/movie.mkv", int64(0), int64(len(data))).
+		Return(&ReadCloserMock{strings.NewReader(data)}, nil).Once()
+	mockClient.On("ReadStreamRange", "/other.mkv", int64(0), int64(len(data))).
+		Return(&ReadCloserMock{strings.NewReader(data)}, nil).Once()
+	mockClient.On("ReadStreamRange", "/movie.mkv", int64(100), int64(len(data)-100)).
+		Return(&ReadCloserMock{strings.NewReader(data[100:])}, nil).Once()
+
+	// Лимита хватает на буферы одного потока
+	pool := utils.NewStreamPool(1<<20, time.Minute, 2<<20)
+	assert.Equal(t, data[:100], readMovie(t, mockClient, pool, 0, 100))
+
+	other, err := utils.NewStreamingRemoteFile(mockClient, "/other.mkv", "/other.mkv", pool)
+	require.NoError(t, err)
+	buf := make([]byte, 100)
+	_, err = io.ReadFull(other, buf)
+	require.NoError(t, err)
+	require.NoError(t, other.Close())
+
+	// Поток /movie.mkv закрыт при возврате потока /other.mkv
+	assert.Equal(t, data[100:200], readMovie(t, mockClient, pool, 100, 100))
+	mockClient.AssertNumberOfCalls(t, "ReadStreamRange", 3)
+}
@@ -0,0 +1,74 @@
+package web
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/ReanSn0w/pikpak-webdav-proxy/pkg/fs"
+)
+
+// Reserver - файловая система с ограниченным локальным кешем
+type Reserver interface {
+	Reserve(ctx context.Context, name string, size int64) error
+}
+
+// TempReserver - файловая система, учитывающая временные файлы
+// в бюджете локального кеша
+type TempReserver interface {
+	ReserveTemp(ctx context.Context, size int64) (func(), error)
+}
+
+// Budget проверяет по Content-Length, поместится ли загружаемый файл
+// в локальный кеш, и отвечает 507 Insufficient Storage до начала записи.
+// Если размер заранее неизвестен и бюджет превышен во время записи,
+// ответ 405 обработчика WebDAV заменяется на 507
+func Budget(r Reserver, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPut {
+			next.ServeHTTP(w, req)
+			return
+		}
+
+		if req.ContentLength > 0 {
+			err := r.Reserve(req.Context(), req.URL.Path, req.ContentLength)
+			switch {
+			case errors.Is(err, fs.ErrInsufficientStorage):
+				http.Error(w, err.Error(), http.StatusInsufficientStorage)
+				return
+			case err != nil:
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+
+		req = req.WithContext(fs.BudgetContext(req.Context()))
+		next.ServeHTTP(&budgetWriter{ResponseWriter: w, ctx: req.Context()}, req)
+	})
+}
+
+// budgetWriter заменяет ответ 405 на 507, если запись отклонена из-за
+// бюджета кеша
+type budgetWriter struct {
+	http.ResponseWriter
+	ctx      context.Context
+	exceeded bool
+}
+
+func (w *budgetWriter) WriteHeader(code int) {
+	if code == http.StatusMethodNotAllowed && fs.BudgetExceeded(w.ctx) {
+		w.exceeded = true
+		http.Error(w.ResponseWriter, fs.ErrInsufficientStorage.Error(), http.StatusInsufficientStorage)
+		return
+	}
+
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *budgetWriter) Write(b []byte) (int, error) {
+	// Текст ответа 405 уже заменен
+	if w.exceeded {
+		return len(b), nil
+	}
+	return w.ResponseWriter.Write(b)
+}
@@ -0,0 +1,57 @@
+package web_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/ReanSn0w/pikpak-webdav-proxy/pkg/fs"
+	"github.com/ReanSn0w/pikpak-webdav-proxy/pkg/web"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeReserver разрешает запись не более limit байт
+type fakeReserver struct {
+	limit int64
+	err   error
+}
+
+func (f fakeReserver) Reserve(ctx context.Context, name string, size int64) error {
+	if f.err != nil {
+		return f.err
+	}
+	if size > f.limit {
+		return fs.ErrInsufficientStorage
+	}
+	return nil
+}
+
+func TestBudget(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+	})
+
+	tests := []struct {
+		name     string
+		reserver fakeReserver
+		method   string
+		body     string
+		expected int
+	}{
+		{"fits", fakeReserver{limit: 10}, http.MethodPut, "data", http.StatusCreated},
+		{"too large", fakeReserver{limit: 2}, http.MethodPut, "data", http.StatusInsufficientStorage},
+		{"not put", fakeReserver{limit: 2}, "PROPPATCH", "data", http.StatusCreated},
+		{"error", fakeReserver{err: errors.New("io")}, http.MethodPut, "data", http.StatusInternalServerError},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			web.Budget(tt.reserver, next).ServeHTTP(rec, httptest.NewRequest(tt.method, "/file.bin", strings.NewReader(tt.body)))
+			assert.Equal(t, tt.expected, rec.Code)
+		})
+	}
+}
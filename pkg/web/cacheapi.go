@@ -0,0 +1,226 @@
+package web
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ReanSn0w/pikpak-webdav-proxy/pkg/fs"
+	"github.com/go-pkgz/lgr"
+)
+
+// CacheMaintainer - файловая система с обслуживанием локального кеша.
+// Ее реализуют PikpakProxy и CacheClient, поэтому команды обслуживания
+// работают одинаково с кешем напрямую и через запущенный сервер
+type CacheMaintainer interface {
+	ListCache(ctx context.Context, root string, recursive bool) ([]fs.CacheEntry, error)
+	CacheFiles(ctx context.Context, root string, verify bool) ([]fs.CacheFile, error)
+	LocalOnlyFiles(ctx context.Context, root string) ([]fs.CacheFile, error)
+	CollectGarbage(ctx context.Context, opts fs.GCOptions) (fs.GCResult, error)
+	Evict(ctx context.Context, name string) error
+}
+
+// CacheAPI - JSON API обслуживания кеша запущенного сервера
+type CacheAPI struct {
+	log    lgr.L
+	m      CacheMaintainer
+	prefix string
+
+	// csrf отклоняет gc и evict, отправленные страницами других сайтов:
+	// браузер подставляет в них учетные данные пользователя
+	csrf *http.CrossOriginProtection
+}
+
+func NewCacheAPI(log lgr.L, m CacheMaintainer, prefix string) *CacheAPI {
+	return &CacheAPI{
+		log:    log,
+		m:      m,
+		prefix: "/" + strings.Trim(prefix, "/") + "/",
+		csrf:   http.NewCrossOriginProtection(),
+	}
+}
+
+// Prefix возвращает путь, по которому доступен API
+func (a *CacheAPI) Prefix() string {
+	return a.prefix
+}
+
+func (a *CacheAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	action := strings.TrimPrefix(r.URL.Path, a.prefix)
+	q := r.URL.Query()
+	name := cleanPath(q.Get("path"))
+	ctx := r.Context()
+
+	if err := a.csrf.Check(r); err != nil {
+		a.log.Logf("[WARN] cache api: %s %s rejected: %v", r.Method, r.URL.Path, err)
+		writeJSONError(w, http.StatusForbidden, err)
+		return
+	}
+
+	var (
+		result any
+		err    error
+	)
+
+	switch {
+	case action == "ls" && r.Method == http.MethodGet:
+		result, err = a.m.ListCache(ctx, name, q.Get("recursive") == "true")
+	case action == "files" && r.Method == http.MethodGet:
+		result, err = a.m.CacheFiles(ctx, name, q.Get("verify") == "true")
+	case action == "export" && r.Method == http.MethodGet:
+		result, err = a.m.LocalOnlyFiles(ctx, name)
+	case action == "gc" && r.Method == http.MethodPost:
+		var opts fs.GCOptions
+		if opts, err = parseGCOptions(q); err != nil {
+			writeJSONError(w, http.StatusBadRequest, err)
+			return
+		}
+		result, err = a.m.CollectGarbage(ctx, opts)
+	case action == "evict" && r.Method == http.MethodPost:
+		err = a.m.Evict(ctx, name)
+		result = struct{}{}
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	if err != nil {
+		a.log.Logf("[ERROR] cache api %s %s: %v", action, name, err)
+		status := http.StatusInternalServerError
+		if errors.Is(err, os.ErrNotExist) {
+			status = http.StatusNotFound
+		}
+		writeJSONError(w, status, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(result)
+}
+
+func parseGCOptions(q url.Values) (fs.GCOptions, error) {
+	opts := fs.GCOptions{DryRun: q.Get("dry-run") == "true"}
+
+	if v := q.Get("older-than"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return opts, fmt.Errorf("invalid older-than: %w", err)
+		}
+		opts.OlderThan = d
+	}
+
+	if v := q.Get("max-size"); v != "" {
+		size, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return opts, fmt.Errorf("invalid max-size: %w", err)
+		}
+		opts.MaxSize = size
+	}
+
+	return opts, nil
+}
+
+type apiError struct {
+	Error string `json:"error"`
+}
+
+func writeJSONError(w http.ResponseWriter, status int, err error) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(apiError{Error: err.Error()})
+}
+
+// CacheClient - клиент CacheAPI запущенного сервера
+type CacheClient struct {
+	base   string
+	user   string
+	pass   string
+	client *http.Client
+}
+
+// NewCacheClient создает клиент API, доступного по адресу base,
+// например http://localhost:8080/.webdav-proxy/cache/. Пустой user отключает
+// аутентификацию
+func NewCacheClient(base, user, pass string) *CacheClient {
+	return &CacheClient{
+		base:   strings.TrimSuffix(base, "/") + "/",
+		user:   user,
+		pass:   pass,
+		client: &http.Client{},
+	}
+}
+
+func (c *CacheClient) ListCache(ctx context.Context, root string, recursive bool) ([]fs.CacheEntry, error) {
+	var result []fs.CacheEntry
+	err := c.do(ctx, http.MethodGet, "ls", url.Values{"path": {root}, "recursive": {strconv.FormatBool(recursive)}}, &result)
+	return result, err
+}
+
+func (c *CacheClient) CacheFiles(ctx context.Context, root string, verify bool) ([]fs.CacheFile, error) {
+	var result []fs.CacheFile
+	err := c.do(ctx, http.MethodGet, "files", url.Values{"path": {root}, "verify": {strconv.FormatBool(verify)}}, &result)
+	return result, err
+}
+
+func (c *CacheClient) LocalOnlyFiles(ctx context.Context, root string) ([]fs.CacheFile, error) {
+	var result []fs.CacheFile
+	err := c.do(ctx, http.MethodGet, "export", url.Values{"path": {root}}, &result)
+	return result, err
+}
+
+func (c *CacheClient) CollectGarbage(ctx context.Context, opts fs.GCOptions) (fs.GCResult, error) {
+	q := url.Values{"dry-run": {strconv.FormatBool(opts.DryRun)}}
+	if opts.OlderThan > 0 {
+		q.Set("older-than", opts.OlderThan.String())
+	}
+	if opts.MaxSize > 0 {
+		q.Set("max-size", strconv.FormatInt(opts.MaxSize, 10))
+	}
+
+	var result fs.GCResult
+	err := c.do(ctx, http.MethodPost, "gc", q, &result)
+	return result, err
+}
+
+func (c *CacheClient) Evict(ctx context.Context, name string) error {
+	return c.do(ctx, http.MethodPost, "evict", url.Values{"path": {name}}, nil)
+}
+
+func (c *CacheClient) do(ctx context.Context, method, action string, q url.Values, result any) error {
+	req, err := http.NewRequestWithContext(ctx, method, c.base+action+"?"+q.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	if c.user != "" {
+		req.SetBasicAuth(c.user, c.pass)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		var apiErr apiError
+		if json.NewDecoder(resp.Body).Decode(&apiErr) != nil || apiErr.Error == "" {
+			apiErr.Error = resp.Status
+		}
+		if resp.StatusCode == http.StatusNotFound {
+			return &os.PathError{Op: action, Path: q.Get("path"), Err: os.ErrNotExist}
+		}
+		return fmt.Errorf("%s: %s", action, apiErr.Error)
+	}
+
+	if result == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(result)
+}
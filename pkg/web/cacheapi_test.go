@@ -0,0 +1,169 @@
+package web_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/ReanSn0w/pikpak-webdav-proxy/pkg/fs"
+	"github.com/ReanSn0w/pikpak-webdav-proxy/pkg/web"
+	lgr "github.com/go-pkgz/lgr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeMaintainer запоминает аргументы вызовов и возвращает заданные результаты
+type fakeMaintainer struct {
+	root      string
+	recursive bool
+	verify    bool
+	gc        fs.GCOptions
+	evicted   []string
+	err       error
+}
+
+func (m *fakeMaintainer) ListCache(ctx context.Context, root string, recursive bool) ([]fs.CacheEntry, error) {
+	m.root, m.recursive = root, recursive
+	return []fs.CacheEntry{{Path: "/a.txt", Size: 3, Layer: fs.LayerBoth}}, m.err
+}
+
+func (m *fakeMaintainer) CacheFiles(ctx context.Context, root string, verify bool) ([]fs.CacheFile, error) {
+	m.root, m.verify = root, verify
+	return []fs.CacheFile{{Path: "/a.txt", State: fs.CacheModified, Reason: "size"}}, m.err
+}
+
+func (m *fakeMaintainer) LocalOnlyFiles(ctx context.Context, root string) ([]fs.CacheFile, error) {
+	m.root = root
+	return []fs.CacheFile{{Path: "/b.txt", State: fs.CacheLocalOnly, SHA256: "abc"}}, m.err
+}
+
+func (m *fakeMaintainer) CollectGarbage(ctx context.Context, opts fs.GCOptions) (fs.GCResult, error) {
+	m.gc = opts
+	return fs.GCResult{Evicted: []fs.CacheFile{{Path: "/a.txt", Size: 3}}, Freed: 3, Size: 7}, m.err
+}
+
+func (m *fakeMaintainer) Evict(ctx context.Context, name string) error {
+	m.evicted = append(m.evicted, name)
+	return m.err
+}
+
+func newCacheClient(t *testing.T, m *fakeMaintainer) *web.CacheClient {
+	api := web.NewCacheAPI(lgr.New(), m, "_cache")
+	mux := http.NewServeMux()
+	mux.Handle(api.Prefix(), api)
+
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+
+	return web.NewCacheClient(srv.URL+api.Prefix(), "", "")
+}
+
+func TestCacheAPI_Roundtrip(t *testing.T) {
+	m := &fakeMaintainer{}
+	client := newCacheClient(t, m)
+	ctx := context.Background()
+
+	entries, err := client.ListCache(ctx, "/dir", true)
+	require.NoError(t, err)
+	assert.Equal(t, "/dir", m.root)
+	assert.True(t, m.recursive)
+	require.Len(t, entries, 1)
+	assert.Equal(t, fs.LayerBoth, entries[0].Layer)
+
+	files, err := client.CacheFiles(ctx, "/", true)
+	require.NoError(t, err)
+	assert.True(t, m.verify)
+	assert.Equal(t, []fs.CacheFile{{Path: "/a.txt", State: fs.CacheModified, Reason: "size"}}, files)
+
+	files, err = client.LocalOnlyFiles(ctx, "/")
+	require.NoError(t, err)
+	assert.Equal(t, "abc", files[0].SHA256)
+
+	result, err := client.CollectGarbage(ctx, fs.GCOptions{OlderThan: time.Hour, MaxSize: 100, DryRun: true})
+	require.NoError(t, err)
+	assert.Equal(t, fs.GCOptions{OlderThan: time.Hour, MaxSize: 100, DryRun: true}, m.gc)
+	assert.Equal(t, int64(3), result.Freed)
+	assert.Equal(t, int64(7), result.Size)
+
+	require.NoError(t, client.Evict(ctx, "/a.txt"))
+	assert.Equal(t, []string{"/a.txt"}, m.evicted)
+}
+
+func TestCacheAPI_Errors(t *testing.T) {
+	m := &fakeMaintainer{err: &os.PathError{Op: "evict", Path: "/a.txt", Err: os.ErrNotExist}}
+	client := newCacheClient(t, m)
+
+	err := client.Evict(context.Background(), "/a.txt")
+	assert.True(t, os.IsNotExist(err))
+
+	m.err = errors.New("remote unavailable")
+	_, err = client.CacheFiles(context.Background(), "/", false)
+	assert.ErrorContains(t, err, "remote unavailable")
+}
+
+// TestCacheAPI_RemoteMissing тестирует ответ 404 для пути, которого нет
+// ни в кеше, ни на удаленном сервере, отвечающем 404
+func TestCacheAPI_RemoteMissing(t *testing.T) {
+	api := web.NewCacheAPI(lgr.New(), newRemoteProxy(t, t.TempDir()), "_cache")
+	mux := http.NewServeMux()
+	mux.Handle(api.Prefix(), api)
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	client := web.NewCacheClient(srv.URL+api.Prefix(), "", "")
+
+	_, err := client.ListCache(context.Background(), "/missing", false)
+	assert.True(t, os.IsNotExist(err), "list: %v", err)
+
+	err = client.Evict(context.Background(), "/missing.txt")
+	assert.True(t, os.IsNotExist(err), "evict: %v", err)
+}
+
+func TestCacheAPI_Methods(t *testing.T) {
+	api := web.NewCacheAPI(lgr.New(), &fakeMaintainer{}, "/_cache/")
+
+	rec := get(api, "/_cache/gc?max-size=10")
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+
+	req := httptest.NewRequest(http.MethodPost, "/_cache/gc?older-than=abc", nil)
+	rec = httptest.NewRecorder()
+	api.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.Contains(t, rec.Body.String(), "invalid older-than")
+}
+
+func TestCacheAPI_CrossOrigin(t *testing.T) {
+	m := &fakeMaintainer{}
+	api := web.NewCacheAPI(lgr.New(), m, "/_cache/")
+
+	// Страница другого сайта не может очистить кеш
+	req := httptest.NewRequest(http.MethodPost, "/_cache/evict?path=/a.txt", nil)
+	req.Header.Set("Sec-Fetch-Site", "cross-site")
+	rec := httptest.NewRecorder()
+	api.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+
+	req = httptest.NewRequest(http.MethodPost, "http://proxy.local/_cache/gc", nil)
+	req.Header.Set("Origin", "https://evil.example")
+	rec = httptest.NewRecorder()
+	api.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+
+	assert.Empty(t, m.evicted)
+	assert.Equal(t, fs.GCOptions{}, m.gc)
+
+	// Чтение и запросы команд без заголовков браузера разрешены
+	req = httptest.NewRequest(http.MethodGet, "/_cache/ls?path=/", nil)
+	req.Header.Set("Sec-Fetch-Site", "cross-site")
+	rec = httptest.NewRecorder()
+	api.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	rec = httptest.NewRecorder()
+	api.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/_cache/evict?path=/a.txt", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, []string{"/a.txt"}, m.evicted)
+}
@@ -0,0 +1,266 @@
+package web
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/ReanSn0w/pikpak-webdav-proxy/pkg/fs"
+	"github.com/go-pkgz/lgr"
+)
+
+// Checksummer - файловая система, предоставляющая контрольные суммы файлов
+type Checksummer interface {
+	Checksums(ctx context.Context, name string) (fs.Checksums, error)
+	CachedChecksums(ctx context.Context, name string) (fs.Checksums, error)
+}
+
+// поддерживаемые алгоритмы в нотации заголовка Digest (RFC 3230).
+// SHA-1 только проверяется при загрузке: его по умолчанию передают
+// в OC-Checksum клиенты Nextcloud и ownCloud
+const (
+	algSHA256 = "sha-256"
+	algMD5    = "md5"
+	algSHA1   = "sha"
+)
+
+// Checksums проверяет контрольные суммы загружаемых файлов, переданные
+// в заголовках Digest и OC-Checksum, и возвращает их при скачивании.
+//
+// Тело PUT с контрольной суммой сначала сохраняется во временный файл
+// в tmpDir, чтобы файл с неверной суммой не попал в кеш. Если cs
+// реализует TempReserver, место под него резервируется в бюджете кеша.
+// Заголовок Digest при скачивании возвращается по запросу Want-Digest,
+// OC-Checksum - если контрольная сумма уже известна или запрошена
+// заголовком X-OC-Checksum
+func Checksums(log lgr.L, cs Checksummer, tmpDir string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodPut:
+			expected, skipped, err := expectedChecksums(r.Header)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if len(skipped) > 0 {
+				log.Logf("[WARN] checksum verification skipped for %s: unsupported algorithms %s",
+					r.URL.Path, strings.Join(skipped, ", "))
+			}
+
+			if len(expected) > 0 {
+				if tr, ok := cs.(TempReserver); ok && r.ContentLength > 0 {
+					release, err := tr.ReserveTemp(r.Context(), r.ContentLength)
+					switch {
+					case errors.Is(err, fs.ErrInsufficientStorage):
+						http.Error(w, err.Error(), http.StatusInsufficientStorage)
+						return
+					case err != nil:
+						http.Error(w, err.Error(), http.StatusInternalServerError)
+						return
+					}
+					defer release()
+				}
+
+				body, err := verifyBody(r.Body, tmpDir, expected)
+				if body != nil {
+					defer func() {
+						body.Close()
+						os.Remove(body.Name())
+					}()
+				}
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+				r.Body = body
+			}
+		case http.MethodGet, http.MethodHead:
+			setChecksumHeaders(w.Header(), r, cs)
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// expectedChecksums разбирает контрольные суммы из заголовков запроса.
+// Неподдерживаемые алгоритмы не проверяются и возвращаются в skipped
+func expectedChecksums(h http.Header) (result map[string]string, skipped []string, err error) {
+	result = make(map[string]string)
+
+	for _, part := range splitList(h.Values("Digest")) {
+		alg, value, ok := strings.Cut(part, "=")
+		if !ok {
+			continue
+		}
+
+		alg = strings.ToLower(strings.TrimSpace(alg))
+		if alg != algSHA256 && alg != algMD5 && alg != algSHA1 {
+			skipped = append(skipped, alg)
+			continue
+		}
+
+		sum, err := base64.StdEncoding.DecodeString(strings.TrimSpace(value))
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid Digest header: %w", err)
+		}
+		result[alg] = hex.EncodeToString(sum)
+	}
+
+	for _, part := range splitList(h.Values("OC-Checksum")) {
+		alg, value, ok := strings.Cut(part, ":")
+		if !ok {
+			continue
+		}
+
+		value = strings.ToLower(strings.TrimSpace(value))
+		switch alg = strings.ToUpper(strings.TrimSpace(alg)); alg {
+		case "SHA256":
+			result[algSHA256] = value
+		case "MD5":
+			result[algMD5] = value
+		case "SHA1":
+			result[algSHA1] = value
+		default:
+			skipped = append(skipped, alg)
+		}
+	}
+
+	return result, skipped, nil
+}
+
+// verifyBody сохраняет тело запроса во временный файл и сверяет его
+// контрольные суммы с ожидаемыми
+func verifyBody(body io.Reader, tmpDir string, expected map[string]string) (*os.File, error) {
+	if err := os.MkdirAll(tmpDir, 0755); err != nil {
+		return nil, err
+	}
+
+	f, err := os.CreateTemp(tmpDir, "upload-*")
+	if err != nil {
+		return nil, err
+	}
+
+	hashes := make(map[string]hash.Hash, len(expected))
+	writers := []io.Writer{f}
+	for alg := range expected {
+		hashes[alg] = newHash(alg)
+		writers = append(writers, hashes[alg])
+	}
+	if _, err := io.Copy(io.MultiWriter(writers...), body); err != nil {
+		return f, err
+	}
+
+	for alg, want := range expected {
+		if got := hex.EncodeToString(hashes[alg].Sum(nil)); got != want {
+			return f, fmt.Errorf("%s checksum mismatch: expected %s, got %s", alg, want, got)
+		}
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return f, err
+	}
+
+	return f, nil
+}
+
+// newHash создает хеш для алгоритма в нотации заголовка Digest
+func newHash(alg string) hash.Hash {
+	switch alg {
+	case algSHA1:
+		return sha1.New()
+	case algMD5:
+		return md5.New()
+	default:
+		return sha256.New()
+	}
+}
+
+// setChecksumHeaders заполняет заголовки Digest и OC-Checksum ответа.
+// Вычислять суммы и запрашивать их у удаленного сервера имеет смысл,
+// только если клиент их запросил в Want-Digest или X-OC-Checksum,
+// иначе используются уже известные суммы локальных файлов
+func setChecksumHeaders(h http.Header, r *http.Request, cs Checksummer) {
+	want := wantedDigests(r.Header.Get("Want-Digest"))
+
+	lookup := cs.CachedChecksums
+	if len(want) > 0 || r.Header.Get("X-OC-Checksum") != "" {
+		lookup = cs.Checksums
+	}
+
+	sums, err := lookup(r.Context(), r.URL.Path)
+	if err != nil {
+		return
+	}
+
+	var digests []string
+	for _, alg := range want {
+		if value := checksumValue(sums, alg); value != "" {
+			sum, _ := hex.DecodeString(value)
+			digests = append(digests, strings.ToUpper(alg)+"="+base64.StdEncoding.EncodeToString(sum))
+		}
+	}
+	if len(digests) > 0 {
+		h.Set("Digest", strings.Join(digests, ","))
+	}
+
+	switch {
+	case sums.SHA256 != "":
+		h.Set("OC-Checksum", "SHA256:"+sums.SHA256)
+	case sums.MD5 != "":
+		h.Set("OC-Checksum", "MD5:"+sums.MD5)
+	}
+}
+
+// wantedDigests возвращает поддерживаемые алгоритмы из Want-Digest
+// в порядке их перечисления, пропуская алгоритмы с q=0
+func wantedDigests(header string) []string {
+	var result []string
+
+	for _, part := range splitList([]string{header}) {
+		alg, params, _ := strings.Cut(part, ";")
+		alg = strings.ToLower(strings.TrimSpace(alg))
+
+		if strings.ReplaceAll(strings.TrimSpace(params), " ", "") == "q=0" {
+			continue
+		}
+
+		if alg == algSHA256 || alg == algMD5 {
+			result = append(result, alg)
+		}
+	}
+
+	return result
+}
+
+func checksumValue(sums fs.Checksums, alg string) string {
+	switch alg {
+	case algSHA256:
+		return sums.SHA256
+	case algMD5:
+		return sums.MD5
+	default:
+		return ""
+	}
+}
+
+func splitList(values []string) []string {
+	var result []string
+	for _, v := range values {
+		for _, part := range strings.Split(v, ",") {
+			if part = strings.TrimSpace(part); part != "" {
+				result = append(result, part)
+			}
+		}
+	}
+	return result
+}
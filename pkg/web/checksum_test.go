@@ -0,0 +1,181 @@
+package web_test
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/ReanSn0w/pikpak-webdav-proxy/pkg/fs"
+	"github.com/ReanSn0w/pikpak-webdav-proxy/pkg/web"
+	lgr "github.com/go-pkgz/lgr"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/webdav"
+)
+
+// контрольные суммы строки "data"
+const (
+	dataSHA256       = "3a6eb0790f39ac87c94f3856b2dd2c5d110e6811602261a9a923d3bb23adc8b7"
+	dataSHA256Base64 = "Om6weQ85rIfJTzhWst0sXREOaBFgImGpqSPTuyOtyLc="
+	dataMD5          = "8d777f385d3dfec8815d20f7496026dc"
+	dataMD5Base64    = "jXd/OF09/siBXSD3SWAm3A=="
+)
+
+// fakeChecksummer возвращает фиксированные контрольные суммы
+type fakeChecksummer struct {
+	sums   map[string]fs.Checksums
+	cached map[string]bool
+}
+
+func (f *fakeChecksummer) Checksums(ctx context.Context, name string) (fs.Checksums, error) {
+	sums, ok := f.sums[name]
+	if !ok {
+		return fs.Checksums{}, fs.ErrNoChecksum
+	}
+	return sums, nil
+}
+
+func (f *fakeChecksummer) CachedChecksums(ctx context.Context, name string) (fs.Checksums, error) {
+	if !f.cached[name] {
+		return fs.Checksums{}, fs.ErrNoChecksum
+	}
+	return f.Checksums(ctx, name)
+}
+
+func newChecksumHandler(t *testing.T) (http.Handler, *fakeChecksummer) {
+	cs := &fakeChecksummer{
+		sums:   map[string]fs.Checksums{"/file.txt": {SHA256: dataSHA256, MD5: dataMD5}},
+		cached: map[string]bool{},
+	}
+
+	mem := webdav.NewMemFS()
+	handler := web.Checksums(lgr.New(), cs, t.TempDir(), &webdav.Handler{FileSystem: mem, LockSystem: webdav.NewMemLS()})
+	return handler, cs
+}
+
+func TestChecksums_PutVerified(t *testing.T) {
+	handler, _ := newChecksumHandler(t)
+
+	tests := []struct {
+		name     string
+		header   string
+		value    string
+		expected int
+	}{
+		{"digest sha-256", "Digest", "SHA-256=" + dataSHA256Base64, http.StatusCreated},
+		{"digest both", "Digest", "sha-256=" + dataSHA256Base64 + ", MD5=" + dataMD5Base64, http.StatusCreated},
+		{"digest mismatch", "Digest", "MD5=" + dataSHA256Base64, http.StatusBadRequest},
+		{"digest unsupported", "Digest", "SHA-512=AAAA", http.StatusCreated},
+		{"oc sha256", "OC-Checksum", "SHA256:" + dataSHA256, http.StatusCreated},
+		{"oc md5 mismatch", "OC-Checksum", "MD5:00000000000000000000000000000000", http.StatusBadRequest},
+		{"digest sha-1", "Digest", "SHA=oXyaqmHoChv3HQ2FCvTluqmAC70=", http.StatusCreated},
+		{"oc sha1", "OC-Checksum", "SHA1:a17c9aaa61e80a1bf71d0d850af4e5baa9800bbd", http.StatusCreated},
+		{"oc sha1 mismatch", "OC-Checksum", "SHA1:0000000000000000000000000000000000000000", http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPut, "/upload.txt", strings.NewReader("data"))
+			req.Header.Set(tt.header, tt.value)
+
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			assert.Equal(t, tt.expected, rec.Code)
+		})
+	}
+}
+
+func TestChecksums_UnsupportedLogged(t *testing.T) {
+	var buf bytes.Buffer
+	cs := &fakeChecksummer{}
+	handler := web.Checksums(lgr.New(lgr.Out(&buf)), cs, t.TempDir(), &webdav.Handler{FileSystem: webdav.NewMemFS(), LockSystem: webdav.NewMemLS()})
+
+	req := httptest.NewRequest(http.MethodPut, "/upload.txt", strings.NewReader("data"))
+	req.Header.Set("OC-Checksum", "ADLER32:045d01c1")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	// Загрузка принимается, но пропуск проверки виден в журнале
+	assert.Equal(t, http.StatusCreated, rec.Code)
+	assert.Contains(t, buf.String(), "checksum verification skipped for /upload.txt: unsupported algorithms ADLER32")
+}
+
+func TestChecksums_RejectedUploadNotStored(t *testing.T) {
+	handler, _ := newChecksumHandler(t)
+
+	req := httptest.NewRequest(http.MethodPut, "/bad.txt", strings.NewReader("data"))
+	req.Header.Set("OC-Checksum", "SHA256:deadbeef")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/bad.txt", nil))
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+func TestChecksums_Get(t *testing.T) {
+	handler, cs := newChecksumHandler(t)
+
+	req := httptest.NewRequest(http.MethodPut, "/file.txt", strings.NewReader("data"))
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	// Без Want-Digest сумма не вычисляется
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/file.txt", nil))
+	assert.Empty(t, rec.Header().Get("Digest"))
+	assert.Empty(t, rec.Header().Get("OC-Checksum"))
+
+	req = httptest.NewRequest(http.MethodGet, "/file.txt", nil)
+	req.Header.Set("Want-Digest", "MD5;q=0.3, sha-256;q=1, SHA-512")
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	assert.Equal(t, "MD5="+dataMD5Base64+",SHA-256="+dataSHA256Base64, rec.Header().Get("Digest"))
+
+	req = httptest.NewRequest(http.MethodHead, "/file.txt", nil)
+	req.Header.Set("X-OC-Checksum", "1")
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	assert.Equal(t, "SHA256:"+dataSHA256, rec.Header().Get("OC-Checksum"))
+
+	cs.cached["/file.txt"] = true
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodHead, "/file.txt", nil))
+	assert.Equal(t, "SHA256:"+dataSHA256, rec.Header().Get("OC-Checksum"))
+}
+
+// reservingChecksummer резервирует место под временные файлы
+type reservingChecksummer struct {
+	fakeChecksummer
+	free     int64
+	reserved int64
+}
+
+func (r *reservingChecksummer) ReserveTemp(ctx context.Context, size int64) (func(), error) {
+	if size > r.free-r.reserved {
+		return nil, fs.ErrInsufficientStorage
+	}
+	r.reserved += size
+	return func() { r.reserved -= size }, nil
+}
+
+func TestChecksums_ReservesSpool(t *testing.T) {
+	cs := &reservingChecksummer{free: 4}
+	handler := web.Checksums(lgr.New(), cs, t.TempDir(), &webdav.Handler{FileSystem: webdav.NewMemFS(), LockSystem: webdav.NewMemLS()})
+
+	req := httptest.NewRequest(http.MethodPut, "/upload.txt", strings.NewReader("data"))
+	req.Header.Set("OC-Checksum", "MD5:"+dataMD5)
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusCreated, rec.Code)
+	assert.Zero(t, cs.reserved)
+
+	// Тело не помещается в кеш даже временно
+	req = httptest.NewRequest(http.MethodPut, "/big.txt", strings.NewReader("more data"))
+	req.Header.Set("OC-Checksum", "MD5:"+dataMD5)
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusInsufficientStorage, rec.Code)
+}
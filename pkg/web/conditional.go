@@ -0,0 +1,92 @@
+package web
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"golang.org/x/net/webdav"
+)
+
+// Preconditions проверяет заголовки If-Match и If-None-Match для запросов,
+// изменяющих файлы. Обработчик WebDAV проверяет их только для GET и HEAD,
+// поэтому без этой проверки клиенты не могут безопасно перезаписывать файлы
+func Preconditions(fs webdav.FileSystem, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ifMatch, ifNoneMatch := r.Header.Get("If-Match"), r.Header.Get("If-None-Match")
+
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodOptions, "PROPFIND":
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if ifMatch == "" && ifNoneMatch == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		etag, exists, err := currentETag(r.Context(), fs, r.URL.Path)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if ifMatch != "" && !(exists && matchETag(ifMatch, etag, false)) {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			return
+		}
+
+		if ifNoneMatch != "" && exists && matchETag(ifNoneMatch, etag, true) {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// currentETag возвращает ETag файла так же, как его вычисляет обработчик WebDAV
+func currentETag(ctx context.Context, fs webdav.FileSystem, name string) (string, bool, error) {
+	info, err := fs.Stat(ctx, name)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		return "", false, nil
+	case err != nil:
+		return "", false, err
+	}
+
+	if e, ok := info.(webdav.ETager); ok {
+		etag, err := e.ETag(ctx)
+		if err != webdav.ErrNotImplemented {
+			return etag, true, err
+		}
+	}
+
+	return fmt.Sprintf(`"%x%x"`, info.ModTime().UnixNano(), info.Size()), true, nil
+}
+
+// matchETag проверяет, совпадает ли etag с одним из значений заголовка.
+// При строгом сравнении (weak = false) слабые ETag не совпадают никогда
+func matchETag(header, etag string, weak bool) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+
+		if candidate == "*" {
+			return true
+		}
+
+		if !weak && (strings.HasPrefix(candidate, "W/") || strings.HasPrefix(etag, "W/")) {
+			continue
+		}
+
+		if strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,89 @@
+package web_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/ReanSn0w/pikpak-webdav-proxy/pkg/web"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/webdav"
+)
+
+func newConditionalHandler(t *testing.T) (http.Handler, string) {
+	mem := webdav.NewMemFS()
+
+	f, err := mem.OpenFile(context.Background(), "/file.txt", os.O_RDWR|os.O_CREATE, 0644)
+	require.NoError(t, err)
+	f.Write([]byte("data"))
+	f.Close()
+
+	handler := web.Preconditions(mem, &webdav.Handler{FileSystem: mem, LockSystem: webdav.NewMemLS()})
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodHead, "/file.txt", nil))
+	etag := rec.Header().Get("ETag")
+	require.NotEmpty(t, etag)
+
+	return handler, etag
+}
+
+func put(handler http.Handler, name string, headers map[string]string) int {
+	req := httptest.NewRequest(http.MethodPut, name, strings.NewReader("new"))
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	return rec.Code
+}
+
+func TestPreconditions_IfMatch(t *testing.T) {
+	handler, etag := newConditionalHandler(t)
+
+	assert.Equal(t, http.StatusPreconditionFailed, put(handler, "/file.txt", map[string]string{"If-Match": `"other"`}))
+	assert.Equal(t, http.StatusPreconditionFailed, put(handler, "/file.txt", map[string]string{"If-Match": "W/" + etag}))
+	assert.Equal(t, http.StatusPreconditionFailed, put(handler, "/missing.txt", map[string]string{"If-Match": "*"}))
+	assert.Equal(t, http.StatusCreated, put(handler, "/file.txt", map[string]string{"If-Match": `"other", ` + etag}))
+}
+
+func TestPreconditions_IfNoneMatch(t *testing.T) {
+	handler, etag := newConditionalHandler(t)
+
+	assert.Equal(t, http.StatusPreconditionFailed, put(handler, "/file.txt", map[string]string{"If-None-Match": "*"}))
+	assert.Equal(t, http.StatusPreconditionFailed, put(handler, "/file.txt", map[string]string{"If-None-Match": etag}))
+	assert.Equal(t, http.StatusCreated, put(handler, "/missing.txt", map[string]string{"If-None-Match": "*"}))
+	assert.Equal(t, http.StatusCreated, put(handler, "/file.txt", map[string]string{"If-None-Match": `"other"`}))
+}
+
+func TestPreconditions_Delete(t *testing.T) {
+	handler, etag := newConditionalHandler(t)
+
+	req := httptest.NewRequest(http.MethodDelete, "/file.txt", nil)
+	req.Header.Set("If-Match", `"stale"`)
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusPreconditionFailed, rec.Code)
+
+	req = httptest.NewRequest(http.MethodDelete, "/file.txt", nil)
+	req.Header.Set("If-Match", etag)
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusNoContent, rec.Code)
+}
+
+// TestPreconditions_CreateOnlyRemote тестирует загрузку только нового файла
+// через прокси, удаленный сервер которого отвечает 404
+func TestPreconditions_CreateOnlyRemote(t *testing.T) {
+	proxy := newRemoteProxy(t, t.TempDir())
+	handler := web.Preconditions(proxy, &webdav.Handler{FileSystem: proxy, LockSystem: webdav.NewMemLS()})
+
+	assert.Equal(t, http.StatusCreated, put(handler, "/new.txt", map[string]string{"If-None-Match": "*"}))
+	assert.Equal(t, http.StatusPreconditionFailed, put(handler, "/new.txt", map[string]string{"If-None-Match": "*"}))
+	assert.Equal(t, http.StatusPreconditionFailed, put(handler, "/other.txt", map[string]string{"If-Match": "*"}))
+}
@@ -0,0 +1,66 @@
+package web
+
+import (
+	"context"
+	"net/http"
+	"os"
+
+	"golang.org/x/net/webdav"
+)
+
+type contentTypeKey struct{}
+
+// ContentType задает заголовок Content-Type для GET и HEAD по типу, который
+// сообщает файловая система через webdav.ContentTyper. Обработчик WebDAV
+// использует его только в PROPFIND, а для GET определяет тип по первым
+// 512 байтам, что для удаленного файла означает лишний запрос к серверу.
+// Тип берется из файла, который открывает обработчик, поэтому его файловая
+// система должна быть обернута в ContentTypeFS
+func ContentType(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), contentTypeKey{}, w.Header())
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// ContentTypeFS оборачивает файловую систему обработчика WebDAV так, чтобы
+// файл, открытый на чтение в запросе через ContentType, задавал
+// заголовок Content-Type ответа
+func ContentTypeFS(fs webdav.FileSystem) webdav.FileSystem {
+	return contentTypeFS{fs}
+}
+
+type contentTypeFS struct {
+	webdav.FileSystem
+}
+
+func (fs contentTypeFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	f, err := fs.FileSystem.OpenFile(ctx, name, flag, perm)
+	if err != nil || flag != os.O_RDONLY {
+		return f, err
+	}
+
+	header, _ := ctx.Value(contentTypeKey{}).(http.Header)
+	if header == nil {
+		return f, nil
+	}
+
+	// Обработчик все равно запрашивает сведения об открытом файле,
+	// поэтому отдельного запроса к серверу здесь нет
+	info, err := f.Stat()
+	if err != nil || info.IsDir() {
+		return f, nil
+	}
+	if ct, ok := info.(webdav.ContentTyper); ok {
+		if ctype, err := ct.ContentType(ctx); err == nil && ctype != "" {
+			header.Set("Content-Type", ctype)
+		}
+	}
+
+	return f, nil
+}
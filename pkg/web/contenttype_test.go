@@ -0,0 +1,100 @@
+package web_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/ReanSn0w/pikpak-webdav-proxy/pkg/web"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/webdav"
+)
+
+// typedFS - файловая система, сообщающая тип файлов через webdav.ContentTyper
+// и считающая вызовы Stat
+type typedFS struct {
+	webdav.FileSystem
+	types map[string]string
+	stats int
+}
+
+func (f *typedFS) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	f.stats++
+	return f.FileSystem.Stat(ctx, name)
+}
+
+func (f *typedFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	file, err := f.FileSystem.OpenFile(ctx, name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return typedFile{File: file, ctype: f.types[path.Ext(name)]}, nil
+}
+
+type typedFile struct {
+	webdav.File
+	ctype string
+}
+
+func (f typedFile) Stat() (os.FileInfo, error) {
+	info, err := f.File.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return typedInfo{FileInfo: info, ctype: f.ctype}, nil
+}
+
+type typedInfo struct {
+	os.FileInfo
+	ctype string
+}
+
+func (i typedInfo) ContentType(ctx context.Context) (string, error) {
+	if i.ctype == "" {
+		return "", webdav.ErrNotImplemented
+	}
+	return i.ctype, nil
+}
+
+func TestContentType(t *testing.T) {
+	mem := webdav.NewMemFS()
+	require.NoError(t, mem.Mkdir(context.Background(), "/dir.mkv", 0755))
+	for _, name := range []string{"/movie.mkv", "/info.nfo", "/unknown.zzz"} {
+		f, err := mem.OpenFile(context.Background(), name, os.O_RDWR|os.O_CREATE, 0644)
+		require.NoError(t, err)
+		_, err = f.Write([]byte("<html><body>text</body></html>"))
+		require.NoError(t, err)
+		f.Close()
+	}
+	fs := &typedFS{FileSystem: mem, types: map[string]string{".mkv": "video/x-matroska", ".nfo": "text/plain; charset=cp866"}}
+
+	handler := web.ContentType(&webdav.Handler{
+		FileSystem: web.ContentTypeFS(fs),
+		LockSystem: webdav.NewMemLS(),
+	})
+
+	tests := []struct {
+		method   string
+		path     string
+		expected string
+	}{
+		{http.MethodGet, "/movie.mkv", "video/x-matroska"},
+		{http.MethodHead, "/info.nfo", "text/plain; charset=cp866"},
+		{http.MethodGet, "/unknown.zzz", "text/html; charset=utf-8"},
+		{http.MethodGet, "/missing.mkv", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.method+tt.path, func(t *testing.T) {
+			fs.stats = 0
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, httptest.NewRequest(tt.method, tt.path, nil))
+			assert.Equal(t, tt.expected, rec.Header().Get("Content-Type"))
+			assert.Zero(t, fs.stats, "тип берется из открытого файла без Stat")
+		})
+	}
+}
@@ -0,0 +1,109 @@
+package web
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"time"
+
+	"github.com/ReanSn0w/pikpak-webdav-proxy/pkg/fs"
+	"github.com/go-pkgz/lgr"
+	"golang.org/x/net/webdav"
+)
+
+// Copier - файловая система, копирующая файлы без передачи содержимого
+// через обработчик WebDAV
+type Copier interface {
+	Stat(ctx context.Context, name string) (os.FileInfo, error)
+	Copy(ctx context.Context, src, dst string, overwrite, recursive bool) error
+}
+
+// Copy выполняет COPY средствами файловой системы вместо копирования
+// обработчиком WebDAV, который читает источник и записывает полную копию.
+// Запросы с заголовком If, с некорректным назначением и к заблокированным
+// путям передаются обработчику, чтобы ответ соответствовал RFC 4918
+func Copy(log lgr.L, c Copier, ls webdav.LockSystem, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "COPY" || r.Header.Get("If") != "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		u, err := url.Parse(r.Header.Get("Destination"))
+		if err != nil || u.Path == "" || (u.Host != "" && u.Host != r.Host) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		src, dst := cleanPath(r.URL.Path), cleanPath(u.Path)
+		if src == dst {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		recursive := true
+		switch r.Header.Get("Depth") {
+		case "", "infinity":
+		case "0":
+			recursive = false
+		default:
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// Временная блокировка назначения, как в обработчике WebDAV,
+		// не дает скопировать файл поверх чужой блокировки
+		now := time.Now()
+		token, err := ls.Create(now, webdav.LockDetails{Root: dst, Duration: -1, ZeroDepth: true})
+		if err != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		defer ls.Unlock(now, token)
+
+		ctx := r.Context()
+		if _, err := c.Stat(ctx, src); err != nil {
+			copyError(w, log, src, dst, err)
+			return
+		}
+		if _, err := c.Stat(ctx, path.Dir(dst)); err != nil {
+			http.Error(w, http.StatusText(http.StatusConflict), http.StatusConflict)
+			return
+		}
+
+		_, err = c.Stat(ctx, dst)
+		created := err != nil
+
+		if err := c.Copy(ctx, src, dst, r.Header.Get("Overwrite") != "F", recursive); err != nil {
+			copyError(w, log, src, dst, err)
+			return
+		}
+
+		log.Logf("[INFO] [COPY] %s -> %s", src, dst)
+		if created {
+			w.WriteHeader(http.StatusCreated)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+func copyError(w http.ResponseWriter, log lgr.L, src, dst string, err error) {
+	status := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		status = http.StatusNotFound
+	case errors.Is(err, os.ErrExist):
+		status = http.StatusPreconditionFailed
+	case errors.Is(err, os.ErrPermission):
+		status = http.StatusForbidden
+	case errors.Is(err, fs.ErrInsufficientStorage):
+		status = http.StatusInsufficientStorage
+	}
+
+	log.Logf("[ERROR] [COPY] %s -> %s: %v", src, dst, err)
+	http.Error(w, http.StatusText(status), status)
+}
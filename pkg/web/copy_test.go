@@ -0,0 +1,120 @@
+package web_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ReanSn0w/pikpak-webdav-proxy/pkg/web"
+	lgr "github.com/go-pkgz/lgr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/webdav"
+)
+
+// fakeCopier копирует файлы в памяти и запоминает вызовы Copy
+type fakeCopier struct {
+	files  map[string]bool
+	copies []string
+}
+
+func (c *fakeCopier) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	if !c.files[name] {
+		return nil, os.ErrNotExist
+	}
+	return nil, nil
+}
+
+func (c *fakeCopier) Copy(ctx context.Context, src, dst string, overwrite, recursive bool) error {
+	if c.files[dst] && !overwrite {
+		return os.ErrExist
+	}
+	c.files[dst] = true
+
+	op := src + "->" + dst
+	if !recursive {
+		op += " (depth 0)"
+	}
+	c.copies = append(c.copies, op)
+	return nil
+}
+
+func copyRequest(h http.Handler, src, dst string, header ...string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("COPY", src, nil)
+	req.Header.Set("Destination", "http://"+req.Host+dst)
+	for i := 0; i+1 < len(header); i += 2 {
+		req.Header.Set(header[i], header[i+1])
+	}
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+func newCopyHandler(ls webdav.LockSystem) (http.Handler, *fakeCopier, *bool) {
+	c := &fakeCopier{files: map[string]bool{"/": true, "/dir": true, "/a.txt": true, "/b.txt": true}}
+	passed := new(bool)
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*passed = true
+		w.WriteHeader(http.StatusTeapot)
+	})
+	return web.Copy(lgr.New(), c, ls, next), c, passed
+}
+
+func TestCopy(t *testing.T) {
+	h, c, passed := newCopyHandler(webdav.NewMemLS())
+
+	assert.Equal(t, http.StatusCreated, copyRequest(h, "/a.txt", "/dir/a.txt").Code)
+	assert.Equal(t, http.StatusNoContent, copyRequest(h, "/a.txt", "/b.txt").Code)
+	assert.Equal(t, http.StatusPreconditionFailed, copyRequest(h, "/a.txt", "/b.txt", "Overwrite", "F").Code)
+	assert.Equal(t, http.StatusCreated, copyRequest(h, "/dir", "/dir2", "Depth", "0").Code)
+	assert.Equal(t, http.StatusNotFound, copyRequest(h, "/missing.txt", "/c.txt").Code)
+	assert.Equal(t, http.StatusConflict, copyRequest(h, "/a.txt", "/missing/a.txt").Code)
+
+	assert.Equal(t, []string{"/a.txt->/dir/a.txt", "/a.txt->/b.txt", "/dir->/dir2 (depth 0)"}, c.copies)
+	assert.False(t, *passed)
+}
+
+func TestCopy_PassThrough(t *testing.T) {
+	ls := webdav.NewMemLS()
+	h, c, passed := newCopyHandler(ls)
+
+	// Условия блокировок проверяет обработчик WebDAV
+	assert.Equal(t, http.StatusTeapot, copyRequest(h, "/a.txt", "/c.txt", "If", "(<opaquelocktoken:x>)").Code)
+	assert.True(t, *passed)
+
+	*passed = false
+	_, err := ls.Create(time.Now(), webdav.LockDetails{Root: "/c.txt", Duration: time.Minute})
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusTeapot, copyRequest(h, "/a.txt", "/c.txt").Code)
+	assert.True(t, *passed)
+
+	*passed = false
+	assert.Equal(t, http.StatusTeapot, copyRequest(h, "/a.txt", "/a.txt").Code)
+	assert.True(t, *passed)
+
+	*passed = false
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/a.txt", nil))
+	assert.True(t, *passed)
+
+	assert.Empty(t, c.copies)
+}
+
+// TestCopy_RemoteMissing тестирует копирование через прокси, удаленный
+// сервер которого отвечает 404
+func TestCopy_RemoteMissing(t *testing.T) {
+	remoteDir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(remoteDir, "a.txt"), []byte("data"), 0644))
+	proxy := newRemoteProxy(t, remoteDir)
+	ls := webdav.NewMemLS()
+	h := web.Copy(lgr.New(), proxy, ls, &webdav.Handler{FileSystem: proxy, LockSystem: ls})
+
+	assert.Equal(t, http.StatusNotFound, copyRequest(h, "/missing.txt", "/b.txt").Code)
+	assert.Equal(t, http.StatusConflict, copyRequest(h, "/a.txt", "/missing/b.txt").Code)
+	assert.Equal(t, http.StatusCreated, copyRequest(h, "/a.txt", "/b.txt").Code)
+}
@@ -0,0 +1,185 @@
+package web
+
+import (
+	"context"
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-pkgz/lgr"
+	"golang.org/x/net/webdav"
+)
+
+// DirReader - файловая система, возвращающая объединенный список файлов директории
+type DirReader interface {
+	webdav.FileSystem
+	Readdir(ctx context.Context, name string) ([]os.FileInfo, error)
+}
+
+// Index отвечает на GET и HEAD для директорий списком файлов в HTML,
+// а если клиент запрашивает application/json или ?format=json - в JSON.
+// Обработчик WebDAV отвечает на GET директории 405 Method Not Allowed,
+// поэтому директория проверяется только для путей с завершающим слешем
+// и после такого ответа, а запросы файлов не требуют лишнего Stat
+func Index(log lgr.L, fs DirReader, next http.Handler) http.Handler {
+	idx := newIndexRenderer(log, fs)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		name := cleanPath(r.URL.Path)
+		isDir := func() bool {
+			info, err := fs.Stat(r.Context(), name)
+			return err == nil && info.IsDir()
+		}
+
+		if strings.HasSuffix(r.URL.Path, "/") && isDir() {
+			idx.serve(w, r, name, "", name)
+			return
+		}
+
+		iw := &indexWriter{ResponseWriter: w, isDir: isDir}
+		next.ServeHTTP(iw, r)
+		if iw.dir {
+			idx.serve(w, r, name, "", name)
+		}
+	})
+}
+
+// indexWriter перехватывает ответ 405 обработчика WebDAV на GET
+// директории, чтобы вместо него отдать список файлов
+type indexWriter struct {
+	http.ResponseWriter
+	isDir func() bool
+	dir   bool
+	wrote bool
+}
+
+func (w *indexWriter) WriteHeader(code int) {
+	if !w.wrote && code == http.StatusMethodNotAllowed && w.isDir() {
+		w.dir = true
+		return
+	}
+
+	w.wrote = true
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *indexWriter) Write(b []byte) (int, error) {
+	// Текст ответа 405 заменяется списком файлов
+	if w.dir {
+		return len(b), nil
+	}
+	w.wrote = true
+	return w.ResponseWriter.Write(b)
+}
+
+// indexEntry - элемент списка файлов директории
+type indexEntry struct {
+	Name    string    `json:"name"`
+	Href    string    `json:"href"`
+	IsDir   bool      `json:"is_dir"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+}
+
+type indexPage struct {
+	Path    string       `json:"path"`
+	Parent  string       `json:"parent,omitempty"`
+	Entries []indexEntry `json:"entries"`
+}
+
+// indexRenderer формирует список файлов директории. Общий для Index
+// и ссылок для общего доступа, которые отличаются только префиксом ссылок
+type indexRenderer struct {
+	log  lgr.L
+	fs   DirReader
+	tmpl *template.Template
+}
+
+func newIndexRenderer(log lgr.L, fs DirReader) *indexRenderer {
+	tmpl := template.Must(template.New("").Funcs(template.FuncMap{
+		"size": formatSize,
+		"time": func(t time.Time) string { return t.Format("2006-01-02 15:04:05") },
+	}).ParseFS(templatesFS, "templates/index.html"))
+
+	return &indexRenderer{log: log, fs: fs, tmpl: tmpl}
+}
+
+// serve отвечает списком файлов директории name. Ссылки строятся
+// от base, а title - путь, отображаемый клиенту
+func (i *indexRenderer) serve(w http.ResponseWriter, r *http.Request, name, base, title string) {
+	infos, err := i.fs.Readdir(r.Context(), name)
+	if err != nil {
+		i.log.Logf("[ERROR] index: readdir %s: %v", name, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	dir := strings.TrimSuffix(base+title, "/")
+	page := indexPage{Path: title, Entries: make([]indexEntry, 0, len(infos))}
+	if title != "/" {
+		page.Parent = escapePath(strings.TrimSuffix(path.Dir(dir), "/") + "/")
+	}
+
+	for _, info := range infos {
+		href := escapePath(dir + "/" + info.Name())
+		if info.IsDir() {
+			href += "/"
+		}
+
+		page.Entries = append(page.Entries, indexEntry{
+			Name:    info.Name(),
+			Href:    href,
+			IsDir:   info.IsDir(),
+			Size:    info.Size(),
+			ModTime: info.ModTime(),
+		})
+	}
+
+	sort.Slice(page.Entries, func(a, b int) bool {
+		if page.Entries[a].IsDir != page.Entries[b].IsDir {
+			return page.Entries[a].IsDir
+		}
+		return page.Entries[a].Name < page.Entries[b].Name
+	})
+
+	if wantsJSON(r) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		if r.Method == http.MethodHead {
+			return
+		}
+		if err := json.NewEncoder(w).Encode(page); err != nil {
+			i.log.Logf("[ERROR] index: encode %s: %v", name, err)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if r.Method == http.MethodHead {
+		return
+	}
+	if err := i.tmpl.ExecuteTemplate(w, "index.html", page); err != nil {
+		i.log.Logf("[ERROR] index: render %s: %v", name, err)
+	}
+}
+
+func wantsJSON(r *http.Request) bool {
+	if r.URL.Query().Get("format") == "json" {
+		return true
+	}
+	return strings.Contains(r.Header.Get("Accept"), "application/json")
+}
+
+func escapePath(p string) string {
+	return (&url.URL{Path: p}).EscapedPath()
+}
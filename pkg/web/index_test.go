@@ -0,0 +1,120 @@
+package web_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/ReanSn0w/pikpak-webdav-proxy/pkg/web"
+	lgr "github.com/go-pkgz/lgr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/webdav"
+)
+
+func TestIndex_HTML(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	})
+	handler := web.Index(lgr.New(), newFakeFilesystem(t), next)
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Header().Get("Content-Type"), "text/html")
+	body := rec.Body.String()
+	assert.Contains(t, body, `href="/dir/"`)
+	assert.Contains(t, body, `href="/file.txt"`)
+	assert.Contains(t, body, "10 B")
+}
+
+func TestIndex_JSON(t *testing.T) {
+	fsys := newFakeFilesystem(t)
+	handler := web.Index(lgr.New(), fsys, &webdav.Handler{FileSystem: fsys, LockSystem: webdav.NewMemLS()})
+
+	req := httptest.NewRequest(http.MethodGet, "/dir", nil)
+	req.Header.Set("Accept", "application/json")
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	var page struct {
+		Path    string `json:"path"`
+		Parent  string `json:"parent"`
+		Entries []any  `json:"entries"`
+	}
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&page))
+	assert.Equal(t, "/dir", page.Path)
+	assert.Equal(t, "/", page.Parent)
+	assert.Empty(t, page.Entries)
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/?format=json", nil))
+
+	var root struct {
+		Entries []struct {
+			Name  string `json:"name"`
+			Href  string `json:"href"`
+			IsDir bool   `json:"is_dir"`
+			Size  int64  `json:"size"`
+		} `json:"entries"`
+	}
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&root))
+	require.Len(t, root.Entries, 2)
+	assert.Equal(t, "dir", root.Entries[0].Name)
+	assert.True(t, root.Entries[0].IsDir)
+	assert.Equal(t, "/file.txt", root.Entries[1].Href)
+	assert.Equal(t, int64(10), root.Entries[1].Size)
+}
+
+func TestIndex_PassesFilesAndOtherMethods(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	})
+	handler := web.Index(lgr.New(), newFakeFilesystem(t), next)
+
+	for _, req := range []*http.Request{
+		httptest.NewRequest(http.MethodGet, "/file.txt", nil),
+		httptest.NewRequest(http.MethodGet, "/missing", nil),
+		httptest.NewRequest("PROPFIND", "/dir", nil),
+	} {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusTeapot, rec.Code, req.Method+" "+req.URL.Path)
+	}
+}
+
+// statCounter считает запросы Stat к файловой системе
+type statCounter struct {
+	web.DirReader
+	stats int
+}
+
+func (s *statCounter) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	s.stats++
+	return s.DirReader.Stat(ctx, name)
+}
+
+func TestIndex_StatOnlyDirectories(t *testing.T) {
+	fsys := &statCounter{DirReader: newFakeFilesystem(t)}
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	})
+	handler := web.Index(lgr.New(), fsys, next)
+
+	// Файл отдает следующий обработчик без проверки директории
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/file.txt", nil))
+	assert.Equal(t, http.StatusTeapot, rec.Code)
+	assert.Zero(t, fsys.stats)
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/dir/", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, 1, fsys.stats)
+}
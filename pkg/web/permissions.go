@@ -0,0 +1,55 @@
+package web
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"os"
+)
+
+// AccessChecker - файловая система с правилами доступа
+type AccessChecker interface {
+	CheckAccess(name string, write bool) error
+}
+
+// Permissions отвечает 403 Forbidden на запросы, запрещенные правилами
+// записи. Обработчик WebDAV не различает ошибки доступа при PUT, DELETE
+// и MKCOL и отвечает на них 404 или 405, поэтому доступ проверяется заранее
+func Permissions(ac AccessChecker, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		write := true
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodOptions, "PROPFIND", "COPY":
+			write = false
+		}
+
+		if !allowed(w, ac, r.URL.Path, write) {
+			return
+		}
+
+		// Для MOVE и COPY проверяется и путь назначения
+		if r.Method == "MOVE" || r.Method == "COPY" {
+			if u, err := url.Parse(r.Header.Get("Destination")); err == nil && u.Path != "" {
+				if !allowed(w, ac, u.Path, true) {
+					return
+				}
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func allowed(w http.ResponseWriter, ac AccessChecker, name string, write bool) bool {
+	err := ac.CheckAccess(name, write)
+	switch {
+	case err == nil:
+		return true
+	case errors.Is(err, os.ErrPermission):
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return false
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return false
+	}
+}
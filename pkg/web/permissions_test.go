@@ -0,0 +1,65 @@
+package web_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/ReanSn0w/pikpak-webdav-proxy/pkg/web"
+	"github.com/stretchr/testify/assert"
+)
+
+// prefixChecker запрещает запись вне /Uploads и любой доступ к /Private
+type prefixChecker struct{}
+
+func (prefixChecker) CheckAccess(name string, write bool) error {
+	switch {
+	case strings.HasPrefix(name, "/Private"):
+		return os.ErrPermission
+	case write && !strings.HasPrefix(name, "/Uploads"):
+		return &os.PathError{Op: "write", Path: name, Err: os.ErrPermission}
+	default:
+		return nil
+	}
+}
+
+func TestPermissions(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	handler := web.Permissions(prefixChecker{}, next)
+
+	tests := []struct {
+		method      string
+		path        string
+		destination string
+		expected    int
+	}{
+		{http.MethodGet, "/file.txt", "", http.StatusNoContent},
+		{"PROPFIND", "/", "", http.StatusNoContent},
+		{http.MethodPut, "/file.txt", "", http.StatusForbidden},
+		{http.MethodPut, "/Uploads/file.txt", "", http.StatusNoContent},
+		{"MKCOL", "/dir", "", http.StatusForbidden},
+		{http.MethodDelete, "/Uploads/file.txt", "", http.StatusNoContent},
+		{http.MethodGet, "/Private/file.txt", "", http.StatusForbidden},
+		{"COPY", "/file.txt", "http://host/Uploads/file.txt", http.StatusNoContent},
+		{"COPY", "/file.txt", "http://host/file2.txt", http.StatusForbidden},
+		{"MOVE", "/Uploads/a.txt", "http://host/Uploads/b.txt", http.StatusNoContent},
+		{"MOVE", "/Uploads/a.txt", "http://host/b.txt", http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.path, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, nil)
+			if tt.destination != "" {
+				req.Header.Set("Destination", tt.destination)
+			}
+
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			assert.Equal(t, tt.expected, rec.Code)
+		})
+	}
+}
@@ -0,0 +1,28 @@
+package web
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/net/webdav"
+)
+
+// CheckPrefix проверяет, что путь служебного обработчика не скрывает
+// директорию хранилища. Пути внутри служебной директории кеша ни с чем
+// не совпадают: она не отображается в хранилище
+func CheckPrefix(fs webdav.FileSystem, prefix string) error {
+	top, _, _ := strings.Cut(strings.Trim(prefix, "/"), "/")
+	if top == "" {
+		return fmt.Errorf("path %q hides the whole storage", prefix)
+	}
+
+	if _, err := fs.Stat(context.Background(), "/"+top); err == nil {
+		return fmt.Errorf("path %q hides the storage directory /%s", prefix, top)
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("check path %q: %w", prefix, err)
+	}
+	return nil
+}
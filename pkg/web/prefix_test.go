@@ -0,0 +1,38 @@
+package web_test
+
+import (
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ReanSn0w/pikpak-webdav-proxy/pkg/fs"
+	"github.com/ReanSn0w/pikpak-webdav-proxy/pkg/web"
+	"github.com/go-pkgz/lgr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/studio-b12/gowebdav"
+	"golang.org/x/net/webdav"
+)
+
+// newRemoteProxy создает прокси над удаленной директорией remoteDir,
+// сервер которой отвечает 404 на запросы отсутствующих файлов
+func newRemoteProxy(t *testing.T, remoteDir string) *fs.PikpakProxy {
+	srv := httptest.NewServer(&webdav.Handler{FileSystem: webdav.Dir(remoteDir), LockSystem: webdav.NewMemLS()})
+	t.Cleanup(srv.Close)
+
+	client := gowebdav.NewAuthClient(srv.URL, gowebdav.NewPreemptiveAuth(&gowebdav.BasicAuth{}))
+	return fs.NewPikpakProxy(lgr.New(), t.TempDir(), client)
+}
+
+func TestCheckPrefix(t *testing.T) {
+	remoteDir := t.TempDir()
+	require.NoError(t, os.Mkdir(filepath.Join(remoteDir, "Movies"), 0755))
+	proxy := newRemoteProxy(t, remoteDir)
+
+	assert.NoError(t, web.CheckPrefix(proxy, "/s/"))
+	assert.NoError(t, web.CheckPrefix(proxy, "/_ui/"))
+	assert.NoError(t, web.CheckPrefix(proxy, "/.webdav-proxy/s/"))
+	assert.ErrorContains(t, web.CheckPrefix(proxy, "/Movies/"), "hides the storage directory /Movies")
+	assert.ErrorContains(t, web.CheckPrefix(proxy, "/"), "hides the whole storage")
+}
@@ -0,0 +1,223 @@
+package web
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/go-pkgz/lgr"
+)
+
+var (
+	errInvalidToken = errors.New("invalid share token")
+	errTokenExpired = errors.New("share token expired")
+)
+
+// Shares - ссылки для общего доступа к файлу или директории без учетных
+// данных WebDAV. Ссылка содержит путь и время истечения, подписанные
+// HMAC-SHA256, поэтому сервер не хранит выданные ссылки
+type Shares struct {
+	log    lgr.L
+	fs     DirReader
+	secret []byte
+	prefix string
+	maxTTL time.Duration
+	index  *indexRenderer
+}
+
+// NewShares создает обработчик ссылок, доступных по адресу prefix.
+// maxTTL ограничивает срок действия создаваемых ссылок
+func NewShares(log lgr.L, fs DirReader, secret []byte, prefix string, maxTTL time.Duration) *Shares {
+	return &Shares{
+		log:    log,
+		fs:     fs,
+		secret: secret,
+		prefix: "/" + strings.Trim(prefix, "/") + "/",
+		maxTTL: maxTTL,
+		index:  newIndexRenderer(log, fs),
+	}
+}
+
+// Prefix возвращает путь, по которому доступны ссылки
+func (s *Shares) Prefix() string {
+	return s.prefix
+}
+
+// sharePayload - подписываемое содержимое ссылки
+type sharePayload struct {
+	Path    string `json:"p"`
+	Expires int64  `json:"e"`
+}
+
+// Link возвращает путь ссылки на файл или директорию name, действующей ttl
+func (s *Shares) Link(name string, ttl time.Duration) (string, time.Time) {
+	expires := time.Now().Add(ttl).Truncate(time.Second)
+	data, _ := json.Marshal(sharePayload{Path: cleanPath(name), Expires: expires.Unix()})
+
+	payload := base64.RawURLEncoding.EncodeToString(data)
+	return s.prefix + payload + "." + s.sign(payload), expires
+}
+
+func (s *Shares) sign(payload string) string {
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// verify проверяет подпись и срок действия ссылки и возвращает ее путь
+func (s *Shares) verify(token string) (string, error) {
+	payload, sig, ok := strings.Cut(token, ".")
+	if !ok || !hmac.Equal([]byte(sig), []byte(s.sign(payload))) {
+		return "", errInvalidToken
+	}
+
+	data, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return "", errInvalidToken
+	}
+
+	var p sharePayload
+	if err := json.Unmarshal(data, &p); err != nil {
+		return "", errInvalidToken
+	}
+
+	if time.Now().Unix() >= p.Expires {
+		return "", errTokenExpired
+	}
+
+	return cleanPath(p.Path), nil
+}
+
+// ServeHTTP отдает файл ссылки с поддержкой Range или список файлов
+// директории. Файлы внутри директории доступны по адресу
+// prefix/token/путь, выйти за пределы директории ссылки нельзя
+func (s *Shares) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	token, rel, hasRel := strings.Cut(strings.TrimPrefix(r.URL.Path, s.prefix), "/")
+	root, err := s.verify(token)
+	switch {
+	case errors.Is(err, errTokenExpired):
+		http.Error(w, err.Error(), http.StatusGone)
+		return
+	case err != nil:
+		http.NotFound(w, r)
+		return
+	}
+
+	rel = cleanPath(rel)
+	name := path.Join(root, rel)
+
+	f, err := s.fs.OpenFile(r.Context(), name, os.O_RDONLY, 0)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			s.log.Logf("[WARN] share %s: %v", name, err)
+		}
+		http.NotFound(w, r)
+		return
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	if info.IsDir() {
+		// Ссылки в списке файлов строятся относительно адреса с "/"
+		if !hasRel {
+			http.Redirect(w, r, r.URL.Path+"/", http.StatusMovedPermanently)
+			return
+		}
+		s.index.serve(w, r, name, s.prefix+token, rel)
+		return
+	}
+
+	w.Header().Set("Content-Disposition", "inline; filename*=UTF-8''"+url.PathEscape(info.Name()))
+	http.ServeContent(w, r, info.Name(), info.ModTime(), f)
+}
+
+// shareResult - ответ на создание ссылки
+type shareResult struct {
+	URL     string    `json:"url"`
+	Expires time.Time `json:"expires"`
+}
+
+// Create создает ссылку на файл или директорию ?path= со сроком действия
+// ?ttl= (не больше maxTTL) и возвращает ее в JSON. Обработчик должен быть
+// доступен только после аутентификации, например по адресу prefix/new:
+// в адресе ссылки всегда есть точка, поэтому он не совпадет с токеном
+func (s *Shares) Create(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := cleanPath(r.URL.Query().Get("path"))
+	if _, err := s.fs.Stat(r.Context(), name); err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	ttl := s.maxTTL
+	if v := r.URL.Query().Get("ttl"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			http.Error(w, "invalid ttl", http.StatusBadRequest)
+			return
+		}
+		ttl = min(d, s.maxTTL)
+	}
+
+	link, expires := s.Link(name, ttl)
+	s.log.Logf("[INFO] share link created for %s until %s", name, expires.Format(time.RFC3339))
+
+	base := baseURL(r)
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(shareResult{
+		URL:     base.String() + link,
+		Expires: expires,
+	})
+}
+
+// LoadSecret загружает ключ подписи ссылок из файла path. Если файла нет,
+// создается случайный ключ, чтобы выданные ссылки действовали после перезапуска
+func LoadSecret(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err == nil && len(data) > 0 {
+		return data, nil
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(path, secret, 0600); err != nil {
+		return nil, err
+	}
+
+	return secret, nil
+}
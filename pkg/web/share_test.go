@@ -0,0 +1,128 @@
+package web_test
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ReanSn0w/pikpak-webdav-proxy/pkg/web"
+	lgr "github.com/go-pkgz/lgr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newShares(t *testing.T) *web.Shares {
+	fake := newFakeFilesystem(t)
+
+	f, err := fake.OpenFile(context.Background(), "/dir/a.txt", os.O_RDWR|os.O_CREATE, 0644)
+	require.NoError(t, err)
+	f.Write([]byte("abcdef"))
+	f.Close()
+
+	return web.NewShares(lgr.New(), fake, []byte("secret"), "/s", time.Hour)
+}
+
+func get(h http.Handler, target string, header ...string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, target, nil)
+	for i := 0; i+1 < len(header); i += 2 {
+		req.Header.Set(header[i], header[i+1])
+	}
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestShares_FileRange(t *testing.T) {
+	shares := newShares(t)
+	link, _ := shares.Link("/file.txt", time.Minute)
+	assert.True(t, strings.HasPrefix(link, "/s/"))
+
+	rec := get(shares, link, "Range", "bytes=2-4")
+	assert.Equal(t, http.StatusPartialContent, rec.Code)
+	body, _ := io.ReadAll(rec.Body)
+	assert.Equal(t, "234", string(body))
+	assert.Contains(t, rec.Header().Get("Content-Disposition"), "file.txt")
+}
+
+func TestShares_Folder(t *testing.T) {
+	shares := newShares(t)
+	link, _ := shares.Link("/dir", time.Minute)
+
+	rec := get(shares, link)
+	assert.Equal(t, http.StatusMovedPermanently, rec.Code)
+
+	rec = get(shares, link+"/")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), `href="`+link+`/a.txt"`)
+
+	rec = get(shares, link+"/a.txt")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "abcdef", rec.Body.String())
+
+	// Выйти за пределы директории ссылки нельзя
+	rec = get(shares, link+"/../file.txt")
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+func TestShares_InvalidAndExpired(t *testing.T) {
+	shares := newShares(t)
+
+	link, _ := shares.Link("/file.txt", time.Minute)
+	rec := get(shares, strings.Replace(link, ".", "x.", 1))
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+
+	other := web.NewShares(lgr.New(), newFakeFilesystem(t), []byte("other"), "/s", time.Hour)
+	rec = get(other, link)
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+
+	expired, _ := shares.Link("/file.txt", -time.Minute)
+	rec = get(shares, expired)
+	assert.Equal(t, http.StatusGone, rec.Code)
+}
+
+func TestShares_Create(t *testing.T) {
+	shares := newShares(t)
+
+	rec := httptest.NewRecorder()
+	shares.Create(rec, httptest.NewRequest(http.MethodPost, "http://proxy/s/new?path=/file.txt&ttl=48h", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	var result struct {
+		URL     string    `json:"url"`
+		Expires time.Time `json:"expires"`
+	}
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&result))
+	assert.True(t, strings.HasPrefix(result.URL, "http://proxy/s/"))
+	assert.WithinDuration(t, time.Now().Add(time.Hour), result.Expires, time.Minute)
+
+	rec = get(shares, strings.TrimPrefix(result.URL, "http://proxy"))
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	rec = httptest.NewRecorder()
+	shares.Create(rec, httptest.NewRequest(http.MethodPost, "/s/new?path=/missing", nil))
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+
+	rec = httptest.NewRecorder()
+	shares.Create(rec, httptest.NewRequest(http.MethodPost, "/s/new?path=/file.txt&ttl=soon", nil))
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
+
+func TestLoadSecret(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "meta", "share_secret")
+
+	first, err := web.LoadSecret(path)
+	require.NoError(t, err)
+	assert.Len(t, first, 32)
+
+	second, err := web.LoadSecret(path)
+	require.NoError(t, err)
+	assert.Equal(t, first, second)
+}
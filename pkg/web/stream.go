@@ -0,0 +1,97 @@
+package web
+
+import (
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/ReanSn0w/pikpak-webdav-proxy/pkg/fs"
+	"github.com/go-pkgz/lgr"
+)
+
+// Streaming помечает GET медиафайлов как потоковое чтение, чтобы удаленный
+// файл читался одним запросом с опережением, а не отдельным запросом на
+// каждый блок. Для директории с параметром ?format=m3u возвращается
+// плейлист из ее медиафайлов
+func Streaming(log lgr.L, types *fs.MIMETypes, dr DirReader, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if r.URL.Query().Get("format") == "m3u" {
+			playlist(w, r, log, types, dr)
+			return
+		}
+
+		if types.IsMedia(r.URL.Path) {
+			r = r.WithContext(fs.StreamingContext(r.Context()))
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// playlist отвечает плейлистом M3U с абсолютными ссылками на медиафайлы
+// директории, отсортированными по имени
+func playlist(w http.ResponseWriter, r *http.Request, log lgr.L, types *fs.MIMETypes, dr DirReader) {
+	name := cleanPath(r.URL.Path)
+
+	info, err := dr.Stat(r.Context(), name)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	if !info.IsDir() {
+		http.Error(w, "not a directory", http.StatusBadRequest)
+		return
+	}
+
+	infos, err := dr.Readdir(r.Context(), name)
+	if err != nil {
+		log.Logf("[ERROR] playlist: readdir %s: %v", name, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	var files []string
+	for _, info := range infos {
+		if !info.IsDir() && types.IsMedia(info.Name()) {
+			files = append(files, info.Name())
+		}
+	}
+	sort.Strings(files)
+
+	// Ссылки экранируются, а управляющие символы в названиях заменяются
+	// пробелами, чтобы имя файла не добавляло в плейлист своих строк
+	base := baseURL(r)
+	var b strings.Builder
+	b.WriteString("#EXTM3U\n")
+	for _, file := range files {
+		base.Path = path.Join(name, file)
+		b.WriteString("#EXTINF:-1," + playlistTitle(file) + "\n")
+		b.WriteString(base.String() + "\n")
+	}
+
+	title := path.Base(name)
+	if title == "/" {
+		title = "playlist"
+	}
+
+	w.Header().Set("Content-Type", "audio/x-mpegurl; charset=utf-8")
+	w.Header().Set("Content-Disposition", "inline; filename*=UTF-8''"+url.PathEscape(title+".m3u"))
+	w.Write([]byte(b.String()))
+}
+
+func playlistTitle(name string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return ' '
+		}
+		return r
+	}, name)
+}
@@ -0,0 +1,89 @@
+package web_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/ReanSn0w/pikpak-webdav-proxy/pkg/fs"
+	"github.com/ReanSn0w/pikpak-webdav-proxy/pkg/web"
+	lgr "github.com/go-pkgz/lgr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStreaming_Playlist(t *testing.T) {
+	fake := newFakeFilesystem(t)
+	ctx := context.Background()
+	for _, name := range []string{"/dir/b ep.mkv", "/dir/a.mp3", "/dir/notes.txt"} {
+		f, err := fake.OpenFile(ctx, name, os.O_RDWR|os.O_CREATE, 0644)
+		require.NoError(t, err)
+		f.Close()
+	}
+	require.NoError(t, fake.Mkdir(ctx, "/dir/sub.mp4", 0755))
+
+	handler := web.Streaming(lgr.New(), fs.NewMIMETypes(nil), fake, http.NotFoundHandler())
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://proxy/dir?format=m3u", nil))
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Header().Get("Content-Type"), "mpegurl")
+	assert.Contains(t, rec.Header().Get("Content-Disposition"), "dir.m3u")
+	assert.Equal(t, strings.Join([]string{
+		"#EXTM3U",
+		"#EXTINF:-1,a.mp3",
+		"http://proxy/dir/a.mp3",
+		"#EXTINF:-1,b ep.mkv",
+		"http://proxy/dir/b%20ep.mkv",
+		"",
+	}, "\n"), rec.Body.String())
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/file.txt?format=m3u", nil))
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
+
+func TestStreaming_PlaylistBehindProxy(t *testing.T) {
+	fake := newFakeFilesystem(t)
+	f, err := fake.OpenFile(context.Background(), "/evil\n#EXTINF:-1,x\nhttp:\n.mkv", os.O_RDWR|os.O_CREATE, 0644)
+	require.NoError(t, err)
+	f.Close()
+
+	handler := web.Streaming(lgr.New(), fs.NewMIMETypes(nil), fake, http.NotFoundHandler())
+
+	req := httptest.NewRequest(http.MethodGet, "http://internal:8080/?format=m3u", nil)
+	req.Header.Set("X-Forwarded-Proto", "https")
+	req.Header.Set("X-Forwarded-Host", "media.example.com")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	// Имя файла с переводами строк не добавляет в плейлист своих строк
+	assert.Equal(t, strings.Join([]string{
+		"#EXTM3U",
+		"#EXTINF:-1,evil #EXTINF:-1,x http: .mkv",
+		"https://media.example.com/evil%0A%23EXTINF:-1,x%0Ahttp:%0A.mkv",
+		"",
+	}, "\n"), rec.Body.String())
+}
+
+func TestStreaming_PassesRequests(t *testing.T) {
+	var calls []string
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls = append(calls, r.Method+" "+r.URL.Path)
+	})
+	handler := web.Streaming(lgr.New(), fs.NewMIMETypes(nil), newFakeFilesystem(t), next)
+
+	for _, req := range []*http.Request{
+		httptest.NewRequest(http.MethodGet, "/movie.mkv", nil),
+		httptest.NewRequest(http.MethodGet, "/file.txt", nil),
+		httptest.NewRequest(http.MethodHead, "/dir?format=m3u", nil),
+	} {
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	assert.Equal(t, []string{"GET /movie.mkv", "GET /file.txt", "HEAD /dir"}, calls)
+}
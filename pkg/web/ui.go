@@ -0,0 +1,246 @@
+package web
+
+import (
+	"context"
+	"embed"
+	"errors"
+	"html/template"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ReanSn0w/pikpak-webdav-proxy/pkg/fs"
+	"github.com/go-pkgz/lgr"
+	"golang.org/x/net/webdav"
+)
+
+//go:embed templates
+var templatesFS embed.FS
+
+// Filesystem - файловая система, которую отображает веб-интерфейс
+type Filesystem interface {
+	webdav.FileSystem
+	ReaddirLayers(ctx context.Context, name string) ([]fs.Entry, error)
+	Evict(ctx context.Context, name string) error
+	Fetch(ctx context.Context, name string) error
+	Conflicts() []fs.Conflict
+}
+
+// UI - встроенный веб-интерфейс для просмотра объединенного дерева файлов
+type UI struct {
+	log    lgr.L
+	fs     Filesystem
+	prefix string
+	tmpl   *template.Template
+
+	// csrf отклоняет изменяющие запросы, отправленные страницами других
+	// сайтов: браузер подставляет в них учетные данные пользователя
+	csrf *http.CrossOriginProtection
+}
+
+func NewUI(log lgr.L, fs Filesystem, prefix string) *UI {
+	prefix = "/" + strings.Trim(prefix, "/") + "/"
+
+	tmpl := template.Must(template.New("").Funcs(template.FuncMap{
+		"size": formatSize,
+		"time": func(t time.Time) string { return t.Format("2006-01-02 15:04:05") },
+	}).ParseFS(templatesFS, "templates/*.html"))
+
+	return &UI{
+		log:    log,
+		fs:     fs,
+		prefix: prefix,
+		tmpl:   tmpl,
+		csrf:   http.NewCrossOriginProtection(),
+	}
+}
+
+// Prefix возвращает путь, по которому доступен интерфейс
+func (u *UI) Prefix() string {
+	return u.prefix
+}
+
+func (u *UI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	action := strings.TrimPrefix(r.URL.Path, u.prefix)
+	name := cleanPath(r.URL.Query().Get("path"))
+
+	if err := u.csrf.Check(r); err != nil {
+		u.log.Logf("[WARN] ui: %s %s rejected: %v", r.Method, r.URL.Path, err)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	switch {
+	case action == "" && r.Method == http.MethodGet:
+		u.browse(w, r, name)
+	case action == "conflicts" && r.Method == http.MethodGet:
+		u.conflicts(w, r)
+	case action == "download" && r.Method == http.MethodGet:
+		u.download(w, r, name)
+	case action == "evict" && r.Method == http.MethodPost:
+		u.cacheAction(w, r, name, u.fs.Evict)
+	case action == "fetch" && r.Method == http.MethodPost:
+		u.cacheAction(w, r, name, u.fs.Fetch)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+type entryView struct {
+	Name    string
+	Path    string
+	IsDir   bool
+	Size    int64
+	ModTime time.Time
+	Layer   string
+}
+
+func (u *UI) browse(w http.ResponseWriter, r *http.Request, name string) {
+	entries, err := u.fs.ReaddirLayers(r.Context(), name)
+	if err != nil {
+		u.log.Logf("[ERROR] ui: readdir %s: %v", name, err)
+		status := http.StatusInternalServerError
+		if errors.Is(err, os.ErrPermission) {
+			status = http.StatusForbidden
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	views := make([]entryView, 0, len(entries))
+	for _, e := range entries {
+		views = append(views, entryView{
+			Name:    e.Name(),
+			Path:    path.Join(name, e.Name()),
+			IsDir:   e.IsDir(),
+			Size:    e.Size(),
+			ModTime: e.ModTime(),
+			Layer:   e.Layer.String(),
+		})
+	}
+
+	sort.Slice(views, func(i, j int) bool {
+		if views[i].IsDir != views[j].IsDir {
+			return views[i].IsDir
+		}
+		return views[i].Name < views[j].Name
+	})
+
+	data := struct {
+		Prefix  string
+		Path    string
+		Parent  string
+		Entries []entryView
+	}{
+		Prefix:  u.prefix,
+		Path:    name,
+		Parent:  path.Dir(name),
+		Entries: views,
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := u.tmpl.ExecuteTemplate(w, "browse.html", data); err != nil {
+		u.log.Logf("[ERROR] ui: render %s: %v", name, err)
+	}
+}
+
+func (u *UI) conflicts(w http.ResponseWriter, r *http.Request) {
+	data := struct {
+		Prefix    string
+		Conflicts []fs.Conflict
+	}{
+		Prefix:    u.prefix,
+		Conflicts: u.fs.Conflicts(),
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := u.tmpl.ExecuteTemplate(w, "conflicts.html", data); err != nil {
+		u.log.Logf("[ERROR] ui: render conflicts: %v", err)
+	}
+}
+
+func (u *UI) download(w http.ResponseWriter, r *http.Request, name string) {
+	f, err := u.fs.OpenFile(r.Context(), name, os.O_RDONLY, 0)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	if info.IsDir() {
+		http.Error(w, "is a directory", http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Disposition", "attachment; filename*=UTF-8''"+url.PathEscape(info.Name()))
+	http.ServeContent(w, r, info.Name(), info.ModTime(), f)
+}
+
+func (u *UI) cacheAction(w http.ResponseWriter, r *http.Request, name string, action func(context.Context, string) error) {
+	if err := action(r.Context(), name); err != nil {
+		u.log.Logf("[ERROR] ui: cache action %s: %v", name, err)
+		status := http.StatusConflict
+		if errors.Is(err, os.ErrPermission) {
+			status = http.StatusForbidden
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	http.Redirect(w, r, u.prefix+"?path="+url.QueryEscape(path.Dir(name)), http.StatusSeeOther)
+}
+
+func cleanPath(name string) string {
+	return path.Clean("/" + name)
+}
+
+// baseURL возвращает адрес прокси, по которому клиент отправил запрос.
+// За обратным прокси, завершающим TLS, схема и адрес берутся из заголовков
+// X-Forwarded-Proto и X-Forwarded-Host
+func baseURL(r *http.Request) url.URL {
+	base := url.URL{Scheme: "http", Host: r.Host}
+	if r.TLS != nil {
+		base.Scheme = "https"
+	}
+
+	if proto := forwarded(r, "X-Forwarded-Proto"); proto == "http" || proto == "https" {
+		base.Scheme = proto
+	}
+	if host := forwarded(r, "X-Forwarded-Host"); host != "" && !strings.ContainsAny(host, "/?#@") {
+		base.Host = host
+	}
+
+	return base
+}
+
+// forwarded возвращает первое значение заголовка, добавленного прокси
+func forwarded(r *http.Request, header string) string {
+	value, _, _ := strings.Cut(r.Header.Get(header), ",")
+	return strings.ToLower(strings.TrimSpace(value))
+}
+
+func formatSize(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return strconv.FormatInt(size, 10) + " B"
+	}
+
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+
+	return strconv.FormatFloat(float64(size)/float64(div), 'f', 1, 64) + " " + string("KMGTPE"[exp]) + "iB"
+}
@@ -0,0 +1,194 @@
+package web_test
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/ReanSn0w/pikpak-webdav-proxy/pkg/fs"
+	"github.com/ReanSn0w/pikpak-webdav-proxy/pkg/web"
+	lgr "github.com/go-pkgz/lgr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/webdav"
+)
+
+// fakeFilesystem - файловая система в памяти с фиксированными слоями
+type fakeFilesystem struct {
+	webdav.FileSystem
+	layers    map[string]fs.Layer
+	conflicts []fs.Conflict
+	evicted   []string
+	fetched   []string
+}
+
+func newFakeFilesystem(t *testing.T) *fakeFilesystem {
+	mem := webdav.NewMemFS()
+	ctx := context.Background()
+
+	require.NoError(t, mem.Mkdir(ctx, "/dir", 0755))
+
+	f, err := mem.OpenFile(ctx, "/file.txt", os.O_RDWR|os.O_CREATE, 0644)
+	require.NoError(t, err)
+	f.Write([]byte("0123456789"))
+	f.Close()
+
+	return &fakeFilesystem{
+		FileSystem: mem,
+		layers: map[string]fs.Layer{
+			"dir":      fs.LayerRemote,
+			"file.txt": fs.LayerBoth,
+		},
+	}
+}
+
+func (f *fakeFilesystem) ReaddirLayers(ctx context.Context, name string) ([]fs.Entry, error) {
+	dir, err := f.OpenFile(ctx, name, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer dir.Close()
+
+	infos, err := dir.Readdir(0)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]fs.Entry, 0, len(infos))
+	for _, info := range infos {
+		entries = append(entries, fs.Entry{FileInfo: info, Layer: f.layers[info.Name()]})
+	}
+
+	return entries, nil
+}
+
+func (f *fakeFilesystem) Readdir(ctx context.Context, name string) ([]os.FileInfo, error) {
+	dir, err := f.OpenFile(ctx, name, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer dir.Close()
+
+	return dir.Readdir(0)
+}
+
+func (f *fakeFilesystem) Evict(ctx context.Context, name string) error {
+	f.evicted = append(f.evicted, name)
+	return nil
+}
+
+func (f *fakeFilesystem) Fetch(ctx context.Context, name string) error {
+	f.fetched = append(f.fetched, name)
+	return nil
+}
+
+func (f *fakeFilesystem) Conflicts() []fs.Conflict {
+	return f.conflicts
+}
+
+func TestUI_Browse(t *testing.T) {
+	ui := web.NewUI(lgr.New(), newFakeFilesystem(t), "/_ui")
+
+	rec := httptest.NewRecorder()
+	ui.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/_ui/?path=/", nil))
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	body := rec.Body.String()
+	assert.Contains(t, body, "file.txt")
+	assert.Contains(t, body, "layer-both")
+	assert.Contains(t, body, "dir/")
+	assert.Contains(t, body, "layer-remote")
+}
+
+func TestUI_DownloadRange(t *testing.T) {
+	ui := web.NewUI(lgr.New(), newFakeFilesystem(t), "/_ui/")
+
+	req := httptest.NewRequest(http.MethodGet, "/_ui/download?path=/file.txt", nil)
+	req.Header.Set("Range", "bytes=2-4")
+
+	rec := httptest.NewRecorder()
+	ui.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusPartialContent, rec.Code)
+	body, _ := io.ReadAll(rec.Body)
+	assert.Equal(t, "234", string(body))
+}
+
+func TestUI_CacheActions(t *testing.T) {
+	fake := newFakeFilesystem(t)
+	ui := web.NewUI(lgr.New(), fake, "/_ui/")
+
+	rec := httptest.NewRecorder()
+	ui.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/_ui/evict?path=/file.txt", nil))
+	assert.Equal(t, http.StatusSeeOther, rec.Code)
+
+	rec = httptest.NewRecorder()
+	ui.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/_ui/fetch?path=/dir/a.txt", nil))
+	assert.Equal(t, http.StatusSeeOther, rec.Code)
+	assert.True(t, strings.HasSuffix(rec.Header().Get("Location"), "?path=%2Fdir"))
+
+	assert.Equal(t, []string{"/file.txt"}, fake.evicted)
+	assert.Equal(t, []string{"/dir/a.txt"}, fake.fetched)
+}
+
+func TestUI_CrossOriginActions(t *testing.T) {
+	fake := newFakeFilesystem(t)
+	ui := web.NewUI(lgr.New(), fake, "/_ui/")
+
+	// Форма другого сайта не может изменить кеш
+	req := httptest.NewRequest(http.MethodPost, "/_ui/evict?path=/file.txt", nil)
+	req.Header.Set("Sec-Fetch-Site", "cross-site")
+	rec := httptest.NewRecorder()
+	ui.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+
+	req = httptest.NewRequest(http.MethodPost, "http://proxy.local/_ui/fetch?path=/file.txt", nil)
+	req.Header.Set("Origin", "https://evil.example")
+	rec = httptest.NewRecorder()
+	ui.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+
+	// Форма самого интерфейса
+	req = httptest.NewRequest(http.MethodPost, "/_ui/evict?path=/file.txt", nil)
+	req.Header.Set("Sec-Fetch-Site", "same-origin")
+	rec = httptest.NewRecorder()
+	ui.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusSeeOther, rec.Code)
+
+	assert.Equal(t, []string{"/file.txt"}, fake.evicted)
+	assert.Empty(t, fake.fetched)
+}
+
+func TestUI_UnknownAction(t *testing.T) {
+	ui := web.NewUI(lgr.New(), newFakeFilesystem(t), "/_ui/")
+
+	rec := httptest.NewRecorder()
+	ui.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/_ui/evict?path=/file.txt", nil))
+
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+func TestUI_Conflicts(t *testing.T) {
+	fake := newFakeFilesystem(t)
+	fake.conflicts = []fs.Conflict{{
+		Path:       "/file.txt",
+		LocalSize:  10,
+		RemoteSize: 2048,
+		Resolution: fs.LayerRemote,
+	}}
+
+	ui := web.NewUI(lgr.New(), fake, "/_ui/")
+
+	rec := httptest.NewRecorder()
+	ui.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/_ui/conflicts", nil))
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	body := rec.Body.String()
+	assert.Contains(t, body, "/file.txt")
+	assert.Contains(t, body, "2.0 KiB")
+	assert.Contains(t, body, "remote")
+}
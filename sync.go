@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/ReanSn0w/pikpak-webdav-proxy/pkg/fs"
+)
+
+// syncCommand - двусторонняя синхронизация локального слоя с удаленным
+// сервером. Работает с LOCAL_PATH напрямую
+type syncCommand struct {
+	DryRun    bool   `long:"dry-run" description:"Только показать действия синхронизации"`
+	Direction string `long:"direction" default:"both" choice:"both" choice:"upload" choice:"download" description:"Направление синхронизации"`
+	Conflict  string `long:"conflict" default:"none" choice:"none" choice:"local" choice:"remote" choice:"newest" choice:"keep-both" description:"Политика для файлов, измененных в обоих слоях (none - пропустить)"`
+	Args      struct {
+		Path string `positional-arg-name:"path"`
+	} `positional-args:"yes"`
+}
+
+// syncRun - выбранная команда синхронизации, см. cacheRun
+var syncRun func(ctx context.Context, p *fs.PikpakProxy, out io.Writer) (fs.SyncResult, error)
+
+func (c *syncCommand) Execute(args []string) error {
+	syncRun = func(ctx context.Context, p *fs.PikpakProxy, out io.Writer) (fs.SyncResult, error) {
+		direction, err := fs.ParseSyncDirection(c.Direction)
+		if err != nil {
+			return fs.SyncResult{}, err
+		}
+
+		policy, err := fs.ParseConflictPolicy(c.Conflict)
+		if err != nil {
+			return fs.SyncResult{}, err
+		}
+
+		result, err := p.Sync(ctx, fs.SyncOptions{
+			Root:      c.Args.Path,
+			Direction: direction,
+			Conflicts: policy,
+			DryRun:    c.DryRun,
+		})
+
+		for _, a := range result.Actions {
+			name := a.Path
+			if a.From != "" {
+				name = a.From + " -> " + a.Path
+			}
+			if a.IsDir {
+				name += "/"
+			}
+
+			if a.Error != "" {
+				fmt.Fprintf(out, "%s %s (%s): %s\n", a.Op, name, a.Reason, a.Error)
+				continue
+			}
+			fmt.Fprintf(out, "%s %s (%s)\n", a.Op, name, a.Reason)
+		}
+
+		verb := "applied"
+		if c.DryRun {
+			verb = "planned"
+		}
+		fmt.Fprintf(out, "%s %d actions: %d conflicts, %d failed\n", verb, len(result.Actions), result.Conflicts, result.Failed)
+
+		return result, err
+	}
+	return nil
+}
+
+// runSyncCommand выполняет синхронизацию и возвращает код завершения:
+// 1, если остались конфликты, и 2 при ошибках
+func runSyncCommand(ctx context.Context, p *fs.PikpakProxy) int {
+	result, err := syncRun(ctx, p, os.Stdout)
+	switch {
+	case err != nil:
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		return 2
+	case result.Failed > 0:
+		return 2
+	case result.Conflicts > 0:
+		return 1
+	}
+	return 0
+}